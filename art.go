@@ -0,0 +1,535 @@
+package memdb
+
+import (
+	"bytes"
+	"sync"
+
+	"github.com/rosedblabs/wal"
+)
+
+// the kinds of the inner nodes of the adaptive radix tree,
+// a node grows to the next kind when it is full, and shrinks back when it is sparse.
+const (
+	artNode4 uint8 = iota
+	artNode16
+	artNode48
+	artNode256
+)
+
+// ART is an adaptive radix tree implementation of the Indexer interface,
+// see "The Adaptive Radix Tree: ARTful Indexing for Main-Memory Databases".
+//
+// The common prefixes of the keys are stored only once by path compression,
+// and the inner nodes use one of four layouts depending on the number of children,
+// so the tree is compact for the keys sharing long prefixes.
+// It only supports the bytewise order of the keys.
+type ART struct {
+	lock     sync.RWMutex
+	root     *artNode
+	size     int
+	keyBytes int64 // total length of the keys
+}
+
+type artLeaf struct {
+	key []byte
+	pos *wal.ChunkPosition
+}
+
+// artNode is a node of the adaptive radix tree.
+//
+// A key ends at the node if its bytes are the path to the node followed by the prefix of the node,
+// and the leaf holds the position of the key. The children are indexed by the next byte of the key.
+type artNode struct {
+	kind        uint8
+	prefix      []byte // compressed path, shares the memory with the key of a leaf
+	leaf        *artLeaf
+	numChildren int
+	// node4, node16: the sorted bytes of the children.
+	// node48: the slot of the child plus 1, indexed by the byte, 0 means no child.
+	// node256: not used.
+	keys []byte
+	// node4, node16: the children in the order of keys.
+	// node48: the slots of the children.
+	// node256: the children indexed by the byte.
+	children []*artNode
+}
+
+func newART() *ART {
+	return &ART{}
+}
+
+func newArtLeafNode(prefix []byte, leaf *artLeaf) *artNode {
+	return &artNode{kind: artNode4, prefix: prefix, leaf: leaf}
+}
+
+// childRef returns the reference to the child of the byte, nil if there is no such child.
+func (n *artNode) childRef(b byte) **artNode {
+	switch n.kind {
+	case artNode4, artNode16:
+		for i := 0; i < n.numChildren; i++ {
+			if n.keys[i] == b {
+				return &n.children[i]
+			}
+		}
+	case artNode48:
+		if slot := n.keys[b]; slot > 0 {
+			return &n.children[slot-1]
+		}
+	case artNode256:
+		if n.children[b] != nil {
+			return &n.children[b]
+		}
+	}
+	return nil
+}
+
+func (n *artNode) addChild(b byte, child *artNode) {
+	switch n.kind {
+	case artNode4, artNode16:
+		if (n.kind == artNode4 && n.numChildren == 4) || n.numChildren == 16 {
+			n.grow()
+			n.addChild(b, child)
+			return
+		}
+		i := 0
+		for i < n.numChildren && n.keys[i] < b {
+			i++
+		}
+		n.keys = append(n.keys, 0)
+		copy(n.keys[i+1:], n.keys[i:])
+		n.keys[i] = b
+		n.children = append(n.children, nil)
+		copy(n.children[i+1:], n.children[i:])
+		n.children[i] = child
+	case artNode48:
+		if n.numChildren == 48 {
+			n.grow()
+			n.addChild(b, child)
+			return
+		}
+		for slot := range n.children {
+			if n.children[slot] == nil {
+				n.children[slot] = child
+				n.keys[b] = byte(slot + 1)
+				break
+			}
+		}
+	case artNode256:
+		n.children[b] = child
+	}
+	n.numChildren++
+}
+
+func (n *artNode) removeChild(b byte) {
+	switch n.kind {
+	case artNode4, artNode16:
+		for i := 0; i < n.numChildren; i++ {
+			if n.keys[i] == b {
+				n.keys = append(n.keys[:i], n.keys[i+1:]...)
+				n.children = append(n.children[:i], n.children[i+1:]...)
+				break
+			}
+		}
+	case artNode48:
+		n.children[n.keys[b]-1] = nil
+		n.keys[b] = 0
+	case artNode256:
+		n.children[b] = nil
+	}
+	n.numChildren--
+	n.shrink()
+}
+
+// grow changes the node to the next larger kind.
+func (n *artNode) grow() {
+	switch n.kind {
+	case artNode4:
+		n.kind = artNode16
+	case artNode16:
+		keys := make([]byte, 256)
+		children := make([]*artNode, 48)
+		for i := 0; i < n.numChildren; i++ {
+			keys[n.keys[i]] = byte(i + 1)
+			children[i] = n.children[i]
+		}
+		n.kind, n.keys, n.children = artNode48, keys, children
+	case artNode48:
+		children := make([]*artNode, 256)
+		for b := 0; b < 256; b++ {
+			if slot := n.keys[b]; slot > 0 {
+				children[b] = n.children[slot-1]
+			}
+		}
+		n.kind, n.keys, n.children = artNode256, nil, children
+	}
+}
+
+// shrink changes the node to the smaller kind if it is sparse enough,
+// the thresholds are lower than the capacities to avoid changing back and forth.
+func (n *artNode) shrink() {
+	switch {
+	case n.kind == artNode256 && n.numChildren <= 37:
+		keys := make([]byte, 256)
+		children := make([]*artNode, 48)
+		slot := 0
+		for b := 0; b < 256; b++ {
+			if n.children[b] != nil {
+				keys[b] = byte(slot + 1)
+				children[slot] = n.children[b]
+				slot++
+			}
+		}
+		n.kind, n.keys, n.children = artNode48, keys, children
+	case n.kind == artNode48 && n.numChildren <= 12:
+		keys := make([]byte, 0, 16)
+		children := make([]*artNode, 0, 16)
+		for b := 0; b < 256; b++ {
+			if slot := n.keys[b]; slot > 0 {
+				keys = append(keys, byte(b))
+				children = append(children, n.children[slot-1])
+			}
+		}
+		n.kind, n.keys, n.children = artNode16, keys, children
+	case n.kind == artNode16 && n.numChildren <= 3:
+		n.kind = artNode4
+	}
+}
+
+// forEachChild calls fn for every child in the order of the bytes, until fn returns false.
+func (n *artNode) forEachChild(reverse bool, fn func(b byte, child *artNode) bool) bool {
+	for i := 0; i < 256; i++ {
+		var b byte
+		var child *artNode
+		switch n.kind {
+		case artNode4, artNode16:
+			if i >= n.numChildren {
+				return true
+			}
+			j := i
+			if reverse {
+				j = n.numChildren - 1 - i
+			}
+			b, child = n.keys[j], n.children[j]
+		default:
+			b = byte(i)
+			if reverse {
+				b = byte(255 - i)
+			}
+			if n.kind == artNode48 {
+				if slot := n.keys[b]; slot > 0 {
+					child = n.children[slot-1]
+				}
+			} else {
+				child = n.children[b]
+			}
+		}
+		if child != nil && !fn(b, child) {
+			return false
+		}
+	}
+	return true
+}
+
+// walk visits the leaves of the subtree in order, until fn returns false.
+// path is the bytes of the keys before the prefix of the node,
+// the subtrees which prune returns true for are skipped.
+func (n *artNode) walk(path []byte, reverse bool, prune func(path []byte) bool, fn func(leaf *artLeaf) bool) bool {
+	path = append(path, n.prefix...)
+	if prune != nil && prune(path) {
+		return true
+	}
+	if !reverse && n.leaf != nil && !fn(n.leaf) {
+		return false
+	}
+	cont := n.forEachChild(reverse, func(b byte, child *artNode) bool {
+		return child.walk(append(path, b), reverse, prune, fn)
+	})
+	if !cont {
+		return false
+	}
+	if reverse && n.leaf != nil {
+		return fn(n.leaf)
+	}
+	return true
+}
+
+func commonPrefixLen(a, b []byte) int {
+	n := min(len(a), len(b))
+	for i := 0; i < n; i++ {
+		if a[i] != b[i] {
+			return i
+		}
+	}
+	return n
+}
+
+// Put key and position into the index.
+func (t *ART) Put(key []byte, position *wal.ChunkPosition) *wal.ChunkPosition {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	oldPos := t.insert(&t.root, 0, &artLeaf{key: key, pos: position})
+	if oldPos == nil {
+		t.keyBytes += int64(len(key))
+	}
+	return oldPos
+}
+
+func (t *ART) insert(ref **artNode, depth int, leaf *artLeaf) *wal.ChunkPosition {
+	key := leaf.key
+	n := *ref
+	if n == nil {
+		*ref = newArtLeafNode(key[depth:], leaf)
+		t.size++
+		return nil
+	}
+
+	p := commonPrefixLen(n.prefix, key[depth:])
+	if p < len(n.prefix) {
+		// the key leaves the compressed path, split the path at the first different byte.
+		parent := &artNode{kind: artNode4, prefix: n.prefix[:p]}
+		parent.addChild(n.prefix[p], n)
+		n.prefix = n.prefix[p+1:]
+		if depth+p == len(key) {
+			parent.leaf = leaf
+		} else {
+			parent.addChild(key[depth+p], newArtLeafNode(key[depth+p+1:], leaf))
+		}
+		*ref = parent
+		t.size++
+		return nil
+	}
+
+	depth += len(n.prefix)
+	if depth == len(key) {
+		if n.leaf != nil {
+			oldPos := n.leaf.pos
+			n.leaf = leaf
+			return oldPos
+		}
+		n.leaf = leaf
+		t.size++
+		return nil
+	}
+
+	child := n.childRef(key[depth])
+	if child == nil {
+		n.addChild(key[depth], newArtLeafNode(key[depth+1:], leaf))
+		t.size++
+		return nil
+	}
+	return t.insert(child, depth+1, leaf)
+}
+
+// Get the position of the key in the index.
+func (t *ART) Get(key []byte) *wal.ChunkPosition {
+	t.lock.RLock()
+	defer t.lock.RUnlock()
+
+	n, depth := t.root, 0
+	for n != nil {
+		if !bytes.HasPrefix(key[depth:], n.prefix) {
+			return nil
+		}
+		depth += len(n.prefix)
+		if depth == len(key) {
+			if n.leaf == nil {
+				return nil
+			}
+			return n.leaf.pos
+		}
+		child := n.childRef(key[depth])
+		if child == nil {
+			return nil
+		}
+		n = *child
+		depth++
+	}
+	return nil
+}
+
+// Delete the index of the key.
+func (t *ART) Delete(key []byte) (*wal.ChunkPosition, bool) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	leaf := t.delete(&t.root, key, 0)
+	if leaf == nil {
+		return nil, false
+	}
+	t.size--
+	t.keyBytes -= int64(len(leaf.key))
+	return leaf.pos, true
+}
+
+func (t *ART) delete(ref **artNode, key []byte, depth int) *artLeaf {
+	n := *ref
+	if n == nil || !bytes.HasPrefix(key[depth:], n.prefix) {
+		return nil
+	}
+
+	var removed *artLeaf
+	depth += len(n.prefix)
+	if depth == len(key) {
+		removed = n.leaf
+		n.leaf = nil
+	} else if child := n.childRef(key[depth]); child != nil {
+		removed = t.delete(child, key, depth+1)
+		if *child == nil {
+			n.removeChild(key[depth])
+		}
+	}
+	if removed == nil || n.leaf != nil {
+		return removed
+	}
+
+	// remove the empty node, and merge the node having only one child into the child.
+	switch n.numChildren {
+	case 0:
+		*ref = nil
+	case 1:
+		n.forEachChild(false, func(b byte, child *artNode) bool {
+			prefix := make([]byte, 0, len(n.prefix)+1+len(child.prefix))
+			prefix = append(prefix, n.prefix...)
+			prefix = append(prefix, b)
+			child.prefix = append(prefix, child.prefix...)
+			*ref = child
+			return false
+		})
+	}
+	return removed
+}
+
+// Size represents the number of keys in the index.
+func (t *ART) Size() int {
+	t.lock.RLock()
+	defer t.lock.RUnlock()
+	return t.size
+}
+
+// MemSize returns the estimated memory used by the index in bytes.
+// The keys are counted in full, though the prefixes only take the memory of the leaves.
+func (t *ART) MemSize() int64 {
+	t.lock.RLock()
+	defer t.lock.RUnlock()
+	return t.keyBytes + int64(t.size)*artLeafOverhead
+}
+
+// ascend visits the leaves whose keys are greater than or equal to startKey in ascending order.
+func (t *ART) ascend(startKey []byte, fn func(leaf *artLeaf) bool) {
+	if t.root == nil {
+		return
+	}
+	var prune func(path []byte) bool
+	if startKey != nil {
+		prune = func(path []byte) bool {
+			// all the keys in the subtree are less than startKey
+			return bytes.Compare(path, startKey[:min(len(path), len(startKey))]) < 0
+		}
+	}
+	t.root.walk(nil, false, prune, func(leaf *artLeaf) bool {
+		if startKey != nil && bytes.Compare(leaf.key, startKey) < 0 {
+			return true
+		}
+		return fn(leaf)
+	})
+}
+
+// descend visits the leaves whose keys are less than or equal to startKey in descending order.
+func (t *ART) descend(startKey []byte, fn func(leaf *artLeaf) bool) {
+	if t.root == nil {
+		return
+	}
+	var prune func(path []byte) bool
+	if startKey != nil {
+		prune = func(path []byte) bool {
+			// all the keys in the subtree are greater than startKey
+			return bytes.Compare(path, startKey[:min(len(path), len(startKey))]) > 0
+		}
+	}
+	t.root.walk(nil, true, prune, func(leaf *artLeaf) bool {
+		if startKey != nil && bytes.Compare(leaf.key, startKey) > 0 {
+			return true
+		}
+		return fn(leaf)
+	})
+}
+
+func artHandler(handleFn func(key []byte, position *wal.ChunkPosition) (bool, error)) func(leaf *artLeaf) bool {
+	return func(leaf *artLeaf) bool {
+		cont, err := handleFn(leaf.key, leaf.pos)
+		if err != nil {
+			return false
+		}
+		return cont
+	}
+}
+
+// Ascend iterates over items in ascending order and invokes the handler function for each item.
+// If the handler function returns false, iteration stops.
+func (t *ART) Ascend(handleFn func(key []byte, position *wal.ChunkPosition) (bool, error)) {
+	t.lock.RLock()
+	defer t.lock.RUnlock()
+	t.ascend(nil, artHandler(handleFn))
+}
+
+// Descend iterates over items in descending order and invokes the handler function for each item.
+// If the handler function returns false, iteration stops.
+func (t *ART) Descend(handleFn func(key []byte, position *wal.ChunkPosition) (bool, error)) {
+	t.lock.RLock()
+	defer t.lock.RUnlock()
+	t.descend(nil, artHandler(handleFn))
+}
+
+// AscendRange iterates in ascending order within [startKey, endKey), invoking handleFn.
+// Stops if handleFn returns false.
+func (t *ART) AscendRange(startKey, endKey []byte, handleFn func(key []byte, position *wal.ChunkPosition) (bool, error)) {
+	t.lock.RLock()
+	defer t.lock.RUnlock()
+
+	fn := artHandler(handleFn)
+	t.ascend(startKey, func(leaf *artLeaf) bool {
+		return bytes.Compare(leaf.key, endKey) < 0 && fn(leaf)
+	})
+}
+
+// DescendRange iterates in descending order within (endKey, startKey], invoking handleFn.
+// Stops if handleFn returns false.
+func (t *ART) DescendRange(startKey, endKey []byte, handleFn func(key []byte, position *wal.ChunkPosition) (bool, error)) {
+	t.lock.RLock()
+	defer t.lock.RUnlock()
+
+	fn := artHandler(handleFn)
+	t.descend(startKey, func(leaf *artLeaf) bool {
+		return bytes.Compare(leaf.key, endKey) > 0 && fn(leaf)
+	})
+}
+
+// AscendGreaterOrEqual iterates in ascending order, starting from key >= given key,
+// invoking handleFn. Stops if handleFn returns false.
+func (t *ART) AscendGreaterOrEqual(key []byte, handleFn func(key []byte, position *wal.ChunkPosition) (bool, error)) {
+	t.lock.RLock()
+	defer t.lock.RUnlock()
+	t.ascend(key, artHandler(handleFn))
+}
+
+// DescendLessOrEqual iterates in descending order, starting from key <= given key,
+// invoking handleFn. Stops if handleFn returns false.
+func (t *ART) DescendLessOrEqual(key []byte, handleFn func(key []byte, position *wal.ChunkPosition) (bool, error)) {
+	t.lock.RLock()
+	defer t.lock.RUnlock()
+	t.descend(key, artHandler(handleFn))
+}
+
+// Iterator returns an index iterator over a snapshot of the index,
+// the keys and positions are copied out of the tree when it is created.
+func (t *ART) Iterator(reverse bool) IndexIterator {
+	t.lock.RLock()
+	defer t.lock.RUnlock()
+
+	items := make([]indexItem, 0, t.size)
+	t.ascend(nil, func(leaf *artLeaf) bool {
+		items = append(items, indexItem{key: leaf.key, pos: leaf.pos})
+		return true
+	})
+	return newSliceIterator(items, reverse, bytewiseLess)
+}
@@ -0,0 +1,61 @@
+package memdb
+
+import (
+	"testing"
+
+	"github.com/rosedblabs/wal"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestART_Node_Grow_Shrink(t *testing.T) {
+	tree := newART()
+	key := func(b int) []byte { return []byte{'k', byte(b)} }
+
+	kinds := map[int]uint8{1: artNode4, 5: artNode16, 17: artNode48, 49: artNode256, 256: artNode256}
+	for i := 0; i < 256; i++ {
+		assert.Nil(t, tree.Put(key(i), &wal.ChunkPosition{ChunkOffset: int64(i)}))
+		if kind, ok := kinds[i+1]; ok && i > 0 {
+			assert.Equal(t, kind, tree.root.kind, i)
+		}
+	}
+	assert.Equal(t, []byte("k"), tree.root.prefix)
+	assert.Equal(t, 256, tree.Size())
+
+	for i := 255; i >= 1; i-- {
+		pos, ok := tree.Delete(key(i))
+		assert.True(t, ok)
+		assert.Equal(t, int64(i), pos.ChunkOffset)
+		for j := 0; j < i; j++ {
+			assert.Equal(t, int64(j), tree.Get(key(j)).ChunkOffset)
+		}
+		switch i {
+		case 37:
+			assert.Equal(t, artNode48, tree.root.kind)
+		case 12:
+			assert.Equal(t, artNode16, tree.root.kind)
+		case 3:
+			assert.Equal(t, artNode4, tree.root.kind)
+		}
+	}
+	// the node having only one leaf is merged with its child
+	assert.Equal(t, key(0), tree.root.prefix)
+	assert.Equal(t, 1, tree.Size())
+}
+
+func TestART_Prefix_Keys(t *testing.T) {
+	tree := newART()
+	keys := []string{"", "a", "ab", "abc", "abd", "b"}
+	for i, key := range keys {
+		assert.Nil(t, tree.Put([]byte(key), &wal.ChunkPosition{ChunkOffset: int64(i)}))
+	}
+	assert.Equal(t, keys, collectIndex(tree.Ascend))
+
+	_, ok := tree.Delete([]byte("ab"))
+	assert.True(t, ok)
+	_, ok = tree.Delete([]byte("ab"))
+	assert.False(t, ok)
+	assert.Nil(t, tree.Get([]byte("ab")))
+	assert.Equal(t, int64(3), tree.Get([]byte("abc")).ChunkOffset)
+	assert.Equal(t, int64(0), tree.Get([]byte("")).ChunkOffset)
+	assert.Equal(t, []string{"b", "abd", "abc", "a", ""}, collectIndex(tree.Descend))
+}
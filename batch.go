@@ -8,6 +8,7 @@ import (
 
 	"github.com/bwmarrin/snowflake"
 	"github.com/hupeh/memdb/utils"
+	"github.com/rosedblabs/wal"
 	"github.com/valyala/bytebufferpool"
 )
 
@@ -37,6 +38,7 @@ type Batch struct {
 	db               *DB
 	pendingWrites    []*LogRecord     // save the data to be written
 	pendingWritesMap map[uint64][]int // map record hash key to index, fast lookup to pendingWrites
+	pendingRanges    []*LogRecord     // range tombstones in pendingWrites, they are not in pendingWritesMap
 	options          BatchOptions
 	mu               sync.RWMutex
 	committed        bool // whether the batch has been committed
@@ -90,6 +92,7 @@ func (b *Batch) reset() {
 	b.db = nil
 	b.pendingWrites = b.pendingWrites[:0]
 	b.pendingWritesMap = nil
+	b.pendingRanges = b.pendingRanges[:0]
 	b.committed = false
 	b.rollbacked = false
 	// put all buffers back to the pool
@@ -117,35 +120,22 @@ func (b *Batch) unlock() {
 
 // Put adds a key-value pair to the batch for writing.
 func (b *Batch) Put(key []byte, value []byte) error {
-	if len(key) == 0 {
-		return ErrKeyIsEmpty
-	}
-	if b.db.closed {
-		return ErrDBClosed
-	}
-	if b.options.ReadOnly {
-		return ErrReadOnlyBatch
-	}
-
-	b.mu.Lock()
-	// write to pendingWrites
-	var record = b.lookupPendingWrites(key)
-	if record == nil {
-		// if the key does not exist in pendingWrites, write a new record
-		// the record will be put back to the pool when the batch is committed or rollbacked
-		record = b.db.recordPool.Get().(*LogRecord)
-		b.appendPendingWrites(key, record)
-	}
-
-	record.Key, record.Value = key, value
-	record.Type, record.Expire = LogRecordNormal, 0
-	b.mu.Unlock()
-
-	return nil
+	return b.put(b.db.keyspace, key, value, 0)
 }
 
 // PutWithTTL adds a key-value pair with ttl to the batch for writing.
 func (b *Batch) PutWithTTL(key []byte, value []byte, ttl time.Duration) error {
+	return b.PutWithDeadline(key, value, b.db.now().Add(ttl))
+}
+
+// PutWithDeadline adds a key-value pair to the batch for writing,
+// the key expires at the deadline.
+func (b *Batch) PutWithDeadline(key []byte, value []byte, deadline time.Time) error {
+	return b.put(b.db.keyspace, key, value, deadline.UnixNano())
+}
+
+// put adds a key-value pair of the keyspace with the expiry time to the batch for writing.
+func (b *Batch) put(ks *keyspace, key []byte, value []byte, expire int64) error {
 	if len(key) == 0 {
 		return ErrKeyIsEmpty
 	}
@@ -157,17 +147,7 @@ func (b *Batch) PutWithTTL(key []byte, value []byte, ttl time.Duration) error {
 	}
 
 	b.mu.Lock()
-	// write to pendingWrites
-	var record = b.lookupPendingWrites(key)
-	if record == nil {
-		// if the key does not exist in pendingWrites, write a new record
-		// the record will be put back to the pool when the batch is committed or rollbacked
-		record = b.db.recordPool.Get().(*LogRecord)
-		b.appendPendingWrites(key, record)
-	}
-
-	record.Key, record.Value = key, value
-	record.Type, record.Expire = LogRecordNormal, time.Now().Add(ttl).UnixNano()
+	b.putPendingWrite(ks, key, value, expire)
 	b.mu.Unlock()
 
 	return nil
@@ -175,6 +155,11 @@ func (b *Batch) PutWithTTL(key []byte, value []byte, ttl time.Duration) error {
 
 // Get retrieves the value associated with a given key from the batch.
 func (b *Batch) Get(key []byte) ([]byte, error) {
+	return b.get(b.db.keyspace, key)
+}
+
+// get retrieves the value of the key of the keyspace from the batch.
+func (b *Batch) get(ks *keyspace, key []byte) ([]byte, error) {
 	if len(key) == 0 {
 		return nil, ErrKeyIsEmpty
 	}
@@ -182,10 +167,10 @@ func (b *Batch) Get(key []byte) ([]byte, error) {
 		return nil, ErrDBClosed
 	}
 
-	now := time.Now().UnixNano()
+	now := b.db.now().UnixNano()
 	// get from pendingWrites
 	b.mu.RLock()
-	var record = b.lookupPendingWrites(key)
+	var record = b.lookupPendingWrites(ks, key)
 	b.mu.RUnlock()
 
 	// if the record is in pendingWrites, return the value directly
@@ -193,14 +178,28 @@ func (b *Batch) Get(key []byte) ([]byte, error) {
 		if record.Type == LogRecordDeleted || record.IsExpired(now) {
 			return nil, ErrKeyNotFound
 		}
+		if record.Type == LogRecordMergeOperand {
+			return b.mergePendingOperands(record)
+		}
 		return record.Value, nil
 	}
 
 	// get key/value from data file
-	chunkPosition := b.db.index.Get(key)
+	chunkPosition := b.lookupIndex(ks, key)
 	if chunkPosition == nil {
+		if err := ks.indexErr(); err != nil {
+			return nil, err
+		}
+		return nil, ErrKeyNotFound
+	}
+	// the expired keys are left in the index until they are deleted with an expired record,
+	// see DB.DeleteExpiredKeys.
+	if ks.expires.isExpired(key, now) {
 		return nil, ErrKeyNotFound
 	}
+	if chain := ks.operands.get(key); chain != nil {
+		return b.db.mergeOperands(key, chain)
+	}
 	chunk, err := b.db.dataFiles.Read(chunkPosition)
 	if err != nil {
 		return nil, err
@@ -212,7 +211,6 @@ func (b *Batch) Get(key []byte) ([]byte, error) {
 		panic("Deleted data cannot exist in the index")
 	}
 	if record.IsExpired(now) {
-		b.db.index.Delete(record.Key)
 		return nil, ErrKeyNotFound
 	}
 	return record.Value, nil
@@ -220,6 +218,11 @@ func (b *Batch) Get(key []byte) ([]byte, error) {
 
 // Delete marks a key for deletion in the batch.
 func (b *Batch) Delete(key []byte) error {
+	return b.delete(b.db.keyspace, key)
+}
+
+// delete marks the key of the keyspace for deletion in the batch.
+func (b *Batch) delete(ks *keyspace, key []byte) error {
 	if len(key) == 0 {
 		return ErrKeyIsEmpty
 	}
@@ -231,29 +234,78 @@ func (b *Batch) Delete(key []byte) error {
 	}
 
 	b.mu.Lock()
-	// only need key and type when deleting a value.
-	var exist bool
-	var record = b.lookupPendingWrites(key)
-	if record != nil {
-		record.Type = LogRecordDeleted
-		record.Value = nil
-		record.Expire = 0
-		exist = true
+	b.deletePendingWrite(ks, key)
+	b.mu.Unlock()
+
+	return nil
+}
+
+// DeleteRange marks the keys in [start, end) for deletion in the batch,
+// the keys are ordered by Options.LessFunc if it is set, and an empty end means no upper bound.
+//
+// Only one range tombstone record is written for all the keys,
+// the writes of the keys in the range before it in the batch are discarded.
+func (b *Batch) DeleteRange(start, end []byte) error {
+	return b.deleteRange(LogRecordRangeDeleted, start, end)
+}
+
+// DeletePrefix marks the keys starting with the prefix for deletion in the batch.
+// An empty prefix deletes all the keys.
+//
+// Only one prefix tombstone record is written for all the keys,
+// the writes of the keys with the prefix before it in the batch are discarded.
+func (b *Batch) DeletePrefix(prefix []byte) error {
+	return b.deleteRange(LogRecordPrefixDeleted, prefix, nil)
+}
+
+func (b *Batch) deleteRange(recordType LogRecordType, start, end []byte) error {
+	if b.db.closed {
+		return ErrDBClosed
+	}
+	if b.options.ReadOnly {
+		return ErrReadOnlyBatch
 	}
-	if !exist {
-		record = &LogRecord{
-			Key:  key,
-			Type: LogRecordDeleted,
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	// discard the pending writes of the keys in the range, they are deleted anyway
+	pendingWrites := b.pendingWrites[:0]
+	for _, record := range b.pendingWrites {
+		if !isRangeTombstone(record.Type) && record.Namespace == defaultNamespaceId &&
+			b.db.rangeContains(recordType, start, end, record.Key) {
+			b.db.recordPool.Put(record)
+			continue
 		}
-		b.appendPendingWrites(key, record)
+		pendingWrites = append(pendingWrites, record)
+	}
+	clear(b.pendingWrites[len(pendingWrites):])
+	b.pendingWrites = pendingWrites
+	b.pendingWritesMap = nil
+	for i, record := range b.pendingWrites {
+		if isRangeTombstone(record.Type) {
+			continue
+		}
+		if b.pendingWritesMap == nil {
+			b.pendingWritesMap = make(map[uint64][]int)
+		}
+		hashKey := utils.MemHash(record.Key)
+		b.pendingWritesMap[hashKey] = append(b.pendingWritesMap[hashKey], i)
 	}
-	b.mu.Unlock()
 
+	record := &LogRecord{Key: start, Value: end, Type: recordType}
+	b.pendingWrites = append(b.pendingWrites, record)
+	b.pendingRanges = append(b.pendingRanges, record)
 	return nil
 }
 
 // Exist checks if the key exists in the database.
 func (b *Batch) Exist(key []byte) (bool, error) {
+	return b.exist(b.db.keyspace, key)
+}
+
+// exist checks if the key exists in the keyspace.
+func (b *Batch) exist(ks *keyspace, key []byte) (bool, error) {
 	if len(key) == 0 {
 		return false, ErrKeyIsEmpty
 	}
@@ -261,10 +313,10 @@ func (b *Batch) Exist(key []byte) (bool, error) {
 		return false, ErrDBClosed
 	}
 
-	now := time.Now().UnixNano()
+	now := b.db.now().UnixNano()
 	// check if the key exists in pendingWrites
 	b.mu.RLock()
-	var record = b.lookupPendingWrites(key)
+	var record = b.lookupPendingWrites(ks, key)
 	b.mu.RUnlock()
 
 	if record != nil {
@@ -272,79 +324,211 @@ func (b *Batch) Exist(key []byte) (bool, error) {
 	}
 
 	// check if the key exists in index
-	position := b.db.index.Get(key)
+	position := b.lookupIndex(ks, key)
 	if position == nil {
+		return false, ks.indexErr()
+	}
+
+	// check if the key is expired, the deleted keys are never in the index
+	if ks.expires.isExpired(key, now) {
 		return false, nil
 	}
+	return true, nil
+}
+
+// ExpireCondition is the condition to set the ttl of a key,
+// like the NX, XX, GT and LT options of the EXPIRE command of Redis.
+type ExpireCondition byte
+
+const (
+	// ExpireAlways sets the ttl whatever the current ttl is.
+	ExpireAlways ExpireCondition = iota
+	// ExpireIfNotSet sets the ttl only if the key has no ttl (NX).
+	ExpireIfNotSet
+	// ExpireIfSet sets the ttl only if the key has a ttl (XX).
+	ExpireIfSet
+	// ExpireIfGreater sets the ttl only if the new expiry time is later than the current one (GT),
+	// a key without ttl never expires, so its ttl is never set.
+	ExpireIfGreater
+	// ExpireIfLess sets the ttl only if the new expiry time is earlier than the current one (LT),
+	// a key without ttl never expires, so its ttl is always set.
+	ExpireIfLess
+)
+
+// match checks whether the expiry time can be changed from current to expire,
+// 0 means the key has no ttl.
+func (c ExpireCondition) match(current, expire int64) bool {
+	switch c {
+	case ExpireIfNotSet:
+		return current == 0
+	case ExpireIfSet:
+		return current != 0
+	case ExpireIfGreater:
+		return current != 0 && expire > current
+	case ExpireIfLess:
+		return current == 0 || expire < current
+	default:
+		return true
+	}
+}
 
-	// check if the record is deleted or expired
-	chunk, err := b.db.dataFiles.Read(position)
+// Expire sets the ttl of the key.
+func (b *Batch) Expire(key []byte, ttl time.Duration) error {
+	_, err := b.ExpireAtIf(key, b.db.now().Add(ttl), ExpireAlways)
+	return err
+}
+
+// ExpireAt sets the expiry time of the key to the deadline.
+func (b *Batch) ExpireAt(key []byte, deadline time.Time) error {
+	_, err := b.ExpireAtIf(key, deadline, ExpireAlways)
+	return err
+}
+
+// ExpireIf sets the ttl of the key if the condition is matched,
+// and reports whether the ttl is set.
+func (b *Batch) ExpireIf(key []byte, ttl time.Duration, cond ExpireCondition) (bool, error) {
+	return b.ExpireAtIf(key, b.db.now().Add(ttl), cond)
+}
+
+// ExpireAtIf sets the expiry time of the key to the deadline if the condition is matched,
+// and reports whether the expiry time is set.
+// The condition is checked and the expiry time is set atomically in the batch.
+func (b *Batch) ExpireAtIf(key []byte, deadline time.Time, cond ExpireCondition) (bool, error) {
+	return b.expireAtIf(b.db.keyspace, key, deadline, cond)
+}
+
+// expireAtIf sets the expiry time of the key of the keyspace if the condition is matched.
+func (b *Batch) expireAtIf(ks *keyspace, key []byte, deadline time.Time, cond ExpireCondition) (bool, error) {
+	if len(key) == 0 {
+		return false, ErrKeyIsEmpty
+	}
+	if b.db.closed {
+		return false, ErrDBClosed
+	}
+	if b.options.ReadOnly {
+		return false, ErrReadOnlyBatch
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	record, pending, err := b.lookupRecord(ks, key, b.db.now().UnixNano())
 	if err != nil {
 		return false, err
 	}
-
-	record = decodeLogRecord(chunk)
-	if record.Type == LogRecordDeleted || record.IsExpired(now) {
-		b.db.index.Delete(record.Key)
+	expire := deadline.UnixNano()
+	if !cond.match(record.Expire, expire) {
 		return false, nil
 	}
+	// update the expiry time, and rewrite the record read from wal to pendingWrites
+	record.Expire = expire
+	if !pending {
+		b.appendPendingWrites(key, record)
+	}
 	return true, nil
 }
 
-// Expire sets the ttl of the key.
-func (b *Batch) Expire(key []byte, ttl time.Duration) error {
+// GetAndTouch retrieves the value of the key, and resets its ttl,
+// so the key expires ttl after it is read last time.
+func (b *Batch) GetAndTouch(key []byte, ttl time.Duration) ([]byte, error) {
 	if len(key) == 0 {
-		return ErrKeyIsEmpty
+		return nil, ErrKeyIsEmpty
 	}
 	if b.db.closed {
-		return ErrDBClosed
+		return nil, ErrDBClosed
 	}
 	if b.options.ReadOnly {
-		return ErrReadOnlyBatch
+		return nil, ErrReadOnlyBatch
 	}
 
 	b.mu.Lock()
 	defer b.mu.Unlock()
 
-	var record = b.lookupPendingWrites(key)
+	now := b.db.now()
+	record, pending, err := b.lookupRecord(b.db.keyspace, key, now.UnixNano())
+	if err != nil {
+		return nil, err
+	}
+	record.Expire = now.Add(ttl).UnixNano()
+	if !pending {
+		b.appendPendingWrites(key, record)
+	}
+	return record.Value, nil
+}
 
-	// if the key exists in pendingWrites, update the expiry time directly
-	if record != nil {
-		// return key not found if the record is deleted or expired
-		if record.Type == LogRecordDeleted || record.IsExpired(time.Now().UnixNano()) {
-			return ErrKeyNotFound
+// lookupRecord returns the live record of the key from pendingWrites,
+// or reads it from wal if the key is not in pendingWrites, pending reports which one it is.
+// If the key is deleted or expired, it returns ErrKeyNotFound.
+// The caller must hold b.mu.
+func (b *Batch) lookupRecord(ks *keyspace, key []byte, now int64) (record *LogRecord, pending bool, err error) {
+	if record = b.lookupPendingWrites(ks, key); record != nil {
+		if record.Type == LogRecordDeleted || record.IsExpired(now) {
+			return nil, false, ErrKeyNotFound
 		}
-		record.Expire = time.Now().Add(ttl).UnixNano()
-		return nil
+		if record.Type == LogRecordMergeOperand {
+			// the operands are combined, so the record can be rewritten as a normal one
+			value, err := b.mergePendingOperands(record)
+			if err != nil {
+				return nil, false, err
+			}
+			record.Type, record.Value = LogRecordNormal, value
+		}
+		return record, true, nil
 	}
-	// if the key does not exist in pendingWrites, get the value from wal
-	position := b.db.index.Get(key)
+
+	position := b.lookupIndex(ks, key)
 	if position == nil {
-		return ErrKeyNotFound
+		if err := ks.indexErr(); err != nil {
+			return nil, false, err
+		}
+		return nil, false, ErrKeyNotFound
+	}
+	if chain := ks.operands.get(key); chain != nil {
+		expire := ks.expires.get(key)
+		if expire > 0 && expire <= now {
+			return nil, false, ErrKeyNotFound
+		}
+		value, err := b.db.mergeOperands(key, chain)
+		if err != nil {
+			return nil, false, err
+		}
+		return &LogRecord{Key: key, Value: value, Type: LogRecordNormal, Expire: expire, Namespace: ks.id}, false, nil
 	}
 	chunk, err := b.db.dataFiles.Read(position)
 	if err != nil {
-		return err
+		return nil, false, err
 	}
-
-	now := time.Now()
 	record = decodeLogRecord(chunk)
-	// if the record is deleted or expired, we can assume that the key does not exist,
-	// and delete the key from the index
-	if record.Type == LogRecordDeleted || record.IsExpired(now.UnixNano()) {
-		b.db.index.Delete(key)
-		return ErrKeyNotFound
-	}
-	// now we get the value from wal, update the expiry time
-	// and rewrite the record to pendingWrites
-	record.Expire = now.Add(ttl).UnixNano()
-	b.appendPendingWrites(key, record)
+	// if the record is deleted or expired, we can assume that the key does not exist
+	if record.Type == LogRecordDeleted || record.IsExpired(now) {
+		return nil, false, ErrKeyNotFound
+	}
+	return record, false, nil
+}
 
-	return nil
+// mergePendingOperands combines the operands of the pending operand record
+// with the value of the key in the index.
+func (b *Batch) mergePendingOperands(record *LogRecord) ([]byte, error) {
+	if b.db.options.MergeOperator == nil {
+		return nil, ErrNoMergeOperator
+	}
+	var existing []byte
+	if position := b.lookupIndex(b.db.keyspace, record.Key); position != nil {
+		var err error
+		if existing, err = b.db.readValue(b.db.keyspace, record.Key, position); err != nil {
+			return nil, err
+		}
+	}
+	return b.db.options.MergeOperator.FullMerge(record.Key, existing, decodeOperands(record.Value))
 }
 
 // TTL returns the ttl of the key.
 func (b *Batch) TTL(key []byte) (time.Duration, error) {
+	return b.ttl(b.db.keyspace, key)
+}
+
+// ttl returns the ttl of the key of the keyspace.
+func (b *Batch) ttl(ks *keyspace, key []byte) (time.Duration, error) {
 	if len(key) == 0 {
 		return -1, ErrKeyIsEmpty
 	}
@@ -352,11 +536,11 @@ func (b *Batch) TTL(key []byte) (time.Duration, error) {
 		return -1, ErrDBClosed
 	}
 
-	now := time.Now()
+	now := b.db.now()
 	b.mu.Lock()
 	defer b.mu.Unlock()
 
-	var record = b.lookupPendingWrites(key)
+	var record = b.lookupPendingWrites(ks, key)
 	if record != nil {
 		if record.Expire == 0 {
 			return -1, nil
@@ -369,36 +553,66 @@ func (b *Batch) TTL(key []byte) (time.Duration, error) {
 		return time.Duration(record.Expire - now.UnixNano()), nil
 	}
 
-	// if the key does not exist in pendingWrites, get the value from wal
-	position := b.db.index.Get(key)
+	// if the key does not exist in pendingWrites, get the expiry time from the index
+	position := b.lookupIndex(ks, key)
 	if position == nil {
 		return -1, ErrKeyNotFound
 	}
-	chunk, err := b.db.dataFiles.Read(position)
-	if err != nil {
-		return -1, err
-	}
-
-	// return key not found if the record is deleted or expired
-	record = decodeLogRecord(chunk)
-	if record.Type == LogRecordDeleted {
-		return -1, ErrKeyNotFound
+	expire := ks.expires.get(key)
+	if expire == 0 {
+		return -1, nil
 	}
-	if record.IsExpired(now.UnixNano()) {
-		b.db.index.Delete(key)
+	// return key not found if the key is expired
+	if expire <= now.UnixNano() {
 		return -1, ErrKeyNotFound
 	}
 
 	// now we get the valid expiry time, we can calculate the ttl
-	if record.Expire > 0 {
-		return time.Duration(record.Expire - now.UnixNano()), nil
+	return time.Duration(expire - now.UnixNano()), nil
+}
+
+// ExpireTime returns the expiry time of the key,
+// the zero time is returned if the key has no ttl.
+func (b *Batch) ExpireTime(key []byte) (time.Time, error) {
+	if len(key) == 0 {
+		return time.Time{}, ErrKeyIsEmpty
 	}
+	if b.db.closed {
+		return time.Time{}, ErrDBClosed
+	}
+
+	now := b.db.now().UnixNano()
+	b.mu.RLock()
+	defer b.mu.RUnlock()
 
-	return -1, nil
+	var expire int64
+	if record := b.lookupPendingWrites(b.db.keyspace, key); record != nil {
+		if record.Type == LogRecordDeleted || record.IsExpired(now) {
+			return time.Time{}, ErrKeyNotFound
+		}
+		expire = record.Expire
+	} else {
+		if b.lookupIndex(b.db.keyspace, key) == nil {
+			return time.Time{}, ErrKeyNotFound
+		}
+		expire = b.db.expires.get(key)
+		if expire > 0 && expire <= now {
+			return time.Time{}, ErrKeyNotFound
+		}
+	}
+	if expire == 0 {
+		return time.Time{}, nil
+	}
+	return time.Unix(0, expire), nil
 }
 
 // Persist removes the ttl of the key.
 func (b *Batch) Persist(key []byte) error {
+	return b.persist(b.db.keyspace, key)
+}
+
+// persist removes the ttl of the key of the keyspace.
+func (b *Batch) persist(ks *keyspace, key []byte) error {
 	if len(key) == 0 {
 		return ErrKeyIsEmpty
 	}
@@ -413,32 +627,20 @@ func (b *Batch) Persist(key []byte) error {
 	defer b.mu.Unlock()
 
 	// if the key exists in pendingWrites, update the expiry time directly
-	var record = b.lookupPendingWrites(key)
+	var record = b.lookupPendingWrites(ks, key)
 	if record != nil {
-		if record.Type == LogRecordDeleted && record.IsExpired(time.Now().UnixNano()) {
+		if record.Type == LogRecordDeleted && record.IsExpired(b.db.now().UnixNano()) {
 			return ErrKeyNotFound
 		}
 		record.Expire = 0
 		return nil
 	}
 
-	// check if the key exists in index
-	position := b.db.index.Get(key)
-	if position == nil {
-		return ErrKeyNotFound
-	}
-	chunk, err := b.db.dataFiles.Read(position)
+	// check if the key exists in index, and read the record
+	record, _, err := b.lookupRecord(ks, key, b.db.now().UnixNano())
 	if err != nil {
 		return err
 	}
-
-	record = decodeLogRecord(chunk)
-	now := time.Now().UnixNano()
-	// check if the record is deleted or expired
-	if record.Type == LogRecordDeleted || record.IsExpired(now) {
-		b.db.index.Delete(record.Key)
-		return ErrKeyNotFound
-	}
 	// if the expiration time is 0, it means that the key has no expiration time,
 	// so we can return directly
 	if record.Expire == 0 {
@@ -477,9 +679,15 @@ func (b *Batch) Commit() error {
 	if b.rollbacked {
 		return ErrBatchRollbacked
 	}
+	// the keys may be missing from a failed index, so the writes are refused
+	for _, record := range b.pendingWrites {
+		if err := b.db.keyspaces[record.Namespace].indexErr(); err != nil {
+			return err
+		}
+	}
 
 	batchId := b.batchId.Generate()
-	now := time.Now().UnixNano()
+	now := b.db.now().UnixNano()
 	// write to wal buffer
 	for _, record := range b.pendingWrites {
 		buf := bytebufferpool.Get()
@@ -515,19 +723,40 @@ func (b *Batch) Commit() error {
 		}
 	}
 
+	// every chunk is garbage until it is indexed
+	for _, position := range chunkPositions {
+		b.db.segmentStats.written(position)
+	}
+	b.db.lastPosition = chunkPositions[len(chunkPositions)-1]
+
 	// write to index
 	for i, record := range b.pendingWrites {
-		if record.Type == LogRecordDeleted || record.IsExpired(now) {
-			b.db.index.Delete(record.Key)
+		ks := b.db.keyspaces[record.Namespace]
+		if isRangeTombstone(record.Type) {
+			b.db.deleteIndexRange(record.Type, record.Key, record.Value)
+		} else if record.Type == LogRecordDeleted || record.IsExpired(now) {
+			b.db.deleteIndex(ks, record.Key)
+		} else if record.Type == LogRecordMergeOperand {
+			b.db.appendIndex(ks, record.Key, chunkPositions[i], record.Expire)
 		} else {
-			b.db.index.Put(record.Key, chunkPositions[i])
+			b.db.putIndex(ks, record.Key, chunkPositions[i], record.Expire)
 		}
 
-		if b.db.options.WatchQueueSize > 0 {
-			e := &Event{Key: record.Key, Value: record.Value, BatchId: record.BatchId}
-			if record.Type == LogRecordDeleted {
+		if b.db.options.WatchQueueSize > 0 && record.Type == LogRecordMergeOperand {
+			// an event for every operand appended in the batch
+			for _, operand := range decodeOperands(record.Value) {
+				b.db.watcher.putEvent(&Event{Action: WatchActionAppend, Key: record.Key, Value: operand, BatchId: record.BatchId, Namespace: ks.name})
+			}
+		} else if b.db.options.WatchQueueSize > 0 {
+			e := &Event{Key: record.Key, Value: record.Value, BatchId: record.BatchId, Namespace: ks.name}
+			switch record.Type {
+			case LogRecordDeleted:
 				e.Action = WatchActionDelete
-			} else {
+			case LogRecordRangeDeleted:
+				e.Action = WatchActionDeleteRange
+			case LogRecordPrefixDeleted:
+				e.Action = WatchActionDeletePrefix
+			default:
 				e.Action = WatchActionPut
 			}
 			b.db.watcher.putEvent(e)
@@ -537,6 +766,7 @@ func (b *Batch) Commit() error {
 	}
 
 	b.committed = true
+	b.db.maybeAutoMerge()
 	return nil
 }
 
@@ -569,27 +799,69 @@ func (b *Batch) Rollback() error {
 		for key := range b.pendingWritesMap {
 			delete(b.pendingWritesMap, key)
 		}
+		b.pendingRanges = b.pendingRanges[:0]
 	}
 
 	b.rollbacked = true
 	return nil
 }
 
-// lookupPendingWrites if the key exists in pendingWrites, update the value directly
-func (b *Batch) lookupPendingWrites(key []byte) *LogRecord {
+// lookupPendingWrites if the key of the keyspace exists in pendingWrites, update the value directly
+func (b *Batch) lookupPendingWrites(ks *keyspace, key []byte) *LogRecord {
 	if len(b.pendingWritesMap) == 0 {
 		return nil
 	}
 
 	hashKey := utils.MemHash(key)
 	for _, entry := range b.pendingWritesMap[hashKey] {
-		if bytes.Equal(b.pendingWrites[entry].Key, key) {
-			return b.pendingWrites[entry]
+		record := b.pendingWrites[entry]
+		if record.Namespace == ks.id && bytes.Equal(record.Key, key) {
+			return record
 		}
 	}
 	return nil
 }
 
+// lookupIndex returns the position of the key in the index of the keyspace,
+// or nil if the key is deleted by a range tombstone in pendingWrites.
+func (b *Batch) lookupIndex(ks *keyspace, key []byte) *wal.ChunkPosition {
+	// the range tombstones are only written for the default namespace
+	for _, record := range b.pendingRanges {
+		if record.Namespace == ks.id && b.db.rangeContains(record.Type, record.Key, record.Value, key) {
+			return nil
+		}
+	}
+	return ks.index.Get(key)
+}
+
+// putPendingWrite writes the key-value pair of the keyspace with the expiry time to pendingWrites.
+// The caller must hold b.mu.
+func (b *Batch) putPendingWrite(ks *keyspace, key, value []byte, expire int64) {
+	var record = b.lookupPendingWrites(ks, key)
+	if record == nil {
+		// if the key does not exist in pendingWrites, write a new record
+		// the record will be put back to the pool when the batch is committed or rollbacked
+		record = b.db.recordPool.Get().(*LogRecord)
+		b.appendPendingWrites(key, record)
+	}
+
+	record.Key, record.Value, record.Namespace = key, value, ks.id
+	record.Type, record.Expire = LogRecordNormal, expire
+}
+
+// deletePendingWrite marks the key of the keyspace for deletion in pendingWrites.
+// The caller must hold b.mu.
+func (b *Batch) deletePendingWrite(ks *keyspace, key []byte) {
+	// only need key and type when deleting a value.
+	if record := b.lookupPendingWrites(ks, key); record != nil {
+		record.Type = LogRecordDeleted
+		record.Value = nil
+		record.Expire = 0
+		return
+	}
+	b.appendPendingWrites(key, &LogRecord{Key: key, Type: LogRecordDeleted, Namespace: ks.id})
+}
+
 // add new record to pendingWrites and pendingWritesMap.
 func (b *Batch) appendPendingWrites(key []byte, record *LogRecord) {
 	b.pendingWrites = append(b.pendingWrites, record)
@@ -3,6 +3,7 @@ package memdb
 import (
 	"os"
 	"testing"
+	"time"
 
 	"github.com/hupeh/memdb/utils"
 	"github.com/stretchr/testify/assert"
@@ -237,3 +238,36 @@ func TestBatch_SetTwice(t *testing.T) {
 	assert.Nil(t, err)
 	assert.Equal(t, res2, value2)
 }
+
+func TestBatch_ExpireAtIf_Pending(t *testing.T) {
+	options := DefaultOptions
+	db, err := Open(options)
+	assert.Nil(t, err)
+	defer destroyDB(db)
+
+	key := []byte("memdb")
+	deadline := time.Now().Add(time.Hour)
+	batch := db.NewBatch(DefaultBatchOptions)
+	assert.Nil(t, batch.PutWithDeadline(key, []byte("val"), deadline))
+	// the condition is checked against the pending write
+	ok, err := batch.ExpireAtIf(key, deadline.Add(time.Hour), ExpireIfNotSet)
+	assert.Nil(t, err)
+	assert.False(t, ok)
+	ok, err = batch.ExpireAtIf(key, deadline.Add(time.Hour), ExpireIfGreater)
+	assert.Nil(t, err)
+	assert.True(t, ok)
+	expireTime, err := batch.ExpireTime(key)
+	assert.Nil(t, err)
+	assert.Equal(t, deadline.Add(time.Hour).UnixNano(), expireTime.UnixNano())
+	assert.Nil(t, batch.Commit())
+
+	expireTime, err = db.ExpireTime(key)
+	assert.Nil(t, err)
+	assert.Equal(t, deadline.Add(time.Hour).UnixNano(), expireTime.UnixNano())
+
+	// a read only batch can't touch the key
+	batch = db.NewBatch(BatchOptions{ReadOnly: true})
+	_, err = batch.GetAndTouch(key, time.Hour)
+	assert.Equal(t, ErrReadOnlyBatch, err)
+	assert.Nil(t, batch.Commit())
+}
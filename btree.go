@@ -8,12 +8,13 @@ import (
 	"github.com/rosedblabs/wal"
 )
 
-// BTree is a memory based btree implementation of the Index interface
+// BTree is a memory based btree implementation of the Indexer interface
 // It is a wrapper around the google/btree package: github.com/google/btree
 type BTree struct {
-	lock *sync.RWMutex
-	tree *btree.BTreeG[*btreeItem]
-	less func(a, b *btreeItem) bool
+	lock     *sync.RWMutex
+	tree     *btree.BTreeG[*btreeItem]
+	less     func(a, b *btreeItem) bool
+	keyBytes int64 // total length of the keys
 }
 
 type btreeItem struct {
@@ -50,6 +51,7 @@ func (mt *BTree) Put(key []byte, position *wal.ChunkPosition) *wal.ChunkPosition
 	if oldValue != nil {
 		return oldValue.pos
 	}
+	mt.keyBytes += int64(len(key))
 	return nil
 }
 
@@ -71,6 +73,7 @@ func (mt *BTree) Delete(key []byte) (*wal.ChunkPosition, bool) {
 
 	value, _ := mt.tree.Delete(&btreeItem{key: key})
 	if value != nil {
+		mt.keyBytes -= int64(len(value.key))
 		return value.pos, true
 	}
 	return nil, false
@@ -81,6 +84,13 @@ func (mt *BTree) Size() int {
 	return mt.tree.Len()
 }
 
+// MemSize returns the estimated memory used by the index in bytes.
+func (mt *BTree) MemSize() int64 {
+	mt.lock.RLock()
+	defer mt.lock.RUnlock()
+	return mt.keyBytes + int64(mt.tree.Len())*btreeItemOverhead
+}
+
 // Ascend iterates over items in ascending order and invokes the handler function for each item.
 // If the handler function returns false, iteration stops.
 func (mt *BTree) Ascend(handleFn func(key []byte, position *wal.ChunkPosition) (bool, error)) {
@@ -172,7 +182,7 @@ func (mt *BTree) DescendLessOrEqual(key []byte, handleFn func(key []byte, positi
 }
 
 // Iterator returns an index iterator.
-func (mt *BTree) Iterator(reverse bool) *BTreeIterator {
+func (mt *BTree) Iterator(reverse bool) IndexIterator {
 	if mt.tree == nil {
 		return nil
 	}
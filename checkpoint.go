@@ -0,0 +1,474 @@
+package memdb
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"hash"
+	"hash/crc32"
+	"io"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/rosedblabs/wal"
+)
+
+const (
+	checkpointFileName    = "INDEX.CKPT"
+	checkpointTmpFileName = "INDEX.CKPT.tmp"
+	checkpointMagic       = 0x4d44424b // "MDBK"
+	checkpointVersion     = 4
+)
+
+var errCorruptedCheckpoint = errors.New("memdb: the index checkpoint is corrupted")
+
+// indexCheckpoint is a snapshot of the index, which covers the WAL up to position.
+//
+// The checkpoint file is laid out as:
+//
+//	+-------+---------+------------+----------+-------+---------+-----+
+//	| magic | version | generation | position | stats | entries | crc |
+//	+-------+---------+------------+----------+-------+---------+-----+
+//
+// The stats are the live and dead bytes of every segment prefixed by their count,
+// and the entries are the namespace ids, positions, expiry times and keys of the index
+// of every namespace in ascending order, followed by the positions of the records
+// of the merge operands of the key, if any.
+// Every entry is prefixed by a non-zero flag and a zero flag ends them. The crc is the crc32 of all the bytes before it.
+//
+// A checkpoint is only valid for the manifest generation it is written with,
+// because a merge moves the records and removes the segments it covers.
+type indexCheckpoint struct {
+	generation uint64
+	position   *wal.ChunkPosition
+	stats      map[wal.SegmentID]segmentStat
+	spaces     []*checkpointSpace
+}
+
+// checkpointSpace is a snapshot of the index of a namespace.
+type checkpointSpace struct {
+	id       uint32
+	iter     IndexIterator
+	expires  *expiryTable
+	operands *operandTable
+}
+
+// checkpointState is the generation and the position covered by the latest checkpoint,
+// a new checkpoint is not needed until either of them changes.
+type checkpointState struct {
+	generation uint64
+	position   *wal.ChunkPosition
+}
+
+// Checkpoint writes the index to the checkpoint file, so the next Open loads it
+// and only replays the WAL written after it.
+// It does nothing if nothing has been written since the latest checkpoint.
+//
+// The index is also checkpointed by Close and every Options.IndexCheckpointInterval,
+// if Options.IndexCheckpoint is enabled.
+func (db *DB) Checkpoint() error {
+	db.mu.RLock()
+	if db.closed {
+		db.mu.RUnlock()
+		return ErrDBClosed
+	}
+	cp, err := db.snapshotCheckpoint()
+	db.mu.RUnlock()
+	if err != nil || cp == nil {
+		return err
+	}
+	return db.writeCheckpoint(cp)
+}
+
+// snapshotCheckpoint takes a snapshot of the index for a checkpoint,
+// it returns nil if the latest checkpoint is still up to date.
+// The data files are synced first, so the checkpoint never covers the writes lost in a crash.
+// The caller must hold db.mu.
+func (db *DB) snapshotCheckpoint() (*indexCheckpoint, error) {
+	if db.lastPosition == nil {
+		return nil, nil
+	}
+	db.checkpointMu.Lock()
+	state := db.checkpointState
+	db.checkpointMu.Unlock()
+	if state.position != nil && state.generation == db.manifest.Generation &&
+		positionEquals(state.position, db.lastPosition) {
+		return nil, nil
+	}
+
+	if err := db.dataFiles.Sync(); err != nil {
+		return nil, err
+	}
+	cp := &indexCheckpoint{
+		generation: db.manifest.Generation,
+		position:   db.lastPosition,
+		stats:      db.segmentStats.snapshot(),
+	}
+	for _, ks := range db.keyspaces {
+		cp.spaces = append(cp.spaces, &checkpointSpace{
+			id:       ks.id,
+			iter:     ks.index.Iterator(false),
+			expires:  ks.expires.clone(),
+			operands: ks.operands.clone(),
+		})
+	}
+	return cp, nil
+}
+
+// writeCheckpoint writes the checkpoint to a temporary file and renames it
+// to the checkpoint file, so a crash never leaves a partial checkpoint behind.
+func (db *DB) writeCheckpoint(cp *indexCheckpoint) error {
+	defer func() {
+		for _, space := range cp.spaces {
+			space.iter.Close()
+		}
+	}()
+
+	db.checkpointMu.Lock()
+	defer db.checkpointMu.Unlock()
+	// a concurrent checkpoint may have written a newer one
+	if state := db.checkpointState; state.position != nil && (state.generation > cp.generation ||
+		state.generation == cp.generation && !positionBefore(state.position, cp.position)) {
+		return nil
+	}
+
+	tmpPath := filepath.Join(db.options.DirPath, checkpointTmpFileName)
+	file, err := os.OpenFile(tmpPath, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	if err = encodeCheckpoint(file, cp); err != nil {
+		_ = file.Close()
+		_ = os.Remove(tmpPath)
+		return err
+	}
+	if err = file.Sync(); err != nil {
+		_ = file.Close()
+		return err
+	}
+	if err = file.Close(); err != nil {
+		return err
+	}
+	if err = os.Rename(tmpPath, filepath.Join(db.options.DirPath, checkpointFileName)); err != nil {
+		return err
+	}
+	if err = syncDir(db.options.DirPath); err != nil {
+		return err
+	}
+
+	db.checkpointState = checkpointState{generation: cp.generation, position: cp.position}
+	return nil
+}
+
+func encodeCheckpoint(w io.Writer, cp *indexCheckpoint) error {
+	crc := crc32.NewIEEE()
+	bw := bufio.NewWriterSize(io.MultiWriter(w, crc), 64*KB)
+	buf := make([]byte, 0, 64)
+
+	buf = binary.LittleEndian.AppendUint32(buf, checkpointMagic)
+	buf = binary.LittleEndian.AppendUint32(buf, checkpointVersion)
+	buf = binary.LittleEndian.AppendUint64(buf, cp.generation)
+	buf = appendPosition(buf, cp.position)
+	buf = binary.AppendUvarint(buf, uint64(len(cp.stats)))
+	if _, err := bw.Write(buf); err != nil {
+		return err
+	}
+	for id, stat := range cp.stats {
+		buf = binary.AppendUvarint(buf[:0], uint64(id))
+		buf = binary.AppendVarint(buf, stat.live)
+		buf = binary.AppendVarint(buf, stat.dead)
+		if _, err := bw.Write(buf); err != nil {
+			return err
+		}
+	}
+
+	// the number of entries is unknown until the iteration is done,
+	// so every entry is prefixed by a flag and the entries end with a zero flag.
+	for _, space := range cp.spaces {
+		for space.iter.Rewind(); space.iter.Valid(); space.iter.Next() {
+			key := space.iter.Key()
+			buf = append(buf[:0], 1)
+			buf = binary.AppendUvarint(buf, uint64(space.id))
+			buf = appendPosition(buf, space.iter.Value())
+			buf = binary.AppendVarint(buf, space.expires.get(key))
+			buf = binary.AppendUvarint(buf, uint64(len(key)))
+			if _, err := bw.Write(buf); err != nil {
+				return err
+			}
+			if _, err := bw.Write(key); err != nil {
+				return err
+			}
+			chain := space.operands.get(key)
+			buf = binary.AppendUvarint(buf[:0], uint64(len(chain)))
+			for _, position := range chain {
+				buf = appendPosition(buf, position)
+			}
+			if _, err := bw.Write(buf); err != nil {
+				return err
+			}
+		}
+	}
+	if err := bw.WriteByte(0); err != nil {
+		return err
+	}
+	if err := bw.Flush(); err != nil {
+		return err
+	}
+	_, err := w.Write(binary.LittleEndian.AppendUint32(nil, crc.Sum32()))
+	return err
+}
+
+func appendPosition(buf []byte, pos *wal.ChunkPosition) []byte {
+	buf = binary.AppendUvarint(buf, uint64(pos.SegmentId))
+	buf = binary.AppendUvarint(buf, uint64(pos.BlockNumber))
+	buf = binary.AppendUvarint(buf, uint64(pos.ChunkOffset))
+	return binary.AppendUvarint(buf, uint64(pos.ChunkSize))
+}
+
+// checkpointReader decodes a checkpoint file and computes its crc as it goes.
+type checkpointReader struct {
+	r   *bufio.Reader
+	crc hash.Hash32
+}
+
+func (cr *checkpointReader) ReadByte() (byte, error) {
+	b, err := cr.r.ReadByte()
+	if err == nil {
+		_, _ = cr.crc.Write([]byte{b})
+	}
+	return b, err
+}
+
+func (cr *checkpointReader) read(buf []byte) error {
+	if _, err := io.ReadFull(cr.r, buf); err != nil {
+		return err
+	}
+	_, _ = cr.crc.Write(buf)
+	return nil
+}
+
+func (cr *checkpointReader) uvarint() (uint64, error) {
+	return binary.ReadUvarint(cr)
+}
+
+func (cr *checkpointReader) position() (*wal.ChunkPosition, error) {
+	var fields [4]uint64
+	for i := range fields {
+		v, err := cr.uvarint()
+		if err != nil {
+			return nil, err
+		}
+		fields[i] = v
+	}
+	return &wal.ChunkPosition{
+		SegmentId:   wal.SegmentID(fields[0]),
+		BlockNumber: uint32(fields[1]),
+		ChunkOffset: int64(fields[2]),
+		ChunkSize:   uint32(fields[3]),
+	}, nil
+}
+
+// readCheckpoint decodes the checkpoint file at path, and calls handleFn for every entry.
+// The entries are handled before the crc is checked at the end of the file,
+// so the caller must discard them if an error is returned.
+func readCheckpoint(path string, handleFn func(namespace uint32, key []byte, position *wal.ChunkPosition, expire int64, chain []*wal.ChunkPosition)) (*indexCheckpoint, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		_ = file.Close()
+	}()
+
+	info, err := file.Stat()
+	if err != nil {
+		return nil, err
+	}
+	cr := &checkpointReader{r: bufio.NewReaderSize(file, 64*KB), crc: crc32.NewIEEE()}
+	header := make([]byte, 16)
+	if err = cr.read(header); err != nil {
+		return nil, err
+	}
+	if binary.LittleEndian.Uint32(header) != checkpointMagic ||
+		binary.LittleEndian.Uint32(header[4:]) != checkpointVersion {
+		return nil, errCorruptedCheckpoint
+	}
+	cp := &indexCheckpoint{generation: binary.LittleEndian.Uint64(header[8:])}
+	if cp.position, err = cr.position(); err != nil {
+		return nil, err
+	}
+
+	numStats, err := cr.uvarint()
+	if err != nil {
+		return nil, err
+	}
+	cp.stats = make(map[wal.SegmentID]segmentStat)
+	for i := uint64(0); i < numStats; i++ {
+		id, err := cr.uvarint()
+		if err != nil {
+			return nil, err
+		}
+		live, err := binary.ReadVarint(cr)
+		if err != nil {
+			return nil, err
+		}
+		dead, err := binary.ReadVarint(cr)
+		if err != nil {
+			return nil, err
+		}
+		cp.stats[wal.SegmentID(id)] = segmentStat{live: live, dead: dead}
+	}
+
+	for {
+		flag, err := cr.ReadByte()
+		if err != nil {
+			return nil, err
+		}
+		if flag == 0 {
+			break
+		}
+		namespace, err := cr.uvarint()
+		if err != nil {
+			return nil, err
+		}
+		position, err := cr.position()
+		if err != nil {
+			return nil, err
+		}
+		expire, err := binary.ReadVarint(cr)
+		if err != nil {
+			return nil, err
+		}
+		keyLen, err := cr.uvarint()
+		if err != nil {
+			return nil, err
+		}
+		if keyLen > uint64(info.Size()) {
+			return nil, errCorruptedCheckpoint
+		}
+		key := make([]byte, keyLen)
+		if err = cr.read(key); err != nil {
+			return nil, err
+		}
+		chainLen, err := cr.uvarint()
+		if err != nil {
+			return nil, err
+		}
+		if chainLen > uint64(info.Size()) {
+			return nil, errCorruptedCheckpoint
+		}
+		var chain []*wal.ChunkPosition
+		for i := uint64(0); i < chainLen; i++ {
+			p, err := cr.position()
+			if err != nil {
+				return nil, err
+			}
+			chain = append(chain, p)
+		}
+		handleFn(uint32(namespace), key, position, expire, chain)
+	}
+
+	sum := cr.crc.Sum32()
+	footer := make([]byte, 4)
+	if _, err = io.ReadFull(cr.r, footer); err != nil {
+		return nil, err
+	}
+	if binary.LittleEndian.Uint32(footer) != sum {
+		return nil, errCorruptedCheckpoint
+	}
+	return cp, nil
+}
+
+// loadIndexFromCheckpoint loads the index and the segment stats from the checkpoint file,
+// and returns the WAL position covered by it.
+//
+// It returns nil if there is no usable checkpoint: the file does not exist, is corrupted,
+// or is written before the latest merge. The index is then left empty,
+// and should be loaded from the hint file and the WAL as usual.
+func (db *DB) loadIndexFromCheckpoint() (*wal.ChunkPosition, error) {
+	// the records of the namespaces dropped after the checkpoint are live in its stats
+	var dropped []*wal.ChunkPosition
+	path := filepath.Join(db.options.DirPath, checkpointFileName)
+	cp, err := readCheckpoint(path, func(namespace uint32, key []byte, position *wal.ChunkPosition, expire int64, chain []*wal.ChunkPosition) {
+		live := chain
+		if len(live) == 0 {
+			live = []*wal.ChunkPosition{position}
+		}
+		ks := db.keyspaces[namespace]
+		if ks == nil {
+			dropped = append(dropped, live...)
+			return
+		}
+		ks.index.Put(key, position)
+		ks.expires.set(key, expire)
+		if len(chain) > 0 {
+			ks.operands.m[string(key)] = chain
+		}
+		if ks.live != nil {
+			for _, p := range live {
+				ks.live.indexed(p)
+			}
+		}
+	})
+	if err == nil && cp.generation == db.manifest.Generation &&
+		cp.position.SegmentId <= db.dataFiles.ActiveSegmentID() {
+		db.segmentStats.restore(cp.stats)
+		for _, position := range dropped {
+			db.segmentStats.released(position)
+		}
+		db.checkpointState = checkpointState{generation: cp.generation, position: cp.position}
+		return cp.position, nil
+	}
+
+	// discard the entries loaded from an unusable checkpoint,
+	// the default index first, the files of the namespaces are in its directory.
+	db.expires = newExpiryTable()
+	db.operands = newOperandTable()
+	if db.index.Size() > 0 {
+		_ = db.closeIndex()
+		if db.index, err = newIndexer(db.options, defaultNamespaceId); err != nil {
+			return nil, err
+		}
+	}
+	for id, ks := range db.keyspaces {
+		if id != defaultNamespaceId {
+			_ = ks.closeIndex()
+			comparator := Comparator{Name: ks.comparator, Less: ks.lessFunc}
+			index, err := db.newNamespaceIndex(id, comparator)
+			if err != nil {
+				return nil, err
+			}
+			db.keyspaces[id] = newKeyspace(id, ks.name, index, comparator)
+		}
+	}
+	return nil, nil
+}
+
+// checkpointLoop checkpoints the index every Options.IndexCheckpointInterval
+// until the database is closed.
+func (db *DB) checkpointLoop() {
+	ticker := time.NewTicker(db.options.IndexCheckpointInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-db.closeCh:
+			return
+		case <-ticker.C:
+			// a background task can't return its error,
+			// the next checkpoint or Close will try again.
+			_ = db.Checkpoint()
+		}
+	}
+}
+
+// positionBefore reports whether the chunk at a is written before the chunk at b.
+func positionBefore(a, b *wal.ChunkPosition) bool {
+	if a.SegmentId != b.SegmentId {
+		return a.SegmentId < b.SegmentId
+	}
+	if a.BlockNumber != b.BlockNumber {
+		return a.BlockNumber < b.BlockNumber
+	}
+	return a.ChunkOffset < b.ChunkOffset
+}
@@ -0,0 +1,223 @@
+package memdb
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/hupeh/memdb/utils"
+	"github.com/rosedblabs/wal"
+	"github.com/stretchr/testify/assert"
+)
+
+// closeWithoutCheckpoint closes the database as if the process crashed after the latest checkpoint.
+func closeWithoutCheckpoint(t *testing.T, db *DB) {
+	db.options.IndexCheckpoint = false
+	assert.Nil(t, db.Close())
+}
+
+func assertTestData(t *testing.T, db *DB, start, end int, exists bool) {
+	for i := start; i < end; i++ {
+		val, err := db.Get(utils.GetTestKey(i))
+		if exists {
+			assert.Nil(t, err)
+			assert.NotNil(t, val)
+		} else {
+			assert.Equal(t, ErrKeyNotFound, err)
+		}
+	}
+}
+
+func TestDB_Checkpoint_Close(t *testing.T) {
+	options := DefaultOptions
+	options.IndexCheckpoint = true
+	options.SegmentSize = 2 * MB
+	db, err := Open(options)
+	assert.Nil(t, err)
+	defer destroyDB(db)
+
+	generateData(t, db, 0, 10000, 512)
+	for i := 0; i < 2000; i++ {
+		assert.Nil(t, db.Delete(utils.GetTestKey(i)))
+	}
+	stat := db.Stat()
+	assert.Nil(t, db.Close())
+
+	_, err = os.Stat(filepath.Join(options.DirPath, checkpointFileName))
+	assert.Nil(t, err)
+
+	db, err = Open(options)
+	assert.Nil(t, err)
+	// the index is loaded from the checkpoint
+	assert.NotNil(t, db.checkpointState.position)
+	stat2 := db.Stat()
+	assert.Equal(t, stat.KeysNum, stat2.KeysNum)
+	assert.Equal(t, stat.LiveSize, stat2.LiveSize)
+	assert.Equal(t, stat.DeadSize, stat2.DeadSize)
+	assertTestData(t, db, 0, 2000, false)
+	assertTestData(t, db, 2000, 10000, true)
+
+	// nothing is written, the checkpoint is not rewritten
+	info, err := os.Stat(filepath.Join(options.DirPath, checkpointFileName))
+	assert.Nil(t, err)
+	time.Sleep(10 * time.Millisecond)
+	assert.Nil(t, db.Checkpoint())
+	info2, err := os.Stat(filepath.Join(options.DirPath, checkpointFileName))
+	assert.Nil(t, err)
+	assert.Equal(t, info.ModTime(), info2.ModTime())
+	assert.Nil(t, db.Close())
+}
+
+func TestDB_Checkpoint_Close_Failed(t *testing.T) {
+	options := DefaultOptions
+	options.IndexCheckpoint = true
+	db, err := Open(options)
+	assert.Nil(t, err)
+	defer destroyDB(db)
+
+	generateData(t, db, 0, 1000, 128)
+	// the temporary checkpoint file can not be created
+	tmpPath := filepath.Join(options.DirPath, checkpointTmpFileName)
+	assert.Nil(t, os.MkdirAll(filepath.Join(tmpPath, "dir"), os.ModePerm))
+	assert.NotNil(t, db.Close())
+	assert.True(t, db.closed)
+	assert.Nil(t, os.RemoveAll(tmpPath))
+
+	// the database is closed and unlocked anyway
+	db, err = Open(options)
+	assert.Nil(t, err)
+	assertTestData(t, db, 0, 1000, true)
+}
+
+func TestDB_Checkpoint_Tail(t *testing.T) {
+	options := DefaultOptions
+	options.IndexCheckpoint = true
+	options.SegmentSize = 2 * MB
+	db, err := Open(options)
+	assert.Nil(t, err)
+	defer destroyDB(db)
+
+	generateData(t, db, 0, 5000, 512)
+	assert.Nil(t, db.Checkpoint())
+
+	// the writes after the checkpoint are replayed from the WAL
+	generateData(t, db, 5000, 10000, 512)
+	for i := 0; i < 1000; i++ {
+		assert.Nil(t, db.Delete(utils.GetTestKey(i)))
+	}
+	stat := db.Stat()
+	closeWithoutCheckpoint(t, db)
+
+	db, err = Open(options)
+	assert.Nil(t, err)
+	assert.NotNil(t, db.checkpointState.position)
+	stat2 := db.Stat()
+	assert.Equal(t, stat.KeysNum, stat2.KeysNum)
+	assert.InDelta(t, stat.LiveSize, stat2.LiveSize, float64(stat.LiveSize)/100)
+	assert.InDelta(t, stat.DeadSize, stat2.DeadSize, float64(stat.DeadSize)/100)
+	assertTestData(t, db, 0, 1000, false)
+	assertTestData(t, db, 1000, 10000, true)
+	assert.Nil(t, db.Close())
+}
+
+func TestDB_Checkpoint_Merge(t *testing.T) {
+	options := DefaultOptions
+	options.IndexCheckpoint = true
+	options.SegmentSize = 2 * MB
+	db, err := Open(options)
+	assert.Nil(t, err)
+	defer destroyDB(db)
+
+	generateData(t, db, 0, 10000, 512)
+	assert.Nil(t, db.Checkpoint())
+	for i := 0; i < 5000; i++ {
+		assert.Nil(t, db.Delete(utils.GetTestKey(i)))
+	}
+	// the merge moves the records, so the checkpoint is stale
+	assert.Nil(t, db.Merge(true))
+	closeWithoutCheckpoint(t, db)
+
+	db, err = Open(options)
+	assert.Nil(t, err)
+	assert.Nil(t, db.checkpointState.position)
+	assert.Equal(t, 5000, db.Stat().KeysNum)
+	assertTestData(t, db, 0, 5000, false)
+	assertTestData(t, db, 5000, 10000, true)
+
+	// the checkpoint written after the merge is used
+	generateData(t, db, 10000, 11000, 512)
+	assert.Nil(t, db.Close())
+	db, err = Open(options)
+	assert.Nil(t, err)
+	assert.NotNil(t, db.checkpointState.position)
+	assert.Equal(t, 6000, db.Stat().KeysNum)
+	assertTestData(t, db, 5000, 11000, true)
+	assert.Nil(t, db.Close())
+}
+
+func TestDB_Checkpoint_Corrupted(t *testing.T) {
+	options := DefaultOptions
+	options.IndexCheckpoint = true
+	db, err := Open(options)
+	assert.Nil(t, err)
+	defer destroyDB(db)
+
+	generateData(t, db, 0, 1000, 128)
+	assert.Nil(t, db.Close())
+
+	path := filepath.Join(options.DirPath, checkpointFileName)
+	data, err := os.ReadFile(path)
+	assert.Nil(t, err)
+	data[len(data)/2] ^= 0xff
+	assert.Nil(t, os.WriteFile(path, data, 0644))
+
+	// the corrupted checkpoint is ignored, and the index is loaded from the WAL
+	db, err = Open(options)
+	assert.Nil(t, err)
+	assert.Nil(t, db.checkpointState.position)
+	assert.Equal(t, 1000, db.Stat().KeysNum)
+	assertTestData(t, db, 0, 1000, true)
+	assert.Nil(t, db.Close())
+}
+
+func TestDB_Checkpoint_Interval(t *testing.T) {
+	options := DefaultOptions
+	options.IndexCheckpoint = true
+	options.IndexCheckpointInterval = 20 * time.Millisecond
+	db, err := Open(options)
+	assert.Nil(t, err)
+	defer destroyDB(db)
+
+	generateData(t, db, 0, 100, 128)
+	assert.Eventually(t, func() bool {
+		_, err := os.Stat(filepath.Join(options.DirPath, checkpointFileName))
+		return err == nil
+	}, time.Second, 10*time.Millisecond)
+}
+
+func TestDB_Checkpoint_Disabled(t *testing.T) {
+	options := DefaultOptions
+	options.IndexCheckpoint = false
+	db, err := Open(options)
+	assert.Nil(t, err)
+	defer destroyDB(db)
+
+	generateData(t, db, 0, 100, 128)
+	assert.Nil(t, db.Close())
+	_, err = os.Stat(filepath.Join(options.DirPath, checkpointFileName))
+	assert.True(t, os.IsNotExist(err))
+}
+
+func TestPositionBefore(t *testing.T) {
+	positions := []*wal.ChunkPosition{
+		{SegmentId: 1, BlockNumber: 0, ChunkOffset: 10},
+		{SegmentId: 1, BlockNumber: 1, ChunkOffset: 0},
+		{SegmentId: 2, BlockNumber: 0, ChunkOffset: 0},
+	}
+	for i := range positions {
+		for j := range positions {
+			assert.Equal(t, i < j, positionBefore(positions[i], positions[j]))
+		}
+	}
+}
@@ -0,0 +1,68 @@
+package memdb
+
+import (
+	"sync"
+	"time"
+)
+
+// Clock is the source of the current time used by the expiry of the keys,
+// including the ttl set by the writes, the expiry checks of the reads and iterators,
+// the expired keys dropped by merge and deleted in background.
+//
+// The intervals of the background tasks, like Options.ActiveExpireInterval and
+// the merge schedules, are measured by the system time whatever the clock is.
+type Clock interface {
+	// Now returns the current time.
+	Now() time.Time
+}
+
+// SystemClock is the Clock of the system time, it is used if Options.Clock is nil.
+var SystemClock Clock = systemClock{}
+
+type systemClock struct{}
+
+func (systemClock) Now() time.Time {
+	return time.Now()
+}
+
+// FakeClock is a Clock whose time only changes when it is set or advanced,
+// so the expiry of the keys can be tested without sleeping.
+// It is safe for concurrent use.
+type FakeClock struct {
+	mu  sync.RWMutex
+	now time.Time
+}
+
+// NewFakeClock returns a FakeClock starting at the given time.
+func NewFakeClock(now time.Time) *FakeClock {
+	return &FakeClock{now: now}
+}
+
+// Now returns the current time of the clock.
+func (c *FakeClock) Now() time.Time {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.now
+}
+
+// Advance moves the clock forward by d.
+func (c *FakeClock) Advance(d time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.now = c.now.Add(d)
+}
+
+// Set sets the current time of the clock.
+func (c *FakeClock) Set(now time.Time) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.now = now
+}
+
+// now returns the current time of the clock of the database.
+func (db *DB) now() time.Time {
+	if db.options.Clock == nil {
+		return SystemClock.Now()
+	}
+	return db.options.Clock.Now()
+}
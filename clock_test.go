@@ -0,0 +1,101 @@
+package memdb
+
+import (
+	"testing"
+	"time"
+
+	"github.com/hupeh/memdb/utils"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestFakeClock(t *testing.T) {
+	start := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	clock := NewFakeClock(start)
+	assert.Equal(t, start, clock.Now())
+	clock.Advance(time.Hour)
+	assert.Equal(t, start.Add(time.Hour), clock.Now())
+	clock.Set(start)
+	assert.Equal(t, start, clock.Now())
+}
+
+func TestDB_Clock_Expiry(t *testing.T) {
+	clock := NewFakeClock(time.Now())
+	options := DefaultOptions
+	options.Clock = clock
+	options.ActiveExpireInterval = 0
+	options.IndexCheckpoint = false
+	db, err := Open(options)
+	assert.Nil(t, err)
+	defer destroyDB(db)
+
+	for i := 0; i < 100; i++ {
+		if i%2 == 0 {
+			err = db.Put(utils.GetTestKey(i), utils.RandomValue(128))
+		} else {
+			err = db.PutWithTTL(utils.GetTestKey(i), utils.RandomValue(128), time.Hour)
+		}
+		assert.Nil(t, err)
+	}
+	ttl, err := db.TTL(utils.GetTestKey(1))
+	assert.Nil(t, err)
+	assert.Equal(t, time.Hour, ttl)
+
+	clock.Advance(time.Minute * 59)
+	ttl, err = db.TTL(utils.GetTestKey(1))
+	assert.Nil(t, err)
+	assert.Equal(t, time.Minute, ttl)
+	_, err = db.Get(utils.GetTestKey(1))
+	assert.Nil(t, err)
+
+	clock.Advance(time.Minute)
+	_, err = db.Get(utils.GetTestKey(1))
+	assert.Equal(t, ErrKeyNotFound, err)
+	_, err = db.TTL(utils.GetTestKey(1))
+	assert.Equal(t, ErrKeyNotFound, err)
+
+	var keys int
+	iter := db.NewIterator(DefaultIteratorOptions)
+	for ; iter.Valid(); iter.Next() {
+		keys++
+	}
+	iter.Close()
+	assert.Equal(t, 50, keys)
+
+	// the expired keys are dropped by merge
+	assert.Nil(t, db.Merge(true))
+	assert.Equal(t, 50, db.Stat().KeysNum)
+
+	// the keys are expired when they are loaded from the data files
+	clock.Set(time.Now().Add(-time.Hour))
+	assert.Nil(t, db.PutWithTTL(utils.GetTestKey(1), utils.RandomValue(128), time.Hour))
+	assert.Nil(t, db.Close())
+	clock.Advance(time.Hour)
+	db, err = Open(options)
+	assert.Nil(t, err)
+	_, err = db.Get(utils.GetTestKey(1))
+	assert.Equal(t, ErrKeyNotFound, err)
+	assert.Equal(t, 50, db.Stat().KeysNum)
+}
+
+func TestDB_Clock_DeleteExpiredKeys(t *testing.T) {
+	clock := NewFakeClock(time.Now())
+	options := DefaultOptions
+	options.Clock = clock
+	options.ActiveExpireInterval = time.Millisecond * 10
+	db, err := Open(options)
+	assert.Nil(t, err)
+	defer destroyDB(db)
+
+	for i := 0; i < 100; i++ {
+		err = db.PutWithTTL(utils.GetTestKey(i), utils.RandomValue(128), time.Hour)
+		assert.Nil(t, err)
+	}
+	time.Sleep(time.Millisecond * 50)
+	assert.Equal(t, 100, db.Stat().KeysNum)
+
+	// the background expiration follows the clock
+	clock.Advance(time.Hour)
+	assert.Eventually(t, func() bool {
+		return db.Stat().KeysNum == 0
+	}, time.Second, time.Millisecond*10)
+}
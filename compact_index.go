@@ -0,0 +1,545 @@
+package memdb
+
+import (
+	"bytes"
+	"encoding/binary"
+	"slices"
+	"sort"
+	"sync"
+	"sync/atomic"
+
+	"github.com/rosedblabs/wal"
+)
+
+const (
+	// compactBlockSize is the size a block of the compact index is split at.
+	compactBlockSize = 1 * KB
+	// compactBlockOverhead is the estimated memory of a block besides its data.
+	compactBlockOverhead = 64
+)
+
+// CompactIndex is a memory compact implementation of the Indexer interface,
+// for the databases holding hundreds of millions of keys.
+//
+// The keys are kept in order in a list of small blocks, each block is a single byte slice
+// in which every key only stores the suffix not shared with the previous key,
+// followed by the varint encoded position. So there is no pointer and no allocation
+// for every key, which saves several times of memory and the GC scanning work,
+// at the cost of decoding a block for every operation.
+//
+// The blocks are never modified once created, a write replaces the block in the list with new ones.
+// An iterator shares the list, which is copied by the next write only while an iterator is reading it.
+type CompactIndex struct {
+	lock    sync.RWMutex
+	blocks  []*compactBlock // sorted by the first key
+	readers *atomic.Int32   // the iterators sharing blocks
+	size    int
+	memSize int64
+	less    func(a, b []byte) bool
+}
+
+type compactBlock struct {
+	firstKey []byte // shares the memory with data
+	data     []byte
+	count    int
+}
+
+// compactEntry is a decoded entry of a block.
+type compactEntry struct {
+	key []byte
+	pos wal.ChunkPosition
+}
+
+func newCompactIndex(lessFunc func(a, b []byte) bool) *CompactIndex {
+	if lessFunc == nil {
+		lessFunc = bytewiseLess
+	}
+	return &CompactIndex{readers: new(atomic.Int32), less: lessFunc}
+}
+
+// encodeCompactBlock encodes the sorted entries into a block.
+//
+// Every entry is encoded as:
+//
+//	+--------+------------+--------+-----------+-------------+-------------+------------+
+//	| shared | suffix len | suffix | segmentId | blockNumber | chunkOffset | chunkSize  |
+//	+--------+------------+--------+-----------+-------------+-------------+------------+
+//
+// and all the fields except the suffix are uvarint.
+func encodeCompactBlock(entries []compactEntry) *compactBlock {
+	size := 0
+	for i := range entries {
+		size += len(entries[i].key) + 5*binary.MaxVarintLen32 + binary.MaxVarintLen64
+	}
+	buf := make([]byte, 0, size)
+	var prev []byte
+	for i := range entries {
+		key, pos := entries[i].key, &entries[i].pos
+		shared := commonPrefixLen(prev, key)
+		buf = binary.AppendUvarint(buf, uint64(shared))
+		buf = binary.AppendUvarint(buf, uint64(len(key)-shared))
+		buf = append(buf, key[shared:]...)
+		buf = binary.AppendUvarint(buf, uint64(pos.SegmentId))
+		buf = binary.AppendUvarint(buf, uint64(pos.BlockNumber))
+		buf = binary.AppendUvarint(buf, uint64(pos.ChunkOffset))
+		buf = binary.AppendUvarint(buf, uint64(pos.ChunkSize))
+		prev = key
+	}
+	// shrink the buffer to the exact size
+	data := make([]byte, len(buf))
+	copy(data, buf)
+
+	// the first key is never shared, it starts after the two lengths.
+	_, n1 := binary.Uvarint(data)
+	keyLen, n2 := binary.Uvarint(data[n1:])
+	return &compactBlock{
+		firstKey: data[n1+n2 : n1+n2+int(keyLen)],
+		data:     data,
+		count:    len(entries),
+	}
+}
+
+// forEach decodes the entries of the block in order, until fn returns false.
+// The key passed to fn is only valid until fn returns.
+func (b *compactBlock) forEach(fn func(key []byte, pos *wal.ChunkPosition) bool) {
+	var key []byte
+	var pos wal.ChunkPosition
+	data := b.data
+	for len(data) > 0 {
+		shared, n := binary.Uvarint(data)
+		data = data[n:]
+		suffixLen, n := binary.Uvarint(data)
+		data = data[n:]
+		key = append(key[:shared], data[:suffixLen]...)
+		data = data[suffixLen:]
+
+		var v uint64
+		v, n = binary.Uvarint(data)
+		pos.SegmentId, data = wal.SegmentID(v), data[n:]
+		v, n = binary.Uvarint(data)
+		pos.BlockNumber, data = uint32(v), data[n:]
+		v, n = binary.Uvarint(data)
+		pos.ChunkOffset, data = int64(v), data[n:]
+		v, n = binary.Uvarint(data)
+		pos.ChunkSize, data = uint32(v), data[n:]
+
+		if !fn(key, &pos) {
+			return
+		}
+	}
+}
+
+// decode returns all the entries of the block,
+// the keys are carved from a single buffer.
+func (b *compactBlock) decode() []compactEntry {
+	entries := make([]compactEntry, 0, b.count)
+	var keys []byte
+	b.forEach(func(key []byte, pos *wal.ChunkPosition) bool {
+		start := len(keys)
+		keys = append(keys, key...)
+		entries = append(entries, compactEntry{key: keys[start:len(keys):len(keys)], pos: *pos})
+		return true
+	})
+	// the buffer may be reallocated while appending, fix the keys at last.
+	offset := 0
+	for i := range entries {
+		n := len(entries[i].key)
+		entries[i].key = keys[offset : offset+n : offset+n]
+		offset += n
+	}
+	return entries
+}
+
+func (b *compactBlock) memSize() int64 {
+	return int64(cap(b.data)) + compactBlockOverhead
+}
+
+// locate returns the index of the block which the key belongs to,
+// it is the last block whose first key is not greater than the key.
+func locateCompactBlock(blocks []*compactBlock, key []byte, less func(a, b []byte) bool) int {
+	i := sort.Search(len(blocks), func(i int) bool {
+		return less(key, blocks[i].firstKey)
+	})
+	return max(i-1, 0)
+}
+
+// searchEntries returns the index of the first entry not less than the key,
+// and whether the entry equals to the key.
+func searchEntries(entries []compactEntry, key []byte, less func(a, b []byte) bool) (int, bool) {
+	i := sort.Search(len(entries), func(i int) bool {
+		return !less(entries[i].key, key)
+	})
+	return i, i < len(entries) && !less(key, entries[i].key)
+}
+
+// ownBlocks copies the list of the blocks before it is modified if an iterator is reading it.
+func (ci *CompactIndex) ownBlocks() {
+	if ci.readers.Load() > 0 {
+		ci.blocks = slices.Clone(ci.blocks)
+		ci.readers = new(atomic.Int32)
+	}
+}
+
+// replaceBlock replaces the i-th block with the blocks encoded from the entries in place,
+// the entries are split into two blocks if they are too large, and the block is removed if they are empty.
+func (ci *CompactIndex) replaceBlock(i int, entries []compactEntry) {
+	ci.ownBlocks()
+	ci.memSize -= ci.blocks[i].memSize()
+	if len(entries) == 0 {
+		ci.blocks = slices.Delete(ci.blocks, i, i+1)
+		return
+	}
+
+	block := encodeCompactBlock(entries)
+	if len(block.data) > compactBlockSize && len(entries) > 1 {
+		half := len(entries) / 2
+		block = encodeCompactBlock(entries[:half])
+		next := encodeCompactBlock(entries[half:])
+		ci.blocks = slices.Insert(ci.blocks, i+1, next)
+		ci.memSize += next.memSize()
+	}
+	ci.blocks[i] = block
+	ci.memSize += block.memSize()
+}
+
+// Put key and position into the index.
+func (ci *CompactIndex) Put(key []byte, position *wal.ChunkPosition) *wal.ChunkPosition {
+	ci.lock.Lock()
+	defer ci.lock.Unlock()
+
+	if len(ci.blocks) == 0 {
+		block := encodeCompactBlock([]compactEntry{{key: key, pos: *position}})
+		ci.blocks = []*compactBlock{block}
+		ci.memSize += block.memSize()
+		ci.size++
+		return nil
+	}
+
+	i := locateCompactBlock(ci.blocks, key, ci.less)
+	entries := ci.blocks[i].decode()
+	j, found := searchEntries(entries, key, ci.less)
+	if found {
+		oldPos := entries[j].pos
+		entries[j].pos = *position
+		ci.replaceBlock(i, entries)
+		return &oldPos
+	}
+
+	entries = append(entries, compactEntry{})
+	copy(entries[j+1:], entries[j:])
+	entries[j] = compactEntry{key: key, pos: *position}
+	ci.replaceBlock(i, entries)
+	ci.size++
+	return nil
+}
+
+// Get the position of the key in the index.
+func (ci *CompactIndex) Get(key []byte) *wal.ChunkPosition {
+	ci.lock.RLock()
+	defer ci.lock.RUnlock()
+
+	if len(ci.blocks) == 0 {
+		return nil
+	}
+	var position *wal.ChunkPosition
+	ci.blocks[locateCompactBlock(ci.blocks, key, ci.less)].forEach(func(k []byte, pos *wal.ChunkPosition) bool {
+		if ci.less(k, key) {
+			return true
+		}
+		if !ci.less(key, k) {
+			p := *pos
+			position = &p
+		}
+		return false
+	})
+	return position
+}
+
+// Delete the index of the key.
+func (ci *CompactIndex) Delete(key []byte) (*wal.ChunkPosition, bool) {
+	ci.lock.Lock()
+	defer ci.lock.Unlock()
+
+	if len(ci.blocks) == 0 {
+		return nil, false
+	}
+	i := locateCompactBlock(ci.blocks, key, ci.less)
+	entries := ci.blocks[i].decode()
+	j, found := searchEntries(entries, key, ci.less)
+	if !found {
+		return nil, false
+	}
+	oldPos := entries[j].pos
+	entries = append(entries[:j], entries[j+1:]...)
+
+	// merge the small block into the next one, so the blocks do not become sparse.
+	if i+1 < len(ci.blocks) && len(ci.blocks[i].data)+len(ci.blocks[i+1].data) <= compactBlockSize {
+		entries = append(entries, ci.blocks[i+1].decode()...)
+		ci.memSize -= ci.blocks[i+1].memSize()
+		ci.ownBlocks()
+		ci.blocks = slices.Delete(ci.blocks, i+1, i+2)
+	}
+	ci.replaceBlock(i, entries)
+	ci.size--
+	return &oldPos, true
+}
+
+// Size represents the number of keys in the index.
+func (ci *CompactIndex) Size() int {
+	ci.lock.RLock()
+	defer ci.lock.RUnlock()
+	return ci.size
+}
+
+// MemSize returns the memory used by the index in bytes.
+func (ci *CompactIndex) MemSize() int64 {
+	ci.lock.RLock()
+	defer ci.lock.RUnlock()
+	return ci.memSize + int64(cap(ci.blocks))*8
+}
+
+// ascend visits the entries not less than startKey in ascending order, until fn returns false.
+func (ci *CompactIndex) ascend(startKey []byte, fn func(key []byte, pos *wal.ChunkPosition) bool) {
+	i := 0
+	if startKey != nil {
+		i = locateCompactBlock(ci.blocks, startKey, ci.less)
+	}
+	cont := true
+	for ; cont && i < len(ci.blocks); i++ {
+		ci.blocks[i].forEach(func(key []byte, pos *wal.ChunkPosition) bool {
+			if startKey != nil && ci.less(key, startKey) {
+				return true
+			}
+			cont = fn(key, pos)
+			return cont
+		})
+	}
+}
+
+// descend visits the entries not greater than startKey in descending order, until fn returns false.
+func (ci *CompactIndex) descend(startKey []byte, fn func(key []byte, pos *wal.ChunkPosition) bool) {
+	i := len(ci.blocks) - 1
+	if startKey != nil && len(ci.blocks) > 0 {
+		i = locateCompactBlock(ci.blocks, startKey, ci.less)
+	}
+	for ; i >= 0; i-- {
+		entries := ci.blocks[i].decode()
+		for j := len(entries) - 1; j >= 0; j-- {
+			if startKey != nil && ci.less(startKey, entries[j].key) {
+				continue
+			}
+			if !fn(entries[j].key, &entries[j].pos) {
+				return
+			}
+		}
+	}
+}
+
+// compactHandler wraps the handler of the Indexer interface,
+// the key and the position are copied because they are reused while decoding.
+func compactHandler(handleFn func(key []byte, position *wal.ChunkPosition) (bool, error)) func(key []byte, pos *wal.ChunkPosition) bool {
+	return func(key []byte, pos *wal.ChunkPosition) bool {
+		p := *pos
+		cont, err := handleFn(bytes.Clone(key), &p)
+		if err != nil {
+			return false
+		}
+		return cont
+	}
+}
+
+// Ascend iterates over items in ascending order and invokes the handler function for each item.
+// If the handler function returns false, iteration stops.
+func (ci *CompactIndex) Ascend(handleFn func(key []byte, position *wal.ChunkPosition) (bool, error)) {
+	ci.lock.RLock()
+	defer ci.lock.RUnlock()
+	ci.ascend(nil, compactHandler(handleFn))
+}
+
+// Descend iterates over items in descending order and invokes the handler function for each item.
+// If the handler function returns false, iteration stops.
+func (ci *CompactIndex) Descend(handleFn func(key []byte, position *wal.ChunkPosition) (bool, error)) {
+	ci.lock.RLock()
+	defer ci.lock.RUnlock()
+	ci.descend(nil, compactHandler(handleFn))
+}
+
+// AscendRange iterates in ascending order within [startKey, endKey), invoking handleFn.
+// Stops if handleFn returns false.
+func (ci *CompactIndex) AscendRange(startKey, endKey []byte, handleFn func(key []byte, position *wal.ChunkPosition) (bool, error)) {
+	ci.lock.RLock()
+	defer ci.lock.RUnlock()
+
+	fn := compactHandler(handleFn)
+	ci.ascend(startKey, func(key []byte, pos *wal.ChunkPosition) bool {
+		return ci.less(key, endKey) && fn(key, pos)
+	})
+}
+
+// DescendRange iterates in descending order within (endKey, startKey], invoking handleFn.
+// Stops if handleFn returns false.
+func (ci *CompactIndex) DescendRange(startKey, endKey []byte, handleFn func(key []byte, position *wal.ChunkPosition) (bool, error)) {
+	ci.lock.RLock()
+	defer ci.lock.RUnlock()
+
+	fn := compactHandler(handleFn)
+	ci.descend(startKey, func(key []byte, pos *wal.ChunkPosition) bool {
+		return ci.less(endKey, key) && fn(key, pos)
+	})
+}
+
+// AscendGreaterOrEqual iterates in ascending order, starting from key >= given key,
+// invoking handleFn. Stops if handleFn returns false.
+func (ci *CompactIndex) AscendGreaterOrEqual(key []byte, handleFn func(key []byte, position *wal.ChunkPosition) (bool, error)) {
+	ci.lock.RLock()
+	defer ci.lock.RUnlock()
+	ci.ascend(key, compactHandler(handleFn))
+}
+
+// DescendLessOrEqual iterates in descending order, starting from key <= given key,
+// invoking handleFn. Stops if handleFn returns false.
+func (ci *CompactIndex) DescendLessOrEqual(key []byte, handleFn func(key []byte, position *wal.ChunkPosition) (bool, error)) {
+	ci.lock.RLock()
+	defer ci.lock.RUnlock()
+	ci.descend(key, compactHandler(handleFn))
+}
+
+// Iterator returns an index iterator over a snapshot of the index,
+// the blocks are immutable, so the iterator shares the list of the blocks until the next write copies it.
+func (ci *CompactIndex) Iterator(reverse bool) IndexIterator {
+	ci.lock.RLock()
+	defer ci.lock.RUnlock()
+
+	readers := ci.readers
+	readers.Add(1)
+	blocks := ci.blocks
+	it := newCompactIterator(len(blocks), reverse, ci.less,
+		func(i int) []byte { return blocks[i].firstKey },
+		func(i int) []compactEntry { return blocks[i].decode() },
+	)
+	it.release = func() { readers.Add(-1) }
+	return it
+}
+
+// compactIterator iterates over a list of sorted compact blocks,
+// only the current block is decoded.
+type compactIterator struct {
+	numBlocks int
+	firstKey  func(i int) []byte         // returns the first key of the i-th block
+	decode    func(i int) []compactEntry // returns the entries of the i-th block
+	reverse   bool
+	less      func(a, b []byte) bool
+	block     int            // index of the current block
+	entries   []compactEntry // decoded entries of the current block
+	entry     int            // index of the current entry
+	release   func()         // called when the iterator is closed, may be nil
+}
+
+func newCompactIterator(numBlocks int, reverse bool, less func(a, b []byte) bool,
+	firstKey func(i int) []byte, decode func(i int) []compactEntry) *compactIterator {
+	it := &compactIterator{
+		numBlocks: numBlocks,
+		firstKey:  firstKey,
+		decode:    decode,
+		reverse:   reverse,
+		less:      less,
+	}
+	it.Rewind()
+	return it
+}
+
+// load decodes the i-th block, and positions the cursor at its first entry,
+// or its last entry for a reverse iterator.
+func (it *compactIterator) load(i int) {
+	it.block = i
+	it.entries = nil
+	if i >= 0 && i < it.numBlocks {
+		it.entries = it.decode(i)
+	}
+	it.entry = 0
+	if it.reverse {
+		it.entry = len(it.entries) - 1
+	}
+}
+
+// Rewind resets the iterator to its initial position.
+func (it *compactIterator) Rewind() {
+	if it.reverse {
+		it.load(it.numBlocks - 1)
+	} else {
+		it.load(0)
+	}
+}
+
+// Seek positions the cursor to the element with the specified key.
+func (it *compactIterator) Seek(key []byte) {
+	if it.numBlocks == 0 {
+		return
+	}
+	i := sort.Search(it.numBlocks, func(i int) bool {
+		return it.less(key, it.firstKey(i))
+	})
+	it.load(max(i-1, 0))
+	j, found := searchEntries(it.entries, key, it.less)
+	it.entry = j
+	if it.reverse {
+		if !found {
+			// the last entry less than the key
+			it.entry--
+		}
+		if it.entry < 0 {
+			it.load(it.block - 1)
+		}
+	} else if it.entry >= len(it.entries) {
+		it.load(it.block + 1)
+	}
+}
+
+// Next moves the cursor to the next element.
+func (it *compactIterator) Next() {
+	if !it.Valid() {
+		return
+	}
+	if it.reverse {
+		if it.entry--; it.entry < 0 {
+			it.load(it.block - 1)
+		}
+	} else {
+		if it.entry++; it.entry >= len(it.entries) {
+			it.load(it.block + 1)
+		}
+	}
+}
+
+// Valid checks if the iterator is still valid for reading.
+func (it *compactIterator) Valid() bool {
+	return it.entry >= 0 && it.entry < len(it.entries)
+}
+
+// Key returns the key of the current element.
+func (it *compactIterator) Key() []byte {
+	if !it.Valid() {
+		return nil
+	}
+	return it.entries[it.entry].key
+}
+
+// Value returns the value (chunk position) of the current element.
+func (it *compactIterator) Value() *wal.ChunkPosition {
+	if !it.Valid() {
+		return nil
+	}
+	pos := it.entries[it.entry].pos
+	return &pos
+}
+
+// Close releases the resources associated with the iterator.
+func (it *compactIterator) Close() {
+	if it.release != nil {
+		it.release()
+		it.release = nil
+	}
+	it.numBlocks = 0
+	it.entries = nil
+	it.entry = -1
+}
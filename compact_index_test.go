@@ -0,0 +1,117 @@
+package memdb
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/rosedblabs/wal"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCompactIndex_Blocks(t *testing.T) {
+	index := newCompactIndex(nil)
+	key := func(i int) []byte { return []byte(fmt.Sprintf("session:%08d", i)) }
+
+	for i := 0; i < 10000; i++ {
+		pos := &wal.ChunkPosition{SegmentId: 1, BlockNumber: uint32(i), ChunkOffset: int64(i % 32768), ChunkSize: 100}
+		assert.Nil(t, index.Put(key(i), pos))
+	}
+	assert.True(t, len(index.blocks) > 1)
+	for _, block := range index.blocks {
+		assert.True(t, len(block.data) <= compactBlockSize)
+	}
+	// the shared prefixes are not stored repeatedly
+	assert.True(t, index.MemSize() < int64(10000*len(key(0))), index.MemSize())
+
+	for i := 0; i < 10000; i++ {
+		pos := index.Get(key(i))
+		assert.NotNil(t, pos)
+		assert.Equal(t, uint32(i), pos.BlockNumber)
+		assert.Equal(t, int64(i%32768), pos.ChunkOffset)
+	}
+
+	// the blocks are merged when the keys are deleted
+	blocks := len(index.blocks)
+	for i := 0; i < 10000; i += 2 {
+		_, ok := index.Delete(key(i))
+		assert.True(t, ok)
+	}
+	assert.True(t, len(index.blocks) < blocks)
+	assert.Equal(t, 5000, index.Size())
+	for i := 1; i < 10000; i += 2 {
+		_, ok := index.Delete(key(i))
+		assert.True(t, ok)
+	}
+	assert.Equal(t, 0, len(index.blocks))
+	assert.Equal(t, int64(0), index.memSize)
+}
+
+func TestCompactIndex_Iterator_Snapshot(t *testing.T) {
+	index := newCompactIndex(nil)
+	for i := 0; i < 1000; i++ {
+		index.Put([]byte(fmt.Sprintf("key-%04d", i)), &wal.ChunkPosition{ChunkOffset: int64(i)})
+	}
+
+	iter := index.Iterator(false)
+	defer iter.Close()
+	// the writes after the iterator is created are not visible to it
+	for i := 0; i < 1000; i++ {
+		index.Delete([]byte(fmt.Sprintf("key-%04d", i)))
+	}
+	count := 0
+	for ; iter.Valid(); iter.Next() {
+		assert.Equal(t, fmt.Sprintf("key-%04d", count), string(iter.Key()))
+		assert.Equal(t, int64(count), iter.Value().ChunkOffset)
+		count++
+	}
+	assert.Equal(t, 1000, count)
+
+	iter.Seek([]byte("key-0500"))
+	assert.Equal(t, "key-0500", string(iter.Key()))
+	iter.Seek([]byte("key-0500a"))
+	assert.Equal(t, "key-0501", string(iter.Key()))
+	iter.Seek([]byte("zzz"))
+	assert.False(t, iter.Valid())
+}
+
+func TestCompactIndex_Copy_On_Write(t *testing.T) {
+	index := newCompactIndex(nil)
+	for i := 0; i < 1000; i++ {
+		index.Put([]byte(fmt.Sprintf("key-%04d", i)), &wal.ChunkPosition{ChunkOffset: int64(i), ChunkSize: 10})
+	}
+	blocks := index.blocks
+
+	// the list of the blocks is modified in place without iterators
+	index.Put([]byte("key-0500"), &wal.ChunkPosition{ChunkOffset: 1, ChunkSize: 10})
+	assert.Same(t, &blocks[0], &index.blocks[0])
+
+	// the list is copied once while an iterator is reading it
+	iter := index.Iterator(false)
+	index.Put([]byte("key-0500"), &wal.ChunkPosition{ChunkOffset: 2, ChunkSize: 10})
+	assert.NotSame(t, &blocks[0], &index.blocks[0])
+	blocks = index.blocks
+	index.Put([]byte("key-0500"), &wal.ChunkPosition{ChunkOffset: 3, ChunkSize: 10})
+	assert.Same(t, &blocks[0], &index.blocks[0])
+
+	iter.Seek([]byte("key-0500"))
+	assert.Equal(t, int64(1), iter.Value().ChunkOffset)
+	iter.Close()
+	index.Put([]byte("key-0500"), &wal.ChunkPosition{ChunkOffset: 4, ChunkSize: 10})
+	assert.Same(t, &blocks[0], &index.blocks[0])
+}
+
+func TestDB_Stat_IndexSize(t *testing.T) {
+	sizes := make(map[IndexType]int64)
+	for _, indexType := range []IndexType{IndexBTree, IndexCompact} {
+		options := DefaultOptions
+		options.IndexType = indexType
+		db, err := Open(options)
+		assert.Nil(t, err)
+		generateData(t, db, 0, 10000, 16)
+		sizes[indexType] = db.Stat().IndexSize
+		destroyDB(db)
+	}
+	assert.True(t, sizes[IndexBTree] > 0)
+	assert.True(t, sizes[IndexCompact] > 0)
+	assert.True(t, sizes[IndexCompact]*2 < sizes[IndexBTree], sizes)
+}
@@ -0,0 +1,107 @@
+package memdb
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"sync"
+)
+
+const (
+	// bytewiseComparatorName is the name of BytewiseComparator,
+	// it is recorded when neither Options.Comparator nor Options.LessFunc is set.
+	bytewiseComparatorName = "memdb.bytewise"
+	// reverseBytewiseComparatorName is the name of ReverseBytewiseComparator.
+	reverseBytewiseComparatorName = "memdb.reverse-bytewise"
+	// customComparatorName is the comparator name recorded when Options.LessFunc is set,
+	// it matches any other LessFunc, because a function has no name to tell them apart.
+	customComparatorName = "memdb.custom"
+)
+
+// Comparator is a named order of the keys in the index.
+//
+// The name of the comparator is recorded in the database directory when it is created,
+// and Open returns ErrComparatorMismatch if it is opened with another one,
+// because the range scans would not find the keys ordered by the other comparator.
+// So a comparator must never change the order of the keys once it is used under a name.
+type Comparator struct {
+	// Name identifies the order of the keys, the names starting with "memdb." are reserved.
+	Name string
+	// Less reports whether the key a is ordered before the key b.
+	// If it is nil, the comparator registered under Name is used.
+	Less func(a, b []byte) bool
+}
+
+var (
+	// BytewiseComparator orders the keys by bytes.Compare, it is the default comparator.
+	BytewiseComparator = Comparator{Name: bytewiseComparatorName, Less: bytewiseLess}
+	// ReverseBytewiseComparator orders the keys in the reverse order of BytewiseComparator.
+	ReverseBytewiseComparator = Comparator{Name: reverseBytewiseComparatorName, Less: func(a, b []byte) bool {
+		return bytes.Compare(a, b) > 0
+	}}
+)
+
+var comparators = struct {
+	mu sync.RWMutex
+	m  map[string]Comparator
+}{m: map[string]Comparator{
+	bytewiseComparatorName:        BytewiseComparator,
+	reverseBytewiseComparatorName: ReverseBytewiseComparator,
+}}
+
+// RegisterComparator makes the comparator available by its name,
+// so Options.Comparator only needs the name of it.
+// It panics if the name is empty or registered already, or Less is nil.
+func RegisterComparator(c Comparator) {
+	if c.Name == "" || c.Less == nil {
+		panic("memdb: RegisterComparator needs a name and a Less function")
+	}
+	comparators.mu.Lock()
+	defer comparators.mu.Unlock()
+	if _, ok := comparators.m[c.Name]; ok || c.Name == customComparatorName {
+		panic("memdb: RegisterComparator called twice for comparator " + c.Name)
+	}
+	comparators.m[c.Name] = c
+}
+
+// LookupComparator returns the comparator registered under the name.
+func LookupComparator(name string) (Comparator, bool) {
+	comparators.mu.RLock()
+	defer comparators.mu.RUnlock()
+	c, ok := comparators.m[name]
+	return c, ok
+}
+
+// resolveComparator returns the comparator set by the comparator or the less function of the options.
+// The Less of the returned byte-wise comparator is nil, so the indexes use their fast path.
+func resolveComparator(c Comparator, lessFunc func(a, b []byte) bool) (Comparator, error) {
+	switch {
+	case c.Name == "" && c.Less != nil:
+		return Comparator{}, errors.New("database comparator name is empty")
+	case c.Name != "" && lessFunc != nil:
+		return Comparator{}, errors.New("database comparator and LessFunc can not be both set")
+	case c.Name == "" && lessFunc == nil:
+		return Comparator{Name: bytewiseComparatorName}, nil
+	case c.Name == "":
+		return Comparator{Name: customComparatorName, Less: lessFunc}, nil
+	case c.Less == nil:
+		registered, ok := LookupComparator(c.Name)
+		if !ok {
+			return Comparator{}, fmt.Errorf("database comparator %q is not registered", c.Name)
+		}
+		c = registered
+	}
+	if c.Name == bytewiseComparatorName {
+		c.Less = nil
+	}
+	return c, nil
+}
+
+// checkComparator returns ErrComparatorMismatch if the comparator recorded in the database directory,
+// which is empty if it is unknown, is not the one to open the database with.
+func checkComparator(recorded, name string) error {
+	if recorded != "" && recorded != name {
+		return fmt.Errorf("%w: the keys are ordered by %q, not %q", ErrComparatorMismatch, recorded, name)
+	}
+	return nil
+}
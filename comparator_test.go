@@ -0,0 +1,151 @@
+package memdb
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestResolveComparator(t *testing.T) {
+	c, err := resolveComparator(Comparator{}, nil)
+	assert.Nil(t, err)
+	assert.Equal(t, bytewiseComparatorName, c.Name)
+	assert.Nil(t, c.Less)
+
+	c, err = resolveComparator(BytewiseComparator, nil)
+	assert.Nil(t, err)
+	assert.Equal(t, bytewiseComparatorName, c.Name)
+	assert.Nil(t, c.Less)
+
+	c, err = resolveComparator(Comparator{Name: reverseBytewiseComparatorName}, nil)
+	assert.Nil(t, err)
+	assert.Equal(t, reverseBytewiseComparatorName, c.Name)
+	assert.True(t, c.Less([]byte("b"), []byte("a")))
+
+	c, err = resolveComparator(Comparator{}, bytewiseLess)
+	assert.Nil(t, err)
+	assert.Equal(t, customComparatorName, c.Name)
+	assert.NotNil(t, c.Less)
+
+	_, err = resolveComparator(Comparator{Name: "unknown"}, nil)
+	assert.NotNil(t, err)
+	_, err = resolveComparator(Comparator{Less: bytewiseLess}, nil)
+	assert.NotNil(t, err)
+	_, err = resolveComparator(ReverseBytewiseComparator, bytewiseLess)
+	assert.NotNil(t, err)
+}
+
+func TestRegisterComparator(t *testing.T) {
+	length := Comparator{Name: "test.length", Less: func(a, b []byte) bool {
+		if len(a) != len(b) {
+			return len(a) < len(b)
+		}
+		return bytes.Compare(a, b) < 0
+	}}
+	RegisterComparator(length)
+	c, ok := LookupComparator("test.length")
+	assert.True(t, ok)
+	assert.True(t, c.Less([]byte("b"), []byte("aa")))
+	_, ok = LookupComparator("test.unknown")
+	assert.False(t, ok)
+
+	assert.Panics(t, func() { RegisterComparator(length) })
+	assert.Panics(t, func() { RegisterComparator(Comparator{Name: customComparatorName, Less: bytewiseLess}) })
+	assert.Panics(t, func() { RegisterComparator(Comparator{Name: "test.nil"}) })
+}
+
+func TestDB_Comparator_Mismatch(t *testing.T) {
+	options := DefaultOptions
+	options.Comparator = ReverseBytewiseComparator
+	db, err := Open(options)
+	assert.Nil(t, err)
+	defer destroyDB(db)
+
+	for _, key := range []string{"a", "c", "b"} {
+		assert.Nil(t, db.Put([]byte(key), []byte(key)))
+	}
+	assert.Nil(t, db.Close())
+
+	// the directory is not locked after a mismatch
+	mismatch := DefaultOptions
+	_, err = Open(mismatch)
+	assert.True(t, errors.Is(err, ErrComparatorMismatch))
+	mismatch.Comparator = BytewiseComparator
+	_, err = Open(mismatch)
+	assert.True(t, errors.Is(err, ErrComparatorMismatch))
+	mismatch.Comparator, mismatch.LessFunc = Comparator{}, bytewiseLess
+	_, err = Open(mismatch)
+	assert.True(t, errors.Is(err, ErrComparatorMismatch))
+
+	// the name is enough for a registered comparator
+	options.Comparator = Comparator{Name: reverseBytewiseComparatorName}
+	db, err = Open(options)
+	assert.Nil(t, err)
+	var keys []string
+	assert.Nil(t, db.AscendKeys(nil, true, func(k []byte) (bool, error) {
+		keys = append(keys, string(k))
+		return true, nil
+	}))
+	assert.Equal(t, []string{"c", "b", "a"}, keys)
+
+	// the comparator is kept by the merge
+	assert.Nil(t, db.Merge(true))
+	assert.Nil(t, db.Close())
+	_, err = Open(DefaultOptions)
+	assert.True(t, errors.Is(err, ErrComparatorMismatch))
+	db, err = Open(options)
+	assert.Nil(t, err)
+}
+
+func TestDB_Comparator_LessFunc(t *testing.T) {
+	options := DefaultOptions
+	options.LessFunc = func(a, b []byte) bool { return bytes.Compare(a, b) > 0 }
+	db, err := Open(options)
+	assert.Nil(t, err)
+	defer destroyDB(db)
+	assert.Nil(t, db.Close())
+
+	_, err = Open(DefaultOptions)
+	assert.True(t, errors.Is(err, ErrComparatorMismatch))
+	db, err = Open(options)
+	assert.Nil(t, err)
+}
+
+func TestDB_Namespace_Comparator_Mismatch(t *testing.T) {
+	options := DefaultOptions
+	options.Namespaces = map[string]NamespaceOptions{
+		"reverse": {Comparator: ReverseBytewiseComparator},
+	}
+	db, err := Open(options)
+	assert.Nil(t, err)
+	defer destroyDB(db)
+
+	reverse, err := db.Namespace("reverse")
+	assert.Nil(t, err)
+	for _, key := range []string{"a", "c", "b"} {
+		assert.Nil(t, reverse.Put([]byte(key), []byte(key)))
+	}
+	assert.Nil(t, db.Close())
+
+	_, err = Open(DefaultOptions)
+	assert.True(t, errors.Is(err, ErrComparatorMismatch))
+
+	db, err = Open(options)
+	assert.Nil(t, err)
+	reverse, err = db.Namespace("reverse")
+	assert.Nil(t, err)
+	var keys []string
+	assert.Nil(t, reverse.AscendKeys(nil, true, func(k []byte) (bool, error) {
+		keys = append(keys, string(k))
+		return true, nil
+	}))
+	assert.Equal(t, []string{"c", "b", "a"}, keys)
+
+	assert.Nil(t, db.Close())
+	options.Namespaces = map[string]NamespaceOptions{"reverse": {Comparator: Comparator{Name: "unknown"}}}
+	_, err = Open(options)
+	assert.NotNil(t, err)
+	assert.False(t, errors.Is(err, ErrComparatorMismatch))
+}
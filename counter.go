@@ -0,0 +1,143 @@
+package memdb
+
+import (
+	"math"
+	"strconv"
+)
+
+// The values of the counters are stored as decimal strings, like the strings written by
+// strconv.FormatInt and strconv.FormatFloat, so they can also be read by Get and written by Put.
+
+// IncrBy adds delta to the integer value of the key in the batch, and returns the new value.
+// The key is created with the value 0 before adding if it does not exist,
+// and the ttl of an existing key is kept.
+// It returns ErrValueNotNumber if the value is not an integer,
+// and ErrValueOverflow if the new value overflows int64.
+func (b *Batch) IncrBy(key []byte, delta int64) (int64, error) {
+	var result int64
+	err := b.updateNumber(key, func(value []byte) ([]byte, error) {
+		var current int64
+		if value != nil {
+			var err error
+			if current, err = strconv.ParseInt(string(value), 10, 64); err != nil {
+				return nil, ErrValueNotNumber
+			}
+		}
+		if (delta > 0 && current > math.MaxInt64-delta) || (delta < 0 && current < math.MinInt64-delta) {
+			return nil, ErrValueOverflow
+		}
+		result = current + delta
+		return strconv.AppendInt(nil, result, 10), nil
+	})
+	return result, err
+}
+
+// DecrBy subtracts delta from the integer value of the key in the batch, and returns the new value.
+// See IncrBy for the details.
+func (b *Batch) DecrBy(key []byte, delta int64) (int64, error) {
+	if delta == math.MinInt64 {
+		return 0, ErrValueOverflow
+	}
+	return b.IncrBy(key, -delta)
+}
+
+// IncrByFloat adds delta to the floating point value of the key in the batch, and returns the new value.
+// The key is created with the value 0 before adding if it does not exist,
+// and the ttl of an existing key is kept.
+// It returns ErrValueNotNumber if the value is not a number,
+// and ErrValueOverflow if the new value is infinite or NaN.
+func (b *Batch) IncrByFloat(key []byte, delta float64) (float64, error) {
+	var result float64
+	err := b.updateNumber(key, func(value []byte) ([]byte, error) {
+		var current float64
+		if value != nil {
+			var err error
+			if current, err = strconv.ParseFloat(string(value), 64); err != nil {
+				return nil, ErrValueNotNumber
+			}
+		}
+		result = current + delta
+		if math.IsInf(result, 0) || math.IsNaN(result) {
+			return nil, ErrValueOverflow
+		}
+		return strconv.AppendFloat(nil, result, 'g', -1, 64), nil
+	})
+	return result, err
+}
+
+// updateNumber replaces the value of the key in the batch with the value returned by updateFn,
+// the value passed to updateFn is nil if the key does not exist.
+func (b *Batch) updateNumber(key []byte, updateFn func(value []byte) ([]byte, error)) error {
+	if len(key) == 0 {
+		return ErrKeyIsEmpty
+	}
+	if b.db.closed {
+		return ErrDBClosed
+	}
+	if b.options.ReadOnly {
+		return ErrReadOnlyBatch
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	record, pending, err := b.lookupRecord(b.db.keyspace, key, b.db.now().UnixNano())
+	if err != nil && err != ErrKeyNotFound {
+		return err
+	}
+	var current []byte
+	if record != nil {
+		current = record.Value
+	}
+	value, err := updateFn(current)
+	if err != nil {
+		return err
+	}
+
+	if record == nil {
+		// the key does not exist, but it may be a deleted or expired record in pendingWrites
+		b.putPendingWrite(b.db.keyspace, key, value, 0)
+		return nil
+	}
+	if !pending {
+		b.appendPendingWrites(key, record)
+	}
+	record.Value = value
+	return nil
+}
+
+// IncrBy adds delta to the integer value of the key atomically, and returns the new value.
+// Actually, it will open a new batch and commit it.
+// You can think the batch has only one IncrBy operation.
+func (db *DB) IncrBy(key []byte, delta int64) (int64, error) {
+	var result int64
+	err := db.update(func(batch *Batch) (err error) {
+		result, err = batch.IncrBy(key, delta)
+		return err
+	})
+	return result, err
+}
+
+// DecrBy subtracts delta from the integer value of the key atomically, and returns the new value.
+// Actually, it will open a new batch and commit it.
+// You can think the batch has only one DecrBy operation.
+func (db *DB) DecrBy(key []byte, delta int64) (int64, error) {
+	var result int64
+	err := db.update(func(batch *Batch) (err error) {
+		result, err = batch.DecrBy(key, delta)
+		return err
+	})
+	return result, err
+}
+
+// IncrByFloat adds delta to the floating point value of the key atomically, and returns the new value.
+// Actually, it will open a new batch and commit it.
+// You can think the batch has only one IncrByFloat operation.
+func (db *DB) IncrByFloat(key []byte, delta float64) (float64, error) {
+	var result float64
+	err := db.update(func(batch *Batch) (err error) {
+		result, err = batch.IncrByFloat(key, delta)
+		return err
+	})
+	return result, err
+}
@@ -0,0 +1,142 @@
+package memdb
+
+import (
+	"math"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDB_IncrBy(t *testing.T) {
+	options := DefaultOptions
+	db, err := Open(options)
+	assert.Nil(t, err)
+	defer destroyDB(db)
+
+	key := []byte("counter")
+	n, err := db.IncrBy(key, 10)
+	assert.Nil(t, err)
+	assert.Equal(t, int64(10), n)
+	n, err = db.DecrBy(key, 15)
+	assert.Nil(t, err)
+	assert.Equal(t, int64(-5), n)
+	value, err := db.Get(key)
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("-5"), value)
+
+	// not a number
+	assert.Nil(t, db.Put([]byte("name"), []byte("memdb")))
+	_, err = db.IncrBy([]byte("name"), 1)
+	assert.Equal(t, ErrValueNotNumber, err)
+	_, err = db.IncrByFloat([]byte("name"), 1)
+	assert.Equal(t, ErrValueNotNumber, err)
+
+	// overflow
+	assert.Nil(t, db.Put([]byte("max"), []byte("9223372036854775807")))
+	_, err = db.IncrBy([]byte("max"), 1)
+	assert.Equal(t, ErrValueOverflow, err)
+	_, err = db.DecrBy([]byte("min"), math.MinInt64)
+	assert.Equal(t, ErrValueOverflow, err)
+	n, err = db.DecrBy([]byte("max"), 1)
+	assert.Nil(t, err)
+	assert.Equal(t, int64(math.MaxInt64-1), n)
+
+	// the ttl is kept
+	assert.Nil(t, db.PutWithTTL([]byte("ttl"), []byte("1"), time.Hour))
+	n, err = db.IncrBy([]byte("ttl"), 1)
+	assert.Nil(t, err)
+	assert.Equal(t, int64(2), n)
+	ttl, err := db.TTL([]byte("ttl"))
+	assert.Nil(t, err)
+	assert.True(t, ttl > time.Minute*59)
+
+	// restart
+	assert.Nil(t, db.Close())
+	db, err = Open(options)
+	assert.Nil(t, err)
+	n, err = db.IncrBy(key, 1)
+	assert.Nil(t, err)
+	assert.Equal(t, int64(-4), n)
+}
+
+func TestDB_IncrByFloat(t *testing.T) {
+	options := DefaultOptions
+	db, err := Open(options)
+	assert.Nil(t, err)
+	defer destroyDB(db)
+
+	key := []byte("counter")
+	f, err := db.IncrByFloat(key, 1.5)
+	assert.Nil(t, err)
+	assert.Equal(t, 1.5, f)
+	// the integers are also floats
+	n, err := db.IncrBy([]byte("int"), 3)
+	assert.Nil(t, err)
+	assert.Equal(t, int64(3), n)
+	f, err = db.IncrByFloat([]byte("int"), 0.25)
+	assert.Nil(t, err)
+	assert.Equal(t, 3.25, f)
+	value, err := db.Get([]byte("int"))
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("3.25"), value)
+
+	_, err = db.IncrByFloat(key, math.Inf(1))
+	assert.Equal(t, ErrValueOverflow, err)
+}
+
+func TestDB_IncrBy_Concurrent(t *testing.T) {
+	options := DefaultOptions
+	db, err := Open(options)
+	assert.Nil(t, err)
+	defer destroyDB(db)
+
+	key := []byte("counter")
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 100; j++ {
+				_, err := db.IncrBy(key, 1)
+				assert.Nil(t, err)
+			}
+		}()
+	}
+	wg.Wait()
+	value, err := db.Get(key)
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("1000"), value)
+}
+
+func TestBatch_IncrBy(t *testing.T) {
+	options := DefaultOptions
+	db, err := Open(options)
+	assert.Nil(t, err)
+	defer destroyDB(db)
+
+	assert.Nil(t, db.Put([]byte("a"), []byte("5")))
+	batch := db.NewBatch(DefaultBatchOptions)
+	n, err := batch.IncrBy([]byte("a"), 1)
+	assert.Nil(t, err)
+	assert.Equal(t, int64(6), n)
+	n, err = batch.IncrBy([]byte("a"), 1)
+	assert.Nil(t, err)
+	assert.Equal(t, int64(7), n)
+	// a deleted key starts from 0
+	assert.Nil(t, batch.Delete([]byte("a")))
+	n, err = batch.IncrBy([]byte("a"), 2)
+	assert.Nil(t, err)
+	assert.Equal(t, int64(2), n)
+	assert.Nil(t, batch.Commit())
+
+	value, err := db.Get([]byte("a"))
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("2"), value)
+
+	batch = db.NewBatch(BatchOptions{ReadOnly: true})
+	_, err = batch.IncrBy([]byte("a"), 1)
+	assert.Equal(t, ErrReadOnlyBatch, err)
+	assert.Nil(t, batch.Commit())
+}
@@ -1,17 +1,14 @@
 package memdb
 
 import (
-	"context"
 	"errors"
 	"fmt"
-	"io"
 	"os"
 	"path/filepath"
 	"regexp"
 	"sync"
 	"time"
 
-	"github.com/bwmarrin/snowflake"
 	"github.com/gofrs/flock"
 	"github.com/hupeh/memdb/utils"
 	"github.com/robfig/cron/v3"
@@ -38,22 +35,34 @@ const (
 // our total data size is limited by the memory size.
 //
 // So if your memory can almost hold all the keys, ROSEDB is the perfect storage engine for you.
+// Otherwise, the IndexDisk index keeps most of the keys on disk,
+// at the cost of a few more disk IOs for the keys not cached in memory.
 type DB struct {
-	dataFiles        *wal.WAL // data files are a sets of segment files in WAL.
-	hintFile         *wal.WAL // hint file is used to store the key and the position for fast startup.
-	index            *BTree
-	options          Options
-	fileLock         *flock.Flock
-	mu               sync.RWMutex
-	closed           bool
-	mergeRunning     uint32 // indicate if the database is merging
-	batchPool        sync.Pool
-	recordPool       sync.Pool
-	encodeHeader     []byte
-	watchCh          chan *Event // user consume channel for watch events
-	watcher          *Watcher
-	expiredCursorKey []byte     // the location to which DeleteExpiredKeys executes.
-	cronScheduler    *cron.Cron // cron scheduler for auto merge task
+	dataFiles       *wal.WAL             // data files are a sets of segment files in WAL.
+	walPins         *walPins             // iterators reading the data files, including the ones replaced by a merge
+	hintFile        *wal.WAL             // hint file is used to store the key and the position for fast startup.
+	*keyspace                            // index of the keys out of any namespace
+	keyspaces       map[uint32]*keyspace // keyspaces of all the namespaces by their ids, including the default one
+	nextNamespaceId uint32               // id of the next namespace created
+	manifest        *manifest            // manifest describes the live data files, replaced after each merge.
+	options         Options
+	fileLock        *flock.Flock
+	mu              sync.RWMutex
+	closed          bool
+	mergeRunning    uint32        // indicate if the database is merging
+	mergeTracker    *mergeTracker // status of the running merge and the history of the past ones
+	batchPool       sync.Pool
+	recordPool      sync.Pool
+	encodeHeader    []byte
+	watchCh         chan *Event // user consume channel for watch events
+	watcher         *Watcher
+	cronScheduler   *cron.Cron         // cron scheduler for auto merge task
+	segmentStats    *segmentStats      // live and dead bytes of the segment files
+	autoMergeCh     chan struct{}      // signal the auto merge goroutine that the garbage thresholds are passed
+	closeCh         chan struct{}      // closed when the database is closed, stop the background goroutines
+	lastPosition    *wal.ChunkPosition // position of the last chunk written to the data files
+	checkpointMu    sync.Mutex         // serializes the index checkpoints
+	checkpointState checkpointState    // generation and position covered by the latest checkpoint
 }
 
 // Stat represents the statistics of the database.
@@ -62,6 +71,13 @@ type Stat struct {
 	KeysNum int
 	// Total disk size of database directory
 	DiskSize int64
+	// Total size of the records referenced by the index
+	LiveSize int64
+	// Total size of the records that can be reclaimed by merge,
+	// including the overwritten, deleted and expired records.
+	DeadSize int64
+	// Memory used by the index, it may be an estimate
+	IndexSize int64
 }
 
 // Open a database with the specified options.
@@ -72,7 +88,17 @@ type Stat struct {
 //
 // It will open the wal files in the database directory and load the index from them.
 // Return the DB instance, or an error if any.
-func Open(options Options) (*DB, error) {
+func Open(options Options) (_ *DB, err error) {
+	// resolve the comparators, the indexes only use the less function of the database
+	comparator, err := resolveComparator(options.Comparator, options.LessFunc)
+	if err != nil {
+		return nil, err
+	}
+	options.Comparator, options.LessFunc = Comparator{}, comparator.Less
+	if options.Namespaces, err = resolveNamespaceOptions(options.Namespaces); err != nil {
+		return nil, err
+	}
+
 	// check options
 	if err := checkOptions(options); err != nil {
 		return nil, err
@@ -94,15 +120,39 @@ func Open(options Options) (*DB, error) {
 	if !hold {
 		return nil, ErrDatabaseIsUsing
 	}
+	// release the opened files and the lock if the database can not be opened
+	var db *DB
+	defer func() {
+		if err != nil {
+			if db != nil {
+				_ = db.closeFiles()
+			}
+			_ = fileLock.Unlock()
+		}
+	}()
 
-	// load merge files if exists
-	if err = loadMergeFiles(options.DirPath); err != nil {
+	// load the manifest, and install the merge files if exists
+	m, err := openManifest(options.DirPath, comparator.Name)
+	if err != nil {
+		return nil, err
+	}
+	if err = checkComparator(m.Comparator, comparator.Name); err != nil {
+		return nil, err
+	}
+
+	index, err := newIndexer(options, defaultNamespaceId)
+	if err != nil {
 		return nil, err
 	}
 
 	// init DB instance
-	db := &DB{
-		index:        newBTree(options.LessFunc),
+	db = &DB{
+		keyspace:     newKeyspace(defaultNamespaceId, "", index, comparator),
+		manifest:     m,
+		segmentStats: newSegmentStats(),
+		walPins:      newWALPins(),
+		mergeTracker: &mergeTracker{},
+		closeCh:      make(chan struct{}),
 		options:      options,
 		fileLock:     fileLock,
 		batchPool:    sync.Pool{New: newBatch},
@@ -110,6 +160,11 @@ func Open(options Options) (*DB, error) {
 		encodeHeader: make([]byte, maxLogRecordHeaderSize),
 	}
 
+	// load the namespaces before their keys
+	if err = db.openNamespaces(); err != nil {
+		return nil, err
+	}
+
 	// open data files
 	if db.dataFiles, err = db.openWalFiles(); err != nil {
 		return nil, err
@@ -137,10 +192,10 @@ func Open(options Options) (*DB, error) {
 			),
 		)
 		_, err = db.cronScheduler.AddFunc(options.AutoMergeCronExpr, func() {
-			// maybe we should deal with different errors with different logic,
-			// but a background task can't omit its error.
-			// after auto merge, we should close and reopen the db.
-			_ = db.Merge(true)
+			// a background task can't return its error,
+			// the result will be reported to Options.OnAutoMerge.
+			// after auto merge, the merge files are installed without reopening the db.
+			db.runAutoMerge(MergeTriggerCron)
 		})
 		if err != nil {
 			return nil, err
@@ -148,6 +203,23 @@ func Open(options Options) (*DB, error) {
 		db.cronScheduler.Start()
 	}
 
+	// enable auto merge by the garbage thresholds
+	if options.AutoMergeDeadRatio > 0 || options.AutoMergeReclaimableSize > 0 {
+		db.autoMergeCh = make(chan struct{}, 1)
+		go db.autoMerge()
+		db.maybeAutoMerge()
+	}
+
+	// enable the active expiration
+	if options.ActiveExpireInterval > 0 {
+		go db.reapExpiredKeys()
+	}
+
+	// enable the periodic index checkpoint
+	if options.IndexCheckpoint && options.IndexCheckpointInterval > 0 {
+		go db.checkpointLoop()
+	}
+
 	return db, nil
 }
 
@@ -167,31 +239,74 @@ func (db *DB) openWalFiles() (*wal.WAL, error) {
 }
 
 func (db *DB) loadIndex() error {
+	// load index from the checkpoint, it covers the hint file and a part of the data files
+	var checkpoint *wal.ChunkPosition
+	if db.options.IndexCheckpoint {
+		var err error
+		if checkpoint, err = db.loadIndexFromCheckpoint(); err != nil {
+			return err
+		}
+	}
 	// load index from hint file
-	if err := db.loadIndexFromHintFile(); err != nil {
-		return err
+	if checkpoint == nil {
+		if err := db.loadIndexFromHintFile(); err != nil {
+			return err
+		}
 	}
 	// load index from data files
-	if err := db.loadIndexFromWAL(); err != nil {
+	if err := db.loadIndexFromWAL(checkpoint); err != nil {
 		return err
 	}
+	for _, ks := range db.keyspaces {
+		if err := ks.indexErr(); err != nil {
+			return err
+		}
+	}
 	return nil
 }
 
 // Close the database, close all data files and release file lock.
 // Set the closed flag to true.
 // The DB instance cannot be used after closing.
+//
+// The database is always closed, even if a step fails,
+// and the errors of all the failed steps are returned together.
 func (db *DB) Close() error {
 	db.mu.Lock()
 	defer db.mu.Unlock()
 
+	if db.closed {
+		return nil
+	}
+
+	var errs []error
+	// checkpoint the index for the next startup, it is best-effort,
+	// without the checkpoint the index is loaded from the hint file and the data files.
+	if db.options.IndexCheckpoint {
+		cp, err := db.snapshotCheckpoint()
+		if err == nil && cp != nil {
+			err = db.writeCheckpoint(cp)
+		}
+		if err != nil {
+			errs = append(errs, err)
+		}
+	}
+
+	errs = append(errs, db.shutdown()...)
+	return errors.Join(errs...)
+}
+
+// shutdown closes all the files, releases the file lock, stops the background
+// goroutines and sets the closed flag, the caller must hold the lock of the database.
+func (db *DB) shutdown() []error {
+	var errs []error
 	if err := db.closeFiles(); err != nil {
-		return err
+		errs = append(errs, err)
 	}
 
 	// release file lock
 	if err := db.fileLock.Unlock(); err != nil {
-		return err
+		errs = append(errs, err)
 	}
 
 	// close watch channel
@@ -204,23 +319,48 @@ func (db *DB) Close() error {
 		db.cronScheduler.Stop()
 	}
 
+	// stop the background goroutines
+	close(db.closeCh)
+
 	db.closed = true
-	return nil
+	return errs
 }
 
-// closeFiles close all data files and hint file
+// closeFiles close all data files and hint file,
+// all of them are closed even if some of them fail.
 func (db *DB) closeFiles() error {
-	// close wal
-	if err := db.dataFiles.Close(); err != nil {
-		return err
+	var errs []error
+	// close wal, it is not opened yet if Open fails before it
+	if db.dataFiles != nil {
+		if err := db.dataFiles.Close(); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	// close the data files replaced by the merges but still read by the iterators
+	if err := db.walPins.closeRetired(); err != nil {
+		errs = append(errs, err)
 	}
 	// close hint file if exists
 	if db.hintFile != nil {
 		if err := db.hintFile.Close(); err != nil {
-			return err
+			errs = append(errs, err)
 		}
 	}
-	return nil
+	// close the index files if the indexes are on disk, the ones of the namespaces first,
+	// their files are in the directory of the default one.
+	for id, ks := range db.keyspaces {
+		if id != defaultNamespaceId {
+			if err := ks.closeIndex(); err != nil {
+				errs = append(errs, err)
+			}
+		}
+	}
+	if db.keyspace != nil {
+		if err := db.closeIndex(); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return errors.Join(errs...)
 }
 
 // Sync all data files to the underlying storage.
@@ -241,9 +381,19 @@ func (db *DB) Stat() *Stat {
 		panic(fmt.Sprintf("memdb: get database directory size error: %v", err))
 	}
 
+	var keysNum int
+	var indexSize int64
+	for _, ks := range db.keyspaces {
+		keysNum += ks.index.Size()
+		indexSize += ks.memSize()
+	}
+	liveSize, deadSize := db.segmentStats.total()
 	return &Stat{
-		KeysNum:  db.index.Size(),
-		DiskSize: diskSize,
+		KeysNum:   keysNum,
+		DiskSize:  diskSize,
+		LiveSize:  liveSize,
+		DeadSize:  deadSize,
+		IndexSize: indexSize,
 	}
 }
 
@@ -287,6 +437,57 @@ func (db *DB) PutWithTTL(key []byte, value []byte, ttl time.Duration) error {
 	return batch.Commit()
 }
 
+// PutWithDeadline a key-value pair into the database, the key expires at the deadline.
+// Actually, it will open a new batch and commit it.
+// You can think the batch has only one PutWithDeadline operation.
+func (db *DB) PutWithDeadline(key []byte, value []byte, deadline time.Time) error {
+	batch := db.batchPool.Get().(*Batch)
+	defer func() {
+		batch.reset()
+		db.batchPool.Put(batch)
+	}()
+	// This is a single put operation, we can set Sync to false.
+	// Because the data will be written to the WAL,
+	// and the WAL file will be synced to disk according to the DB options.
+	batch.init(false, false, db)
+	if err := batch.PutWithDeadline(key, value, deadline); err != nil {
+		_ = batch.Rollback()
+		return err
+	}
+	return batch.Commit()
+}
+
+// update runs updateFn in a new write batch and commits it,
+// the batch is rolled back if updateFn returns an error.
+func (db *DB) update(updateFn func(batch *Batch) error) error {
+	batch := db.batchPool.Get().(*Batch)
+	defer func() {
+		batch.reset()
+		db.batchPool.Put(batch)
+	}()
+	// This is a single write operation, we can set Sync to false.
+	// Because the data will be written to the WAL,
+	// and the WAL file will be synced to disk according to the DB options.
+	batch.init(false, false, db)
+	if err := updateFn(batch); err != nil {
+		_ = batch.Rollback()
+		return err
+	}
+	return batch.Commit()
+}
+
+// view runs viewFn in a new read only batch.
+func (db *DB) view(viewFn func(batch *Batch) error) error {
+	batch := db.batchPool.Get().(*Batch)
+	batch.init(true, false, db)
+	defer func() {
+		_ = batch.Commit()
+		batch.reset()
+		db.batchPool.Put(batch)
+	}()
+	return viewFn(batch)
+}
+
 // Get the value of the specified key from the database.
 // Actually, it will open a new batch and commit it.
 // You can think the batch has only one Get operation.
@@ -321,6 +522,43 @@ func (db *DB) Delete(key []byte) error {
 	return batch.Commit()
 }
 
+// DeleteRange deletes the keys in [start, end) from the database,
+// the keys are ordered by Options.LessFunc if it is set, and an empty end means no upper bound.
+// Only one range tombstone record is written to the data files for all the keys.
+// Actually, it will open a new batch and commit it.
+// You can think the batch has only one DeleteRange operation.
+func (db *DB) DeleteRange(start, end []byte) error {
+	batch := db.batchPool.Get().(*Batch)
+	defer func() {
+		batch.reset()
+		db.batchPool.Put(batch)
+	}()
+	batch.init(false, false, db)
+	if err := batch.DeleteRange(start, end); err != nil {
+		_ = batch.Rollback()
+		return err
+	}
+	return batch.Commit()
+}
+
+// DeletePrefix deletes the keys starting with the prefix from the database.
+// Only one prefix tombstone record is written to the data files for all the keys.
+// Actually, it will open a new batch and commit it.
+// You can think the batch has only one DeletePrefix operation.
+func (db *DB) DeletePrefix(prefix []byte) error {
+	batch := db.batchPool.Get().(*Batch)
+	defer func() {
+		batch.reset()
+		db.batchPool.Put(batch)
+	}()
+	batch.init(false, false, db)
+	if err := batch.DeletePrefix(prefix); err != nil {
+		_ = batch.Rollback()
+		return err
+	}
+	return batch.Commit()
+}
+
 // Exist checks if the specified key exists in the database.
 // Actually, it will open a new batch and commit it.
 // You can think the batch has only one Exist operation.
@@ -353,6 +591,61 @@ func (db *DB) Expire(key []byte, ttl time.Duration) error {
 	return batch.Commit()
 }
 
+// ExpireAt sets the expiry time of the key to the deadline.
+func (db *DB) ExpireAt(key []byte, deadline time.Time) error {
+	_, err := db.ExpireAtIf(key, deadline, ExpireAlways)
+	return err
+}
+
+// ExpireIf sets the ttl of the key if the condition is matched,
+// and reports whether the ttl is set.
+func (db *DB) ExpireIf(key []byte, ttl time.Duration, cond ExpireCondition) (bool, error) {
+	return db.ExpireAtIf(key, db.now().Add(ttl), cond)
+}
+
+// ExpireAtIf sets the expiry time of the key to the deadline if the condition is matched,
+// and reports whether the expiry time is set.
+func (db *DB) ExpireAtIf(key []byte, deadline time.Time, cond ExpireCondition) (bool, error) {
+	batch := db.batchPool.Get().(*Batch)
+	defer func() {
+		batch.reset()
+		db.batchPool.Put(batch)
+	}()
+	// This is a single expire operation, we can set Sync to false.
+	// Because the data will be written to the WAL,
+	// and the WAL file will be synced to disk according to the DB options.
+	batch.init(false, false, db)
+	ok, err := batch.ExpireAtIf(key, deadline, cond)
+	if err != nil || !ok {
+		_ = batch.Rollback()
+		return false, err
+	}
+	return true, batch.Commit()
+}
+
+// GetAndTouch gets the value of the key, and resets its ttl,
+// so the key expires ttl after it is read last time.
+func (db *DB) GetAndTouch(key []byte, ttl time.Duration) ([]byte, error) {
+	batch := db.batchPool.Get().(*Batch)
+	defer func() {
+		batch.reset()
+		db.batchPool.Put(batch)
+	}()
+	// This is a single touch operation, we can set Sync to false.
+	// Because the data will be written to the WAL,
+	// and the WAL file will be synced to disk according to the DB options.
+	batch.init(false, false, db)
+	value, err := batch.GetAndTouch(key, ttl)
+	if err != nil {
+		_ = batch.Rollback()
+		return nil, err
+	}
+	if err = batch.Commit(); err != nil {
+		return nil, err
+	}
+	return value, nil
+}
+
 // TTL get the ttl of the key.
 func (db *DB) TTL(key []byte) (time.Duration, error) {
 	batch := db.batchPool.Get().(*Batch)
@@ -365,6 +658,19 @@ func (db *DB) TTL(key []byte) (time.Duration, error) {
 	return batch.TTL(key)
 }
 
+// ExpireTime gets the expiry time of the key,
+// the zero time is returned if the key has no ttl.
+func (db *DB) ExpireTime(key []byte) (time.Time, error) {
+	batch := db.batchPool.Get().(*Batch)
+	batch.init(true, false, db)
+	defer func() {
+		_ = batch.Commit()
+		batch.reset()
+		db.batchPool.Put(batch)
+	}()
+	return batch.ExpireTime(key)
+}
+
 // Persist removes the ttl of the key.
 // If the key does not exist or expired, it will return ErrKeyNotFound.
 func (db *DB) Persist(key []byte) error {
@@ -397,11 +703,11 @@ func (db *DB) Ascend(handleFn func(k []byte, v []byte) (bool, error)) {
 	defer db.mu.RUnlock()
 
 	db.index.Ascend(func(key []byte, pos *wal.ChunkPosition) (bool, error) {
-		chunk, err := db.dataFiles.Read(pos)
+		value, err := db.readValue(db.keyspace, key, pos)
 		if err != nil {
 			return false, err
 		}
-		if value := db.checkValue(chunk); value != nil {
+		if value != nil {
 			return handleFn(key, value)
 		}
 		return true, nil
@@ -414,11 +720,11 @@ func (db *DB) AscendRange(startKey, endKey []byte, handleFn func(k []byte, v []b
 	defer db.mu.RUnlock()
 
 	db.index.AscendRange(startKey, endKey, func(key []byte, pos *wal.ChunkPosition) (bool, error) {
-		chunk, err := db.dataFiles.Read(pos)
+		value, err := db.readValue(db.keyspace, key, pos)
 		if err != nil {
 			return false, nil
 		}
-		if value := db.checkValue(chunk); value != nil {
+		if value != nil {
 			return handleFn(key, value)
 		}
 		return true, nil
@@ -431,11 +737,11 @@ func (db *DB) AscendGreaterOrEqual(key []byte, handleFn func(k []byte, v []byte)
 	defer db.mu.RUnlock()
 
 	db.index.AscendGreaterOrEqual(key, func(key []byte, pos *wal.ChunkPosition) (bool, error) {
-		chunk, err := db.dataFiles.Read(pos)
+		value, err := db.readValue(db.keyspace, key, pos)
 		if err != nil {
 			return false, nil
 		}
-		if value := db.checkValue(chunk); value != nil {
+		if value != nil {
 			return handleFn(key, value)
 		}
 		return true, nil
@@ -443,9 +749,8 @@ func (db *DB) AscendGreaterOrEqual(key []byte, handleFn func(k []byte, v []byte)
 }
 
 // AscendKeys calls handleFn for each key in the db in ascending order.
-// Since our expiry time is stored in the value, if you want to filter expired keys,
-// you need to set parameter filterExpired to true. But the performance will be affected.
-// Because we need to read the value of each key to determine if it is expired.
+// If filterExpired is true, the expired keys are skipped,
+// the expiry time of the keys is kept in memory, so the data files are not read.
 func (db *DB) AscendKeys(pattern []byte, filterExpired bool, handleFn func(k []byte) (bool, error)) error {
 	db.mu.RLock()
 	defer db.mu.RUnlock()
@@ -459,18 +764,13 @@ func (db *DB) AscendKeys(pattern []byte, filterExpired bool, handleFn func(k []b
 		}
 	}
 
+	now := db.now().UnixNano()
 	db.index.Ascend(func(key []byte, pos *wal.ChunkPosition) (bool, error) {
 		if reg != nil && !reg.Match(key) {
 			return true, nil
 		}
-		if filterExpired {
-			chunk, err := db.dataFiles.Read(pos)
-			if err != nil {
-				return false, err
-			}
-			if value := db.checkValue(chunk); value == nil {
-				return true, nil
-			}
+		if filterExpired && db.expires.isExpired(key, now) {
+			return true, nil
 		}
 		return handleFn(key)
 	})
@@ -478,9 +778,8 @@ func (db *DB) AscendKeys(pattern []byte, filterExpired bool, handleFn func(k []b
 }
 
 // AscendKeysRange calls handleFn for keys within a range in the db in ascending order.
-// Since our expiry time is stored in the value, if you want to filter expired keys,
-// you need to set parameter filterExpired to true. But the performance will be affected.
-// Because we need to read the value of each key to determine if it is expired.
+// If filterExpired is true, the expired keys are skipped,
+// the expiry time of the keys is kept in memory, so the data files are not read.
 func (db *DB) AscendKeysRange(startKey, endKey, pattern []byte, filterExpired bool, handleFn func(k []byte) (bool, error)) error {
 	db.mu.RLock()
 	defer db.mu.RUnlock()
@@ -494,18 +793,13 @@ func (db *DB) AscendKeysRange(startKey, endKey, pattern []byte, filterExpired bo
 		}
 	}
 
+	now := db.now().UnixNano()
 	db.index.AscendRange(startKey, endKey, func(key []byte, pos *wal.ChunkPosition) (bool, error) {
 		if reg != nil && !reg.Match(key) {
 			return true, nil
 		}
-		if filterExpired {
-			chunk, err := db.dataFiles.Read(pos)
-			if err != nil {
-				return false, err
-			}
-			if value := db.checkValue(chunk); value == nil {
-				return true, nil
-			}
+		if filterExpired && db.expires.isExpired(key, now) {
+			return true, nil
 		}
 		return handleFn(key)
 	})
@@ -518,11 +812,11 @@ func (db *DB) Descend(handleFn func(k []byte, v []byte) (bool, error)) {
 	defer db.mu.RUnlock()
 
 	db.index.Descend(func(key []byte, pos *wal.ChunkPosition) (bool, error) {
-		chunk, err := db.dataFiles.Read(pos)
+		value, err := db.readValue(db.keyspace, key, pos)
 		if err != nil {
 			return false, nil
 		}
-		if value := db.checkValue(chunk); value != nil {
+		if value != nil {
 			return handleFn(key, value)
 		}
 		return true, nil
@@ -535,11 +829,11 @@ func (db *DB) DescendRange(startKey, endKey []byte, handleFn func(k []byte, v []
 	defer db.mu.RUnlock()
 
 	db.index.DescendRange(startKey, endKey, func(key []byte, pos *wal.ChunkPosition) (bool, error) {
-		chunk, err := db.dataFiles.Read(pos)
+		value, err := db.readValue(db.keyspace, key, pos)
 		if err != nil {
 			return false, nil
 		}
-		if value := db.checkValue(chunk); value != nil {
+		if value != nil {
 			return handleFn(key, value)
 		}
 		return true, nil
@@ -552,11 +846,11 @@ func (db *DB) DescendLessOrEqual(key []byte, handleFn func(k []byte, v []byte) (
 	defer db.mu.RUnlock()
 
 	db.index.DescendLessOrEqual(key, func(key []byte, pos *wal.ChunkPosition) (bool, error) {
-		chunk, err := db.dataFiles.Read(pos)
+		value, err := db.readValue(db.keyspace, key, pos)
 		if err != nil {
 			return false, nil
 		}
-		if value := db.checkValue(chunk); value != nil {
+		if value != nil {
 			return handleFn(key, value)
 		}
 		return true, nil
@@ -564,9 +858,8 @@ func (db *DB) DescendLessOrEqual(key []byte, handleFn func(k []byte, v []byte) (
 }
 
 // DescendKeys calls handleFn for each key in the db in descending order.
-// Since our expiry time is stored in the value, if you want to filter expired keys,
-// you need to set parameter filterExpired to true. But the performance will be affected.
-// Because we need to read the value of each key to determine if it is expired.
+// If filterExpired is true, the expired keys are skipped,
+// the expiry time of the keys is kept in memory, so the data files are not read.
 func (db *DB) DescendKeys(pattern []byte, filterExpired bool, handleFn func(k []byte) (bool, error)) error {
 	db.mu.RLock()
 	defer db.mu.RUnlock()
@@ -580,18 +873,13 @@ func (db *DB) DescendKeys(pattern []byte, filterExpired bool, handleFn func(k []
 		}
 	}
 
+	now := db.now().UnixNano()
 	db.index.Descend(func(key []byte, pos *wal.ChunkPosition) (bool, error) {
 		if reg != nil && !reg.Match(key) {
 			return true, nil
 		}
-		if filterExpired {
-			chunk, err := db.dataFiles.Read(pos)
-			if err != nil {
-				return false, err
-			}
-			if value := db.checkValue(chunk); value == nil {
-				return true, nil
-			}
+		if filterExpired && db.expires.isExpired(key, now) {
+			return true, nil
 		}
 		return handleFn(key)
 	})
@@ -599,9 +887,8 @@ func (db *DB) DescendKeys(pattern []byte, filterExpired bool, handleFn func(k []
 }
 
 // DescendKeysRange calls handleFn for keys within a range in the db in descending order.
-// Since our expiry time is stored in the value, if you want to filter expired keys,
-// you need to set parameter filterExpired to true. But the performance will be affected.
-// Because we need to read the value of each key to determine if it is expired.
+// If filterExpired is true, the expired keys are skipped,
+// the expiry time of the keys is kept in memory, so the data files are not read.
 func (db *DB) DescendKeysRange(startKey, endKey, pattern []byte, filterExpired bool, handleFn func(k []byte) (bool, error)) error {
 	db.mu.RLock()
 	defer db.mu.RUnlock()
@@ -615,18 +902,13 @@ func (db *DB) DescendKeysRange(startKey, endKey, pattern []byte, filterExpired b
 		}
 	}
 
+	now := db.now().UnixNano()
 	db.index.DescendRange(startKey, endKey, func(key []byte, pos *wal.ChunkPosition) (bool, error) {
 		if reg != nil && !reg.Match(key) {
 			return true, nil
 		}
-		if filterExpired {
-			chunk, err := db.dataFiles.Read(pos)
-			if err != nil {
-				return false, err
-			}
-			if value := db.checkValue(chunk); value == nil {
-				return true, nil
-			}
+		if filterExpired && db.expires.isExpired(key, now) {
+			return true, nil
 		}
 		return handleFn(key)
 	})
@@ -635,7 +917,7 @@ func (db *DB) DescendKeysRange(startKey, endKey, pattern []byte, filterExpired b
 
 func (db *DB) checkValue(chunk []byte) []byte {
 	record := decodeLogRecord(chunk)
-	now := time.Now().UnixNano()
+	now := db.now().UnixNano()
 	if record.Type != LogRecordDeleted && !record.IsExpired(now) {
 		return record.Value
 	}
@@ -650,142 +932,59 @@ func checkOptions(options Options) error {
 		return errors.New("database data file size must be greater than 0")
 	}
 
-	if len(options.AutoMergeCronExpr) > 0 {
-		if _, err := cron.NewParser(cron.SecondOptional | cron.Minute | cron.Hour | cron.Dom | cron.Month | cron.Dow | cron.Descriptor).
-			Parse(options.AutoMergeCronExpr); err != nil {
-			return fmt.Errorf("database auto merge cron expression is invalid, err: %s", err)
-		}
+	if options.AutoMergeDeadRatio < 0 || options.AutoMergeDeadRatio > 1 {
+		return errors.New("database auto merge dead ratio must be between 0 and 1")
+	}
+	if options.MergeSegmentDeadRatio < 0 || options.MergeSegmentDeadRatio > 1 {
+		return errors.New("database merge segment dead ratio must be between 0 and 1")
 	}
 
-	return nil
-}
-
-// loadIndexFromWAL loads index from WAL.
-// It will iterate over all the WAL files and read data
-// from them to rebuild the index.
-func (db *DB) loadIndexFromWAL() error {
-	mergeFinSegmentId, err := getMergeFinSegmentId(db.options.DirPath)
-	if err != nil {
-		return err
+	if options.IndexType > IndexDisk {
+		return errors.New("database index type is unknown")
 	}
-	indexRecords := make(map[uint64][]*IndexRecord)
-	now := time.Now().UnixNano()
-	// get a reader for WAL
-	reader := db.dataFiles.NewReader()
-	db.dataFiles.SetIsStartupTraversal(true)
-	for {
-		// if the current segment id is less than the mergeFinSegmentId,
-		// we can skip this segment because it has been merged,
-		// and we can load index from the hint file directly.
-		if reader.CurrentSegmentId() <= mergeFinSegmentId {
-			reader.SkipCurrentSegment()
-			continue
-		}
-
-		chunk, position, err := reader.Next()
-		if err != nil {
-			if err == io.EOF {
-				break
+	if options.IndexType == IndexDisk && options.DiskIndexMemtableSize <= 0 {
+		return errors.New("database disk index memtable size must be greater than 0")
+	}
+	if options.IndexType == IndexART && options.LessFunc != nil {
+		return errors.New("database index ART does not support the custom LessFunc")
+	}
+	if options.IndexType == IndexART {
+		for name, opts := range options.Namespaces {
+			if opts.Comparator.Less != nil {
+				return fmt.Errorf("database index ART does not support the comparator of namespace %q", name)
 			}
-			return err
 		}
-		// decode and get log record
-		record := decodeLogRecord(chunk)
+	}
 
-		// if we get the end of a batch,
-		// all records in this batch are ready to be indexed.
-		if record.Type == LogRecordBatchFinished {
-			batchId, err := snowflake.ParseBytes(record.Key)
-			if err != nil {
-				return err
-			}
-			for _, idxRecord := range indexRecords[uint64(batchId)] {
-				if idxRecord.recordType == LogRecordNormal {
-					db.index.Put(idxRecord.key, idxRecord.position)
-				}
-				if idxRecord.recordType == LogRecordDeleted {
-					db.index.Delete(idxRecord.key)
-				}
-			}
-			// delete indexRecords according to batchId after indexing
-			delete(indexRecords, uint64(batchId))
-		} else if record.Type == LogRecordNormal && record.BatchId == mergeFinishedBatchID {
-			// if the record is a normal record and the batch id is 0,
-			// it means that the record is involved in the merge operation.
-			// so put the record into index directly.
-			db.index.Put(record.Key, position)
-		} else {
-			// expired records should not be indexed
-			if record.IsExpired(now) {
-				db.index.Delete(record.Key)
-				continue
-			}
-			// put the record into the temporary indexRecords
-			indexRecords[record.BatchId] = append(indexRecords[record.BatchId],
-				&IndexRecord{
-					key:        record.Key,
-					recordType: record.Type,
-					position:   position,
-				})
+	if options.ActiveExpireInterval < 0 || options.ActiveExpireBudget < 0 {
+		return errors.New("database active expire interval and budget must not be negative")
+	}
+	if options.IndexCheckpointInterval < 0 {
+		return errors.New("database index checkpoint interval must not be negative")
+	}
+
+	if len(options.AutoMergeCronExpr) > 0 {
+		if _, err := cron.NewParser(cron.SecondOptional | cron.Minute | cron.Hour | cron.Dom | cron.Month | cron.Dow | cron.Descriptor).
+			Parse(options.AutoMergeCronExpr); err != nil {
+			return fmt.Errorf("database auto merge cron expression is invalid, err: %s", err)
 		}
 	}
-	db.dataFiles.SetIsStartupTraversal(false)
+
 	return nil
 }
 
-// DeleteExpiredKeys scan the entire index in ascending order to delete expired keys.
-// It is a time-consuming operation, so we need to specify a timeout
-// to prevent the DB from being unavailable for a long time.
+// DeleteExpiredKeys deletes the expired keys from the index.
+// The expired keys are found from the expiry times kept in memory, without reading the data files.
+// The keys are deleted in small groups, so the DB is not blocked for a long time,
+// and it returns when the timeout is reached even if some expired keys are left.
+//
+// An expired record is written to the data files for every deleted key,
+// so the expiration is replayed when the DB is opened, and a WatchActionExpire event is sent
+// to the watcher if it is enabled. The expired keys are not deleted by the reads,
+// they are only hidden until they are deleted here.
+//
+// The expired keys are also deleted in background if Options.ActiveExpireInterval is set.
 func (db *DB) DeleteExpiredKeys(timeout time.Duration) error {
-	// set timeout
-	ctx, cancel := context.WithTimeout(context.Background(), timeout)
-	defer cancel()
-	done := make(chan struct{}, 1)
-
-	var innerErr error
-	now := time.Now().UnixNano()
-	go func(ctx context.Context) {
-		db.mu.Lock()
-		defer db.mu.Unlock()
-		for {
-			// select 100 keys from the db.index
-			positions := make([]*wal.ChunkPosition, 0, 100)
-			db.index.AscendGreaterOrEqual(db.expiredCursorKey, func(k []byte, pos *wal.ChunkPosition) (bool, error) {
-				positions = append(positions, pos)
-				if len(positions) >= 100 {
-					return false, nil
-				}
-				return true, nil
-			})
-
-			// If keys in the db.index has been traversed, len(positions) will be 0.
-			if len(positions) == 0 {
-				db.expiredCursorKey = nil
-				done <- struct{}{}
-				return
-			}
-
-			// delete from index if the key is expired.
-			for _, pos := range positions {
-				chunk, err := db.dataFiles.Read(pos)
-				if err != nil {
-					innerErr = err
-					done <- struct{}{}
-					return
-				}
-				record := decodeLogRecord(chunk)
-				if record.IsExpired(now) {
-					db.index.Delete(record.Key)
-				}
-				db.expiredCursorKey = record.Key
-			}
-		}
-	}(ctx)
-
-	select {
-	case <-ctx.Done():
-		return innerErr
-	case <-done:
-		return innerErr
-	}
+	_, err := db.deleteExpiredKeys(db.now().UnixNano(), time.Now().Add(timeout))
+	return err
 }
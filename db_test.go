@@ -744,6 +744,140 @@ func TestDB_Expire2(t *testing.T) {
 	assert.Equal(t, err, ErrKeyNotFound)
 }
 
+func TestDB_PutWithDeadline(t *testing.T) {
+	options := DefaultOptions
+	db, err := Open(options)
+	assert.Nil(t, err)
+	defer destroyDB(db)
+
+	deadline := time.Now().Add(time.Millisecond * 1500)
+	err = db.PutWithDeadline(utils.GetTestKey(1), utils.RandomValue(10), deadline)
+	assert.Nil(t, err)
+	expireTime, err := db.ExpireTime(utils.GetTestKey(1))
+	assert.Nil(t, err)
+	assert.Equal(t, deadline.UnixNano(), expireTime.UnixNano())
+
+	// a deadline in the past deletes the key
+	err = db.PutWithDeadline(utils.GetTestKey(2), utils.RandomValue(10), time.Now().Add(-time.Second))
+	assert.Nil(t, err)
+	_, err = db.Get(utils.GetTestKey(2))
+	assert.Equal(t, ErrKeyNotFound, err)
+
+	time.Sleep(time.Second * 2)
+	_, err = db.Get(utils.GetTestKey(1))
+	assert.Equal(t, ErrKeyNotFound, err)
+}
+
+func TestDB_ExpireAt(t *testing.T) {
+	options := DefaultOptions
+	db, err := Open(options)
+	assert.Nil(t, err)
+	defer destroyDB(db)
+
+	// not exist
+	err = db.ExpireAt(utils.GetTestKey(1), time.Now().Add(time.Hour))
+	assert.Equal(t, ErrKeyNotFound, err)
+	_, err = db.ExpireTime(utils.GetTestKey(1))
+	assert.Equal(t, ErrKeyNotFound, err)
+
+	err = db.Put(utils.GetTestKey(1), utils.RandomValue(10))
+	assert.Nil(t, err)
+	expireTime, err := db.ExpireTime(utils.GetTestKey(1))
+	assert.Nil(t, err)
+	assert.True(t, expireTime.IsZero())
+
+	deadline := time.Now().Add(time.Hour)
+	err = db.ExpireAt(utils.GetTestKey(1), deadline)
+	assert.Nil(t, err)
+
+	// restart
+	assert.Nil(t, db.Close())
+	db, err = Open(options)
+	assert.Nil(t, err)
+	expireTime, err = db.ExpireTime(utils.GetTestKey(1))
+	assert.Nil(t, err)
+	assert.Equal(t, deadline.UnixNano(), expireTime.UnixNano())
+	ttl, err := db.TTL(utils.GetTestKey(1))
+	assert.Nil(t, err)
+	assert.True(t, ttl > time.Minute*59)
+}
+
+func TestDB_ExpireIf(t *testing.T) {
+	options := DefaultOptions
+	db, err := Open(options)
+	assert.Nil(t, err)
+	defer destroyDB(db)
+
+	key := utils.GetTestKey(1)
+	err = db.Put(key, utils.RandomValue(10))
+	assert.Nil(t, err)
+
+	expireTime := func() time.Time {
+		expireTime, err := db.ExpireTime(key)
+		assert.Nil(t, err)
+		return expireTime
+	}
+
+	// the key has no ttl
+	ok, err := db.ExpireIf(key, time.Hour, ExpireIfSet)
+	assert.Nil(t, err)
+	assert.False(t, ok)
+	ok, err = db.ExpireIf(key, time.Hour, ExpireIfGreater)
+	assert.Nil(t, err)
+	assert.False(t, ok)
+	assert.True(t, expireTime().IsZero())
+	ok, err = db.ExpireIf(key, time.Hour*2, ExpireIfLess)
+	assert.Nil(t, err)
+	assert.True(t, ok)
+	assert.False(t, expireTime().IsZero())
+
+	// the key has a ttl
+	deadline := time.Now().Add(time.Hour * 3)
+	ok, err = db.ExpireAtIf(key, deadline, ExpireIfNotSet)
+	assert.Nil(t, err)
+	assert.False(t, ok)
+	ok, err = db.ExpireAtIf(key, deadline, ExpireIfGreater)
+	assert.Nil(t, err)
+	assert.True(t, ok)
+	assert.Equal(t, deadline.UnixNano(), expireTime().UnixNano())
+	ok, err = db.ExpireAtIf(key, deadline.Add(time.Hour), ExpireIfLess)
+	assert.Nil(t, err)
+	assert.False(t, ok)
+	ok, err = db.ExpireAtIf(key, deadline.Add(-time.Hour), ExpireIfLess)
+	assert.Nil(t, err)
+	assert.True(t, ok)
+	assert.Equal(t, deadline.Add(-time.Hour).UnixNano(), expireTime().UnixNano())
+	ok, err = db.ExpireAtIf(key, deadline, ExpireIfSet)
+	assert.Nil(t, err)
+	assert.True(t, ok)
+	assert.Equal(t, deadline.UnixNano(), expireTime().UnixNano())
+
+	_, err = db.ExpireIf(utils.GetTestKey(2), time.Hour, ExpireAlways)
+	assert.Equal(t, ErrKeyNotFound, err)
+}
+
+func TestDB_GetAndTouch(t *testing.T) {
+	options := DefaultOptions
+	db, err := Open(options)
+	assert.Nil(t, err)
+	defer destroyDB(db)
+
+	key, value := utils.GetTestKey(1), utils.RandomValue(10)
+	err = db.PutWithTTL(key, value, time.Millisecond*500)
+	assert.Nil(t, err)
+
+	// the ttl is refreshed by every read
+	for i := 0; i < 4; i++ {
+		time.Sleep(time.Millisecond * 300)
+		val, err := db.GetAndTouch(key, time.Millisecond*500)
+		assert.Nil(t, err)
+		assert.Equal(t, value, val)
+	}
+	time.Sleep(time.Millisecond * 700)
+	_, err = db.GetAndTouch(key, time.Millisecond*500)
+	assert.Equal(t, ErrKeyNotFound, err)
+}
+
 func TestDB_DeleteExpiredKeys(t *testing.T) {
 	options := DefaultOptions
 	db, err := Open(options)
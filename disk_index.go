@@ -0,0 +1,777 @@
+package memdb
+
+import (
+	"bufio"
+	"container/list"
+	"fmt"
+	"hash/maphash"
+	"os"
+	"path/filepath"
+	"slices"
+	"sort"
+	"strconv"
+	"sync"
+	"sync/atomic"
+
+	"github.com/rosedblabs/wal"
+)
+
+const (
+	diskIndexDirName = "index"
+	// diskIndexBlockSize is the size of a block in the index files,
+	// which is the unit of reading and caching.
+	diskIndexBlockSize = 4 * KB
+	// diskIndexTierFiles is the number of the files of a tier which are merged into a file of the next tier.
+	// A file of the tier n has about DiskIndexMemtableSize*diskIndexTierFiles^n keys,
+	// so a key is rewritten once per tier, and a Get reads a few blocks per tier.
+	diskIndexTierFiles = 4
+	// diskIndexHandleOverhead is the estimated memory of a block handle besides the first key.
+	diskIndexHandleOverhead = 48
+	// diskBloomBitsPerKey and diskBloomHashes make about 1% of the missing keys pass the bloom filter of a file.
+	diskBloomBitsPerKey = 10
+	diskBloomHashes     = 7
+)
+
+// DiskIndex is an implementation of the Indexer interface which keeps most of the keys on disk,
+// for the databases whose keys do not fit in memory.
+//
+// The recent writes are kept in a memtable. When the memtable is full, it is written to
+// a sorted index file, and only a sparse summary of the file, the first key of every block,
+// is kept in memory, with the last key and a bloom filter of the file, so a missing key
+// seldom reads a block. The blocks read by Get are kept in an LRU cache.
+// The files are tiered: the flushed files are in the tier 0, and when a tier has diskIndexTierFiles files,
+// they are merged into one file of the next tier in the background, so the writes are not blocked by the merge.
+//
+// A deleted key is kept as a tombstone, a zero position, until the oldest file is merged.
+// The index files are only a cache of the index, they are rebuilt when the database is opened.
+//
+// Put and Delete look up the old position of the key with the read lock, which does not block Get,
+// the writers are serialized by another lock, so the old position can not change in between.
+//
+// If an index file can not be written or read, the index fails, and Err returns the error.
+// The keys of a failed index may be missing, so the database returns the error from the later operations.
+type DiskIndex struct {
+	writeLock    sync.Mutex // serializes Put and Delete
+	lock         sync.RWMutex
+	dirPath      string
+	memtable     *BTree
+	memtableSize int
+	files        []*diskIndexFile // the newest first, so the lower tiers are first
+	nextFileId   uint32
+	compacting   bool           // whether a tier is being merged
+	compactWg    sync.WaitGroup // the running merge
+	closed       bool
+	cache        *diskBlockCache
+	size         int
+	less         func(a, b []byte) bool
+	seed         maphash.Seed // the seed of the bloom filters
+	errMu        sync.Mutex
+	err          error // the first error of the index files
+}
+
+// diskIndexFile is an immutable sorted index file.
+type diskIndexFile struct {
+	id      uint32
+	tier    int
+	path    string
+	file    *os.File
+	handles []diskBlockHandle
+	lastKey []byte
+	filter  diskBloomFilter
+	refs    atomic.Int32 // the index and the iterators reading the file
+}
+
+// diskBlockHandle locates a block in the index file.
+type diskBlockHandle struct {
+	firstKey []byte
+	offset   int64
+	size     uint32
+	count    int
+}
+
+// diskIndexDir returns the directory of the index files of the namespace,
+// the ones of the namespaces are in the directory of the default namespace.
+func diskIndexDir(dirPath string, namespace uint32) string {
+	dir := filepath.Join(dirPath, diskIndexDirName)
+	if namespace != defaultNamespaceId {
+		dir = filepath.Join(dir, strconv.FormatUint(uint64(namespace), 10))
+	}
+	return dir
+}
+
+func newDiskIndex(dirPath string, options Options) (*DiskIndex, error) {
+	lessFunc := options.LessFunc
+	if lessFunc == nil {
+		lessFunc = bytewiseLess
+	}
+
+	// the index files of the last time are outdated, the index is always rebuilt when opened.
+	if err := os.RemoveAll(dirPath); err != nil {
+		return nil, err
+	}
+	if err := os.MkdirAll(dirPath, os.ModePerm); err != nil {
+		return nil, err
+	}
+
+	return &DiskIndex{
+		dirPath:      dirPath,
+		memtable:     newBTree(lessFunc),
+		memtableSize: options.DiskIndexMemtableSize,
+		cache:        newDiskBlockCache(options.DiskIndexCacheSize),
+		less:         lessFunc,
+		seed:         maphash.MakeSeed(),
+	}, nil
+}
+
+// isTombstone checks whether the position marks a deleted key,
+// a real chunk is never empty because of the chunk header.
+func isTombstone(position *wal.ChunkPosition) bool {
+	return position.ChunkSize == 0
+}
+
+// fail records the first error of the index files, it fails the index.
+func (di *DiskIndex) fail(err error) {
+	di.errMu.Lock()
+	defer di.errMu.Unlock()
+	if di.err == nil {
+		di.err = fmt.Errorf("the disk index failed: %w", err)
+	}
+}
+
+// Err returns the error which failed the index, nil if the index works.
+func (di *DiskIndex) Err() error {
+	di.errMu.Lock()
+	defer di.errMu.Unlock()
+	return di.err
+}
+
+// get returns the position of the key, nil if it does not exist or is deleted,
+// or if the block of the key can not be read, which fails the index.
+func (di *DiskIndex) get(key []byte) *wal.ChunkPosition {
+	if position := di.memtable.Get(key); position != nil {
+		if isTombstone(position) {
+			return nil
+		}
+		return position
+	}
+	for _, f := range di.files {
+		position, err := di.getFromFile(f, key)
+		if err != nil {
+			di.fail(err)
+			return nil
+		}
+		if position != nil {
+			if isTombstone(position) {
+				return nil
+			}
+			return position
+		}
+	}
+	return nil
+}
+
+func (di *DiskIndex) getFromFile(f *diskIndexFile, key []byte) (*wal.ChunkPosition, error) {
+	if len(f.handles) == 0 || di.less(f.lastKey, key) || !f.filter.mayContain(maphash.Bytes(di.seed, key)) {
+		return nil, nil
+	}
+	i := sort.Search(len(f.handles), func(i int) bool {
+		return di.less(key, f.handles[i].firstKey)
+	})
+	if i == 0 {
+		// less than the first key of the file
+		return nil, nil
+	}
+
+	block := di.cache.get(f.id, i-1)
+	if block == nil {
+		var err error
+		if block, err = f.readBlock(i - 1); err != nil {
+			return nil, err
+		}
+		di.cache.put(f.id, i-1, block)
+	}
+	var position *wal.ChunkPosition
+	block.forEach(func(k []byte, pos *wal.ChunkPosition) bool {
+		if di.less(k, key) {
+			return true
+		}
+		if !di.less(key, k) {
+			p := *pos
+			position = &p
+		}
+		return false
+	})
+	return position, nil
+}
+
+// Put key and position into the index.
+func (di *DiskIndex) Put(key []byte, position *wal.ChunkPosition) *wal.ChunkPosition {
+	di.writeLock.Lock()
+	defer di.writeLock.Unlock()
+
+	oldPos := di.Get(key)
+	di.lock.Lock()
+	defer di.lock.Unlock()
+	if oldPos == nil {
+		di.size++
+	}
+	di.memtable.Put(key, position)
+	di.maybeFlush()
+	return oldPos
+}
+
+// Get the position of the key in the index.
+func (di *DiskIndex) Get(key []byte) *wal.ChunkPosition {
+	di.lock.RLock()
+	defer di.lock.RUnlock()
+	return di.get(key)
+}
+
+// Delete the index of the key.
+func (di *DiskIndex) Delete(key []byte) (*wal.ChunkPosition, bool) {
+	di.writeLock.Lock()
+	defer di.writeLock.Unlock()
+
+	oldPos := di.Get(key)
+	if oldPos == nil {
+		return nil, false
+	}
+	di.lock.Lock()
+	defer di.lock.Unlock()
+	di.size--
+	if len(di.files) == 0 {
+		di.memtable.Delete(key)
+	} else {
+		// the key in the files is shadowed by the tombstone
+		di.memtable.Put(key, &wal.ChunkPosition{})
+		di.maybeFlush()
+	}
+	return oldPos, true
+}
+
+// maybeFlush writes the memtable to a new index file if it is full,
+// and starts merging a tier of the files if it is full.
+// If a file can not be written, the index fails and the keys are kept in the memtable.
+func (di *DiskIndex) maybeFlush() {
+	if di.memtable.Size() < di.memtableSize || di.Err() != nil {
+		return
+	}
+
+	memtable := di.memtable.Iterator(false)
+	f, err := di.writeFile(di.newFileId(), memtable, false)
+	memtable.Close()
+	if err != nil {
+		di.fail(err)
+		return
+	}
+	di.files = append([]*diskIndexFile{f}, di.files...)
+	di.memtable = newBTree(di.less)
+	di.maybeCompact()
+}
+
+// maybeCompact starts merging the oldest diskIndexTierFiles files of the lowest tier which has
+// that many in the background, only one merge runs at a time. The caller must hold the lock.
+//
+// Exactly diskIndexTierFiles files are merged even if more have been flushed while
+// the previous merge was running, so a file of the tier n always holds
+// diskIndexTierFiles^n flushes and the shape of the tiers does not depend on timing.
+func (di *DiskIndex) maybeCompact() {
+	if di.compacting || di.closed || di.Err() != nil {
+		return
+	}
+	// the files of a tier are next to each other, and the tiers are ordered
+	for start, end := 0, 0; start < len(di.files); start = end {
+		for end = start; end < len(di.files) && di.files[end].tier == di.files[start].tier; end++ {
+		}
+		if end-start < diskIndexTierFiles {
+			continue
+		}
+		files := slices.Clone(di.files[end-diskIndexTierFiles : end])
+		// the iterator keeps the files until the merge is done
+		iter := di.newIterator(false, nil, files, true)
+		di.compacting = true
+		di.compactWg.Add(1)
+		go di.compact(files, iter, end == len(di.files), di.newFileId())
+		return
+	}
+}
+
+// compact merges the files into one file of the next tier without the lock, the files are immutable.
+// The tombstones are dropped if the oldest file is merged, no older key is shadowed by them.
+func (di *DiskIndex) compact(files []*diskIndexFile, iter *diskIndexIterator, oldest bool, id uint32) {
+	defer di.compactWg.Done()
+
+	merged, err := di.writeFile(id, iter, oldest)
+	if err == nil {
+		err = iter.err
+	}
+	iter.Close()
+
+	di.lock.Lock()
+	defer di.lock.Unlock()
+	di.compacting = false
+	if err != nil {
+		if merged != nil {
+			merged.unref()
+		}
+		di.fail(err)
+		return
+	}
+	if di.closed {
+		merged.unref()
+		return
+	}
+	// only the newer files are added while merging, so the files are still next to each other
+	merged.tier = files[0].tier + 1
+	i := slices.Index(di.files, files[0])
+	di.files = slices.Replace(di.files, i, i+len(files), merged)
+	for _, f := range files {
+		f.unref()
+	}
+	di.maybeCompact()
+}
+
+// newFileId returns the id of a new index file, the caller must hold the lock.
+func (di *DiskIndex) newFileId() uint32 {
+	di.nextFileId++
+	return di.nextFileId
+}
+
+// writeFile writes the entries of the iterator to a new index file of the tier 0.
+func (di *DiskIndex) writeFile(id uint32, iter IndexIterator, skipTombstones bool) (*diskIndexFile, error) {
+	f := &diskIndexFile{
+		id:   id,
+		path: filepath.Join(di.dirPath, fmt.Sprintf("%09d.IDX", id)),
+	}
+	file, err := os.OpenFile(f.path, os.O_CREATE|os.O_RDWR|os.O_TRUNC, 0644)
+	if err != nil {
+		return nil, err
+	}
+	f.file = file
+	f.refs.Store(1)
+
+	writer := bufio.NewWriterSize(file, 64*KB)
+	var offset int64
+	var entries []compactEntry
+	var entriesSize int
+	var hashes []uint64
+	flushBlock := func() error {
+		if len(entries) == 0 {
+			return nil
+		}
+		block := encodeCompactBlock(entries)
+		if _, err := writer.Write(block.data); err != nil {
+			return err
+		}
+		f.handles = append(f.handles, diskBlockHandle{
+			firstKey: append([]byte(nil), block.firstKey...),
+			offset:   offset,
+			size:     uint32(len(block.data)),
+			count:    len(entries),
+		})
+		offset += int64(len(block.data))
+		entries, entriesSize = entries[:0], 0
+		return nil
+	}
+
+	for ; iter.Valid(); iter.Next() {
+		position := iter.Value()
+		if skipTombstones && isTombstone(position) {
+			continue
+		}
+		entries = append(entries, compactEntry{key: iter.Key(), pos: *position})
+		entriesSize += len(iter.Key()) + 8
+		hashes = append(hashes, maphash.Bytes(di.seed, iter.Key()))
+		f.lastKey = append(f.lastKey[:0], iter.Key()...)
+		if entriesSize >= diskIndexBlockSize {
+			if err = flushBlock(); err != nil {
+				f.unref()
+				return nil, err
+			}
+		}
+	}
+	if err = flushBlock(); err == nil {
+		err = writer.Flush()
+	}
+	if err != nil {
+		f.unref()
+		return nil, err
+	}
+	f.filter = newDiskBloomFilter(hashes)
+	return f, nil
+}
+
+// readBlock reads the i-th block of the file.
+func (f *diskIndexFile) readBlock(i int) (*compactBlock, error) {
+	handle := f.handles[i]
+	data := make([]byte, handle.size)
+	if _, err := f.file.ReadAt(data, handle.offset); err != nil {
+		return nil, err
+	}
+	return &compactBlock{data: data, count: handle.count}, nil
+}
+
+// unref releases a reference of the file, the file is removed when it is not used anymore.
+func (f *diskIndexFile) unref() {
+	if f.refs.Add(-1) == 0 {
+		_ = f.file.Close()
+		_ = os.Remove(f.path)
+	}
+}
+
+// Size represents the number of keys in the index.
+func (di *DiskIndex) Size() int {
+	di.lock.RLock()
+	defer di.lock.RUnlock()
+	return di.size
+}
+
+// MemSize returns the estimated memory used by the index in bytes,
+// including the memtable, the summaries of the files and the block cache.
+func (di *DiskIndex) MemSize() int64 {
+	di.lock.RLock()
+	defer di.lock.RUnlock()
+
+	size := di.memtable.MemSize() + di.cache.memSize()
+	for _, f := range di.files {
+		size += int64(len(f.lastKey)) + int64(len(f.filter.bits))*8
+		for i := range f.handles {
+			size += int64(len(f.handles[i].firstKey)) + diskIndexHandleOverhead
+		}
+	}
+	return size
+}
+
+// newIterator returns an iterator merging the memtable, if it is not nil, and the files,
+// the tombstones are returned only for merging the files. The caller must hold the lock.
+// If a block can not be read, the iterator ends there and the index fails.
+func (di *DiskIndex) newIterator(reverse bool, memtable *BTree, files []*diskIndexFile, tombstones bool) *diskIndexIterator {
+	it := &diskIndexIterator{reverse: reverse, less: di.less, tombstones: tombstones}
+	if memtable != nil {
+		it.sources = append(it.sources, memtable.Iterator(reverse))
+	}
+	for _, f := range files {
+		f.refs.Add(1)
+		it.files = append(it.files, f)
+		it.sources = append(it.sources, newCompactIterator(len(f.handles), reverse, di.less,
+			func(i int) []byte { return f.handles[i].firstKey },
+			func(i int) []compactEntry {
+				block, err := f.readBlock(i)
+				if err != nil {
+					it.fail(err)
+					di.fail(err)
+					return nil
+				}
+				return block.decode()
+			},
+		))
+	}
+	it.findNext()
+	return it
+}
+
+func (di *DiskIndex) iterate(startKey []byte, reverse bool, handleFn func(key []byte, position *wal.ChunkPosition) (bool, error)) {
+	di.lock.RLock()
+	defer di.lock.RUnlock()
+
+	it := di.newIterator(reverse, di.memtable, di.files, false)
+	defer it.Close()
+	if startKey != nil {
+		it.Seek(startKey)
+	}
+	for ; it.Valid(); it.Next() {
+		cont, err := handleFn(it.Key(), it.Value())
+		if err != nil || !cont {
+			return
+		}
+	}
+}
+
+// Ascend iterates over items in ascending order and invokes the handler function for each item.
+// If the handler function returns false, iteration stops.
+func (di *DiskIndex) Ascend(handleFn func(key []byte, position *wal.ChunkPosition) (bool, error)) {
+	di.iterate(nil, false, handleFn)
+}
+
+// Descend iterates over items in descending order and invokes the handler function for each item.
+// If the handler function returns false, iteration stops.
+func (di *DiskIndex) Descend(handleFn func(key []byte, position *wal.ChunkPosition) (bool, error)) {
+	di.iterate(nil, true, handleFn)
+}
+
+// AscendRange iterates in ascending order within [startKey, endKey), invoking handleFn.
+// Stops if handleFn returns false.
+func (di *DiskIndex) AscendRange(startKey, endKey []byte, handleFn func(key []byte, position *wal.ChunkPosition) (bool, error)) {
+	di.iterate(startKey, false, func(key []byte, position *wal.ChunkPosition) (bool, error) {
+		if !di.less(key, endKey) {
+			return false, nil
+		}
+		return handleFn(key, position)
+	})
+}
+
+// DescendRange iterates in descending order within (endKey, startKey], invoking handleFn.
+// Stops if handleFn returns false.
+func (di *DiskIndex) DescendRange(startKey, endKey []byte, handleFn func(key []byte, position *wal.ChunkPosition) (bool, error)) {
+	di.iterate(startKey, true, func(key []byte, position *wal.ChunkPosition) (bool, error) {
+		if !di.less(endKey, key) {
+			return false, nil
+		}
+		return handleFn(key, position)
+	})
+}
+
+// AscendGreaterOrEqual iterates in ascending order, starting from key >= given key,
+// invoking handleFn. Stops if handleFn returns false.
+func (di *DiskIndex) AscendGreaterOrEqual(key []byte, handleFn func(key []byte, position *wal.ChunkPosition) (bool, error)) {
+	di.iterate(key, false, handleFn)
+}
+
+// DescendLessOrEqual iterates in descending order, starting from key <= given key,
+// invoking handleFn. Stops if handleFn returns false.
+func (di *DiskIndex) DescendLessOrEqual(key []byte, handleFn func(key []byte, position *wal.ChunkPosition) (bool, error)) {
+	di.iterate(key, true, handleFn)
+}
+
+// Iterator returns an index iterator over a snapshot of the index,
+// the files are kept until the iterator is closed.
+func (di *DiskIndex) Iterator(reverse bool) IndexIterator {
+	di.lock.RLock()
+	defer di.lock.RUnlock()
+	return di.newIterator(reverse, di.memtable, di.files, false)
+}
+
+// Close closes and removes the index files, it waits for the running merge.
+func (di *DiskIndex) Close() error {
+	di.lock.Lock()
+	di.closed = true
+	di.lock.Unlock()
+	di.compactWg.Wait()
+
+	di.lock.Lock()
+	defer di.lock.Unlock()
+
+	for _, f := range di.files {
+		f.unref()
+	}
+	di.files = nil
+	di.memtable = newBTree(di.less)
+	di.cache = newDiskBlockCache(0)
+	di.size = 0
+	return os.RemoveAll(di.dirPath)
+}
+
+// diskBloomFilter tells whether a key may be in an index file, by the hashes of the keys.
+type diskBloomFilter struct {
+	bits []uint64
+}
+
+func newDiskBloomFilter(hashes []uint64) diskBloomFilter {
+	f := diskBloomFilter{bits: make([]uint64, (len(hashes)*diskBloomBitsPerKey+63)/64+1)}
+	for _, h := range hashes {
+		f.locate(h, func(word int, mask uint64) bool {
+			f.bits[word] |= mask
+			return true
+		})
+	}
+	return f
+}
+
+// locate calls fn with the bits of the hash until fn returns false,
+// the bits are derived from the two halves of the hash by double hashing.
+func (f diskBloomFilter) locate(h uint64, fn func(word int, mask uint64) bool) bool {
+	m := uint64(len(f.bits)) * 64
+	h1, h2 := h&0xffffffff, h>>32
+	for i := uint64(0); i < diskBloomHashes; i++ {
+		bit := (h1 + i*h2) % m
+		if !fn(int(bit/64), 1<<(bit%64)) {
+			return false
+		}
+	}
+	return true
+}
+
+// mayContain returns false if the key of the hash is not in the file.
+func (f diskBloomFilter) mayContain(h uint64) bool {
+	return f.locate(h, func(word int, mask uint64) bool {
+		return f.bits[word]&mask != 0
+	})
+}
+
+// diskIndexIterator merges the iterators of the memtable and the files.
+// If a key exists in several sources, the newest one wins, and the tombstones are skipped unless tombstones is set.
+type diskIndexIterator struct {
+	sources    []IndexIterator // the newest first
+	files      []*diskIndexFile
+	reverse    bool
+	tombstones bool
+	less       func(a, b []byte) bool
+	key        []byte
+	pos        *wal.ChunkPosition
+	valid      bool
+	err        error // the error of reading a block, which ends the iterator
+}
+
+// fail ends the iterator with the error.
+func (it *diskIndexIterator) fail(err error) {
+	if it.err == nil {
+		it.err = err
+	}
+}
+
+// findNext moves to the next key which is not deleted.
+func (it *diskIndexIterator) findNext() {
+	for {
+		best := -1
+		for i, source := range it.sources {
+			if !source.Valid() {
+				continue
+			}
+			if best < 0 || it.before(source.Key(), it.sources[best].Key()) {
+				best = i
+			}
+		}
+		if best < 0 || it.err != nil {
+			it.key, it.pos, it.valid = nil, nil, false
+			return
+		}
+
+		key, pos := it.sources[best].Key(), it.sources[best].Value()
+		// skip the same key in the older sources
+		for _, source := range it.sources {
+			if source.Valid() && !it.less(source.Key(), key) && !it.less(key, source.Key()) {
+				source.Next()
+			}
+		}
+		if it.tombstones || !isTombstone(pos) {
+			it.key, it.pos, it.valid = key, pos, true
+			return
+		}
+	}
+}
+
+func (it *diskIndexIterator) before(a, b []byte) bool {
+	if it.reverse {
+		return it.less(b, a)
+	}
+	return it.less(a, b)
+}
+
+// Rewind resets the iterator to its initial position.
+func (it *diskIndexIterator) Rewind() {
+	for _, source := range it.sources {
+		source.Rewind()
+	}
+	it.findNext()
+}
+
+// Seek positions the cursor to the element with the specified key.
+func (it *diskIndexIterator) Seek(key []byte) {
+	for _, source := range it.sources {
+		source.Rewind()
+		source.Seek(key)
+	}
+	it.findNext()
+}
+
+// Next moves the cursor to the next element.
+func (it *diskIndexIterator) Next() {
+	if !it.valid {
+		return
+	}
+	it.findNext()
+}
+
+// Valid checks if the iterator is still valid for reading.
+func (it *diskIndexIterator) Valid() bool {
+	return it.valid
+}
+
+// Key returns the key of the current element.
+func (it *diskIndexIterator) Key() []byte {
+	return it.key
+}
+
+// Value returns the value (chunk position) of the current element.
+func (it *diskIndexIterator) Value() *wal.ChunkPosition {
+	return it.pos
+}
+
+// Close releases the resources associated with the iterator.
+func (it *diskIndexIterator) Close() {
+	for _, source := range it.sources {
+		source.Close()
+	}
+	for _, f := range it.files {
+		f.unref()
+	}
+	it.sources, it.files = nil, nil
+	it.key, it.pos, it.valid = nil, nil, false
+}
+
+// diskBlockCache is an LRU cache of the blocks of the index files.
+type diskBlockCache struct {
+	mu       sync.Mutex
+	capacity int64
+	size     int64
+	ll       *list.List
+	items    map[diskBlockCacheKey]*list.Element
+}
+
+type diskBlockCacheKey struct {
+	fileId uint32
+	block  int
+}
+
+type diskBlockCacheEntry struct {
+	key   diskBlockCacheKey
+	block *compactBlock
+}
+
+func newDiskBlockCache(capacity int64) *diskBlockCache {
+	return &diskBlockCache{
+		capacity: capacity,
+		ll:       list.New(),
+		items:    make(map[diskBlockCacheKey]*list.Element),
+	}
+}
+
+func (c *diskBlockCache) get(fileId uint32, block int) *compactBlock {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	elem, ok := c.items[diskBlockCacheKey{fileId, block}]
+	if !ok {
+		return nil
+	}
+	c.ll.MoveToFront(elem)
+	return elem.Value.(*diskBlockCacheEntry).block
+}
+
+func (c *diskBlockCache) put(fileId uint32, block int, b *compactBlock) {
+	if c.capacity <= 0 {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	key := diskBlockCacheKey{fileId, block}
+	if _, ok := c.items[key]; ok {
+		return
+	}
+	c.items[key] = c.ll.PushFront(&diskBlockCacheEntry{key: key, block: b})
+	c.size += b.memSize()
+	for c.size > c.capacity {
+		oldest := c.ll.Back()
+		entry := oldest.Value.(*diskBlockCacheEntry)
+		c.ll.Remove(oldest)
+		delete(c.items, entry.key)
+		c.size -= entry.block.memSize()
+	}
+}
+
+func (c *diskBlockCache) memSize() int64 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.size
+}
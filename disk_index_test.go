@@ -0,0 +1,227 @@
+package memdb
+
+import (
+	"fmt"
+	"hash/maphash"
+	"math"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/hupeh/memdb/utils"
+	"github.com/rosedblabs/wal"
+	"github.com/stretchr/testify/assert"
+)
+
+func newTestDiskIndex(t *testing.T) *DiskIndex {
+	options := DefaultOptions
+	options.DirPath = t.TempDir()
+	options.DiskIndexMemtableSize = 100
+	options.DiskIndexCacheSize = 16 * KB
+	index, err := newDiskIndex(diskIndexDir(options.DirPath, defaultNamespaceId), options)
+	assert.Nil(t, err)
+	return index
+}
+
+func TestDiskIndex_Flush_Merge(t *testing.T) {
+	index := newTestDiskIndex(t)
+	defer index.Close()
+	key := func(i int) []byte { return []byte(fmt.Sprintf("event:%08d", i)) }
+
+	for i := 0; i < 10000; i++ {
+		assert.Nil(t, index.Put(key(i), &wal.ChunkPosition{SegmentId: 1, ChunkOffset: int64(i), ChunkSize: 10}))
+		assert.True(t, index.memtable.Size() < 100)
+	}
+	// the merges run in the background
+	index.compactWg.Wait()
+	tiers := make(map[int]int)
+	flushes := 0
+	for i, f := range index.files {
+		if i > 0 {
+			assert.True(t, index.files[i-1].tier <= f.tier)
+		}
+		tiers[f.tier]++
+		flushes += int(math.Pow(diskIndexTierFiles, float64(f.tier)))
+	}
+	for _, n := range tiers {
+		assert.True(t, n < diskIndexTierFiles)
+	}
+	assert.True(t, len(tiers) > 1)
+	// a merge writes one file from diskIndexTierFiles files, the other files are flushed
+	merges := (int(index.nextFileId) - len(index.files)) / diskIndexTierFiles
+	assert.Equal(t, int(index.nextFileId)-merges, flushes)
+	entries, err := os.ReadDir(index.dirPath)
+	assert.Nil(t, err)
+	assert.Equal(t, len(index.files), len(entries))
+
+	// overwrite and delete the keys in the files
+	for i := 0; i < 10000; i += 2 {
+		oldPos := index.Put(key(i), &wal.ChunkPosition{SegmentId: 2, ChunkOffset: int64(i), ChunkSize: 10})
+		assert.Equal(t, int64(i), oldPos.ChunkOffset)
+	}
+	for i := 1; i < 10000; i += 4 {
+		oldPos, ok := index.Delete(key(i))
+		assert.True(t, ok)
+		assert.Equal(t, wal.SegmentID(1), oldPos.SegmentId)
+	}
+	assert.Equal(t, 7500, index.Size())
+	for i := 0; i < 10000; i++ {
+		pos := index.Get(key(i))
+		switch {
+		case i%2 == 0:
+			assert.Equal(t, wal.SegmentID(2), pos.SegmentId)
+		case i%4 == 1:
+			assert.Nil(t, pos)
+		default:
+			assert.Equal(t, wal.SegmentID(1), pos.SegmentId)
+		}
+	}
+
+	// only the summary, the memtable and the cache are in memory
+	assert.True(t, index.cache.memSize() <= 16*KB)
+	assert.True(t, index.MemSize() < 10000*int64(len(key(0))), index.MemSize())
+}
+
+func TestDiskIndex_Missing_Keys(t *testing.T) {
+	index := newTestDiskIndex(t)
+	defer index.Close()
+	key := func(i int) []byte { return []byte(fmt.Sprintf("event:%08d", i)) }
+
+	// every file holds the keys of the whole range
+	for i := 0; i < 5000; i++ {
+		j := i * 7919 % 5000 * 2
+		assert.Nil(t, index.Put(key(j), &wal.ChunkPosition{SegmentId: 1, ChunkOffset: int64(j), ChunkSize: 10}))
+	}
+	index.compactWg.Wait()
+	assert.True(t, len(index.files) > 1)
+
+	passed, missing := 0, 0
+	for _, f := range index.files {
+		for i := 1; i < 10000; i += 2 {
+			if f.filter.mayContain(maphash.Bytes(index.seed, key(i))) {
+				passed++
+			}
+			missing++
+		}
+	}
+	assert.True(t, passed < missing/20)
+
+	// the keys out of the range of the files do not read any block
+	index.cache = newDiskBlockCache(16 * KB)
+	assert.Nil(t, index.Get([]byte("event:99999999")))
+	assert.Nil(t, index.Get([]byte("a")))
+	assert.Equal(t, int64(0), index.cache.memSize())
+
+	for i := 0; i < 10000; i++ {
+		pos := index.Get(key(i))
+		if i%2 == 0 {
+			assert.Equal(t, int64(i), pos.ChunkOffset)
+		} else {
+			assert.Nil(t, pos)
+		}
+	}
+	assert.Equal(t, 5000, index.Size())
+}
+
+func TestDiskIndex_Iterator_Keeps_Files(t *testing.T) {
+	index := newTestDiskIndex(t)
+	defer index.Close()
+
+	for i := 0; i < 1000; i++ {
+		index.Put(utils.GetTestKey(i), &wal.ChunkPosition{ChunkOffset: int64(i), ChunkSize: 10})
+	}
+	iter := index.Iterator(false)
+	paths := make([]string, 0, len(index.files))
+	for _, f := range index.files {
+		paths = append(paths, f.path)
+	}
+
+	// the files are merged while the iterator is reading them
+	for i := 1000; i < 2000; i++ {
+		index.Put(utils.GetTestKey(i), &wal.ChunkPosition{ChunkOffset: int64(i), ChunkSize: 10})
+	}
+	for _, path := range paths {
+		_, err := os.Stat(path)
+		assert.Nil(t, err)
+	}
+	count := 0
+	for ; iter.Valid(); iter.Next() {
+		count++
+	}
+	assert.Equal(t, 1000, count)
+
+	index.compactWg.Wait()
+	iter.Close()
+	for _, path := range paths {
+		_, err := os.Stat(path)
+		assert.True(t, os.IsNotExist(err))
+	}
+}
+
+func TestDiskIndex_Failed(t *testing.T) {
+	index := newTestDiskIndex(t)
+	defer index.Close()
+
+	for i := 0; i < 100; i++ {
+		index.Put(utils.GetTestKey(i), &wal.ChunkPosition{ChunkOffset: int64(i), ChunkSize: 10})
+	}
+	assert.Equal(t, 1, len(index.files))
+	assert.Nil(t, index.Err())
+
+	// the index file can not be written, the keys are kept in the memtable
+	assert.Nil(t, os.RemoveAll(index.dirPath))
+	for i := 100; i < 200; i++ {
+		index.Put(utils.GetTestKey(i), &wal.ChunkPosition{ChunkOffset: int64(i), ChunkSize: 10})
+	}
+	assert.NotNil(t, index.Err())
+	assert.Equal(t, 1, len(index.files))
+	assert.Equal(t, 100, index.memtable.Size())
+	assert.Equal(t, int64(150), index.Get(utils.GetTestKey(150)).ChunkOffset)
+
+	// the block can not be read
+	index = newTestDiskIndex(t)
+	defer index.Close()
+	for i := 0; i < 100; i++ {
+		index.Put(utils.GetTestKey(i), &wal.ChunkPosition{ChunkOffset: int64(i), ChunkSize: 10})
+	}
+	assert.Nil(t, index.files[0].file.Close())
+	assert.Nil(t, index.Get(utils.GetTestKey(50)))
+	assert.NotNil(t, index.Err())
+}
+
+func TestDB_IndexDisk(t *testing.T) {
+	options := DefaultOptions
+	options.IndexType = IndexDisk
+	options.DiskIndexMemtableSize = 10000
+	options.DiskIndexCacheSize = 256 * KB
+	db, err := Open(options)
+	assert.Nil(t, err)
+	defer destroyDB(db)
+
+	generateData(t, db, 0, 100000, 16)
+	for i := 0; i < 100000; i += 10 {
+		assert.Nil(t, db.Delete(utils.GetTestKey(i)))
+	}
+	check := func() {
+		assert.Equal(t, 90000, db.Stat().KeysNum)
+		for i := 0; i < 100000; i++ {
+			_, err := db.Get(utils.GetTestKey(i))
+			if i%10 == 0 {
+				assert.Equal(t, ErrKeyNotFound, err)
+			} else {
+				assert.Nil(t, err)
+			}
+		}
+	}
+	check()
+	assert.Nil(t, db.Merge(true))
+	check()
+
+	// the index files are rebuilt when the database is opened
+	assert.Nil(t, db.Close())
+	_, err = os.Stat(filepath.Join(options.DirPath, diskIndexDirName))
+	assert.True(t, os.IsNotExist(err))
+	db, err = Open(options)
+	assert.Nil(t, err)
+	check()
+}
@@ -3,13 +3,23 @@ package memdb
 import "errors"
 
 var (
-	ErrKeyIsEmpty      = errors.New("the key is empty")
-	ErrKeyNotFound     = errors.New("key not found in database")
-	ErrDatabaseIsUsing = errors.New("the database directory is used by another process")
-	ErrReadOnlyBatch   = errors.New("the batch is read only")
-	ErrBatchCommitted  = errors.New("the batch is committed")
-	ErrBatchRollbacked = errors.New("the batch is rollbacked")
-	ErrDBClosed        = errors.New("the database is closed")
-	ErrMergeRunning    = errors.New("the merge operation is running")
-	ErrWatchDisabled   = errors.New("the watch is disabled")
+	ErrKeyIsEmpty         = errors.New("the key is empty")
+	ErrKeyNotFound        = errors.New("key not found in database")
+	ErrDatabaseIsUsing    = errors.New("the database directory is used by another process")
+	ErrReadOnlyBatch      = errors.New("the batch is read only")
+	ErrBatchCommitted     = errors.New("the batch is committed")
+	ErrBatchRollbacked    = errors.New("the batch is rollbacked")
+	ErrDBClosed           = errors.New("the database is closed")
+	ErrMergeRunning       = errors.New("the merge operation is running")
+	ErrWatchDisabled      = errors.New("the watch is disabled")
+	ErrMergeNoFreeSegment = errors.New("no free segment id for the merged data")
+	ErrManifestCorrupted  = errors.New("the manifest file is corrupted")
+	ErrValueNotNumber     = errors.New("the value is not a number")
+	ErrValueOverflow      = errors.New("the number overflows")
+	ErrNoMergeOperator    = errors.New("the merge operator is not set")
+	ErrNamespaceNameEmpty = errors.New("the namespace name is empty")
+	ErrNamespaceNotFound  = errors.New("namespace not found in database")
+	ErrNamespaceDropped   = errors.New("the namespace is dropped")
+	ErrComparatorMismatch = errors.New("the comparator does not match the one of the database")
+	ErrMergeInstallFailed = errors.New("the merge files failed to install, the database is closed")
 )
@@ -51,4 +51,23 @@ func main() {
 		log.Println(err)
 	}
 	println(ttl.String())
+
+	// the expiry time can also be an absolute time,
+	// and it is only changed if the condition is matched.
+	ok, err := db.ExpireAtIf([]byte("name2"), time.Now().Add(time.Minute), memdb.ExpireIfGreater)
+	if err != nil {
+		panic(err)
+	}
+	println(ok)
+	expireTime, err := db.ExpireTime([]byte("name2"))
+	if err != nil {
+		log.Println(err)
+	}
+	println(expireTime.String())
+
+	// the ttl of the key is reset every time it is read by GetAndTouch.
+	_, err = db.GetAndTouch([]byte("name"), time.Second*5)
+	if err != nil {
+		log.Println(err)
+	}
 }
@@ -0,0 +1,269 @@
+package memdb
+
+import (
+	"container/heap"
+	"sync"
+	"time"
+
+	"github.com/valyala/bytebufferpool"
+)
+
+const (
+	// expiryEntryOverhead is the estimated memory of every key in the expiry table besides the key itself,
+	// including the entry of the expiry heap.
+	expiryEntryOverhead = 80
+	// expiryReapBatchSize is the number of the expired keys deleted while holding the lock once.
+	expiryReapBatchSize = 100
+	// expiryHeapMinCompact is the minimum number of the stale entries before the heap is rebuilt.
+	expiryHeapMinCompact = 1024
+)
+
+// expiryTable keeps the expiry time of the keys in the index,
+// so the ttl checks of the keys do not read the records from the data files.
+//
+// Only the keys with a ttl are stored, it is updated together with the index
+// by putIndex and deleteIndex.
+//
+// The keys are also ordered by the expiry time in a min heap, so the expired keys
+// are found in O(log n) time for each of them, without scanning all the keys.
+// The heap entries are not removed when the ttl of a key is changed or removed,
+// they are skipped when popped if the time does not match the table,
+// and the heap is rebuilt from the table when the stale entries are more than the live ones.
+type expiryTable struct {
+	mu       sync.RWMutex
+	m        map[string]int64
+	heap     expiryHeap
+	keyBytes int64 // total length of the keys
+}
+
+type expiryEntry struct {
+	expire int64
+	key    string
+}
+
+// expiryHeap is a min heap of the expiry entries ordered by the expiry time.
+type expiryHeap []expiryEntry
+
+func (h expiryHeap) Len() int           { return len(h) }
+func (h expiryHeap) Less(i, j int) bool { return h[i].expire < h[j].expire }
+func (h expiryHeap) Swap(i, j int)      { h[i], h[j] = h[j], h[i] }
+func (h *expiryHeap) Push(x any)        { *h = append(*h, x.(expiryEntry)) }
+func (h *expiryHeap) Pop() any {
+	old := *h
+	entry := old[len(old)-1]
+	*h = old[:len(old)-1]
+	return entry
+}
+
+func newExpiryTable() *expiryTable {
+	return &expiryTable{m: make(map[string]int64)}
+}
+
+// set the expiry time of the key, 0 means the key has no ttl.
+func (t *expiryTable) set(key []byte, expire int64) {
+	if expire == 0 {
+		t.remove(key)
+		return
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	old, ok := t.m[string(key)]
+	if !ok {
+		t.keyBytes += int64(len(key))
+	}
+	if old == expire {
+		return
+	}
+	t.m[string(key)] = expire
+	heap.Push(&t.heap, expiryEntry{expire: expire, key: string(key)})
+	t.maybeCompact()
+}
+
+// get the expiry time of the key, 0 means the key has no ttl.
+func (t *expiryTable) get(key []byte) int64 {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	return t.m[string(key)]
+}
+
+// remove the expiry time of the key.
+func (t *expiryTable) remove(key []byte) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if _, ok := t.m[string(key)]; ok {
+		delete(t.m, string(key))
+		t.keyBytes -= int64(len(key))
+		t.maybeCompact()
+	}
+}
+
+// maybeCompact rebuilds the heap from the table if most of the heap entries are stale.
+func (t *expiryTable) maybeCompact() {
+	if len(t.heap) < 2*len(t.m)+expiryHeapMinCompact {
+		return
+	}
+	t.heap = make(expiryHeap, 0, len(t.m))
+	for key, expire := range t.m {
+		t.heap = append(t.heap, expiryEntry{expire: expire, key: key})
+	}
+	heap.Init(&t.heap)
+}
+
+// isExpired checks whether the key is expired at now.
+func (t *expiryTable) isExpired(key []byte, now int64) bool {
+	expire := t.get(key)
+	return expire > 0 && expire <= now
+}
+
+// popExpired removes at most limit keys expired at now from the heap and returns them,
+// all of them if limit is not greater than 0. The keys are left in the table,
+// they are removed when the keys are deleted from the index.
+func (t *expiryTable) popExpired(now int64, limit int) [][]byte {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	var keys [][]byte
+	for len(t.heap) > 0 && t.heap[0].expire <= now {
+		entry := heap.Pop(&t.heap).(expiryEntry)
+		if t.m[entry.key] != entry.expire {
+			// the ttl of the key is changed or removed
+			continue
+		}
+		keys = append(keys, []byte(entry.key))
+		if limit > 0 && len(keys) >= limit {
+			break
+		}
+	}
+	return keys
+}
+
+// pushBack puts the keys returned by popExpired back into the heap,
+// the keys whose ttl has been removed since are skipped.
+func (t *expiryTable) pushBack(keys [][]byte) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	for _, key := range keys {
+		if expire, ok := t.m[string(key)]; ok {
+			heap.Push(&t.heap, expiryEntry{expire: expire, key: string(key)})
+		}
+	}
+}
+
+// clone returns a copy of the table.
+func (t *expiryTable) clone() *expiryTable {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	c := &expiryTable{m: make(map[string]int64, len(t.m)), keyBytes: t.keyBytes}
+	for key, expire := range t.m {
+		c.m[key] = expire
+	}
+	return c
+}
+
+// memSize returns the estimated memory used by the table in bytes.
+func (t *expiryTable) memSize() int64 {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	return t.keyBytes + int64(len(t.m))*expiryEntryOverhead
+}
+
+// deleteExpiredKeys deletes the keys expired at now from the index in small groups,
+// until no expired key is left, or the deadline is passed if it is not zero.
+// It returns the number of the deleted keys.
+func (db *DB) deleteExpiredKeys(now int64, deadline time.Time) (int, error) {
+	var deleted int
+	for {
+		if !deadline.IsZero() && time.Now().After(deadline) {
+			return deleted, nil
+		}
+		db.mu.Lock()
+		if db.closed {
+			db.mu.Unlock()
+			return deleted, ErrDBClosed
+		}
+		// the keys of every namespace are deleted in turn
+		var popped int
+		var err error
+		for _, ks := range db.keyspaces {
+			keys := ks.expires.popExpired(now, expiryReapBatchSize)
+			if err = db.expireKeys(ks, keys, now); err != nil {
+				// the keys are still in the index, they are expired by the next call.
+				ks.expires.pushBack(keys)
+				break
+			}
+			deleted += len(keys)
+			popped = max(popped, len(keys))
+		}
+		db.mu.Unlock()
+		if err != nil {
+			return deleted, err
+		}
+		if popped < expiryReapBatchSize {
+			return deleted, nil
+		}
+	}
+}
+
+// expireKeys deletes the keys expired at now from the index of the keyspace,
+// an expired record is written for every key, so the expiration is replayed
+// when the database is opened, and it is visible to the readers of the data files.
+// The keys not expired any more are skipped. The caller must hold db.mu.
+func (db *DB) expireKeys(ks *keyspace, keys [][]byte, now int64) error {
+	var records []*LogRecord
+	var buffers []*bytebufferpool.ByteBuffer
+	defer func() {
+		for _, buf := range buffers {
+			bytebufferpool.Put(buf)
+		}
+	}()
+	for _, key := range keys {
+		expire := ks.expires.get(key)
+		if expire == 0 || expire > now {
+			continue
+		}
+		record := &LogRecord{Key: key, Type: LogRecordExpired, Expire: expire, Namespace: ks.id}
+		buf := bytebufferpool.Get()
+		buffers = append(buffers, buf)
+		db.dataFiles.PendingWrites(encodeLogRecord(record, db.encodeHeader, buf))
+		records = append(records, record)
+	}
+	if len(records) == 0 {
+		return nil
+	}
+
+	positions, err := db.dataFiles.WriteAll()
+	if err != nil {
+		db.dataFiles.ClearPendingWrites()
+		return err
+	}
+	db.lastPosition = positions[len(positions)-1]
+	for i, record := range records {
+		// the expired record is garbage as soon as it is written
+		db.segmentStats.written(positions[i])
+		db.deleteIndex(ks, record.Key)
+		if db.options.WatchQueueSize > 0 {
+			db.watcher.putEvent(&Event{Action: WatchActionExpire, Key: record.Key, Namespace: ks.name})
+		}
+	}
+	return nil
+}
+
+// reapExpiredKeys deletes the expired keys every Options.ActiveExpireInterval
+// until the database is closed, spending at most Options.ActiveExpireBudget every time.
+func (db *DB) reapExpiredKeys() {
+	ticker := time.NewTicker(db.options.ActiveExpireInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-db.closeCh:
+			return
+		case <-ticker.C:
+			var deadline time.Time
+			if db.options.ActiveExpireBudget > 0 {
+				deadline = time.Now().Add(db.options.ActiveExpireBudget)
+			}
+			// a background task can't return its error,
+			// the only error is that the database is closed.
+			_, _ = db.deleteExpiredKeys(db.now().UnixNano(), deadline)
+		}
+	}
+}
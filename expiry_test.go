@@ -0,0 +1,308 @@
+package memdb
+
+import (
+	"math"
+	"testing"
+	"time"
+
+	"github.com/hupeh/memdb/utils"
+	"github.com/rosedblabs/wal"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestExpiryTable(t *testing.T) {
+	table := newExpiryTable()
+	table.set([]byte("a"), 100)
+	table.set([]byte("b"), 200)
+	table.set([]byte("c"), 0)
+	assert.Equal(t, int64(100), table.get([]byte("a")))
+	assert.Equal(t, int64(0), table.get([]byte("c")))
+	assert.True(t, table.isExpired([]byte("a"), 100))
+	assert.False(t, table.isExpired([]byte("b"), 100))
+	assert.False(t, table.isExpired([]byte("c"), 100))
+
+	// a key without ttl is removed from the table
+	table.set([]byte("a"), 0)
+	assert.Equal(t, int64(0), table.get([]byte("a")))
+	table.remove([]byte("b"))
+	assert.Equal(t, int64(0), table.memSize())
+	// the stale heap entries are skipped
+	assert.Len(t, table.popExpired(300, 0), 0)
+}
+
+func TestExpiryTable_PopExpired(t *testing.T) {
+	table := newExpiryTable()
+	for i := 0; i < 100; i++ {
+		table.set(utils.GetTestKey(i), int64(100-i))
+	}
+	// the ttl of a key is changed, the old heap entry is stale
+	table.set(utils.GetTestKey(99), 1000)
+
+	keys := table.popExpired(10, 0)
+	assert.Len(t, keys, 9)
+	// the keys are popped in the order of the expiry time
+	for i, key := range keys {
+		assert.Equal(t, utils.GetTestKey(98-i), key)
+	}
+	assert.Len(t, table.popExpired(50, 5), 5)
+	assert.Len(t, table.popExpired(100, 0), 85)
+	assert.Len(t, table.popExpired(999, 0), 0)
+	assert.Equal(t, [][]byte{utils.GetTestKey(99)}, table.popExpired(1000, 0))
+}
+
+func TestExpiryTable_Compact(t *testing.T) {
+	table := newExpiryTable()
+	for i := 0; i < 10*expiryHeapMinCompact; i++ {
+		table.set([]byte("key"), int64(i+1))
+	}
+	assert.True(t, len(table.heap) <= expiryHeapMinCompact+2)
+	assert.Equal(t, [][]byte{[]byte("key")}, table.popExpired(math.MaxInt64, 0))
+}
+
+func TestDecodeHintRecord_Legacy(t *testing.T) {
+	pos := &wal.ChunkPosition{SegmentId: 3, BlockNumber: 2, ChunkOffset: 100, ChunkSize: 50}
+	key, position, expire, namespace := decodeHintRecord(encodeHintRecord(7, []byte("key"), pos, 12345), manifestVersion)
+	assert.Equal(t, []byte("key"), key)
+	assert.Equal(t, pos, position)
+	assert.Equal(t, int64(12345), expire)
+	assert.Equal(t, uint32(7), namespace)
+
+	// the hint records written before the namespace was added
+	buf := []byte{3, 2, 100, 50, 2}
+	buf = append(buf, "key"...)
+	key, position, expire, namespace = decodeHintRecord(buf, hintExpireVersion)
+	assert.Equal(t, []byte("key"), key)
+	assert.Equal(t, pos, position)
+	assert.Equal(t, int64(1), expire)
+	assert.Equal(t, uint32(0), namespace)
+
+	// the hint records written before the expiry time was added
+	buf = []byte{3, 2, 100, 50}
+	buf = append(buf, "key"...)
+	key, position, expire, _ = decodeHintRecord(buf, legacyManifestVersion)
+	assert.Equal(t, []byte("key"), key)
+	assert.Equal(t, pos, position)
+	assert.Equal(t, int64(0), expire)
+}
+
+func putTestTTLData(t *testing.T, db *DB) {
+	for i := 0; i < 300; i++ {
+		var err error
+		switch i % 3 {
+		case 0:
+			err = db.Put(utils.GetTestKey(i), utils.RandomValue(128))
+		case 1:
+			err = db.PutWithTTL(utils.GetTestKey(i), utils.RandomValue(128), time.Hour)
+		default:
+			err = db.PutWithTTL(utils.GetTestKey(i), utils.RandomValue(128), time.Millisecond*200)
+		}
+		assert.Nil(t, err)
+	}
+}
+
+func assertTestTTLData(t *testing.T, db *DB) {
+	for i := 0; i < 300; i++ {
+		ttl, err := db.TTL(utils.GetTestKey(i))
+		switch i % 3 {
+		case 0:
+			assert.Nil(t, err)
+			assert.Equal(t, time.Duration(-1), ttl)
+		case 1:
+			assert.Nil(t, err)
+			assert.True(t, ttl > time.Minute*59)
+		default:
+			assert.Equal(t, ErrKeyNotFound, err)
+		}
+	}
+	var keys int
+	assert.Nil(t, db.AscendKeys(nil, true, func(k []byte) (bool, error) {
+		keys++
+		return true, nil
+	}))
+	assert.Equal(t, 200, keys)
+}
+
+func TestDB_Expiry_Hint(t *testing.T) {
+	options := DefaultOptions
+	options.IndexCheckpoint = false
+	db, err := Open(options)
+	assert.Nil(t, err)
+	defer destroyDB(db)
+
+	putTestTTLData(t, db)
+	assert.Nil(t, db.Merge(true))
+	assert.Nil(t, db.Close())
+
+	// the expiry time is loaded from the hint file
+	db, err = Open(options)
+	assert.Nil(t, err)
+	time.Sleep(time.Millisecond * 300)
+	assertTestTTLData(t, db)
+	assert.Nil(t, db.Close())
+}
+
+func TestDB_Expiry_Checkpoint(t *testing.T) {
+	options := DefaultOptions
+	options.IndexCheckpoint = true
+	db, err := Open(options)
+	assert.Nil(t, err)
+	defer destroyDB(db)
+
+	putTestTTLData(t, db)
+	assert.Nil(t, db.Close())
+
+	// the expiry time is loaded from the checkpoint
+	db, err = Open(options)
+	assert.Nil(t, err)
+	assert.NotNil(t, db.checkpointState.position)
+	time.Sleep(time.Millisecond * 300)
+	assertTestTTLData(t, db)
+	assert.Nil(t, db.Close())
+}
+
+func TestDB_DeleteExpiredKeys_Index(t *testing.T) {
+	options := DefaultOptions
+	options.ActiveExpireInterval = 0
+	db, err := Open(options)
+	assert.Nil(t, err)
+	defer destroyDB(db)
+
+	putTestTTLData(t, db)
+	time.Sleep(time.Millisecond * 300)
+	assert.Nil(t, db.DeleteExpiredKeys(time.Second))
+	assert.Equal(t, 200, db.Stat().KeysNum)
+	// only the keys not expired are left
+	assert.Len(t, db.expires.m, 100)
+}
+
+func TestDB_DeleteExpiredKeys_Write_Failed(t *testing.T) {
+	options := DefaultOptions
+	options.ActiveExpireInterval = 0
+	db, err := Open(options)
+	assert.Nil(t, err)
+	defer destroyDB(db)
+
+	putTestTTLData(t, db)
+	time.Sleep(time.Millisecond * 300)
+	assert.Nil(t, db.dataFiles.Close())
+	assert.NotNil(t, db.DeleteExpiredKeys(time.Second))
+	assert.Equal(t, 300, db.Stat().KeysNum)
+
+	// the keys failed to expire are expired by the next call
+	db.dataFiles, err = db.openWalFiles()
+	assert.Nil(t, err)
+	assert.Nil(t, db.DeleteExpiredKeys(time.Second))
+	assert.Equal(t, 200, db.Stat().KeysNum)
+	assert.Len(t, db.expires.m, 100)
+}
+
+func TestDB_ActiveExpire(t *testing.T) {
+	options := DefaultOptions
+	options.ActiveExpireInterval = time.Millisecond * 20
+	db, err := Open(options)
+	assert.Nil(t, err)
+	defer destroyDB(db)
+
+	putTestTTLData(t, db)
+	assert.Equal(t, 300, db.Stat().KeysNum)
+	// the expired keys are deleted in background without being read
+	assert.Eventually(t, func() bool {
+		return db.Stat().KeysNum == 200
+	}, time.Second*2, time.Millisecond*20)
+	assert.Len(t, db.expires.m, 100)
+}
+
+func TestDB_ActiveExpire_Disabled(t *testing.T) {
+	options := DefaultOptions
+	options.ActiveExpireInterval = 0
+	db, err := Open(options)
+	assert.Nil(t, err)
+	defer destroyDB(db)
+
+	putTestTTLData(t, db)
+	time.Sleep(time.Millisecond * 300)
+	assert.Equal(t, 300, db.Stat().KeysNum)
+}
+
+func TestDB_DeleteExpiredKeys_Record(t *testing.T) {
+	options := DefaultOptions
+	options.IndexCheckpoint = false
+	options.ActiveExpireInterval = 0
+	db, err := Open(options)
+	assert.Nil(t, err)
+	defer destroyDB(db)
+
+	putTestTTLData(t, db)
+	time.Sleep(time.Millisecond * 300)
+	deadSize := db.Stat().DeadSize
+	assert.Nil(t, db.DeleteExpiredKeys(time.Second))
+	// the expired records and the records written for the expirations are garbage
+	assert.True(t, db.Stat().DeadSize > deadSize)
+
+	var expired int
+	reader := db.dataFiles.NewReader()
+	for {
+		chunk, _, err := reader.Next()
+		if err != nil {
+			break
+		}
+		record := decodeLogRecord(chunk)
+		if record.Type == LogRecordExpired {
+			expired++
+			assert.True(t, record.Expire > 0)
+		}
+	}
+	assert.Equal(t, 100, expired)
+	stat := db.Stat()
+	assert.Nil(t, db.Close())
+
+	// the expirations are replayed
+	db, err = Open(options)
+	assert.Nil(t, err)
+	assertTestTTLData(t, db)
+	assert.Equal(t, stat.LiveSize, db.Stat().LiveSize)
+	assert.Equal(t, stat.DeadSize, db.Stat().DeadSize)
+	assert.Nil(t, db.Close())
+}
+
+func TestDB_Expire_Replay_Rewritten(t *testing.T) {
+	options := DefaultOptions
+	options.IndexCheckpoint = false
+	options.ActiveExpireInterval = 0
+	db, err := Open(options)
+	assert.Nil(t, err)
+	defer destroyDB(db)
+
+	key := utils.GetTestKey(1)
+	assert.Nil(t, db.PutWithTTL(key, utils.RandomValue(128), time.Millisecond*100))
+	time.Sleep(time.Millisecond * 200)
+	assert.Nil(t, db.DeleteExpiredKeys(time.Second))
+	// the key is written again after the expiration
+	assert.Nil(t, db.PutWithTTL(key, utils.RandomValue(128), time.Hour))
+	assert.Nil(t, db.Close())
+
+	db, err = Open(options)
+	assert.Nil(t, err)
+	ttl, err := db.TTL(key)
+	assert.Nil(t, err)
+	assert.True(t, ttl > time.Minute*59)
+	assert.Nil(t, db.Close())
+}
+
+func TestDB_Get_Expired_Not_Deleted(t *testing.T) {
+	options := DefaultOptions
+	options.ActiveExpireInterval = 0
+	db, err := Open(options)
+	assert.Nil(t, err)
+	defer destroyDB(db)
+
+	key := utils.GetTestKey(1)
+	assert.Nil(t, db.PutWithTTL(key, utils.RandomValue(128), time.Millisecond*100))
+	time.Sleep(time.Millisecond * 200)
+	_, err = db.Get(key)
+	assert.Equal(t, ErrKeyNotFound, err)
+	// the read only hides the key, it is deleted with an expired record
+	assert.Equal(t, 1, db.Stat().KeysNum)
+	assert.Nil(t, db.DeleteExpiredKeys(time.Second))
+	assert.Equal(t, 0, db.Stat().KeysNum)
+}
@@ -0,0 +1,231 @@
+package memdb
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/rosedblabs/wal"
+)
+
+// segmentStat records how many bytes of a segment file are
+// still referenced by the index (live), and how many are not (dead).
+type segmentStat struct {
+	live int64
+	dead int64
+}
+
+// segmentStats tracks the live and dead bytes of every segment file.
+//
+// Every chunk written to the WAL is dead until it is put into the index,
+// and it becomes dead again when the key is overwritten, deleted or expired.
+// So the tombstones, the batch finished records, and the records of
+// uncommitted batches are all counted as dead bytes, which a merge can reclaim.
+type segmentStats struct {
+	mu        sync.Mutex
+	segments  map[wal.SegmentID]*segmentStat
+	totalLive int64
+	totalDead int64
+}
+
+func newSegmentStats() *segmentStats {
+	return &segmentStats{segments: make(map[wal.SegmentID]*segmentStat)}
+}
+
+func (s *segmentStats) segment(id wal.SegmentID) *segmentStat {
+	stat, ok := s.segments[id]
+	if !ok {
+		stat = &segmentStat{}
+		s.segments[id] = stat
+	}
+	return stat
+}
+
+// written adds a chunk written to the WAL as dead bytes.
+func (s *segmentStats) written(position *wal.ChunkPosition) {
+	s.mu.Lock()
+	s.segment(position.SegmentId).dead += int64(position.ChunkSize)
+	s.totalDead += int64(position.ChunkSize)
+	s.mu.Unlock()
+}
+
+// indexed marks a chunk as live because the index points to it.
+func (s *segmentStats) indexed(position *wal.ChunkPosition) {
+	size := int64(position.ChunkSize)
+	s.mu.Lock()
+	stat := s.segment(position.SegmentId)
+	stat.live += size
+	stat.dead -= size
+	s.totalLive += size
+	s.totalDead -= size
+	s.mu.Unlock()
+}
+
+// released marks a chunk as dead because the index does not point to it anymore.
+func (s *segmentStats) released(position *wal.ChunkPosition) {
+	s.releasedSize(position.SegmentId, int64(position.ChunkSize))
+}
+
+// releasedSize marks the bytes of a segment as dead, like released does for a chunk.
+func (s *segmentStats) releasedSize(id wal.SegmentID, size int64) {
+	s.mu.Lock()
+	stat := s.segment(id)
+	stat.live -= size
+	stat.dead += size
+	s.totalLive -= size
+	s.totalDead += size
+	s.mu.Unlock()
+}
+
+// sized counts the bytes of a segment file which are not tracked yet as dead,
+// size is the size of the file.
+func (s *segmentStats) sized(id wal.SegmentID, size int64) {
+	s.mu.Lock()
+	stat := s.segment(id)
+	if untracked := size - stat.live - stat.dead; untracked > 0 {
+		stat.dead += untracked
+		s.totalDead += untracked
+	}
+	s.mu.Unlock()
+}
+
+// remove forgets the segments that the filter returns true for,
+// it is used when the segment files are replaced by a merge.
+func (s *segmentStats) remove(filter func(id wal.SegmentID) bool) {
+	s.mu.Lock()
+	for id, stat := range s.segments {
+		if filter(id) {
+			s.totalLive -= stat.live
+			s.totalDead -= stat.dead
+			delete(s.segments, id)
+		}
+	}
+	s.mu.Unlock()
+}
+
+// snapshot returns a copy of the stats of all the segments.
+func (s *segmentStats) snapshot() map[wal.SegmentID]segmentStat {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	stats := make(map[wal.SegmentID]segmentStat, len(s.segments))
+	for id, stat := range s.segments {
+		stats[id] = *stat
+	}
+	return stats
+}
+
+// restore replaces the stats of all the segments with the snapshot.
+func (s *segmentStats) restore(stats map[wal.SegmentID]segmentStat) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.segments = make(map[wal.SegmentID]*segmentStat, len(stats))
+	s.totalLive, s.totalDead = 0, 0
+	for id, stat := range stats {
+		stat := stat
+		s.segments[id] = &stat
+		s.totalLive += stat.live
+		s.totalDead += stat.dead
+	}
+}
+
+// total returns the live and dead bytes of all the segments.
+func (s *segmentStats) total() (live int64, dead int64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.totalLive, s.totalDead
+}
+
+// putIndex puts the key, the position and the expiry time of its record into the index
+// of the keyspace, the record replaced by it becomes dead.
+func (db *DB) putIndex(ks *keyspace, key []byte, position *wal.ChunkPosition, expire int64) {
+	db.indexed(ks, position)
+	if oldPos := ks.index.Put(key, position); oldPos != nil {
+		db.releaseIndex(ks, key, oldPos)
+	}
+	ks.expires.set(key, expire)
+}
+
+// deleteIndex deletes the key from the index of the keyspace, the record of the key becomes dead.
+func (db *DB) deleteIndex(ks *keyspace, key []byte) {
+	if oldPos, ok := ks.index.Delete(key); ok {
+		db.releaseIndex(ks, key, oldPos)
+		ks.expires.remove(key)
+	}
+}
+
+// releaseIndex marks the old records of the key dead,
+// which are the record at the old position, or all the records of its merge operands.
+func (db *DB) releaseIndex(ks *keyspace, key []byte, oldPos *wal.ChunkPosition) {
+	chain := ks.operands.remove(key)
+	if chain == nil {
+		db.released(ks, oldPos)
+		return
+	}
+	for _, position := range chain {
+		db.released(ks, position)
+	}
+}
+
+// needMerge checks whether the dead bytes pass the thresholds of auto merge.
+func (db *DB) needMerge() bool {
+	if db.options.AutoMergeDeadRatio <= 0 && db.options.AutoMergeReclaimableSize <= 0 {
+		return false
+	}
+	live, dead := db.segmentStats.total()
+	if dead <= 0 {
+		return false
+	}
+	if db.options.AutoMergeReclaimableSize > 0 && dead >= db.options.AutoMergeReclaimableSize {
+		return true
+	}
+	return db.options.AutoMergeDeadRatio > 0 &&
+		float64(dead)/float64(live+dead) >= db.options.AutoMergeDeadRatio
+}
+
+// maybeAutoMerge wakes up the auto merge goroutine if the thresholds are passed.
+func (db *DB) maybeAutoMerge() {
+	if db.autoMergeCh == nil || !db.needMerge() {
+		return
+	}
+	select {
+	case db.autoMergeCh <- struct{}{}:
+	default:
+		// a merge is already pending
+	}
+}
+
+// autoMerge runs the merges triggered by the garbage thresholds in background,
+// two merges are at least Options.AutoMergeMinInterval apart.
+func (db *DB) autoMerge() {
+	var lastMerge time.Time
+	for {
+		select {
+		case <-db.closeCh:
+			return
+		case <-db.autoMergeCh:
+		}
+
+		if wait := db.options.AutoMergeMinInterval - time.Since(lastMerge); wait > 0 {
+			select {
+			case <-db.closeCh:
+				return
+			case <-time.After(wait):
+			}
+		}
+		// the garbage may be reclaimed by another merge while waiting.
+		if !db.needMerge() {
+			continue
+		}
+		lastMerge = time.Now()
+		db.runAutoMerge(MergeTriggerGarbage)
+	}
+}
+
+// runAutoMerge runs a merge started by the database itself,
+// and reports the result to Options.OnAutoMerge.
+func (db *DB) runAutoMerge(trigger MergeTrigger) {
+	result := db.merge(context.Background(), trigger, MergeOptions{ReopenAfterDone: true})
+	if db.options.OnAutoMerge != nil {
+		db.options.OnAutoMerge(result)
+	}
+}
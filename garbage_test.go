@@ -0,0 +1,142 @@
+package memdb
+
+import (
+	"testing"
+	"time"
+
+	"github.com/hupeh/memdb/utils"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDB_Stat_Live_Dead_Size(t *testing.T) {
+	options := DefaultOptions
+	db, err := Open(options)
+	assert.Nil(t, err)
+	defer destroyDB(db)
+
+	generateData(t, db, 0, 10000, 128)
+	stat := db.Stat()
+	assert.True(t, stat.LiveSize > 0)
+	// only the batch finished records are garbage
+	assert.True(t, stat.DeadSize < stat.LiveSize)
+
+	// overwrite and delete half of the keys
+	generateData(t, db, 0, 5000, 128)
+	for i := 5000; i < 10000; i++ {
+		assert.Nil(t, db.Delete(utils.GetTestKey(i)))
+	}
+	stat2 := db.Stat()
+	assert.True(t, stat2.LiveSize < stat.LiveSize)
+	assert.True(t, stat2.DeadSize > stat2.LiveSize)
+
+	// the statistics are rebuilt when the database is opened again
+	assert.Nil(t, db.Close())
+	db2, err := Open(options)
+	assert.Nil(t, err)
+	stat3 := db2.Stat()
+	assert.InDelta(t, stat2.LiveSize, stat3.LiveSize, float64(stat2.LiveSize)/100)
+	assert.InDelta(t, stat2.DeadSize, stat3.DeadSize, float64(stat2.DeadSize)/100)
+
+	// all the garbage is reclaimed by merge
+	assert.Nil(t, db2.Merge(true))
+	stat4 := db2.Stat()
+	assert.Equal(t, int64(0), stat4.DeadSize)
+	assert.True(t, stat4.LiveSize > 0)
+	assert.Nil(t, db2.Close())
+}
+
+func TestDB_Stat_Dead_Size_Selective_Merge(t *testing.T) {
+	options := DefaultOptions
+	options.SegmentSize = MB
+	options.MergeSegmentDeadRatio = 0.5
+	db, err := Open(options)
+	assert.Nil(t, err)
+	defer destroyDB(db)
+
+	// the first segments are all garbage, the following ones are a quarter garbage
+	// and left alone by the merge.
+	generateData(t, db, 0, 40000, 128)
+	for i := 0; i < 20000; i++ {
+		assert.Nil(t, db.Delete(utils.GetTestKey(i)))
+	}
+	for i := 20000; i < 40000; i += 4 {
+		assert.Nil(t, db.Delete(utils.GetTestKey(i)))
+	}
+	assert.Nil(t, db.Merge(true))
+	stats := db.segmentStats.snapshot()
+	mergeFinSegmentId := db.manifest.MergeFinSegmentId
+
+	// the dead bytes of the segments left alone are not forgotten
+	// when the index is loaded from the hint file.
+	assert.Nil(t, db.Close())
+	db2, err := Open(options)
+	assert.Nil(t, err)
+	defer func() {
+		_ = db2.Close()
+	}()
+	stats2 := db2.segmentStats.snapshot()
+	clean := 0
+	for id, stat := range stats {
+		if id > mergeFinSegmentId {
+			continue
+		}
+		stat2 := stats2[id]
+		assert.Equal(t, stat.live, stat2.live)
+		// the block paddings are dead too
+		assert.InDelta(t, stat.dead, stat2.dead, float64(stat.live+stat.dead)/1000)
+		if stat.dead > stat.live/4 {
+			clean++
+		}
+	}
+	assert.True(t, clean > 0)
+}
+
+func TestDB_Auto_Merge_Dead_Ratio(t *testing.T) {
+	results := make(chan MergeResult, 10)
+	options := DefaultOptions
+	options.AutoMergeDeadRatio = 0.5
+	options.AutoMergeMinInterval = 0
+	options.OnAutoMerge = func(result MergeResult) {
+		results <- result
+	}
+	db, err := Open(options)
+	assert.Nil(t, err)
+	defer destroyDB(db)
+
+	generateData(t, db, 0, 1000, 128)
+	select {
+	case <-results:
+		t.Fatal("merge should not be triggered")
+	case <-time.After(time.Millisecond * 200):
+	}
+
+	// overwrite all the keys several times, the dead ratio will pass the threshold
+	for i := 0; i < 3; i++ {
+		generateData(t, db, 0, 1000, 128)
+	}
+	select {
+	case result := <-results:
+		assert.Nil(t, result.Err)
+		assert.Equal(t, MergeTriggerGarbage, result.Trigger)
+	case <-time.After(time.Second * 10):
+		t.Fatal("merge should be triggered")
+	}
+
+	for i := 0; i < 1000; i++ {
+		val, err := db.Get(utils.GetTestKey(i))
+		assert.Nil(t, err)
+		assert.NotNil(t, val)
+	}
+	// the keys overwritten while merging may trigger another merge
+	assert.Eventually(t, func() bool {
+		stat := db.Stat()
+		return float64(stat.DeadSize)/float64(stat.LiveSize+stat.DeadSize) < 0.5
+	}, time.Second*10, time.Millisecond*10)
+}
+
+func TestDB_Auto_Merge_Invalid_Dead_Ratio(t *testing.T) {
+	options := DefaultOptions
+	options.AutoMergeDeadRatio = 1.5
+	_, err := Open(options)
+	assert.NotNil(t, err)
+}
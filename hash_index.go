@@ -0,0 +1,176 @@
+package memdb
+
+import (
+	"hash/maphash"
+	"sort"
+	"sync"
+	"sync/atomic"
+
+	"github.com/rosedblabs/wal"
+)
+
+// hashIndexShards is the number of shards of the hash index,
+// the keys are spread over the shards to reduce the lock contention.
+const hashIndexShards = 256
+
+// HashIndex is a sharded hash implementation of the Indexer interface.
+//
+// It is designed for the workloads which only do point lookups.
+// The keys are not ordered, so the ordered operations sort a snapshot of all the keys,
+// which costs O(n log n) time and O(n) memory for every call.
+type HashIndex struct {
+	seed     maphash.Seed
+	shards   [hashIndexShards]hashIndexShard
+	size     atomic.Int64
+	keyBytes atomic.Int64 // total length of the keys
+	less     func(a, b []byte) bool
+}
+
+type hashIndexShard struct {
+	mu sync.RWMutex
+	m  map[string]*wal.ChunkPosition
+}
+
+func newHashIndex(lessFunc func(a, b []byte) bool) *HashIndex {
+	if lessFunc == nil {
+		lessFunc = bytewiseLess
+	}
+	h := &HashIndex{seed: maphash.MakeSeed(), less: lessFunc}
+	for i := range h.shards {
+		h.shards[i].m = make(map[string]*wal.ChunkPosition)
+	}
+	return h
+}
+
+func (h *HashIndex) shard(key []byte) *hashIndexShard {
+	return &h.shards[maphash.Bytes(h.seed, key)%hashIndexShards]
+}
+
+// Put key and position into the index.
+func (h *HashIndex) Put(key []byte, position *wal.ChunkPosition) *wal.ChunkPosition {
+	s := h.shard(key)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	oldPos, ok := s.m[string(key)]
+	s.m[string(key)] = position
+	if !ok {
+		h.size.Add(1)
+		h.keyBytes.Add(int64(len(key)))
+	}
+	return oldPos
+}
+
+// Get the position of the key in the index.
+func (h *HashIndex) Get(key []byte) *wal.ChunkPosition {
+	s := h.shard(key)
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.m[string(key)]
+}
+
+// Delete the index of the key.
+func (h *HashIndex) Delete(key []byte) (*wal.ChunkPosition, bool) {
+	s := h.shard(key)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	oldPos, ok := s.m[string(key)]
+	if ok {
+		delete(s.m, string(key))
+		h.size.Add(-1)
+		h.keyBytes.Add(-int64(len(key)))
+	}
+	return oldPos, ok
+}
+
+// Size represents the number of keys in the index.
+func (h *HashIndex) Size() int {
+	return int(h.size.Load())
+}
+
+// MemSize returns the estimated memory used by the index in bytes.
+func (h *HashIndex) MemSize() int64 {
+	return h.keyBytes.Load() + h.size.Load()*hashEntryOverhead
+}
+
+// snapshot returns the keys accepted by the filter in ascending order.
+// The shards are locked one by one, so the snapshot is not atomic across the shards.
+func (h *HashIndex) snapshot(filter func(key []byte) bool) []indexItem {
+	items := make([]indexItem, 0, h.Size())
+	for i := range h.shards {
+		s := &h.shards[i]
+		s.mu.RLock()
+		for key, pos := range s.m {
+			k := []byte(key)
+			if filter == nil || filter(k) {
+				items = append(items, indexItem{key: k, pos: pos})
+			}
+		}
+		s.mu.RUnlock()
+	}
+	sort.Slice(items, func(i, j int) bool { return h.less(items[i].key, items[j].key) })
+	return items
+}
+
+func iterateItems(items []indexItem, reverse bool, handleFn func(key []byte, position *wal.ChunkPosition) (bool, error)) {
+	for i := range items {
+		item := items[i]
+		if reverse {
+			item = items[len(items)-1-i]
+		}
+		cont, err := handleFn(item.key, item.pos)
+		if err != nil || !cont {
+			return
+		}
+	}
+}
+
+// Ascend iterates over items in ascending order and invokes the handler function for each item.
+// If the handler function returns false, iteration stops.
+func (h *HashIndex) Ascend(handleFn func(key []byte, position *wal.ChunkPosition) (bool, error)) {
+	iterateItems(h.snapshot(nil), false, handleFn)
+}
+
+// Descend iterates over items in descending order and invokes the handler function for each item.
+// If the handler function returns false, iteration stops.
+func (h *HashIndex) Descend(handleFn func(key []byte, position *wal.ChunkPosition) (bool, error)) {
+	iterateItems(h.snapshot(nil), true, handleFn)
+}
+
+// AscendRange iterates in ascending order within [startKey, endKey), invoking handleFn.
+// Stops if handleFn returns false.
+func (h *HashIndex) AscendRange(startKey, endKey []byte, handleFn func(key []byte, position *wal.ChunkPosition) (bool, error)) {
+	iterateItems(h.snapshot(func(key []byte) bool {
+		return !h.less(key, startKey) && h.less(key, endKey)
+	}), false, handleFn)
+}
+
+// DescendRange iterates in descending order within (endKey, startKey], invoking handleFn.
+// Stops if handleFn returns false.
+func (h *HashIndex) DescendRange(startKey, endKey []byte, handleFn func(key []byte, position *wal.ChunkPosition) (bool, error)) {
+	iterateItems(h.snapshot(func(key []byte) bool {
+		return !h.less(startKey, key) && h.less(endKey, key)
+	}), true, handleFn)
+}
+
+// AscendGreaterOrEqual iterates in ascending order, starting from key >= given key,
+// invoking handleFn. Stops if handleFn returns false.
+func (h *HashIndex) AscendGreaterOrEqual(key []byte, handleFn func(key []byte, position *wal.ChunkPosition) (bool, error)) {
+	iterateItems(h.snapshot(func(k []byte) bool {
+		return !h.less(k, key)
+	}), false, handleFn)
+}
+
+// DescendLessOrEqual iterates in descending order, starting from key <= given key,
+// invoking handleFn. Stops if handleFn returns false.
+func (h *HashIndex) DescendLessOrEqual(key []byte, handleFn func(key []byte, position *wal.ChunkPosition) (bool, error)) {
+	iterateItems(h.snapshot(func(k []byte) bool {
+		return !h.less(key, k)
+	}), true, handleFn)
+}
+
+// Iterator returns an index iterator over a sorted snapshot of the index.
+func (h *HashIndex) Iterator(reverse bool) IndexIterator {
+	return newSliceIterator(h.snapshot(nil), reverse, h.less)
+}
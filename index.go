@@ -0,0 +1,222 @@
+package memdb
+
+import (
+	"bytes"
+	"sort"
+
+	"github.com/rosedblabs/wal"
+)
+
+// IndexType is the type of the in-memory index.
+type IndexType = byte
+
+const (
+	// IndexBTree is a btree index, it is the default one and supports Options.LessFunc.
+	IndexBTree IndexType = iota
+	// IndexART is an adaptive radix tree index. The common prefixes of the keys
+	// are stored only once, so it is smaller and faster than the btree when
+	// a lot of keys share long prefixes. It only supports the bytewise order.
+	IndexART
+	// IndexHash is a sharded hash index for the workloads of point lookups.
+	// It has the fastest Put, Get and Delete, but the keys are not ordered,
+	// so every ordered operation, such as Ascend and Iterator,
+	// has to sort a snapshot of all the keys.
+	IndexHash
+	// IndexCompact is a memory compact index for hundreds of millions of keys.
+	// The keys are prefix compressed in byte blocks with the positions packed inline,
+	// so it takes several times less memory than the btree, and almost no GC work.
+	// The operations are slower because a block is decoded for every operation.
+	IndexCompact
+	// IndexDisk keeps most of the keys in the index files on disk, for the databases
+	// whose keys do not fit in memory. Only the recent writes, a sparse summary
+	// of the files with their bloom filters and a block cache are kept in memory, see DiskIndex for details.
+	IndexDisk
+)
+
+// Indexer is the in-memory index of the database, it maps every key to the position of its record.
+//
+// All the methods must be safe for concurrent use.
+// The ranges follow the google/btree package: AscendRange iterates over [startKey, endKey),
+// and DescendRange iterates over (endKey, startKey].
+type Indexer interface {
+	// Put key and position into the index, returns the old position if the key exists.
+	Put(key []byte, position *wal.ChunkPosition) *wal.ChunkPosition
+
+	// Get the position of the key in the index.
+	Get(key []byte) *wal.ChunkPosition
+
+	// Delete the index of the key, returns the old position and whether the key existed.
+	Delete(key []byte) (*wal.ChunkPosition, bool)
+
+	// Size represents the number of keys in the index.
+	Size() int
+
+	// MemSize returns the memory used by the index in bytes,
+	// it may be an estimate.
+	MemSize() int64
+
+	// Ascend iterates over items in ascending order and invokes the handler function for each item.
+	// If the handler function returns false, iteration stops.
+	Ascend(handleFn func(key []byte, position *wal.ChunkPosition) (bool, error))
+
+	// Descend iterates over items in descending order and invokes the handler function for each item.
+	// If the handler function returns false, iteration stops.
+	Descend(handleFn func(key []byte, position *wal.ChunkPosition) (bool, error))
+
+	// AscendRange iterates in ascending order within [startKey, endKey), invoking handleFn.
+	AscendRange(startKey, endKey []byte, handleFn func(key []byte, position *wal.ChunkPosition) (bool, error))
+
+	// DescendRange iterates in descending order within (endKey, startKey], invoking handleFn.
+	DescendRange(startKey, endKey []byte, handleFn func(key []byte, position *wal.ChunkPosition) (bool, error))
+
+	// AscendGreaterOrEqual iterates in ascending order, starting from key >= given key.
+	AscendGreaterOrEqual(key []byte, handleFn func(key []byte, position *wal.ChunkPosition) (bool, error))
+
+	// DescendLessOrEqual iterates in descending order, starting from key <= given key.
+	DescendLessOrEqual(key []byte, handleFn func(key []byte, position *wal.ChunkPosition) (bool, error))
+
+	// Iterator returns an index iterator over a snapshot of the index.
+	Iterator(reverse bool) IndexIterator
+}
+
+// failingIndexer is implemented by the indexes whose operations can fail, such as DiskIndex.
+// Err returns the error which failed the index, the keys may be missing from the index after it.
+type failingIndexer interface {
+	Err() error
+}
+
+// IndexIterator is an iterator over the keys and positions of an Indexer.
+type IndexIterator interface {
+	// Rewind resets the iterator to its initial position.
+	Rewind()
+
+	// Seek positions the cursor to the first element whose key is greater than or equal to the given key,
+	// or less than or equal to the given key for a reverse iterator.
+	Seek(key []byte)
+
+	// Next moves the cursor to the next element.
+	Next()
+
+	// Valid checks if the iterator is still valid for reading.
+	Valid() bool
+
+	// Key returns the key of the current element.
+	Key() []byte
+
+	// Value returns the value (chunk position) of the current element.
+	Value() *wal.ChunkPosition
+
+	// Close releases the resources associated with the iterator.
+	Close()
+}
+
+// newIndexer creates the index of the namespace specified by the options.
+func newIndexer(options Options, namespace uint32) (Indexer, error) {
+	switch options.IndexType {
+	case IndexART:
+		return newART(), nil
+	case IndexHash:
+		return newHashIndex(options.LessFunc), nil
+	case IndexCompact:
+		return newCompactIndex(options.LessFunc), nil
+	case IndexDisk:
+		return newDiskIndex(diskIndexDir(options.DirPath, namespace), options)
+	default:
+		return newBTree(options.LessFunc), nil
+	}
+}
+
+// the estimated memory of every key in the indexes besides the key itself,
+// including the item, the position, and the share of the inner nodes.
+const (
+	btreeItemOverhead = 64
+	artLeafOverhead   = 80
+	hashEntryOverhead = 72
+)
+
+// indexItem is a key and its position, used by the snapshots of the indexes.
+type indexItem struct {
+	key []byte
+	pos *wal.ChunkPosition
+}
+
+// sliceIterator iterates over a sorted snapshot of an index,
+// it is used by the indexes which can not be cloned cheaply.
+type sliceIterator struct {
+	items   []indexItem // sorted in ascending order
+	reverse bool
+	less    func(a, b []byte) bool
+	index   int
+}
+
+func newSliceIterator(items []indexItem, reverse bool, less func(a, b []byte) bool) *sliceIterator {
+	it := &sliceIterator{items: items, reverse: reverse, less: less}
+	it.Rewind()
+	return it
+}
+
+// Rewind resets the iterator to its initial position.
+func (it *sliceIterator) Rewind() {
+	if it.reverse {
+		it.index = len(it.items) - 1
+	} else {
+		it.index = 0
+	}
+}
+
+// Seek positions the cursor to the element with the specified key.
+func (it *sliceIterator) Seek(key []byte) {
+	// the first item greater than or equal to the key
+	i := sort.Search(len(it.items), func(i int) bool {
+		return !it.less(it.items[i].key, key)
+	})
+	if it.reverse && (i == len(it.items) || it.less(key, it.items[i].key)) {
+		// the last item less than or equal to the key
+		i--
+	}
+	it.index = i
+}
+
+// Next moves the cursor to the next element.
+func (it *sliceIterator) Next() {
+	if !it.Valid() {
+		return
+	}
+	if it.reverse {
+		it.index--
+	} else {
+		it.index++
+	}
+}
+
+// Valid checks if the iterator is still valid for reading.
+func (it *sliceIterator) Valid() bool {
+	return it.index >= 0 && it.index < len(it.items)
+}
+
+// Key returns the key of the current element.
+func (it *sliceIterator) Key() []byte {
+	if !it.Valid() {
+		return nil
+	}
+	return it.items[it.index].key
+}
+
+// Value returns the value (chunk position) of the current element.
+func (it *sliceIterator) Value() *wal.ChunkPosition {
+	if !it.Valid() {
+		return nil
+	}
+	return it.items[it.index].pos
+}
+
+// Close releases the resources associated with the iterator.
+func (it *sliceIterator) Close() {
+	it.items = nil
+	it.index = -1
+}
+
+// bytewiseLess is the default order of the keys.
+func bytewiseLess(a, b []byte) bool {
+	return bytes.Compare(a, b) < 0
+}
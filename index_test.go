@@ -0,0 +1,234 @@
+package memdb
+
+import (
+	"bytes"
+	"fmt"
+	"math/rand"
+	"sort"
+	"testing"
+
+	"github.com/hupeh/memdb/utils"
+	"github.com/rosedblabs/wal"
+	"github.com/stretchr/testify/assert"
+)
+
+var testIndexTypes = map[string]IndexType{
+	"btree":   IndexBTree,
+	"art":     IndexART,
+	"hash":    IndexHash,
+	"compact": IndexCompact,
+	"disk":    IndexDisk,
+}
+
+func newTestIndexer(t *testing.T, options Options) Indexer {
+	options.DirPath = t.TempDir()
+	// flush the keys of the disk index to the files frequently
+	options.DiskIndexMemtableSize = 1000
+	options.DiskIndexCacheSize = 64 * KB
+	index, err := newIndexer(options, defaultNamespaceId)
+	assert.Nil(t, err)
+	return index
+}
+
+// randomIndexKeys returns keys sharing prefixes, including the keys which are prefixes of others.
+func randomIndexKeys(r *rand.Rand, n int) [][]byte {
+	keys := make([][]byte, 0, n)
+	for i := 0; i < n; i++ {
+		var key []byte
+		switch r.Intn(3) {
+		case 0:
+			key = []byte(fmt.Sprintf("user:%d", r.Intn(n)))
+		case 1:
+			key = []byte(fmt.Sprintf("user:%d:session:%d", r.Intn(100), r.Intn(100)))
+		default:
+			key = make([]byte, 1+r.Intn(4))
+			r.Read(key)
+		}
+		keys = append(keys, key)
+	}
+	return keys
+}
+
+func collectIndex(fn func(handleFn func(key []byte, position *wal.ChunkPosition) (bool, error))) []string {
+	var keys []string
+	fn(func(key []byte, position *wal.ChunkPosition) (bool, error) {
+		keys = append(keys, string(key))
+		return true, nil
+	})
+	return keys
+}
+
+func filterKeys(sorted []string, filter func(key string) bool, reverse bool) []string {
+	var keys []string
+	for i := range sorted {
+		key := sorted[i]
+		if reverse {
+			key = sorted[len(sorted)-1-i]
+		}
+		if filter(key) {
+			keys = append(keys, key)
+		}
+	}
+	return keys
+}
+
+func TestIndexer_Conformance(t *testing.T) {
+	for name, indexType := range testIndexTypes {
+		t.Run(name, func(t *testing.T) {
+			r := rand.New(rand.NewSource(1))
+			index := newTestIndexer(t, Options{IndexType: indexType})
+			expected := make(map[string]*wal.ChunkPosition)
+
+			// put, overwrite and delete
+			for i, key := range randomIndexKeys(r, 20000) {
+				pos := &wal.ChunkPosition{SegmentId: 1, ChunkOffset: int64(i), ChunkSize: 100}
+				oldPos := index.Put(key, pos)
+				assert.Equal(t, expected[string(key)], oldPos)
+				expected[string(key)] = pos
+			}
+			for i, key := range randomIndexKeys(r, 20000) {
+				oldPos, ok := index.Delete(key)
+				expectedPos, exists := expected[string(key)]
+				assert.Equal(t, exists, ok, i)
+				assert.Equal(t, expectedPos, oldPos)
+				delete(expected, string(key))
+			}
+			assert.Equal(t, len(expected), index.Size())
+			for key, pos := range expected {
+				assert.Equal(t, pos, index.Get([]byte(key)))
+			}
+
+			sorted := make([]string, 0, len(expected))
+			for key := range expected {
+				sorted = append(sorted, key)
+			}
+			sort.Strings(sorted)
+			all := func(string) bool { return true }
+			assert.Equal(t, filterKeys(sorted, all, false), collectIndex(index.Ascend))
+			assert.Equal(t, filterKeys(sorted, all, true), collectIndex(index.Descend))
+
+			start, end := "user:1", "user:5"
+			assert.Equal(t, filterKeys(sorted, func(key string) bool { return key >= start && key < end }, false),
+				collectIndex(func(fn func(key []byte, position *wal.ChunkPosition) (bool, error)) {
+					index.AscendRange([]byte(start), []byte(end), fn)
+				}))
+			assert.Equal(t, filterKeys(sorted, func(key string) bool { return key <= end && key > start }, true),
+				collectIndex(func(fn func(key []byte, position *wal.ChunkPosition) (bool, error)) {
+					index.DescendRange([]byte(end), []byte(start), fn)
+				}))
+			assert.Equal(t, filterKeys(sorted, func(key string) bool { return key >= start }, false),
+				collectIndex(func(fn func(key []byte, position *wal.ChunkPosition) (bool, error)) {
+					index.AscendGreaterOrEqual([]byte(start), fn)
+				}))
+			assert.Equal(t, filterKeys(sorted, func(key string) bool { return key <= end }, true),
+				collectIndex(func(fn func(key []byte, position *wal.ChunkPosition) (bool, error)) {
+					index.DescendLessOrEqual([]byte(end), fn)
+				}))
+
+			// stop early
+			count := 0
+			index.Ascend(func(key []byte, position *wal.ChunkPosition) (bool, error) {
+				count++
+				return count < 10, nil
+			})
+			assert.Equal(t, 10, count)
+
+			// iterators
+			for _, reverse := range []bool{false, true} {
+				iter := index.Iterator(reverse)
+				var keys []string
+				for ; iter.Valid(); iter.Next() {
+					keys = append(keys, string(iter.Key()))
+					assert.Equal(t, expected[string(iter.Key())], iter.Value())
+				}
+				assert.Equal(t, filterKeys(sorted, all, reverse), keys)
+
+				iter.Rewind()
+				iter.Seek([]byte(start))
+				assert.True(t, iter.Valid())
+				if reverse {
+					assert.True(t, bytes.Compare(iter.Key(), []byte(start)) <= 0)
+				} else {
+					assert.True(t, bytes.Compare(iter.Key(), []byte(start)) >= 0)
+				}
+				iter.Close()
+				assert.False(t, iter.Valid())
+			}
+		})
+	}
+}
+
+func TestIndexer_Hash_LessFunc(t *testing.T) {
+	index := newTestIndexer(t, Options{IndexType: IndexHash, LessFunc: func(a, b []byte) bool {
+		return bytes.Compare(a, b) > 0
+	}})
+	for i := 0; i < 100; i++ {
+		index.Put(utils.GetTestKey(i), &wal.ChunkPosition{})
+	}
+	keys := collectIndex(index.Ascend)
+	assert.Equal(t, 100, len(keys))
+	assert.True(t, sort.SliceIsSorted(keys, func(i, j int) bool { return keys[i] > keys[j] }))
+}
+
+func TestDB_IndexType(t *testing.T) {
+	for name, indexType := range testIndexTypes {
+		t.Run(name, func(t *testing.T) {
+			options := DefaultOptions
+			options.IndexType = indexType
+			options.DiskIndexMemtableSize = 1000
+			db, err := Open(options)
+			assert.Nil(t, err)
+			defer destroyDB(db)
+
+			generateData(t, db, 0, 10000, 128)
+			for i := 5000; i < 10000; i++ {
+				assert.Nil(t, db.Delete(utils.GetTestKey(i)))
+			}
+			assert.Nil(t, db.Merge(true))
+			assert.Nil(t, db.Close())
+
+			db, err = Open(options)
+			assert.Nil(t, err)
+			assert.Equal(t, 5000, db.Stat().KeysNum)
+			for i := 0; i < 10000; i++ {
+				_, err := db.Get(utils.GetTestKey(i))
+				if i < 5000 {
+					assert.Nil(t, err)
+				} else {
+					assert.Equal(t, ErrKeyNotFound, err)
+				}
+			}
+
+			iter := db.NewIterator(DefaultIteratorOptions)
+			defer iter.Close()
+			var prev []byte
+			count := 0
+			for ; iter.Valid(); iter.Next() {
+				item := iter.Item()
+				assert.True(t, prev == nil || bytes.Compare(prev, item.Key) < 0)
+				prev = item.Key
+				count++
+			}
+			assert.Equal(t, 5000, count)
+		})
+	}
+}
+
+func TestDB_IndexType_Invalid(t *testing.T) {
+	options := DefaultOptions
+	options.IndexType = IndexART
+	options.LessFunc = func(a, b []byte) bool { return bytes.Compare(a, b) > 0 }
+	_, err := Open(options)
+	assert.NotNil(t, err)
+
+	options = DefaultOptions
+	options.IndexType = IndexART
+	options.Namespaces = map[string]NamespaceOptions{"reverse": {Comparator: ReverseBytewiseComparator}}
+	_, err = Open(options)
+	assert.NotNil(t, err)
+
+	options = DefaultOptions
+	options.IndexType = 100
+	_, err = Open(options)
+	assert.NotNil(t, err)
+}
@@ -2,8 +2,11 @@ package memdb
 
 import (
 	"bytes"
+	"errors"
 	"log"
-	"time"
+	"sync"
+
+	"github.com/rosedblabs/wal"
 )
 
 // Item represents a key-value pair in the database.
@@ -16,9 +19,15 @@ type Item struct {
 // provides methods to traverse over the key/value pairs in the database.
 // It wraps the index iterator and adds functionality to
 // retrieve the actual values from the database.
+//
+// The iterator reads the data files which were open when it was created, even if a merge
+// replaces them while it is open, so the values match the snapshot of the index.
+// The replaced data files are closed when the last iterator reading them is closed,
+// the replaced segment files stay readable through them until then, see walPins.
 type Iterator struct {
-	indexIter *BTreeIterator  // index iterator for traversing keys
+	indexIter IndexIterator   // index iterator for traversing keys
 	db        *DB             // database instance for retrieving values
+	dataFiles *wal.WAL        // the data files the positions of the index iterator point to
 	options   IteratorOptions // user-defined configuration options
 	lastError error           // stores the last error encountered during iteration
 }
@@ -26,10 +35,27 @@ type Iterator struct {
 // NewIterator initializes and returns a new database iterator with the specified options.
 // The iterator is automatically positioned at the first valid entry.
 func (db *DB) NewIterator(opts IteratorOptions) *Iterator {
-	indexIter := db.index.Iterator(opts.Reverse)
+	return db.newIterator(db.keyspace, opts)
+}
+
+// newIterator returns a new iterator of the keys in the keyspace.
+func (db *DB) newIterator(ks *keyspace, opts IteratorOptions) *Iterator {
+	// the snapshot of the index and the data files are taken together,
+	// a merge installed online replaces both of them under the lock.
+	db.mu.RLock()
+	if db.closed {
+		db.mu.RUnlock()
+		return &Iterator{db: db, options: opts, lastError: ErrDBClosed}
+	}
+	indexIter := ks.index.Iterator(opts.Reverse)
+	dataFiles := db.dataFiles
+	db.walPins.pin(dataFiles)
+	db.mu.RUnlock()
+
 	iterator := &Iterator{
 		db:        db,
 		indexIter: indexIter,
+		dataFiles: dataFiles,
 		options:   opts,
 	}
 	_ = iterator.skipToNext()
@@ -94,8 +120,10 @@ func (it *Iterator) Close() {
 	}
 
 	it.indexIter.Close()
+	it.db.walPins.unpin(it.dataFiles)
 	it.indexIter = nil
 	it.db = nil
+	it.dataFiles = nil
 }
 
 // Err returns the last error encountered during iteration.
@@ -128,7 +156,7 @@ func (it *Iterator) skipToNext() *LogRecord {
 		}
 
 		// read the record from data file
-		chunk, err := it.db.dataFiles.Read(position)
+		chunk, err := it.dataFiles.Read(position)
 		if err != nil {
 			it.lastError = err
 			if !it.options.ContinueOnError {
@@ -142,13 +170,91 @@ func (it *Iterator) skipToNext() *LogRecord {
 
 		// Skip if record is deleted or expired
 		record := decodeLogRecord(chunk)
-		now := time.Now().UnixNano()
+		now := it.db.now().UnixNano()
 		if record.Type == LogRecordDeleted || record.IsExpired(now) {
 			it.indexIter.Next()
 			continue
 		}
 
+		// combine the merge operands up to the position in the snapshot of the index
+		if record.Type == LogRecordMergeOperand {
+			if record.Value, err = it.db.readOperands(it.dataFiles, key, it.db.operandChain(key, position)); err != nil {
+				it.lastError = err
+				if !it.options.ContinueOnError {
+					it.Close()
+					return nil
+				}
+				log.Printf("Error merging operands at key %q: %v", key, err)
+				it.indexIter.Next()
+				continue
+			}
+			record.Type = LogRecordNormal
+		}
+
 		return record
 	}
 	return nil
 }
+
+// walPins counts the iterators reading each set of data files.
+//
+// A merge installed online retires the data files instead of closing them,
+// they are closed when the last iterator reading them is closed, or when the database is closed.
+// Pinning is chosen over invalidating the open iterators, so an iterator never fails because of a merge.
+// It relies on the files replaced or removed by the merge staying readable while they are open.
+type walPins struct {
+	mu      sync.Mutex
+	refs    map[*wal.WAL]int
+	retired map[*wal.WAL]struct{}
+}
+
+func newWALPins() *walPins {
+	return &walPins{refs: make(map[*wal.WAL]int), retired: make(map[*wal.WAL]struct{})}
+}
+
+// pin marks the data files as read by an iterator.
+func (p *walPins) pin(w *wal.WAL) {
+	p.mu.Lock()
+	p.refs[w]++
+	p.mu.Unlock()
+}
+
+// unpin releases a pin of the data files, they are closed if they are retired and not pinned anymore.
+func (p *walPins) unpin(w *wal.WAL) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.refs[w]--; p.refs[w] > 0 {
+		return
+	}
+	delete(p.refs, w)
+	if _, ok := p.retired[w]; ok {
+		delete(p.retired, w)
+		// nobody is waiting for the error of the retired data files.
+		_ = w.Close()
+	}
+}
+
+// retire closes the data files replaced by a merge, or leaves them to the last iterator reading them.
+func (p *walPins) retire(w *wal.WAL) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.refs[w] > 0 {
+		p.retired[w] = struct{}{}
+		return nil
+	}
+	return w.Close()
+}
+
+// closeRetired closes all the retired data files, the iterators reading them fail afterwards.
+func (p *walPins) closeRetired() error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	var errs []error
+	for w := range p.retired {
+		if err := w.Close(); err != nil {
+			errs = append(errs, err)
+		}
+		delete(p.retired, w)
+	}
+	return errors.Join(errs...)
+}
@@ -6,6 +6,7 @@ import (
 	"testing"
 	"time"
 
+	"github.com/hupeh/memdb/utils"
 	"github.com/stretchr/testify/assert"
 )
 
@@ -296,3 +297,42 @@ func TestIterator_UseAfterClose(t *testing.T) {
 	iter.Close()
 	assert.Equal(t, iter.Valid(), false)
 }
+
+func TestIterator_Merge_Online(t *testing.T) {
+	options := DefaultOptions
+	options.DirPath = filepath.Join(options.DirPath, "iterator_merge_online")
+	db, err := Open(options)
+	assert.Nil(t, err)
+	defer destroyDB(db)
+
+	// the merged segment reuses the id of the original one, and the records are moved.
+	kvs := make(map[string][]byte)
+	for i := 0; i < 20000; i++ {
+		key, value := utils.GetTestKey(i%10000), utils.RandomValue(128)
+		kvs[string(key)] = value
+		assert.Nil(t, db.Put(key, value))
+	}
+
+	iter := db.NewIterator(DefaultIteratorOptions)
+	assert.Nil(t, db.Merge(true))
+	for i := 0; i < 10000; i += 2 {
+		assert.Nil(t, db.Put(utils.GetTestKey(i), utils.RandomValue(128)))
+	}
+
+	// the iterator reads the data files replaced by the merge
+	var count int
+	for ; iter.Valid(); iter.Next() {
+		item := iter.Item()
+		assert.NotNil(t, item)
+		assert.Equal(t, kvs[string(item.Key)], item.Value)
+		count++
+	}
+	assert.Nil(t, iter.Err())
+	assert.Equal(t, len(kvs), count)
+	assert.Len(t, db.walPins.retired, 1)
+
+	// they are closed with the last iterator
+	iter.Close()
+	assert.Len(t, db.walPins.retired, 0)
+	assert.Len(t, db.walPins.refs, 0)
+}
@@ -0,0 +1,249 @@
+// Package keys encodes tuples of values into byte keys whose bytes.Compare order
+// is the order of the tuples, so composite keys work with the default index order of memdb.
+//
+// The tuples are compared element by element, and a tuple is ordered before the longer
+// tuples it is a prefix of. The elements of the same type are compared by their values,
+// the elements of different types are ordered by their types:
+//
+//	nil < []byte < string < int64 < uint64 < float64 < false < true < time.Time
+//
+// The key of a tuple is a prefix of the keys of the longer tuples starting with it,
+// and of no other key, so it can be used as IteratorOptions.Prefix,
+// and PrefixRange returns the range of them for DB.AscendRange.
+//
+//	db.Put(keys.Pack("user", 42, "name"), []byte("tom"))
+//	start, end := keys.PrefixRange("user", 42)
+//	db.AscendRange(start, end, handleFn)
+package keys
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math"
+	"time"
+)
+
+// The type codes of the elements, they set the order of the elements of different types.
+const (
+	nilCode    = 0x00
+	bytesCode  = 0x01
+	stringCode = 0x02
+	intCode    = 0x10
+	uintCode   = 0x11
+	floatCode  = 0x12
+	falseCode  = 0x20
+	trueCode   = 0x21
+	timeCode   = 0x30
+)
+
+// The bytes and strings end with a terminator, and their zero bytes are escaped,
+// so no encoded value is the prefix of another one.
+const (
+	escapeByte     = 0x00
+	escapedZero    = 0xff
+	terminatorByte = 0x01
+)
+
+// ErrInvalidKey is returned by Unpack if the key is not encoded by Pack.
+var ErrInvalidKey = errors.New("keys: the key is not a packed tuple")
+
+// Pack encodes the elements into a key, see Append.
+func Pack(elems ...any) []byte {
+	return Append(nil, elems...)
+}
+
+// Append appends the key of the elements to dst and returns the extended buffer.
+//
+// The elements can be nil, []byte, string, bool, time.Time, and the integer and floating point types.
+// The signed integers are encoded as int64, the unsigned ones as uint64, and float32 as float64,
+// so they are unpacked as these types. The times are unpacked in UTC with the monotonic clock stripped.
+// It panics if the type of an element is not one of them.
+func Append(dst []byte, elems ...any) []byte {
+	for _, elem := range elems {
+		switch v := elem.(type) {
+		case nil:
+			dst = append(dst, nilCode)
+		case []byte:
+			dst = appendBytes(append(dst, bytesCode), v)
+		case string:
+			dst = appendBytes(append(dst, stringCode), []byte(v))
+		case int:
+			dst = appendInt(dst, int64(v))
+		case int8:
+			dst = appendInt(dst, int64(v))
+		case int16:
+			dst = appendInt(dst, int64(v))
+		case int32:
+			dst = appendInt(dst, int64(v))
+		case int64:
+			dst = appendInt(dst, v)
+		case uint:
+			dst = appendUint(dst, uint64(v))
+		case uint8:
+			dst = appendUint(dst, uint64(v))
+		case uint16:
+			dst = appendUint(dst, uint64(v))
+		case uint32:
+			dst = appendUint(dst, uint64(v))
+		case uint64:
+			dst = appendUint(dst, v)
+		case float32:
+			dst = appendFloat(dst, float64(v))
+		case float64:
+			dst = appendFloat(dst, v)
+		case bool:
+			if v {
+				dst = append(dst, trueCode)
+			} else {
+				dst = append(dst, falseCode)
+			}
+		case time.Time:
+			// the seconds and the nanoseconds cover all the times, unlike UnixNano
+			dst = binary.BigEndian.AppendUint64(append(dst, timeCode), uint64(v.Unix())^signBit)
+			dst = binary.BigEndian.AppendUint32(dst, uint32(v.Nanosecond()))
+		default:
+			panic(fmt.Sprintf("keys: unsupported element type %T", elem))
+		}
+	}
+	return dst
+}
+
+const signBit = 1 << 63
+
+func appendBytes(dst, b []byte) []byte {
+	for _, c := range b {
+		if c == escapeByte {
+			dst = append(dst, escapeByte, escapedZero)
+		} else {
+			dst = append(dst, c)
+		}
+	}
+	return append(dst, escapeByte, terminatorByte)
+}
+
+// appendInt flips the sign bit, so the negative integers are ordered before the positive ones.
+func appendInt(dst []byte, v int64) []byte {
+	return binary.BigEndian.AppendUint64(append(dst, intCode), uint64(v)^signBit)
+}
+
+func appendUint(dst []byte, v uint64) []byte {
+	return binary.BigEndian.AppendUint64(append(dst, uintCode), v)
+}
+
+// appendFloat flips the sign bit of the positive numbers, and all the bits of the negative ones,
+// so they are ordered as the numbers, and -0 is ordered before 0.
+func appendFloat(dst []byte, v float64) []byte {
+	bits := math.Float64bits(v)
+	if bits&signBit != 0 {
+		bits = ^bits
+	} else {
+		bits ^= signBit
+	}
+	return binary.BigEndian.AppendUint64(append(dst, floatCode), bits)
+}
+
+// Unpack decodes the elements of the key encoded by Pack.
+// It returns ErrInvalidKey if the key is not encoded by Pack.
+func Unpack(key []byte) ([]any, error) {
+	var elems []any
+	for len(key) > 0 {
+		code := key[0]
+		key = key[1:]
+		switch code {
+		case nilCode:
+			elems = append(elems, nil)
+		case bytesCode, stringCode:
+			b, n, err := decodeBytes(key)
+			if err != nil {
+				return nil, err
+			}
+			key = key[n:]
+			if code == stringCode {
+				elems = append(elems, string(b))
+			} else {
+				elems = append(elems, b)
+			}
+		case intCode, uintCode, floatCode:
+			if len(key) < 8 {
+				return nil, ErrInvalidKey
+			}
+			bits := binary.BigEndian.Uint64(key)
+			key = key[8:]
+			switch code {
+			case intCode:
+				elems = append(elems, int64(bits^signBit))
+			case uintCode:
+				elems = append(elems, bits)
+			default:
+				if bits&signBit != 0 {
+					bits ^= signBit
+				} else {
+					bits = ^bits
+				}
+				elems = append(elems, math.Float64frombits(bits))
+			}
+		case falseCode, trueCode:
+			elems = append(elems, code == trueCode)
+		case timeCode:
+			if len(key) < 12 {
+				return nil, ErrInvalidKey
+			}
+			sec := int64(binary.BigEndian.Uint64(key) ^ signBit)
+			nsec := binary.BigEndian.Uint32(key[8:])
+			if nsec >= uint32(time.Second) {
+				return nil, ErrInvalidKey
+			}
+			key = key[12:]
+			elems = append(elems, time.Unix(sec, int64(nsec)).UTC())
+		default:
+			return nil, ErrInvalidKey
+		}
+	}
+	return elems, nil
+}
+
+// decodeBytes decodes the escaped bytes at the start of the buffer,
+// and returns them with the length of the encoded bytes including the terminator.
+func decodeBytes(buf []byte) ([]byte, int, error) {
+	b := make([]byte, 0, len(buf))
+	for i := 0; i < len(buf); i++ {
+		if buf[i] != escapeByte {
+			b = append(b, buf[i])
+			continue
+		}
+		if i+1 == len(buf) {
+			return nil, 0, ErrInvalidKey
+		}
+		switch buf[i+1] {
+		case terminatorByte:
+			return b, i + 2, nil
+		case escapedZero:
+			b = append(b, escapeByte)
+			i++
+		default:
+			return nil, 0, ErrInvalidKey
+		}
+	}
+	return nil, 0, ErrInvalidKey
+}
+
+// PrefixRange returns the range [start, end) of the keys of the tuples starting with the elements,
+// in the byte-wise order. The key of the elements themselves is the start of the range.
+func PrefixRange(elems ...any) (start, end []byte) {
+	start = Pack(elems...)
+	return start, PrefixEnd(start)
+}
+
+// PrefixEnd returns the first key ordered after all the keys starting with the prefix in the byte-wise order,
+// or nil if there is no such key, which happens only if all the bytes of the prefix are 0xff.
+func PrefixEnd(prefix []byte) []byte {
+	end := bytes.TrimRight(prefix, "\xff")
+	if len(end) == 0 {
+		return nil
+	}
+	end = bytes.Clone(end)
+	end[len(end)-1]++
+	return end
+}
@@ -0,0 +1,167 @@
+package keys
+
+import (
+	"bytes"
+	"math"
+	"testing"
+	"time"
+
+	"github.com/hupeh/memdb"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPack_Order(t *testing.T) {
+	now := time.Unix(1700000000, 500)
+	// the tuples in ascending order
+	tuples := [][]any{
+		{},
+		{nil},
+		{nil, nil},
+		{[]byte{}},
+		{[]byte{0}},
+		{[]byte{0, 0}},
+		{[]byte{0, 1}},
+		{[]byte{1}},
+		{""},
+		{"", nil},
+		{"", "a"},
+		{"a"},
+		{"a", "b"},
+		{"a", int64(-1)},
+		{"a", int64(0)},
+		{"a\x00"},
+		{"a\x00b"},
+		{"a\x01"},
+		{"ab"},
+		{"b"},
+		{"\xff"},
+		{math.MinInt64},
+		{-1 << 40},
+		{-1},
+		{0},
+		{0, "a"},
+		{1},
+		{255},
+		{256},
+		{math.MaxInt64},
+		{uint(0)},
+		{uint64(1)},
+		{uint64(math.MaxUint64)},
+		{math.Inf(-1)},
+		{-math.MaxFloat64},
+		{-1.5},
+		{-math.SmallestNonzeroFloat64},
+		{math.Copysign(0, -1)},
+		{0.0},
+		{math.SmallestNonzeroFloat64},
+		{1.5},
+		{math.MaxFloat64},
+		{math.Inf(1)},
+		{false},
+		{false, true},
+		{true},
+		{time.Unix(-1, 0)},
+		{time.Unix(0, 0)},
+		{now},
+		{now.Add(1)},
+		{now.Add(time.Second)},
+	}
+	for i := 1; i < len(tuples); i++ {
+		a, b := Pack(tuples[i-1]...), Pack(tuples[i]...)
+		assert.True(t, bytes.Compare(a, b) < 0, "%v should be ordered before %v", tuples[i-1], tuples[i])
+	}
+}
+
+func TestPack_Unpack(t *testing.T) {
+	now := time.Now()
+	elems, err := Unpack(Pack(nil, []byte("a\x00b"), "c\x00\xff", 1, int8(-2), uint16(3), float32(1.5), -2.25, true, false, now))
+	assert.Nil(t, err)
+	assert.Equal(t, []any{nil, []byte("a\x00b"), "c\x00\xff", int64(1), int64(-2), uint64(3), 1.5, -2.25, true, false, now.Round(0).UTC()}, elems)
+
+	elems, err = Unpack(Pack(math.MinInt64, uint64(math.MaxUint64), math.Inf(-1), time.Unix(-100, 7)))
+	assert.Nil(t, err)
+	assert.Equal(t, []any{int64(math.MinInt64), uint64(math.MaxUint64), math.Inf(-1), time.Unix(-100, 7).UTC()}, elems)
+
+	elems, err = Unpack(nil)
+	assert.Nil(t, err)
+	assert.Empty(t, elems)
+
+	// the tuple is appended to the buffer
+	key := Append(Pack("a"), 1)
+	assert.Equal(t, Pack("a", 1), key)
+
+	assert.Panics(t, func() { Pack(struct{}{}) })
+}
+
+func TestUnpack_Invalid(t *testing.T) {
+	for _, key := range [][]byte{
+		{0xff},
+		{stringCode, 'a'},
+		{stringCode, 'a', 0x00},
+		{stringCode, 'a', 0x00, 0x02},
+		{intCode, 0, 0, 0},
+		{timeCode, 0, 0, 0, 0, 0, 0, 0, 0, 0xff, 0xff, 0xff, 0xff},
+		append(Pack("a"), timeCode),
+	} {
+		_, err := Unpack(key)
+		assert.Equal(t, ErrInvalidKey, err, "%q", key)
+	}
+}
+
+func TestPrefixRange(t *testing.T) {
+	start, end := PrefixRange("user", 1)
+	assert.Equal(t, Pack("user", 1), start)
+	for _, key := range [][]byte{Pack("user", 1), Pack("user", 1, "name"), Pack("user", 1, nil), Pack("user", 1, math.Inf(1))} {
+		assert.True(t, bytes.HasPrefix(key, start))
+		assert.True(t, bytes.Compare(key, start) >= 0 && bytes.Compare(key, end) < 0)
+	}
+	for _, key := range [][]byte{Pack("user", 0), Pack("user", 2), Pack("user"), Pack("user\x00", 1), Pack("users", 1)} {
+		assert.False(t, bytes.HasPrefix(key, start))
+		assert.False(t, bytes.Compare(key, start) >= 0 && bytes.Compare(key, end) < 0)
+	}
+
+	assert.Equal(t, []byte{1, 3}, PrefixEnd([]byte{1, 2, 0xff, 0xff}))
+	assert.Nil(t, PrefixEnd([]byte{0xff}))
+	assert.Nil(t, PrefixEnd(nil))
+}
+
+func TestKeys_DB(t *testing.T) {
+	options := memdb.DefaultOptions
+	options.DirPath = t.TempDir()
+	db, err := memdb.Open(options)
+	assert.Nil(t, err)
+	defer func() {
+		_ = db.Close()
+	}()
+
+	for _, id := range []int{-1, 2, 10, 1} {
+		for _, field := range []string{"name", "age"} {
+			assert.Nil(t, db.Put(Pack("user", id, field), []byte(field)))
+		}
+	}
+	assert.Nil(t, db.Put(Pack("users", 1), []byte("other")))
+
+	var got [][]any
+	start, end := PrefixRange("user")
+	db.AscendRange(start, end, func(k []byte, v []byte) (bool, error) {
+		elems, err := Unpack(k)
+		assert.Nil(t, err)
+		got = append(got, elems[1:])
+		return true, nil
+	})
+	assert.Equal(t, [][]any{
+		{int64(-1), "age"}, {int64(-1), "name"},
+		{int64(1), "age"}, {int64(1), "name"},
+		{int64(2), "age"}, {int64(2), "name"},
+		{int64(10), "age"}, {int64(10), "name"},
+	}, got)
+
+	iter := db.NewIterator(memdb.IteratorOptions{Prefix: Pack("user", 2)})
+	defer iter.Close()
+	var values []string
+	for ; iter.Valid(); iter.Next() {
+		item := iter.Item()
+		values = append(values, string(item.Value))
+	}
+	assert.Equal(t, []string{"age", "name"}, values)
+}
@@ -0,0 +1,235 @@
+package memdb
+
+import (
+	"bytes"
+	"io"
+	"os"
+	"runtime"
+	"sync"
+
+	"github.com/bwmarrin/snowflake"
+	"github.com/rosedblabs/wal"
+)
+
+// LoadProgress is the progress of loading the index from the data files when the database is opened.
+// The segments covered by the hint file or the index checkpoint are not counted.
+type LoadProgress struct {
+	SegmentsLoaded int   // number of the segments loaded into the index
+	SegmentsTotal  int   // number of the segments to load
+	BytesLoaded    int64 // size of the segments loaded into the index
+	BytesTotal     int64 // size of the segments to load
+}
+
+// loadedSegment is the records read from a segment by a loading worker.
+type loadedSegment struct {
+	records []*IndexRecord
+	err     error
+}
+
+// loadIndexFromWAL loads index from WAL.
+// It will iterate over all the WAL files and read data
+// from them to rebuild the index.
+// If checkpoint is not nil, the chunks up to it are already in the index and are skipped.
+//
+// The segments are read and decoded by several goroutines, and applied to the index
+// one by one in the order of their ids, so a later write always wins,
+// and a batch is only indexed when its batch finished record is applied.
+func (db *DB) loadIndexFromWAL(checkpoint *wal.ChunkPosition) error {
+	mergeFinSegmentId := db.manifest.MergeFinSegmentId
+	if checkpoint != nil {
+		db.lastPosition = checkpoint
+		// the segments before the checkpoint are covered by it
+		mergeFinSegmentId = max(mergeFinSegmentId, checkpoint.SegmentId-1)
+	}
+
+	// the segments below mergeFinSegmentId have been merged,
+	// and we can load index from the hint file directly.
+	allIds, err := listSegmentIds(db.options.DirPath, dataFileNameSuffix, db.dataFiles.ActiveSegmentID())
+	if err != nil {
+		return err
+	}
+	var ids []wal.SegmentID
+	progress := LoadProgress{}
+	for _, id := range allIds {
+		if id <= mergeFinSegmentId {
+			continue
+		}
+		info, err := os.Stat(wal.SegmentFileName(db.options.DirPath, dataFileNameSuffix, id))
+		if err != nil {
+			return err
+		}
+		ids = append(ids, id)
+		progress.BytesTotal += info.Size()
+	}
+	progress.SegmentsTotal = len(ids)
+	if len(ids) == 0 {
+		return nil
+	}
+
+	db.dataFiles.SetIsStartupTraversal(true)
+	defer db.dataFiles.SetIsStartupTraversal(false)
+
+	workers := min(runtime.GOMAXPROCS(0), len(ids))
+	// every segment is read by one worker, so the cached block of the startup traversal is not shared.
+	// the tokens bound the segments read but not applied yet, which are kept in memory.
+	results := make([]chan loadedSegment, len(ids))
+	for i := range results {
+		results[i] = make(chan loadedSegment, 1)
+	}
+	jobs := make(chan int, len(ids))
+	for i := range ids {
+		jobs <- i
+	}
+	close(jobs)
+	tokens := make(chan struct{}, 2*workers)
+	done := make(chan struct{})
+
+	now := db.now().UnixNano()
+	var wg sync.WaitGroup
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				// take the token before the job, so the segment waited by the applier always has one.
+				select {
+				case tokens <- struct{}{}:
+				case <-done:
+					return
+				}
+				i, ok := <-jobs
+				if !ok {
+					return
+				}
+				records, err := db.readSegmentRecords(ids[i], checkpoint)
+				results[i] <- loadedSegment{records: records, err: err}
+			}
+		}()
+	}
+	defer func() {
+		// stop the workers if the loading fails
+		close(done)
+		wg.Wait()
+	}()
+
+	indexRecords := make(map[uint64][]*IndexRecord)
+	for i, id := range ids {
+		result := <-results[i]
+		<-tokens
+		if result.err != nil {
+			return result.err
+		}
+		if err = db.applyIndexRecords(result.records, indexRecords, now); err != nil {
+			return err
+		}
+
+		progress.SegmentsLoaded++
+		if info, err := os.Stat(wal.SegmentFileName(db.options.DirPath, dataFileNameSuffix, id)); err == nil {
+			progress.BytesLoaded += info.Size()
+		}
+		if db.options.OnLoadProgress != nil {
+			db.options.OnLoadProgress(progress)
+		}
+	}
+	return nil
+}
+
+// readSegmentRecords reads and decodes all the records of the segment,
+// the records up to the checkpoint are skipped.
+func (db *DB) readSegmentRecords(id wal.SegmentID, checkpoint *wal.ChunkPosition) ([]*IndexRecord, error) {
+	reader := db.dataFiles.NewReaderWithMax(id)
+	for reader.CurrentSegmentId() < id {
+		reader.SkipCurrentSegment()
+	}
+
+	var records []*IndexRecord
+	for {
+		chunk, position, err := reader.Next()
+		if err != nil {
+			if err == io.EOF {
+				break
+			}
+			return nil, err
+		}
+		if checkpoint != nil && !positionBefore(checkpoint, position) {
+			continue
+		}
+		record := decodeLogRecord(chunk)
+		indexRecord := &IndexRecord{
+			// the key is copied, so the value of the chunk is not kept in memory
+			key:        bytes.Clone(record.Key),
+			recordType: record.Type,
+			batchId:    record.BatchId,
+			expire:     record.Expire,
+			position:   position,
+			namespace:  record.Namespace,
+		}
+		if isRangeTombstone(record.Type) {
+			indexRecord.end = bytes.Clone(record.Value)
+		}
+		records = append(records, indexRecord)
+	}
+	return records, nil
+}
+
+// applyIndexRecords applies the records of a segment to the index in order,
+// the records of the unfinished batches are kept in indexRecords by batch id.
+func (db *DB) applyIndexRecords(records []*IndexRecord, indexRecords map[uint64][]*IndexRecord, now int64) error {
+	for _, record := range records {
+		db.lastPosition = record.position
+		// every chunk is garbage until it is indexed
+		db.segmentStats.written(record.position)
+
+		// if we get the end of a batch,
+		// all records in this batch are ready to be indexed.
+		if record.recordType == LogRecordBatchFinished {
+			batchId, err := snowflake.ParseBytes(record.key)
+			if err != nil {
+				return err
+			}
+			for _, idxRecord := range indexRecords[uint64(batchId)] {
+				ks := db.keyspaces[idxRecord.namespace]
+				if ks == nil {
+					// the namespace is dropped, the record is garbage
+					continue
+				}
+				if idxRecord.recordType == LogRecordNormal {
+					db.putIndex(ks, idxRecord.key, idxRecord.position, idxRecord.expire)
+				}
+				if idxRecord.recordType == LogRecordDeleted {
+					db.deleteIndex(ks, idxRecord.key)
+				}
+				if idxRecord.recordType == LogRecordMergeOperand {
+					db.appendIndex(ks, idxRecord.key, idxRecord.position, idxRecord.expire)
+				}
+				if isRangeTombstone(idxRecord.recordType) {
+					db.deleteIndexRange(idxRecord.recordType, idxRecord.key, idxRecord.end)
+				}
+			}
+			// delete indexRecords according to batchId after indexing
+			delete(indexRecords, uint64(batchId))
+		} else if ks := db.keyspaces[record.namespace]; ks == nil {
+			// the namespace is dropped, the record is garbage
+			continue
+		} else if record.recordType == LogRecordExpired {
+			// the key is expired and deleted, unless it has been written again.
+			if ks.expires.get(record.key) == record.expire {
+				db.deleteIndex(ks, record.key)
+			}
+		} else if record.recordType == LogRecordNormal && record.batchId == mergeFinishedBatchID {
+			// if the record is a normal record and the batch id is 0,
+			// it means that the record is involved in the merge operation.
+			// so put the record into index directly.
+			db.putIndex(ks, record.key, record.position, record.expire)
+		} else {
+			// expired records should not be indexed
+			if record.expire > 0 && record.expire <= now {
+				db.deleteIndex(ks, record.key)
+				continue
+			}
+			// put the record into the temporary indexRecords
+			indexRecords[record.batchId] = append(indexRecords[record.batchId], record)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,80 @@
+package memdb
+
+import (
+	"testing"
+
+	"github.com/hupeh/memdb/utils"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDB_Load_Parallel(t *testing.T) {
+	options := DefaultOptions
+	options.SegmentSize = 256 * KB
+	options.IndexCheckpoint = false
+	db, err := Open(options)
+	assert.Nil(t, err)
+	defer destroyDB(db)
+
+	// overwrite the keys across the segments, the last write must win
+	values := make(map[int][]byte)
+	for round := 0; round < 3; round++ {
+		for start := 0; start < 2000; start += 200 {
+			batch := db.NewBatch(DefaultBatchOptions)
+			for i := start; i < start+200; i++ {
+				values[i] = utils.RandomValue(128)
+				assert.Nil(t, batch.Put(utils.GetTestKey(i), values[i]))
+			}
+			assert.Nil(t, batch.Commit())
+		}
+		for i := round * 100; i < 2000; i += 7 {
+			assert.Nil(t, db.Delete(utils.GetTestKey(i)))
+			delete(values, i)
+		}
+	}
+	stat := db.Stat()
+	assert.Nil(t, db.Close())
+
+	var progresses []LoadProgress
+	options.OnLoadProgress = func(progress LoadProgress) {
+		progresses = append(progresses, progress)
+	}
+	db, err = Open(options)
+	assert.Nil(t, err)
+
+	stat2 := db.Stat()
+	assert.Equal(t, stat.KeysNum, stat2.KeysNum)
+	assert.Equal(t, len(values), stat2.KeysNum)
+	for i := 0; i < 2000; i++ {
+		val, err := db.Get(utils.GetTestKey(i))
+		if expected, ok := values[i]; ok {
+			assert.Nil(t, err)
+			assert.Equal(t, expected, val)
+		} else {
+			assert.Equal(t, ErrKeyNotFound, err)
+		}
+	}
+
+	assert.True(t, len(progresses) > 1)
+	last := progresses[len(progresses)-1]
+	assert.Equal(t, len(progresses), last.SegmentsTotal)
+	assert.Equal(t, last.SegmentsTotal, last.SegmentsLoaded)
+	assert.Equal(t, last.BytesTotal, last.BytesLoaded)
+	for i := 1; i < len(progresses); i++ {
+		assert.True(t, progresses[i].BytesLoaded > progresses[i-1].BytesLoaded)
+	}
+	assert.Nil(t, db.Close())
+}
+
+func TestDB_Load_Empty(t *testing.T) {
+	options := DefaultOptions
+	called := false
+	options.OnLoadProgress = func(progress LoadProgress) {
+		called = true
+		assert.Equal(t, 1, progress.SegmentsTotal)
+	}
+	db, err := Open(options)
+	assert.Nil(t, err)
+	defer destroyDB(db)
+	assert.True(t, called)
+	assert.Equal(t, 0, db.Stat().KeysNum)
+}
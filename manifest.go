@@ -0,0 +1,263 @@
+package memdb
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"os"
+	"path/filepath"
+	"sort"
+
+	"github.com/rosedblabs/wal"
+)
+
+const (
+	manifestFileName = "MANIFEST"
+	manifestMagic    = 0x4d44424d // "MDBM"
+	// manifestVersion 2 adds the expiry time to the hint records,
+	// and 3 adds the namespace id.
+	manifestVersion = 3
+	// legacyManifestVersion is the version of the manifests migrated from a MERGEFIN file,
+	// whose hint records are written in the first format.
+	legacyManifestVersion = 1
+)
+
+// manifest describes the set of files that make up a database.
+//
+// Merged segments are numbered at or below MergeFinSegmentId, and the index for them
+// is loaded from the hint file instead of replaying the WAL.
+// All segments above MergeFinSegmentId are the tail of the WAL written after the last merge.
+//
+// The manifest is the commit point of a merge: once a manifest with a new generation
+// is written, the merged files are the live data, and the installation can be
+// rolled forward again if the process crashes in the middle of it.
+type manifest struct {
+	Version           uint32
+	Generation        uint64 // increased by one for every installed merge
+	Comparator        string // name of the comparator used to order the index
+	MergeFinSegmentId wal.SegmentID
+	Segments          []wal.SegmentID // live segments at or below MergeFinSegmentId
+}
+
+// +---------+---------+------------+------------+-------------+------------+----------+----------+
+// |  magic  | version | generation |  merge fin | name length |    name    | segments |  crc32   |
+// +---------+---------+------------+------------+-------------+------------+----------+----------+
+//
+//	4 bytes   4 bytes    8 bytes      4 bytes      uvarint       varint     uvarint+ids  4 bytes
+func encodeManifest(m *manifest) []byte {
+	buf := make([]byte, 20, 32+len(m.Comparator)+len(m.Segments)*binary.MaxVarintLen32)
+	binary.LittleEndian.PutUint32(buf[0:], manifestMagic)
+	binary.LittleEndian.PutUint32(buf[4:], m.Version)
+	binary.LittleEndian.PutUint64(buf[8:], m.Generation)
+	binary.LittleEndian.PutUint32(buf[16:], m.MergeFinSegmentId)
+	buf = binary.AppendUvarint(buf, uint64(len(m.Comparator)))
+	buf = append(buf, m.Comparator...)
+	buf = binary.AppendUvarint(buf, uint64(len(m.Segments)))
+	for _, id := range m.Segments {
+		buf = binary.AppendUvarint(buf, uint64(id))
+	}
+	return binary.LittleEndian.AppendUint32(buf, crc32.ChecksumIEEE(buf))
+}
+
+func decodeManifest(buf []byte) (*manifest, error) {
+	if len(buf) < 24 {
+		return nil, ErrManifestCorrupted
+	}
+	body, sum := buf[:len(buf)-4], binary.LittleEndian.Uint32(buf[len(buf)-4:])
+	if crc32.ChecksumIEEE(body) != sum {
+		return nil, ErrManifestCorrupted
+	}
+	if binary.LittleEndian.Uint32(body[0:]) != manifestMagic {
+		return nil, ErrManifestCorrupted
+	}
+
+	m := &manifest{
+		Version:           binary.LittleEndian.Uint32(body[4:]),
+		Generation:        binary.LittleEndian.Uint64(body[8:]),
+		MergeFinSegmentId: binary.LittleEndian.Uint32(body[16:]),
+	}
+	if m.Version > manifestVersion {
+		return nil, fmt.Errorf("memdb: unsupported manifest version %d", m.Version)
+	}
+
+	var index = 20
+	// comparator name
+	nameLen, n := binary.Uvarint(body[index:])
+	if n <= 0 || uint64(len(body)-index-n) < nameLen {
+		return nil, ErrManifestCorrupted
+	}
+	index += n
+	m.Comparator = string(body[index : index+int(nameLen)])
+	index += int(nameLen)
+
+	// live segments
+	count, n := binary.Uvarint(body[index:])
+	if n <= 0 {
+		return nil, ErrManifestCorrupted
+	}
+	index += n
+	for i := uint64(0); i < count; i++ {
+		id, n := binary.Uvarint(body[index:])
+		if n <= 0 {
+			return nil, ErrManifestCorrupted
+		}
+		index += n
+		m.Segments = append(m.Segments, wal.SegmentID(id))
+	}
+	return m, nil
+}
+
+// hasSegment reports whether the segment is part of the merged data.
+func (m *manifest) hasSegment(id wal.SegmentID) bool {
+	return containsSegment(m.Segments, id)
+}
+
+// readManifestFile reads and validates the manifest stored in the given file.
+func readManifestFile(path string) (*manifest, error) {
+	buf, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return decodeManifest(buf)
+}
+
+// writeManifestFile replaces the given file with the manifest atomically.
+func writeManifestFile(path string, m *manifest) error {
+	return writeFileAtomic(path, encodeManifest(m))
+}
+
+// writeFileAtomic replaces the given file with the data atomically.
+// The content is written to a temporary file first, synced, and then renamed.
+func writeFileAtomic(path string, data []byte) error {
+	tmpPath := path + ".tmp"
+	file, err := os.OpenFile(tmpPath, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	if _, err = file.Write(data); err != nil {
+		_ = file.Close()
+		return err
+	}
+	if err = file.Sync(); err != nil {
+		_ = file.Close()
+		return err
+	}
+	if err = file.Close(); err != nil {
+		return err
+	}
+	if err = os.Rename(tmpPath, path); err != nil {
+		return err
+	}
+	return syncDir(filepath.Dir(path))
+}
+
+// syncDir flushes the directory entries, so renames and removals survive a crash.
+func syncDir(dirPath string) error {
+	dir, err := os.Open(dirPath)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		_ = dir.Close()
+	}()
+	// some platforms do not support syncing a directory, ignore the error there.
+	_ = dir.Sync()
+	return nil
+}
+
+// openManifest loads the manifest of the database directory,
+// finishes the installation of a completed merge if there is one,
+// and removes the segment files that are no longer part of the database.
+//
+// A database created before the manifest was introduced is migrated
+// from its MERGEFIN file, and a new database gets an empty manifest.
+func openManifest(dirPath, comparator string) (*manifest, error) {
+	m, err := readManifestFile(filepath.Join(dirPath, manifestFileName))
+	if err != nil {
+		if !errors.Is(err, os.ErrNotExist) {
+			return nil, err
+		}
+		if m, err = migrateManifest(dirPath, comparator); err != nil {
+			return nil, err
+		}
+	}
+
+	if m, err = loadMergeFiles(dirPath, m); err != nil {
+		return nil, err
+	}
+	if err = removeStaleSegments(dirPath, m); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+// migrateManifest creates the first manifest of a database directory.
+func migrateManifest(dirPath, comparator string) (*manifest, error) {
+	m := &manifest{Version: manifestVersion, Comparator: comparator}
+
+	legacyFinFile := wal.SegmentFileName(dirPath, mergeFinNameSuffix, 1)
+	mergeFinSegmentId, err := getMergeFinSegmentId(dirPath)
+	if err != nil {
+		return nil, err
+	}
+	if mergeFinSegmentId > 0 {
+		// the database was merged before, all the segments at or below
+		// the merge finished segment id were written by the merge.
+		m.Version = legacyManifestVersion
+		if m.Segments, err = listSegmentIds(dirPath, dataFileNameSuffix, mergeFinSegmentId); err != nil {
+			return nil, err
+		}
+		m.MergeFinSegmentId = mergeFinSegmentId
+	}
+
+	if err = writeManifestFile(filepath.Join(dirPath, manifestFileName), m); err != nil {
+		return nil, err
+	}
+	if err = os.Remove(legacyFinFile); err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	return m, nil
+}
+
+// removeStaleSegments removes the data files at or below the merge finished segment id
+// that are not recorded in the manifest, they are left over by an interrupted installation.
+func removeStaleSegments(dirPath string, m *manifest) error {
+	ids, err := listSegmentIds(dirPath, dataFileNameSuffix, m.MergeFinSegmentId)
+	if err != nil {
+		return err
+	}
+	for _, id := range ids {
+		if m.hasSegment(id) {
+			continue
+		}
+		if err = os.Remove(wal.SegmentFileName(dirPath, dataFileNameSuffix, id)); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	return nil
+}
+
+// listSegmentIds returns the sorted ids of the segment files
+// with the given extension whose id is less than or equal to maxId.
+func listSegmentIds(dirPath, ext string, maxId wal.SegmentID) ([]wal.SegmentID, error) {
+	entries, err := os.ReadDir(dirPath)
+	if err != nil {
+		return nil, err
+	}
+	var ids []wal.SegmentID
+	for _, entry := range entries {
+		if entry.IsDir() {
+			continue
+		}
+		var id wal.SegmentID
+		if _, err := fmt.Sscanf(entry.Name(), "%d"+ext, &id); err != nil {
+			continue
+		}
+		if id <= maxId {
+			ids = append(ids, id)
+		}
+	}
+	sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+	return ids, nil
+}
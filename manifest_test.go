@@ -0,0 +1,215 @@
+package memdb
+
+import (
+	"encoding/binary"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/hupeh/memdb/utils"
+	"github.com/rosedblabs/wal"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestManifest_Encode_Decode(t *testing.T) {
+	m := &manifest{
+		Version:           manifestVersion,
+		Generation:        3,
+		Comparator:        bytewiseComparatorName,
+		MergeFinSegmentId: 12,
+		Segments:          []wal.SegmentID{1, 2, 5, 12},
+	}
+	buf := encodeManifest(m)
+	m2, err := decodeManifest(buf)
+	assert.Nil(t, err)
+	assert.Equal(t, m, m2)
+	assert.True(t, m2.hasSegment(5))
+	assert.False(t, m2.hasSegment(4))
+
+	// flip one byte, the checksum should not match
+	buf[10] ^= 0xff
+	_, err = decodeManifest(buf)
+	assert.Equal(t, ErrManifestCorrupted, err)
+
+	_, err = decodeManifest(buf[:8])
+	assert.Equal(t, ErrManifestCorrupted, err)
+}
+
+func TestManifest_Open_New(t *testing.T) {
+	options := DefaultOptions
+	db, err := Open(options)
+	assert.Nil(t, err)
+	defer destroyDB(db)
+
+	m, err := readManifestFile(filepath.Join(options.DirPath, manifestFileName))
+	assert.Nil(t, err)
+	assert.Equal(t, uint64(0), m.Generation)
+	assert.Equal(t, bytewiseComparatorName, m.Comparator)
+	assert.Equal(t, wal.SegmentID(0), m.MergeFinSegmentId)
+}
+
+func TestManifest_Open_Corrupted_Unlocks(t *testing.T) {
+	options := DefaultOptions
+	db, err := Open(options)
+	assert.Nil(t, err)
+	defer destroyDB(db)
+	assert.Nil(t, db.Put(utils.GetTestKey(1), utils.RandomValue(10)))
+	assert.Nil(t, db.Close())
+
+	path := filepath.Join(options.DirPath, manifestFileName)
+	data, err := os.ReadFile(path)
+	assert.Nil(t, err)
+	corrupted := append([]byte(nil), data...)
+	corrupted[len(corrupted)-1] ^= 0xff
+	assert.Nil(t, os.WriteFile(path, corrupted, 0644))
+	_, err = Open(options)
+	assert.Equal(t, ErrManifestCorrupted, err)
+
+	// the failed Open released the directory
+	assert.Nil(t, os.WriteFile(path, data, 0644))
+	db, err = Open(options)
+	assert.Nil(t, err)
+	_, err = db.Get(utils.GetTestKey(1))
+	assert.Nil(t, err)
+}
+
+func TestManifest_Merge_Generation(t *testing.T) {
+	options := DefaultOptions
+	options.SegmentSize = 32 * MB
+	db, err := Open(options)
+	assert.Nil(t, err)
+	defer destroyDB(db)
+
+	generateData(t, db, 0, 100000, 512)
+	for i := 0; i < 2; i++ {
+		err = db.Merge(true)
+		assert.Nil(t, err)
+	}
+	assert.Equal(t, uint64(2), db.manifest.Generation)
+	assert.True(t, len(db.manifest.Segments) > 0)
+	for _, id := range db.manifest.Segments {
+		assert.True(t, id <= db.manifest.MergeFinSegmentId)
+	}
+
+	m, err := readManifestFile(filepath.Join(options.DirPath, manifestFileName))
+	assert.Nil(t, err)
+	assert.Equal(t, db.manifest, m)
+}
+
+func TestManifest_Install_Interrupted(t *testing.T) {
+	options := DefaultOptions
+	options.SegmentSize = 32 * MB
+	db, err := Open(options)
+	assert.Nil(t, err)
+	defer destroyDB(db)
+
+	generateData(t, db, 0, 100000, 512)
+	generateData(t, db, 0, 50000, 512)
+	err = db.Merge(false)
+	assert.Nil(t, err)
+	assert.Nil(t, db.Close())
+
+	// simulate a crash right after the manifest is committed,
+	// only the first merged segment has been moved.
+	mergePath := mergeDirPath(options.DirPath)
+	mergeFin, err := readManifestFile(wal.SegmentFileName(mergePath, mergeFinNameSuffix, 1))
+	assert.Nil(t, err)
+	err = writeManifestFile(filepath.Join(options.DirPath, manifestFileName), mergeFin)
+	assert.Nil(t, err)
+	first := mergeFin.Segments[0]
+	assert.Nil(t, os.Remove(wal.SegmentFileName(options.DirPath, dataFileNameSuffix, first)))
+	assert.Nil(t, os.Rename(
+		wal.SegmentFileName(mergePath, dataFileNameSuffix, first),
+		wal.SegmentFileName(options.DirPath, dataFileNameSuffix, first),
+	))
+
+	db, err = Open(options)
+	assert.Nil(t, err)
+	_, err = os.Stat(mergePath)
+	assert.True(t, os.IsNotExist(err))
+	assert.Equal(t, mergeFin.Generation, db.manifest.Generation)
+	assert.Equal(t, 100000, db.Stat().KeysNum)
+	for i := 0; i < 100000; i++ {
+		val, err := db.Get(utils.GetTestKey(i))
+		assert.Nil(t, err)
+		assert.NotNil(t, val)
+	}
+}
+
+func TestManifest_Install_Failed(t *testing.T) {
+	options := DefaultOptions
+	options.SegmentSize = 32 * MB
+	db, err := Open(options)
+	assert.Nil(t, err)
+	defer destroyDB(db)
+
+	generateData(t, db, 0, 100000, 512)
+	generateData(t, db, 0, 50000, 512)
+	err = db.Merge(false)
+	assert.Nil(t, err)
+	assert.Nil(t, db.Close())
+
+	// make the move of the last merged segment fail after the manifest is committed.
+	mergePath := mergeDirPath(options.DirPath)
+	mergeFin, err := readManifestFile(wal.SegmentFileName(mergePath, mergeFinNameSuffix, 1))
+	assert.Nil(t, err)
+	last := wal.SegmentFileName(options.DirPath, dataFileNameSuffix, mergeFin.Segments[len(mergeFin.Segments)-1])
+	assert.Nil(t, os.Remove(last))
+	assert.Nil(t, os.MkdirAll(filepath.Join(last, "block"), os.ModePerm))
+
+	_, err = Open(options)
+	assert.NotNil(t, err)
+	m, err := readManifestFile(filepath.Join(options.DirPath, manifestFileName))
+	assert.Nil(t, err)
+	assert.Equal(t, mergeFin.Generation, m.Generation)
+	_, err = os.Stat(mergePath)
+	assert.Nil(t, err)
+
+	// the next open rolls the installation forward.
+	assert.Nil(t, os.RemoveAll(last))
+	db, err = Open(options)
+	assert.Nil(t, err)
+	_, err = os.Stat(mergePath)
+	assert.True(t, os.IsNotExist(err))
+	assert.Equal(t, 100000, db.Stat().KeysNum)
+	for i := 0; i < 100000; i++ {
+		val, err := db.Get(utils.GetTestKey(i))
+		assert.Nil(t, err)
+		assert.NotNil(t, val)
+	}
+}
+
+func TestManifest_Migrate_Legacy(t *testing.T) {
+	options := DefaultOptions
+	db, err := Open(options)
+	assert.Nil(t, err)
+	defer destroyDB(db)
+
+	generateData(t, db, 0, 10000, 128)
+	err = db.Merge(true)
+	assert.Nil(t, err)
+	generateData(t, db, 10000, 20000, 128)
+	mergeFinSegmentId := db.manifest.MergeFinSegmentId
+	assert.Nil(t, db.Close())
+
+	// rewrite the directory into the layout used before the manifest was introduced.
+	assert.Nil(t, os.Remove(filepath.Join(options.DirPath, manifestFileName)))
+	finFile, err := wal.Open(wal.Options{
+		DirPath:        options.DirPath,
+		SegmentSize:    GB,
+		SegmentFileExt: mergeFinNameSuffix,
+	})
+	assert.Nil(t, err)
+	buf := make([]byte, 4)
+	binary.LittleEndian.PutUint32(buf, mergeFinSegmentId)
+	_, err = finFile.Write(buf)
+	assert.Nil(t, err)
+	assert.Nil(t, finFile.Close())
+
+	db, err = Open(options)
+	assert.Nil(t, err)
+	assert.Equal(t, mergeFinSegmentId, db.manifest.MergeFinSegmentId)
+	_, err = os.Stat(wal.SegmentFileName(options.DirPath, mergeFinNameSuffix, 1))
+	assert.True(t, os.IsNotExist(err))
+	assert.Equal(t, 20000, db.Stat().KeysNum)
+}
@@ -1,15 +1,19 @@
 package memdb
 
 import (
+	"context"
 	"encoding/binary"
+	"errors"
 	"fmt"
 	"io"
 	"math"
 	"os"
 	"path/filepath"
+	"sort"
 	"sync/atomic"
 	"time"
 
+	"github.com/hupeh/memdb/utils"
 	"github.com/rosedblabs/wal"
 	"github.com/valyala/bytebufferpool"
 )
@@ -17,6 +21,8 @@ import (
 const (
 	mergeDirSuffixName   = "-merge"
 	mergeFinishedBatchID = 0
+	// mergeProgressInterval is how many bytes are scanned between two progress reports.
+	mergeProgressInterval = 4 * MB
 )
 
 // Merge merges all the data files in the database.
@@ -26,77 +32,321 @@ const (
 // Merge operation maybe a very time-consuming operation when the database is large.
 // So it is recommended to perform this operation when the database is idle.
 //
-// If reopenAfterDone is true, the original file will be replaced by the merge file,
-// and db's index will be rebuilt after the merge completes.
+// If reopenAfterDone is true, the original file will be replaced by the merge file
+// while the database stays open. The positions of the merged keys are patched
+// in the index from the hint file, so the database is only blocked for
+// the short time of swapping the files. If swapping the files fails,
+// the database is closed and ErrMergeInstallFailed is returned,
+// the installation is finished when the database is opened again.
+// Otherwise, the merge file will be installed the next time the database is opened.
 func (db *DB) Merge(reopenAfterDone bool) error {
-	if err := db.doMerge(); err != nil {
-		return err
+	return db.MergeWithOptions(context.Background(), MergeOptions{ReopenAfterDone: reopenAfterDone})
+}
+
+// MergeWithOptions is like Merge, but the merge can be throttled,
+// observed and cancelled.
+//
+// If the context is cancelled before the merge files are complete,
+// the partial merge directory is removed and the context error is returned,
+// the database is left as it was before the merge.
+func (db *DB) MergeWithOptions(ctx context.Context, opts MergeOptions) error {
+	return db.merge(ctx, MergeTriggerManual, opts).Err
+}
+
+// merge runs a merge operation, and records the result in the merge history.
+func (db *DB) merge(ctx context.Context, trigger MergeTrigger, opts MergeOptions) MergeResult {
+	result := MergeResult{Trigger: trigger, StartTime: time.Now()}
+	// check if the merge operation is running,
+	// the flag is held until the merge files are installed.
+	if !atomic.CompareAndSwapUint32(&db.mergeRunning, 0, 1) {
+		result.Err = ErrMergeRunning
+		return result
 	}
-	if !reopenAfterDone {
-		return nil
+	defer atomic.StoreUint32(&db.mergeRunning, 0)
+
+	live, dead := db.segmentStats.total()
+	result.BytesBefore = live + dead
+	db.mergeTracker.start(trigger, result.StartTime)
+	onProgress := opts.OnProgress
+	opts.OnProgress = func(progress MergeProgress) {
+		db.mergeTracker.update(progress)
+		if onProgress != nil {
+			onProgress(progress)
+		}
+	}
+
+	var err error
+	if opts.Incremental {
+		err = db.doIncrementalMerge(ctx, opts)
+	} else {
+		var changes *mergeChanges
+		changes, err = db.doMerge(ctx, opts)
+		if err == nil && opts.ReopenAfterDone && changes != nil {
+			err = db.installMergeFiles(changes)
+		}
+	}
+
+	live, dead = db.segmentStats.total()
+	result.BytesAfter = live + dead
+	result.Duration = time.Since(result.StartTime)
+	result.Err = err
+	db.mergeTracker.finish(&result)
+	return result
+}
+
+// MergeTrigger is what started a merge operation.
+type MergeTrigger = byte
+
+const (
+	// MergeTriggerManual is a merge started by calling Merge.
+	MergeTriggerManual MergeTrigger = iota
+	// MergeTriggerCron is a merge started by Options.AutoMergeCronExpr.
+	MergeTriggerCron
+	// MergeTriggerGarbage is a merge started when the dead bytes pass
+	// Options.AutoMergeDeadRatio or Options.AutoMergeReclaimableSize.
+	MergeTriggerGarbage
+)
+
+// MergeResult describes a finished merge operation.
+type MergeResult struct {
+	Trigger   MergeTrigger
+	StartTime time.Time
+	Duration  time.Duration
+	// BytesBefore and BytesAfter are the size of the data files before and after the merge,
+	// they are the same if the merge files are not installed until the database is opened again.
+	BytesBefore int64
+	BytesAfter  int64
+	Progress    MergeProgress // the final progress of the merge
+	Err         error         // nil if the merge succeeded
+}
+
+// MergeProgress describes how far a running merge operation has gone.
+type MergeProgress struct {
+	BytesScanned   int64 // bytes read from the segments being merged
+	BytesWritten   int64 // bytes written to the merge files
+	RecordsKept    int64 // records rewritten to the merge files
+	RecordsDropped int64 // records dropped because they are not valid data
+}
+
+// mergeChanges describes how the index should be patched after a merge is installed.
+type mergeChanges struct {
+	mergeFinSegmentId wal.SegmentID
+	selected          []wal.SegmentID     // segments rewritten by the merge, sorted
+	clean             []wal.SegmentID     // segments left alone by the merge, sorted
+	freeIds           []wal.SegmentID     // ids the merged segments can be renamed to, sorted
+	outputs           []wal.SegmentID     // ids of the merged segments, sorted
+	expiredKeys       map[uint32][][]byte // keys whose record was dropped by the merge because it is expired, by namespace ids
+}
+
+// installMergeFiles replaces the original files with the merge files without closing the database.
+//
+// All the keys whose position is still in the rewritten segments get the new position
+// from the hint file. The keys written, or deleted, while the merge was running
+// point to the newer segments, so they are left unchanged.
+//
+// If it fails after the data files are closed, the database is closed
+// and ErrMergeInstallFailed is returned, see failInstall.
+func (db *DB) installMergeFiles(changes *mergeChanges) error {
+	// read the new positions before blocking the database,
+	// the hint records of the segments left alone are not needed.
+	var keys [][]byte
+	var positions []*wal.ChunkPosition
+	var namespaces []uint32
+	err := iterateHintFile(mergeDirPath(db.options.DirPath), manifestVersion, func(key []byte, position *wal.ChunkPosition, _ int64, namespace uint32) {
+		if containsSegment(changes.outputs, position.SegmentId) {
+			keys = append(keys, key)
+			positions = append(positions, position)
+			namespaces = append(namespaces, namespace)
+		}
+	})
+	if err != nil {
+		return err
 	}
 
 	db.mu.Lock()
 	defer db.mu.Unlock()
+	if db.closed {
+		return ErrDBClosed
+	}
 
-	// close current files
-	_ = db.closeFiles()
+	// close current files, they can't be used anymore even if it fails.
+	// The open iterators keep reading them, they are closed by the last one.
+	err = db.walPins.retire(db.dataFiles)
+	db.dataFiles = nil
+	if err != nil {
+		return db.failInstall(err)
+	}
 
 	// replace original file
-	err := loadMergeFiles(db.options.DirPath)
+	m, err := loadMergeFiles(db.options.DirPath, db.manifest)
 	if err != nil {
-		return err
+		return db.failInstall(err)
 	}
+	db.manifest = m
 
 	// open data files
 	if db.dataFiles, err = db.openWalFiles(); err != nil {
+		return db.failInstall(err)
+	}
+
+	// patch the index with the positions in the merged segments.
+	merged := func(ks *keyspace, key []byte) bool {
+		position := ks.index.Get(key)
+		return position != nil && containsSegment(changes.selected, position.SegmentId)
+	}
+	// the keys dropped by the merge because they are expired are deleted with an expired record,
+	// before the stats of the segments holding them are removed.
+	for id, keys := range changes.expiredKeys {
+		ks := db.keyspaces[id]
+		if ks == nil {
+			continue
+		}
+		var expiredKeys [][]byte
+		for _, key := range keys {
+			if merged(ks, key) {
+				expiredKeys = append(expiredKeys, key)
+			}
+		}
+		if err = db.expireKeys(ks, expiredKeys, db.now().UnixNano()); err != nil {
+			return db.failInstall(err)
+		}
+	}
+
+	isSelected := func(id wal.SegmentID) bool {
+		return containsSegment(changes.selected, id)
+	}
+	db.segmentStats.remove(isSelected)
+	for _, ks := range db.keyspaces {
+		if ks.live != nil {
+			ks.live.remove(isSelected)
+		}
+	}
+	for i, key := range keys {
+		db.segmentStats.written(positions[i])
+		// the records of the namespaces dropped while merging are dead
+		if ks := db.keyspaces[namespaces[i]]; ks != nil && merged(ks, key) {
+			ks.index.Put(key, positions[i])
+			db.indexed(ks, positions[i])
+		}
+	}
+
+	return nil
+}
+
+// failInstall closes the database when the merge files fail to install.
+//
+// Once the data files are closed the index may point to segments which have
+// been replaced, or only partly replaced, by the merged ones, so the database
+// can neither go on nor go back. It is closed instead, the next Open
+// rolls the installation forward and loads the index from the files on disk.
+func (db *DB) failInstall(err error) error {
+	errs := append([]error{fmt.Errorf("%w: %w", ErrMergeInstallFailed, err)}, db.shutdown()...)
+	return errors.Join(errs...)
+}
+
+func (db *DB) doMerge(ctx context.Context, opts MergeOptions) (*mergeChanges, error) {
+	maxId, err := db.rotateForMerge()
+	if err != nil || maxId == 0 {
+		return nil, err
+	}
+
+	selected, err := db.selectMergeSegments(maxId)
+	if err != nil || len(selected) == 0 {
+		return nil, err
+	}
+	changes, err := db.newMergeChanges(maxId, selected)
+	if err != nil {
+		return nil, err
+	}
+	if err = db.writeMergeFiles(ctx, opts, changes, &MergeProgress{}); err != nil {
+		return nil, err
+	}
+	return changes, nil
+}
+
+// doIncrementalMerge merges the selected segments in groups of MergeOptions.SegmentsPerStep,
+// and installs the merged segments of every group before merging the next one.
+// So the extra disk space needed is about the live data of one group,
+// instead of the live data of the whole database.
+//
+// If the merge fails or is cancelled, the groups already merged stay installed.
+func (db *DB) doIncrementalMerge(ctx context.Context, opts MergeOptions) error {
+	maxId, err := db.rotateForMerge()
+	if err != nil || maxId == 0 {
 		return err
 	}
 
-	// discard the old index first.
-	db.index = newBTree(db.options.LessFunc)
-	// rebuild index
-	if err = db.loadIndex(); err != nil {
+	selected, err := db.selectMergeSegments(maxId)
+	if err != nil {
 		return err
 	}
+	step := opts.SegmentsPerStep
+	if step <= 0 {
+		step = 1
+	}
 
+	var progress MergeProgress
+	for i := 0; i < len(selected); i += step {
+		if err = ctx.Err(); err != nil {
+			return err
+		}
+		group := selected[i:min(i+step, len(selected))]
+		// the segment files have been changed by the previous steps,
+		// so the changes are computed again for every group.
+		changes, err := db.newMergeChanges(maxId, group)
+		if err != nil {
+			return err
+		}
+		if err = db.writeMergeFiles(ctx, opts, changes, &progress); err != nil {
+			return err
+		}
+		if err = db.installMergeFiles(changes); err != nil {
+			return err
+		}
+	}
 	return nil
 }
 
-func (db *DB) doMerge() error {
+// rotateForMerge creates a new active segment file, so all the older segment files
+// can be merged while the subsequent writes go to the new one.
+// It returns the id of the last segment to be merged, or 0 if the database is empty.
+func (db *DB) rotateForMerge() (wal.SegmentID, error) {
 	db.mu.Lock()
+	defer db.mu.Unlock()
 	// check if the database is closed
 	if db.closed {
-		db.mu.Unlock()
-		return ErrDBClosed
+		return 0, ErrDBClosed
 	}
 	// check if the data files is empty
 	if db.dataFiles.IsEmpty() {
-		db.mu.Unlock()
-		return nil
+		return 0, nil
 	}
-	// check if the merge operation is running
-	if atomic.LoadUint32(&db.mergeRunning) == 1 {
-		db.mu.Unlock()
-		return ErrMergeRunning
+	// the merge only keeps the records in the index, so the merge operands
+	// and the records they are appended to are folded into the values first.
+	// No more operands are appended until the merge is done, see Batch.Append.
+	if err := db.foldOperands(); err != nil {
+		return 0, err
 	}
-	// set the mergeRunning flag to true
-	atomic.StoreUint32(&db.mergeRunning, 1)
-	// set the mergeRunning flag to false when the merge operation is completed
-	defer atomic.StoreUint32(&db.mergeRunning, 0)
 
 	prevActiveSegId := db.dataFiles.ActiveSegmentID()
 	// rotate the write-ahead log, create a new active segment file.
 	// so all the older segment files will be merged.
 	if err := db.dataFiles.OpenNewActiveSegment(); err != nil {
-		db.mu.Unlock()
-		return err
+		return 0, err
 	}
-
 	// we can unlock the mutex here, because the write-ahead log files has been rotated,
 	// and the new active segment file will be used for the subsequent writes.
 	// Our Merge operation will only read from the older segment files.
-	db.mu.Unlock()
+	return prevActiveSegId, nil
+}
+
+// writeMergeFiles rewrites the live records of the selected segments into the merge directory,
+// together with the hint file and the manifest to be installed.
+// The progress is accumulated into the given one.
+func (db *DB) writeMergeFiles(ctx context.Context, opts MergeOptions, changes *mergeChanges, progress *MergeProgress) error {
+	db.mu.RLock()
+	generation, comparator := db.manifest.Generation+1, db.manifest.Comparator
+	db.mu.RUnlock()
 
 	// open a merge db to write the data to the new data file.
 	// delete the merge directory if it exists and create a new one.
@@ -104,73 +354,302 @@ func (db *DB) doMerge() error {
 	if err != nil {
 		return err
 	}
+	finished := false
 	defer func() {
 		_ = mergeDB.Close()
+		// the partial merge files are useless, remove them at once
+		// instead of leaving them to the next time the database is opened.
+		if !finished {
+			_ = os.RemoveAll(mergeDB.options.DirPath)
+		}
 	}()
 
 	buf := bytebufferpool.Get()
-	now := time.Now().UnixNano()
+	now := db.now().UnixNano()
 	defer bytebufferpool.Put(buf)
 
-	// iterate all the data files, and write the valid data to the new data file.
-	reader := db.dataFiles.NewReaderWithMax(prevActiveSegId)
-	for {
-		buf.Reset()
-		chunk, position, err := reader.Next()
-		if err != nil {
-			if err == io.EOF {
-				break
-			}
-			return err
+	limiter := utils.NewRateLimiter(opts.RateLimitBytesPerSec)
+	lastReport := progress.BytesScanned
+	report := func() {
+		if opts.OnProgress != nil {
+			opts.OnProgress(*progress)
 		}
-		record := decodeLogRecord(chunk)
-		// Only handle the normal log record, LogRecordDeleted and LogRecordBatchFinished
-		// will be ignored, because they are not valid data.
-		if record.Type == LogRecordNormal && (record.Expire == 0 || record.Expire > now) {
+		lastReport = progress.BytesScanned
+	}
+
+	// iterate the selected data files, and write the valid data to the new data file.
+	for _, segmentId := range changes.selected {
+		reader := newSegmentReader(db.dataFiles, segmentId)
+		for {
+			buf.Reset()
+			chunk, position, err := reader.Next()
+			if err != nil {
+				if err == io.EOF {
+					break
+				}
+				return err
+			}
+			if err = limiter.WaitN(ctx, int(position.ChunkSize)); err != nil {
+				return err
+			}
+			progress.BytesScanned += int64(position.ChunkSize)
+			if progress.BytesScanned-lastReport >= mergeProgressInterval {
+				report()
+			}
+
+			record := decodeLogRecord(chunk)
+			// Only handle the normal log record, LogRecordDeleted and LogRecordBatchFinished
+			// will be ignored, because they are not valid data.
+			if record.Type != LogRecordNormal {
+				progress.RecordsDropped++
+				continue
+			}
+			// the records of the dropped namespaces are not in any index
+			var indexPos *wal.ChunkPosition
 			db.mu.RLock()
-			indexPos := db.index.Get(record.Key)
+			if ks := db.keyspaces[record.Namespace]; ks != nil {
+				indexPos = ks.index.Get(record.Key)
+			}
 			db.mu.RUnlock()
-			if indexPos != nil && positionEquals(indexPos, position) {
-				// clear the batch id of the record,
-				// all data after merge will be valid data, so the batch id should be 0.
-				record.BatchId = mergeFinishedBatchID
-				// Since the mergeDB will never be used for any read or write operations,
-				// it is not necessary to update the index.
-				newPosition, err := mergeDB.dataFiles.Write(encodeLogRecord(record, mergeDB.encodeHeader, buf))
-				if err != nil {
-					return err
-				}
-				// And now we should write the new position to the write-ahead log,
-				// which is so-called HINT FILE in bitcask paper.
-				// The HINT FILE will be used to rebuild the index quickly when the database is restarted.
-				_, err = mergeDB.hintFile.Write(encodeHintRecord(record.Key, newPosition))
-				if err != nil {
-					return err
+			if indexPos == nil || !positionEquals(indexPos, position) {
+				progress.RecordsDropped++
+				continue
+			}
+			if record.IsExpired(now) {
+				// the key is still in the index, it should be removed
+				// when the merge files are installed.
+				if changes.expiredKeys == nil {
+					changes.expiredKeys = make(map[uint32][][]byte)
 				}
+				changes.expiredKeys[record.Namespace] = append(changes.expiredKeys[record.Namespace], record.Key)
+				progress.RecordsDropped++
+				continue
+			}
+
+			// clear the batch id of the record,
+			// all data after merge will be valid data, so the batch id should be 0.
+			record.BatchId = mergeFinishedBatchID
+			// Since the mergeDB will never be used for any read or write operations,
+			// it is not necessary to update the index.
+			encRecord := encodeLogRecord(record, mergeDB.encodeHeader, buf)
+			if err = limiter.WaitN(ctx, len(encRecord)); err != nil {
+				return err
+			}
+			newPosition, err := mergeDB.dataFiles.Write(encRecord)
+			if err != nil {
+				return err
+			}
+			progress.BytesWritten += int64(newPosition.ChunkSize)
+			progress.RecordsKept++
+			// the merged segment will be renamed to a free segment id when the merge is done.
+			if int(newPosition.SegmentId) > len(changes.freeIds) {
+				return ErrMergeNoFreeSegment
+			}
+			newPosition.SegmentId = changes.freeIds[newPosition.SegmentId-1]
+			// And now we should write the new position to the write-ahead log,
+			// which is so-called HINT FILE in bitcask paper.
+			// The HINT FILE will be used to rebuild the index quickly when the database is restarted.
+			_, err = mergeDB.hintFile.Write(encodeHintRecord(record.Namespace, record.Key, newPosition, record.Expire))
+			if err != nil {
+				return err
 			}
 		}
+		report()
+	}
+
+	// The segments which are not selected are kept as they are,
+	// but the index for them should also be loaded from the hint file,
+	// because all the segments at or below the merge finished segment id are not replayed.
+	if err = db.writeCleanSegmentHints(mergeDB.hintFile, changes); err != nil {
+		return err
+	}
+
+	// the merged data must be durable before the merge is marked as finished.
+	if err = mergeDB.dataFiles.Sync(); err != nil {
+		return err
+	}
+	if err = mergeDB.hintFile.Sync(); err != nil {
+		return err
+	}
+	if err = mergeDB.Close(); err != nil {
+		return err
+	}
+	if changes.outputs, err = renameMergedSegments(mergeDB.options.DirPath, changes.freeIds); err != nil {
+		return err
 	}
 
 	// After rewrite all the data, we should add a file to indicate that the merge operation is completed.
 	// So when we restart the database, we can know that the merge is completed if the file exists,
 	// otherwise, we will delete the merge directory and redo the merge operation again.
-	mergeFinFile, err := mergeDB.openMergeFinishedFile()
-	if err != nil {
-		return err
+	// The file holds the manifest which will be installed with the merged files.
+	mergeFin := &manifest{
+		Version:           manifestVersion,
+		Generation:        generation,
+		Comparator:        comparator,
+		MergeFinSegmentId: changes.mergeFinSegmentId,
+		Segments:          mergeSegmentIds(changes.clean, changes.outputs),
 	}
-	_, err = mergeFinFile.Write(encodeMergeFinRecord(prevActiveSegId))
-	if err != nil {
+	// the last chance to give up the merge.
+	if err = ctx.Err(); err != nil {
 		return err
 	}
-	// close the merge finished file
-	if err := mergeFinFile.Close(); err != nil {
+	if err = writeManifestFile(wal.SegmentFileName(mergeDB.options.DirPath, mergeFinNameSuffix, 1), mergeFin); err != nil {
 		return err
 	}
+	finished = true
 
-	// all done successfully, return nil
+	// all done successfully
 	return nil
 }
 
+// selectMergeSegments decides which segments at or below maxId will be rewritten.
+//
+// If Options.MergeSegmentDeadRatio is 0, all the segments will be rewritten.
+// Otherwise, only the segments whose dead ratio reaches it will be rewritten,
+// and the others are left alone.
+func (db *DB) selectMergeSegments(maxId wal.SegmentID) ([]wal.SegmentID, error) {
+	ids, err := listSegmentIds(db.options.DirPath, dataFileNameSuffix, maxId)
+	if err != nil {
+		return nil, err
+	}
+	if db.options.MergeSegmentDeadRatio <= 0 {
+		return ids, nil
+	}
+
+	var selected []wal.SegmentID
+	db.segmentStats.mu.Lock()
+	for _, id := range ids {
+		stat, ok := db.segmentStats.segments[id]
+		if ok && stat.dead > 0 && float64(stat.dead)/float64(stat.live+stat.dead) >= db.options.MergeSegmentDeadRatio {
+			selected = append(selected, id)
+		}
+	}
+	db.segmentStats.mu.Unlock()
+	return selected, nil
+}
+
+// newMergeChanges describes a merge which rewrites the selected segments,
+// and leaves the other segments at or below maxId alone.
+//
+// The merged data is written into the ids of the rewritten segments,
+// and the ids which are no longer used by any segment file.
+func (db *DB) newMergeChanges(maxId wal.SegmentID, selected []wal.SegmentID) (*mergeChanges, error) {
+	ids, err := listSegmentIds(db.options.DirPath, dataFileNameSuffix, maxId)
+	if err != nil {
+		return nil, err
+	}
+
+	changes := &mergeChanges{mergeFinSegmentId: maxId}
+	for _, id := range ids {
+		if containsSegment(selected, id) {
+			changes.selected = append(changes.selected, id)
+		} else {
+			changes.clean = append(changes.clean, id)
+		}
+	}
+	for id := wal.SegmentID(1); id <= maxId; id++ {
+		if !containsSegment(changes.clean, id) {
+			changes.freeIds = append(changes.freeIds, id)
+		}
+	}
+	return changes, nil
+}
+
+// writeCleanSegmentHints writes the hint records for the keys in the segments which are not rewritten.
+func (db *DB) writeCleanSegmentHints(hintFile *wal.WAL, changes *mergeChanges) error {
+	if len(changes.clean) == 0 {
+		return nil
+	}
+
+	var keys [][]byte
+	var positions []*wal.ChunkPosition
+	var expires []int64
+	var namespaces []uint32
+	db.mu.RLock()
+	for _, ks := range db.keyspaces {
+		ks.index.Ascend(func(key []byte, position *wal.ChunkPosition) (bool, error) {
+			if containsSegment(changes.clean, position.SegmentId) {
+				keys = append(keys, key)
+				positions = append(positions, position)
+				expires = append(expires, ks.expires.get(key))
+				namespaces = append(namespaces, ks.id)
+			}
+			return true, nil
+		})
+	}
+	db.mu.RUnlock()
+
+	for i, key := range keys {
+		if _, err := hintFile.Write(encodeHintRecord(namespaces[i], key, positions[i], expires[i])); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// renameMergedSegments renames the merged segments, which are numbered from 1,
+// to the free segment ids, and removes the empty ones.
+// It returns the ids of the renamed segments.
+func renameMergedSegments(mergePath string, freeIds []wal.SegmentID) ([]wal.SegmentID, error) {
+	ids, err := listSegmentIds(mergePath, dataFileNameSuffix, math.MaxUint32)
+	if err != nil {
+		return nil, err
+	}
+	nonEmpty, err := mergedSegmentIds(mergePath, math.MaxUint32)
+	if err != nil {
+		return nil, err
+	}
+
+	// rename from the largest id, the free id of a segment is never less than its own id,
+	// so it will not overwrite a segment which is not renamed yet.
+	var outputs []wal.SegmentID
+	for i := len(ids) - 1; i >= 0; i-- {
+		id := ids[i]
+		path := wal.SegmentFileName(mergePath, dataFileNameSuffix, id)
+		if !containsSegment(nonEmpty, id) {
+			if err = os.Remove(path); err != nil {
+				return nil, err
+			}
+			continue
+		}
+		if int(id) > len(freeIds) {
+			return nil, ErrMergeNoFreeSegment
+		}
+		freeId := freeIds[id-1]
+		if freeId != id {
+			if err = os.Rename(path, wal.SegmentFileName(mergePath, dataFileNameSuffix, freeId)); err != nil {
+				return nil, err
+			}
+		}
+		outputs = append(outputs, freeId)
+	}
+	sort.Slice(outputs, func(i, j int) bool { return outputs[i] < outputs[j] })
+	return outputs, nil
+}
+
+// newSegmentReader returns a reader which only reads the given segment of the WAL.
+func newSegmentReader(dataFiles *wal.WAL, segmentId wal.SegmentID) *wal.Reader {
+	reader := dataFiles.NewReaderWithMax(segmentId)
+	for reader.CurrentSegmentId() < segmentId {
+		reader.SkipCurrentSegment()
+	}
+	return reader
+}
+
+// containsSegment reports whether the sorted ids contain the id.
+func containsSegment(ids []wal.SegmentID, id wal.SegmentID) bool {
+	i := sort.Search(len(ids), func(i int) bool { return ids[i] >= id })
+	return i < len(ids) && ids[i] == id
+}
+
+// mergeSegmentIds returns the sorted union of two sorted id lists.
+func mergeSegmentIds(a, b []wal.SegmentID) []wal.SegmentID {
+	ids := make([]wal.SegmentID, 0, len(a)+len(b))
+	ids = append(append(ids, a...), b...)
+	sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+	return ids
+}
+
 func (db *DB) openMergeDB() (*DB, error) {
 	mergePath := mergeDirPath(db.options.DirPath)
 	// delete the merge directory if it exists
@@ -181,7 +660,17 @@ func (db *DB) openMergeDB() (*DB, error) {
 	// we don't need to use the original sync policy,
 	// because we can sync the data file manually after the merge operation is completed.
 	options.Sync, options.BytesPerSync = false, 0
+	// the merge db is only written once, it needs neither auto merge nor watch.
+	options.AutoMergeCronExpr, options.AutoMergeDeadRatio, options.AutoMergeReclaimableSize = "", 0, 0
+	options.WatchQueueSize = 0
+	options.OnLoadProgress = nil
+	options.ActiveExpireInterval = 0
+	// the index of the merge db is never used.
+	options.IndexType = IndexBTree
+	options.IndexCheckpoint = false
 	options.DirPath = mergePath
+	// the options of the database hold the resolved comparator, see Open.
+	options.Comparator, options.LessFunc = Comparator{Name: db.comparator, Less: db.lessFunc}, nil
 	mergeDB, err := Open(options)
 	if err != nil {
 		return nil, err
@@ -209,93 +698,148 @@ func mergeDirPath(dirPath string) string {
 	return filepath.Join(dir, base+mergeDirSuffixName)
 }
 
-func (db *DB) openMergeFinishedFile() (*wal.WAL, error) {
-	return wal.Open(wal.Options{
-		DirPath:        db.options.DirPath,
-		SegmentSize:    GB,
-		SegmentFileExt: mergeFinNameSuffix,
-		Sync:           false,
-		BytesPerSync:   0,
-	})
-}
-
 func positionEquals(a, b *wal.ChunkPosition) bool {
 	return a.SegmentId == b.SegmentId &&
 		a.BlockNumber == b.BlockNumber &&
 		a.ChunkOffset == b.ChunkOffset
 }
 
-// loadMergeFiles loads all the merge files, and copy the data to the original data directory.
-// If there is no merge files, or the merge operation is not completed, it will return nil.
-func loadMergeFiles(dirPath string) error {
+// loadMergeFiles installs the merge files into the original data directory.
+// If there is no merge files, or the merge operation is not completed,
+// it will return the given manifest unchanged.
+//
+// The manifest of the merge is written to the data directory first,
+// which is the point where the merged files become the live data.
+// Then the merged segments and the hint file are moved in, and the stale
+// segments are removed. Every step can be safely repeated, so if the process crashes
+// in the middle of it, the next call will roll the installation forward.
+func loadMergeFiles(dirPath string, m *manifest) (_ *manifest, err error) {
 	// check if there is a merge directory
 	mergeDirPath := mergeDirPath(dirPath)
 	if _, err := os.Stat(mergeDirPath); err != nil {
 		// does not exist, just return.
 		if os.IsNotExist(err) {
-			return nil
+			return m, nil
 		}
-		return err
+		return nil, err
 	}
 
-	// remove the merge directory at last
+	// remove the merge directory at last. Once the merge is committed the directory
+	// holds the only copy of the segments not moved yet, so it is kept on error
+	// for the next call to roll the installation forward.
 	defer func() {
-		_ = os.RemoveAll(mergeDirPath)
+		if err == nil {
+			_ = os.RemoveAll(mergeDirPath)
+		}
 	}()
 
-	copyFile := func(suffix string, fileId uint32, force bool) {
-		srcFile := wal.SegmentFileName(mergeDirPath, suffix, fileId)
-		stat, err := os.Stat(srcFile)
-		if os.IsNotExist(err) {
-			return
+	mergeFin, err := readMergeFinFile(mergeDirPath, m)
+	if err != nil {
+		// if the merge finished file does not exist or is broken,
+		// the merge operation is not completed, the merge directory will be removed.
+		if os.IsNotExist(err) || errors.Is(err, ErrManifestCorrupted) {
+			return m, nil
 		}
-		if err != nil {
-			panic(fmt.Sprintf("loadMergeFiles: failed to get src file stat %v", err))
+		return nil, err
+	}
+	if mergeFin.Generation < m.Generation {
+		// the merge has been installed and superseded by a newer one.
+		return m, nil
+	}
+	if mergeFin.Generation > m.Generation {
+		// commit the merge, from now on the merged files are the live data.
+		if err = writeManifestFile(filepath.Join(dirPath, manifestFileName), mergeFin); err != nil {
+			return nil, err
 		}
-		if !force && stat.Size() == 0 {
-			return
+	}
+
+	moveFile := func(suffix string, fileId uint32) error {
+		srcFile := wal.SegmentFileName(mergeDirPath, suffix, fileId)
+		if _, err := os.Stat(srcFile); err != nil {
+			// the file has been moved already.
+			if os.IsNotExist(err) {
+				return nil
+			}
+			return err
 		}
 		destFile := wal.SegmentFileName(dirPath, suffix, fileId)
-		_ = os.Rename(srcFile, destFile)
+		if err := os.Remove(destFile); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		return os.Rename(srcFile, destFile)
 	}
 
-	// get the merge finished segment id
-	mergeFinSegmentId, err := getMergeFinSegmentId(mergeDirPath)
-	if err != nil {
-		return err
-	}
-	// now we get the merge finished segment id, so all the segment id less than the merge finished segment id
-	// should be moved to the original data directory, and the original data files should be deleted.
-	for fileId := uint32(1); fileId <= mergeFinSegmentId; fileId++ {
-		destFile := wal.SegmentFileName(dirPath, dataFileNameSuffix, fileId)
-		// will have bug here if continue, check it later.todo
-
-		// If we call Merge multiple times, some segment files will be deleted earlier, so just skip them.
-		// if _, err = os.Stat(destFile); os.IsNotExist(err) {
-		// 	continue
-		// } else if err != nil {
-		// 	return err
-		// }
-
-		// remove the original data file
-		if _, err = os.Stat(destFile); err == nil {
-			if err = os.Remove(destFile); err != nil {
-				return err
-			}
+	// move the merged data files to the original data directory,
+	// the original data files with the same id will be replaced.
+	for _, fileId := range mergeFin.Segments {
+		if err = moveFile(dataFileNameSuffix, fileId); err != nil {
+			return nil, err
 		}
-		// move the merge data file to the original data directory
-		copyFile(dataFileNameSuffix, fileId, false)
+	}
+	// there is only one hint file, so the file id is always 1.
+	if err = moveFile(hintFileNameSuffix, 1); err != nil {
+		return nil, err
+	}
+	// the original data files which are not replaced are invalid now.
+	if err = removeStaleSegments(dirPath, mergeFin); err != nil {
+		return nil, err
+	}
+	if err = syncDir(dirPath); err != nil {
+		return nil, err
 	}
 
-	// copy MERGEFINISHED and HINT files to the original data directory
-	// there is only one merge finished file, so the file id is always 1,
-	// the same as the hint file.
-	copyFile(mergeFinNameSuffix, 1, true)
-	copyFile(hintFileNameSuffix, 1, true)
+	return mergeFin, nil
+}
 
-	return nil
+// readMergeFinFile reads the manifest written by a completed merge operation.
+// A merge directory written before the manifest was introduced only records
+// the merge finished segment id, its manifest is derived from the merged segment files.
+func readMergeFinFile(mergePath string, m *manifest) (*manifest, error) {
+	mergeFin, err := readManifestFile(wal.SegmentFileName(mergePath, mergeFinNameSuffix, 1))
+	if !errors.Is(err, ErrManifestCorrupted) {
+		return mergeFin, err
+	}
+
+	mergeFinSegmentId, err := getMergeFinSegmentId(mergePath)
+	if err != nil {
+		return nil, err
+	}
+	if mergeFinSegmentId == 0 {
+		return nil, ErrManifestCorrupted
+	}
+	segments, err := mergedSegmentIds(mergePath, mergeFinSegmentId)
+	if err != nil {
+		return nil, err
+	}
+	return &manifest{
+		Version:           legacyManifestVersion,
+		Generation:        m.Generation + 1,
+		Comparator:        m.Comparator,
+		MergeFinSegmentId: mergeFinSegmentId,
+		Segments:          segments,
+	}, nil
 }
 
+// mergedSegmentIds returns the ids of the non-empty data files written by the merge.
+func mergedSegmentIds(mergePath string, maxId wal.SegmentID) ([]wal.SegmentID, error) {
+	ids, err := listSegmentIds(mergePath, dataFileNameSuffix, maxId)
+	if err != nil {
+		return nil, err
+	}
+	segments := ids[:0]
+	for _, id := range ids {
+		stat, err := os.Stat(wal.SegmentFileName(mergePath, dataFileNameSuffix, id))
+		if err != nil {
+			return nil, err
+		}
+		if stat.Size() > 0 {
+			segments = append(segments, id)
+		}
+	}
+	return segments, nil
+}
+
+// getMergeFinSegmentId reads the merge finished file written before the manifest was introduced.
 func getMergeFinSegmentId(mergePath string) (wal.SegmentID, error) {
 	// check if the merge operation is completed
 	mergeFinFile, err := os.Open(wal.SegmentFileName(mergePath, mergeFinNameSuffix, 1))
@@ -319,8 +863,41 @@ func getMergeFinSegmentId(mergePath string) (wal.SegmentID, error) {
 }
 
 func (db *DB) loadIndexFromHintFile() error {
+	err := iterateHintFile(db.options.DirPath, db.manifest.Version, func(key []byte, position *wal.ChunkPosition, expire int64, namespace uint32) {
+		// All the hint records are valid because it is generated by the merge operation.
+		// So just put them into the index without checking.
+		db.segmentStats.written(position)
+		// unless the namespace is dropped after the merge
+		if ks := db.keyspaces[namespace]; ks != nil {
+			db.putIndex(ks, key, position, expire)
+		}
+	})
+	if err != nil {
+		return err
+	}
+
+	// the segments covered by the hint file are not read, and the ones left alone
+	// by a selective merge still hold the dead records, all the bytes
+	// which are not referenced by a hint record are dead.
+	ids, err := listSegmentIds(db.options.DirPath, dataFileNameSuffix, db.manifest.MergeFinSegmentId)
+	if err != nil {
+		return err
+	}
+	for _, id := range ids {
+		info, err := os.Stat(wal.SegmentFileName(db.options.DirPath, dataFileNameSuffix, id))
+		if err != nil {
+			return err
+		}
+		db.segmentStats.sized(id, info.Size())
+	}
+	return nil
+}
+
+// iterateHintFile calls handleFn for each hint record in the hint file of the directory,
+// version is the version of the manifest written with the hint file.
+func iterateHintFile(dirPath string, version uint32, handleFn func(key []byte, position *wal.ChunkPosition, expire int64, namespace uint32)) error {
 	hintFile, err := wal.Open(wal.Options{
-		DirPath: db.options.DirPath,
+		DirPath: dirPath,
 		// we don't need to rotate the hint file, just write all data to the same file.
 		SegmentSize:    math.MaxInt64,
 		SegmentFileExt: hintFileNameSuffix,
@@ -343,11 +920,7 @@ func (db *DB) loadIndexFromHintFile() error {
 			}
 			return err
 		}
-
-		key, position := decodeHintRecord(chunk)
-		// All the hint records are valid because it is generated by the merge operation.
-		// So just put them into the index without checking.
-		db.index.Put(key, position)
+		handleFn(decodeHintRecord(chunk, version))
 	}
 	hintFile.SetIsStartupTraversal(false)
 	return nil
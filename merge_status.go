@@ -0,0 +1,87 @@
+package memdb
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// mergeHistorySize is the maximum number of finished merges kept in the history.
+const mergeHistorySize = 32
+
+// MergeStatus describes the running merge operation and the finished ones.
+type MergeStatus struct {
+	// Running indicates whether a merge is running now.
+	Running bool
+	// Trigger, StartTime and Progress describe the running merge,
+	// they are zero values if no merge is running.
+	Trigger   MergeTrigger
+	StartTime time.Time
+	Progress  MergeProgress
+	// LastResult is the result of the last finished merge, nil if there is none.
+	LastResult *MergeResult
+	// History holds the results of the recent finished merges, the oldest first.
+	History []MergeResult
+}
+
+// mergeTracker records the progress of the running merge and the results of the finished ones,
+// whatever started them.
+type mergeTracker struct {
+	mu        sync.Mutex
+	trigger   MergeTrigger
+	startTime time.Time
+	progress  MergeProgress
+	history   []MergeResult
+}
+
+func (t *mergeTracker) start(trigger MergeTrigger, startTime time.Time) {
+	t.mu.Lock()
+	t.trigger = trigger
+	t.startTime = startTime
+	t.progress = MergeProgress{}
+	t.mu.Unlock()
+}
+
+func (t *mergeTracker) update(progress MergeProgress) {
+	t.mu.Lock()
+	t.progress = progress
+	t.mu.Unlock()
+}
+
+// finish fills the final progress into the result, and appends it to the history.
+func (t *mergeTracker) finish(result *MergeResult) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	result.Progress = t.progress
+	if len(t.history) == mergeHistorySize {
+		copy(t.history, t.history[1:])
+		t.history = t.history[:mergeHistorySize-1]
+	}
+	t.history = append(t.history, *result)
+	t.trigger = 0
+	t.startTime = time.Time{}
+	t.progress = MergeProgress{}
+}
+
+// MergeStatus returns the status of the running merge operation,
+// and the results of the recent finished ones, including the merges
+// started by Options.AutoMergeCronExpr and the dead bytes thresholds.
+func (db *DB) MergeStatus() *MergeStatus {
+	t := db.mergeTracker
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	status := &MergeStatus{
+		Running:   atomic.LoadUint32(&db.mergeRunning) == 1,
+		Trigger:   t.trigger,
+		StartTime: t.startTime,
+		Progress:  t.progress,
+		History:   make([]MergeResult, len(t.history)),
+	}
+	copy(status.History, t.history)
+	if n := len(status.History); n > 0 {
+		last := status.History[n-1]
+		status.LastResult = &last
+	}
+	return status
+}
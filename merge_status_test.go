@@ -0,0 +1,100 @@
+package memdb
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDB_MergeStatus(t *testing.T) {
+	options := DefaultOptions
+	db, err := Open(options)
+	assert.Nil(t, err)
+	defer destroyDB(db)
+
+	status := db.MergeStatus()
+	assert.False(t, status.Running)
+	assert.Nil(t, status.LastResult)
+	assert.Equal(t, 0, len(status.History))
+
+	generateData(t, db, 0, 10000, 128)
+	generateData(t, db, 0, 10000, 128)
+
+	// observe the running merge from the progress callback
+	var running *MergeStatus
+	err = db.MergeWithOptions(context.Background(), MergeOptions{
+		ReopenAfterDone: true,
+		OnProgress: func(progress MergeProgress) {
+			if running == nil {
+				running = db.MergeStatus()
+			}
+		},
+	})
+	assert.Nil(t, err)
+	assert.NotNil(t, running)
+	assert.True(t, running.Running)
+	assert.Equal(t, MergeTriggerManual, running.Trigger)
+	assert.False(t, running.StartTime.IsZero())
+
+	status = db.MergeStatus()
+	assert.False(t, status.Running)
+	assert.True(t, status.StartTime.IsZero())
+	assert.NotNil(t, status.LastResult)
+	assert.Nil(t, status.LastResult.Err)
+	assert.True(t, status.LastResult.BytesAfter < status.LastResult.BytesBefore)
+	assert.Equal(t, int64(10000), status.LastResult.Progress.RecordsKept)
+	assert.Equal(t, 1, len(status.History))
+}
+
+func TestDB_MergeStatus_Failed(t *testing.T) {
+	options := DefaultOptions
+	db, err := Open(options)
+	assert.Nil(t, err)
+	defer destroyDB(db)
+
+	generateData(t, db, 0, 10000, 128)
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	err = db.MergeWithOptions(ctx, DefaultMergeOptions)
+	assert.Equal(t, context.Canceled, err)
+
+	status := db.MergeStatus()
+	assert.NotNil(t, status.LastResult)
+	assert.Equal(t, context.Canceled, status.LastResult.Err)
+	assert.Equal(t, status.LastResult.BytesBefore, status.LastResult.BytesAfter)
+}
+
+func TestDB_MergeStatus_History(t *testing.T) {
+	options := DefaultOptions
+	db, err := Open(options)
+	assert.Nil(t, err)
+	defer destroyDB(db)
+
+	for i := 0; i < mergeHistorySize+5; i++ {
+		generateData(t, db, 0, 100, 128)
+		assert.Nil(t, db.Merge(true))
+	}
+	status := db.MergeStatus()
+	assert.Equal(t, mergeHistorySize, len(status.History))
+	for i := 1; i < len(status.History); i++ {
+		assert.False(t, status.History[i].StartTime.Before(status.History[i-1].StartTime))
+	}
+	assert.Equal(t, status.History[mergeHistorySize-1], *status.LastResult)
+}
+
+func TestDB_MergeStatus_Auto_Merge(t *testing.T) {
+	options := DefaultOptions
+	options.AutoMergeCronExpr = "* * * * * *" // every second
+	db, err := Open(options)
+	assert.Nil(t, err)
+	defer destroyDB(db)
+
+	generateData(t, db, 0, 1000, 128)
+	time.Sleep(time.Millisecond * 2500)
+	status := db.MergeStatus()
+	assert.NotNil(t, status.LastResult)
+	assert.Equal(t, MergeTriggerCron, status.LastResult.Trigger)
+	assert.Nil(t, status.LastResult.Err)
+}
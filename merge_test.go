@@ -1,12 +1,17 @@
 package memdb
 
 import (
+	"context"
+	"math"
 	"math/rand"
 	"os"
+	"path/filepath"
 	"sync"
 	"testing"
+	"time"
 
 	"github.com/hupeh/memdb/utils"
+	"github.com/rosedblabs/wal"
 	"github.com/stretchr/testify/assert"
 )
 
@@ -303,3 +308,363 @@ func TestDB_Merge_Concurrent_Put(t *testing.T) {
 	assert.Equal(t, count, db.index.Size())
 
 }
+
+func TestDB_Merge_Online_Patch_Index(t *testing.T) {
+	options := DefaultOptions
+	// the expired keys are left to the merge
+	options.ActiveExpireInterval = 0
+	db, err := Open(options)
+	assert.Nil(t, err)
+	defer destroyDB(db)
+
+	for i := 0; i < 100000; i++ {
+		err := db.Put(utils.GetTestKey(i), utils.RandomValue(128))
+		assert.Nil(t, err)
+	}
+	for i := 100000; i < 110000; i++ {
+		err := db.PutWithTTL(utils.GetTestKey(i), utils.RandomValue(128), time.Millisecond*100)
+		assert.Nil(t, err)
+	}
+	time.Sleep(time.Millisecond * 200)
+
+	changes, err := db.doMerge(context.Background(), DefaultMergeOptions)
+	assert.Nil(t, err)
+	assert.Equal(t, 10000, len(changes.expiredKeys[defaultNamespaceId]))
+
+	// writes after the rotation must win over the merged records.
+	kvs := make(map[string][]byte)
+	for i := 0; i < 1000; i++ {
+		key, value := utils.GetTestKey(i), utils.RandomValue(128)
+		kvs[string(key)] = value
+		assert.Nil(t, db.Put(key, value))
+	}
+	for i := 1000; i < 2000; i++ {
+		assert.Nil(t, db.Delete(utils.GetTestKey(i)))
+	}
+
+	err = db.installMergeFiles(changes)
+	assert.Nil(t, err)
+	_, err = os.Stat(mergeDirPath(options.DirPath))
+	assert.True(t, os.IsNotExist(err))
+
+	check := func(db *DB) {
+		assert.Equal(t, 99000, db.index.Size())
+		for i := 0; i < 110000; i++ {
+			key := utils.GetTestKey(i)
+			val, err := db.Get(key)
+			switch {
+			case i < 1000:
+				assert.Nil(t, err)
+				assert.Equal(t, kvs[string(key)], val)
+			case i < 2000 || i >= 100000:
+				assert.Equal(t, ErrKeyNotFound, err)
+			default:
+				assert.Nil(t, err)
+				assert.NotNil(t, val)
+			}
+		}
+	}
+	check(db)
+
+	// the patched index must be the same as the one loaded from disk.
+	assert.Nil(t, db.Close())
+	db2, err := Open(options)
+	assert.Nil(t, err)
+	defer func() {
+		_ = db2.Close()
+	}()
+	check(db2)
+}
+
+func TestDB_Merge_Online_Install_Failed(t *testing.T) {
+	options := DefaultOptions
+	db, err := Open(options)
+	assert.Nil(t, err)
+	defer destroyDB(db)
+
+	kvs := make(map[string][]byte)
+	for i := 0; i < 100000; i++ {
+		key, value := utils.GetTestKey(i), utils.RandomValue(128)
+		kvs[string(key)] = value
+		assert.Nil(t, db.Put(key, value))
+	}
+	for i := 0; i < 50000; i++ {
+		key, value := utils.GetTestKey(i), utils.RandomValue(128)
+		kvs[string(key)] = value
+		assert.Nil(t, db.Put(key, value))
+	}
+
+	changes, err := db.doMerge(context.Background(), DefaultMergeOptions)
+	assert.Nil(t, err)
+	assert.True(t, len(changes.outputs) > 0)
+
+	// make the move of the last merged segment fail after the manifest is committed.
+	last := wal.SegmentFileName(options.DirPath, dataFileNameSuffix, changes.outputs[len(changes.outputs)-1])
+	assert.Nil(t, os.Remove(last))
+	assert.Nil(t, os.MkdirAll(filepath.Join(last, "block"), os.ModePerm))
+
+	err = db.installMergeFiles(changes)
+	assert.ErrorIs(t, err, ErrMergeInstallFailed)
+	assert.Equal(t, ErrDBClosed, db.Put(utils.GetTestKey(0), utils.RandomValue(128)))
+	_, err = db.Get(utils.GetTestKey(0))
+	assert.Equal(t, ErrDBClosed, err)
+	assert.Nil(t, db.Close())
+
+	// the next open finishes the installation.
+	assert.Nil(t, os.RemoveAll(last))
+	db, err = Open(options)
+	assert.Nil(t, err)
+	_, err = os.Stat(mergeDirPath(options.DirPath))
+	assert.True(t, os.IsNotExist(err))
+	assert.Equal(t, len(kvs), db.index.Size())
+	for key, value := range kvs {
+		val, err := db.Get([]byte(key))
+		assert.Nil(t, err)
+		assert.Equal(t, value, val)
+	}
+}
+
+func TestDB_Merge_Selective(t *testing.T) {
+	options := DefaultOptions
+	options.SegmentSize = MB
+	options.MergeSegmentDeadRatio = 0.5
+	db, err := Open(options)
+	assert.Nil(t, err)
+	defer destroyDB(db)
+
+	// the first segments are overwritten later, the following ones stay clean.
+	kvs := make(map[string][]byte)
+	put := func(start, end int) {
+		for i := start; i < end; i++ {
+			key, value := utils.GetTestKey(i), utils.RandomValue(128)
+			kvs[string(key)] = value
+			assert.Nil(t, db.Put(key, value))
+		}
+	}
+	put(0, 20000)
+	dirtyMax := db.dataFiles.ActiveSegmentID() - 1
+	put(20000, 40000)
+	cleanMax := db.dataFiles.ActiveSegmentID() - 1
+	for i := 0; i < 20000; i++ {
+		assert.Nil(t, db.Delete(utils.GetTestKey(i)))
+		delete(kvs, string(utils.GetTestKey(i)))
+	}
+	put(0, 2000)
+
+	cleanFiles := make(map[wal.SegmentID]os.FileInfo)
+	for id := dirtyMax + 2; id <= cleanMax; id++ {
+		stat, err := os.Stat(wal.SegmentFileName(options.DirPath, dataFileNameSuffix, id))
+		assert.Nil(t, err)
+		cleanFiles[id] = stat
+	}
+	deadSize := db.Stat().DeadSize
+
+	err = db.Merge(true)
+	assert.Nil(t, err)
+	assert.True(t, db.Stat().DeadSize < deadSize)
+	// the clean segments are not rewritten
+	for id, stat := range cleanFiles {
+		assert.True(t, db.manifest.hasSegment(id))
+		stat2, err := os.Stat(wal.SegmentFileName(options.DirPath, dataFileNameSuffix, id))
+		assert.Nil(t, err)
+		assert.Equal(t, stat.Size(), stat2.Size())
+		assert.Equal(t, stat.ModTime(), stat2.ModTime())
+	}
+
+	check := func(db *DB) {
+		assert.Equal(t, len(kvs), db.index.Size())
+		for key, value := range kvs {
+			v, err := db.Get([]byte(key))
+			assert.Nil(t, err)
+			assert.Equal(t, value, v)
+		}
+		for i := 2000; i < 20000; i++ {
+			_, err := db.Get(utils.GetTestKey(i))
+			assert.Equal(t, ErrKeyNotFound, err)
+		}
+	}
+	check(db)
+
+	// merge again, the non-contiguous segment ids are handled.
+	put(40000, 45000)
+	err = db.Merge(true)
+	assert.Nil(t, err)
+	check(db)
+
+	assert.Nil(t, db.Close())
+	db2, err := Open(options)
+	assert.Nil(t, err)
+	defer func() {
+		_ = db2.Close()
+	}()
+	check(db2)
+}
+
+func TestDB_MergeWithOptions_Progress(t *testing.T) {
+	options := DefaultOptions
+	db, err := Open(options)
+	assert.Nil(t, err)
+	defer destroyDB(db)
+
+	generateData(t, db, 0, 20000, 128)
+	generateData(t, db, 0, 10000, 128)
+
+	var last MergeProgress
+	calls := 0
+	err = db.MergeWithOptions(context.Background(), MergeOptions{
+		ReopenAfterDone: true,
+		OnProgress: func(progress MergeProgress) {
+			assert.True(t, progress.BytesScanned >= last.BytesScanned)
+			last = progress
+			calls++
+		},
+	})
+	assert.Nil(t, err)
+	assert.True(t, calls > 0)
+	assert.Equal(t, int64(20000), last.RecordsKept)
+	// 10000 overwritten records and the batch finished records
+	assert.True(t, last.RecordsDropped >= 10000)
+	assert.True(t, last.BytesWritten > 0 && last.BytesWritten < last.BytesScanned)
+	assert.Equal(t, 20000, db.Stat().KeysNum)
+}
+
+func TestDB_MergeWithOptions_RateLimit(t *testing.T) {
+	options := DefaultOptions
+	db, err := Open(options)
+	assert.Nil(t, err)
+	defer destroyDB(db)
+
+	// about 1.5MB to be read and written
+	generateData(t, db, 0, 5000, 128)
+
+	start := time.Now()
+	err = db.MergeWithOptions(context.Background(), MergeOptions{
+		ReopenAfterDone:      true,
+		RateLimitBytesPerSec: 1 * MB,
+	})
+	assert.Nil(t, err)
+	assert.True(t, time.Since(start) >= 300*time.Millisecond)
+	assert.Equal(t, 5000, db.Stat().KeysNum)
+}
+
+func TestDB_MergeWithOptions_Cancel(t *testing.T) {
+	options := DefaultOptions
+	db, err := Open(options)
+	assert.Nil(t, err)
+	defer destroyDB(db)
+
+	generateData(t, db, 0, 10000, 128)
+	generation := db.manifest.Generation
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	err = db.MergeWithOptions(ctx, MergeOptions{
+		ReopenAfterDone:      true,
+		RateLimitBytesPerSec: 100 * KB,
+	})
+	assert.Equal(t, context.DeadlineExceeded, err)
+	_, err = os.Stat(mergeDirPath(options.DirPath))
+	assert.True(t, os.IsNotExist(err))
+	assert.Equal(t, generation, db.manifest.Generation)
+
+	// the database works as before, and can be merged again
+	for i := 0; i < 10000; i++ {
+		val, err := db.Get(utils.GetTestKey(i))
+		assert.Nil(t, err)
+		assert.NotNil(t, val)
+	}
+	assert.Nil(t, db.Merge(true))
+	assert.Equal(t, 10000, db.Stat().KeysNum)
+}
+
+func TestDB_MergeWithOptions_Incremental(t *testing.T) {
+	options := DefaultOptions
+	options.SegmentSize = 4 * MB
+	db, err := Open(options)
+	assert.Nil(t, err)
+	defer destroyDB(db)
+
+	generateData(t, db, 0, 50000, 512)
+	generateData(t, db, 0, 25000, 512)
+	for i := 40000; i < 50000; i++ {
+		assert.Nil(t, db.Delete(utils.GetTestKey(i)))
+	}
+	segments, err := listSegmentIds(options.DirPath, dataFileNameSuffix, math.MaxUint32)
+	assert.Nil(t, err)
+	sizeBefore := db.Stat().DiskSize
+
+	// the merge directory never holds more than the live data of one group.
+	var maxMergeSize int64
+	err = db.MergeWithOptions(context.Background(), MergeOptions{
+		Incremental:     true,
+		SegmentsPerStep: 2,
+		OnProgress: func(progress MergeProgress) {
+			size, err := utils.DirSize(mergeDirPath(options.DirPath))
+			assert.Nil(t, err)
+			maxMergeSize = max(maxMergeSize, size)
+		},
+	})
+	assert.Nil(t, err)
+	assert.True(t, maxMergeSize > 0)
+	assert.True(t, maxMergeSize <= 2*options.SegmentSize+MB, maxMergeSize)
+	assert.Equal(t, uint64((len(segments)+1)/2), db.manifest.Generation)
+	assert.True(t, db.Stat().DiskSize < sizeBefore)
+
+	check := func(db *DB) {
+		assert.Equal(t, 40000, db.Stat().KeysNum)
+		for i := 0; i < 50000; i++ {
+			val, err := db.Get(utils.GetTestKey(i))
+			if i < 40000 {
+				assert.Nil(t, err)
+				assert.NotNil(t, val)
+			} else {
+				assert.Equal(t, ErrKeyNotFound, err)
+			}
+		}
+	}
+	check(db)
+
+	assert.Nil(t, db.Close())
+	db, err = Open(options)
+	assert.Nil(t, err)
+	check(db)
+}
+
+func TestDB_MergeWithOptions_Incremental_Cancel(t *testing.T) {
+	options := DefaultOptions
+	options.SegmentSize = 4 * MB
+	db, err := Open(options)
+	assert.Nil(t, err)
+	defer destroyDB(db)
+
+	generateData(t, db, 0, 50000, 512)
+	generateData(t, db, 0, 50000, 512)
+
+	// cancel while the second group is being merged,
+	// the first group stays installed.
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	err = db.MergeWithOptions(ctx, MergeOptions{
+		Incremental: true,
+		OnProgress: func(progress MergeProgress) {
+			// the callback runs in the merge goroutine, so the manifest is not changing.
+			if db.manifest.Generation > 0 {
+				cancel()
+			}
+		},
+	})
+	assert.Equal(t, context.Canceled, err)
+	assert.Equal(t, uint64(1), db.manifest.Generation)
+	_, err = os.Stat(mergeDirPath(options.DirPath))
+	assert.True(t, os.IsNotExist(err))
+
+	assert.Nil(t, db.Close())
+	db, err = Open(options)
+	assert.Nil(t, err)
+	assert.Equal(t, 50000, db.Stat().KeysNum)
+	for i := 0; i < 50000; i++ {
+		val, err := db.Get(utils.GetTestKey(i))
+		assert.Nil(t, err)
+		assert.NotNil(t, val)
+	}
+}
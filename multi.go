@@ -0,0 +1,134 @@
+package memdb
+
+import (
+	"sort"
+
+	"github.com/rosedblabs/wal"
+)
+
+// MultiGet gets the values of the keys in the batch, values[i] and errs[i] are the result of keys[i]
+// like the result of Get, errs[i] is ErrKeyNotFound if the key does not exist.
+// The records are read from the data files in the order of their positions,
+// so the reads of the keys in the same block are close together.
+func (b *Batch) MultiGet(keys [][]byte) (values [][]byte, errs []error) {
+	values = make([][]byte, len(keys))
+	errs = make([]error, len(keys))
+	if b.db.closed {
+		for i := range errs {
+			errs[i] = ErrDBClosed
+		}
+		return values, errs
+	}
+
+	type read struct {
+		i        int
+		position *wal.ChunkPosition
+	}
+	var reads []read
+	now := b.db.now().UnixNano()
+
+	b.mu.RLock()
+	for i, key := range keys {
+		if len(key) == 0 {
+			errs[i] = ErrKeyIsEmpty
+			continue
+		}
+		// get from pendingWrites
+		if record := b.lookupPendingWrites(b.db.keyspace, key); record != nil {
+			switch {
+			case record.Type == LogRecordDeleted || record.IsExpired(now):
+				errs[i] = ErrKeyNotFound
+			case record.Type == LogRecordMergeOperand:
+				values[i], errs[i] = b.mergePendingOperands(record)
+			default:
+				values[i] = record.Value
+			}
+			continue
+		}
+		position := b.lookupIndex(b.db.keyspace, key)
+		if position == nil || b.db.expires.isExpired(key, now) {
+			errs[i] = ErrKeyNotFound
+			continue
+		}
+		if chain := b.db.operands.get(key); chain != nil {
+			values[i], errs[i] = b.db.mergeOperands(key, chain)
+			continue
+		}
+		reads = append(reads, read{i: i, position: position})
+	}
+	b.mu.RUnlock()
+
+	sort.Slice(reads, func(i, j int) bool {
+		return positionBefore(reads[i].position, reads[j].position)
+	})
+	for _, r := range reads {
+		chunk, err := b.db.dataFiles.Read(r.position)
+		if err != nil {
+			errs[r.i] = err
+			continue
+		}
+		record := decodeLogRecord(chunk)
+		if record.Type == LogRecordDeleted {
+			panic("Deleted data cannot exist in the index")
+		}
+		if record.IsExpired(now) {
+			errs[r.i] = ErrKeyNotFound
+			continue
+		}
+		values[r.i] = record.Value
+	}
+	return values, errs
+}
+
+// MultiPut adds the key-value pairs of the items to the batch.
+// It stops at the first invalid item, the items before it are left in the batch.
+func (b *Batch) MultiPut(items []Item) error {
+	for _, item := range items {
+		if err := b.Put(item.Key, item.Value); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// MultiDelete marks the keys for deletion in the batch.
+// It stops at the first invalid key, the keys before it are left in the batch.
+func (b *Batch) MultiDelete(keys [][]byte) error {
+	for _, key := range keys {
+		if err := b.Delete(key); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// MultiGet gets the values of the keys from the database, see Batch.MultiGet.
+// All the keys are read under one read lock, so the values are a consistent view of the database.
+func (db *DB) MultiGet(keys [][]byte) ([][]byte, []error) {
+	batch := db.batchPool.Get().(*Batch)
+	batch.init(true, false, db)
+	defer func() {
+		_ = batch.Commit()
+		batch.reset()
+		db.batchPool.Put(batch)
+	}()
+	return batch.MultiGet(keys)
+}
+
+// MultiPut puts the key-value pairs of the items into the database.
+// Actually, it will open a new batch and commit it,
+// so either all the items are written or none of them is.
+func (db *DB) MultiPut(items []Item) error {
+	return db.update(func(batch *Batch) error {
+		return batch.MultiPut(items)
+	})
+}
+
+// MultiDelete deletes the keys from the database.
+// Actually, it will open a new batch and commit it,
+// so either all the keys are deleted or none of them is.
+func (db *DB) MultiDelete(keys [][]byte) error {
+	return db.update(func(batch *Batch) error {
+		return batch.MultiDelete(keys)
+	})
+}
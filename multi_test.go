@@ -0,0 +1,110 @@
+package memdb
+
+import (
+	"testing"
+	"time"
+
+	"github.com/hupeh/memdb/utils"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDB_MultiGet(t *testing.T) {
+	options := DefaultOptions
+	options.MergeOperator = ConcatOperator
+	db, err := Open(options)
+	assert.Nil(t, err)
+	defer destroyDB(db)
+
+	var items []Item
+	for i := 0; i < 100; i++ {
+		items = append(items, Item{Key: utils.GetTestKey(i), Value: utils.RandomValue(128)})
+	}
+	assert.Nil(t, db.MultiPut(items))
+	assert.Nil(t, db.Delete(utils.GetTestKey(10)))
+	assert.Nil(t, db.PutWithTTL(utils.GetTestKey(20), []byte("v"), time.Nanosecond))
+	assert.Nil(t, db.Append(utils.GetTestKey(30), []byte("a")))
+	time.Sleep(time.Millisecond)
+
+	// the keys in the reverse order of the positions
+	var keys [][]byte
+	for i := 99; i >= 0; i-- {
+		keys = append(keys, utils.GetTestKey(i))
+	}
+	keys = append(keys, nil, utils.GetTestKey(1000))
+	values, errs := db.MultiGet(keys)
+	assert.Len(t, values, len(keys))
+	assert.Len(t, errs, len(keys))
+	for i := 0; i < 100; i++ {
+		switch k := 99 - i; k {
+		case 10, 20:
+			assert.Equal(t, ErrKeyNotFound, errs[i])
+			assert.Nil(t, values[i])
+		case 30:
+			assert.Nil(t, errs[i])
+			assert.Equal(t, append(items[k].Value, 'a'), values[i])
+		default:
+			assert.Nil(t, errs[i])
+			assert.Equal(t, items[k].Value, values[i])
+		}
+	}
+	assert.Equal(t, ErrKeyIsEmpty, errs[100])
+	assert.Equal(t, ErrKeyNotFound, errs[101])
+
+	values, errs = db.MultiGet(nil)
+	assert.Len(t, values, 0)
+	assert.Len(t, errs, 0)
+}
+
+func TestDB_MultiPut_MultiDelete(t *testing.T) {
+	options := DefaultOptions
+	db, err := Open(options)
+	assert.Nil(t, err)
+	defer destroyDB(db)
+
+	// nothing is written if an item is invalid
+	err = db.MultiPut([]Item{{Key: []byte("a"), Value: []byte("1")}, {Key: nil, Value: []byte("2")}})
+	assert.Equal(t, ErrKeyIsEmpty, err)
+	_, err = db.Get([]byte("a"))
+	assert.Equal(t, ErrKeyNotFound, err)
+
+	assert.Nil(t, db.MultiPut([]Item{
+		{Key: []byte("a"), Value: []byte("1")},
+		{Key: []byte("b"), Value: []byte("2")},
+		{Key: []byte("a"), Value: []byte("3")},
+	}))
+	values, errs := db.MultiGet([][]byte{[]byte("a"), []byte("b")})
+	assert.Equal(t, []error{nil, nil}, errs)
+	assert.Equal(t, [][]byte{[]byte("3"), []byte("2")}, values)
+
+	assert.Equal(t, ErrKeyIsEmpty, db.MultiDelete([][]byte{[]byte("a"), nil}))
+	assert.Nil(t, db.MultiDelete([][]byte{[]byte("a"), []byte("b"), []byte("c")}))
+	_, errs = db.MultiGet([][]byte{[]byte("a"), []byte("b")})
+	assert.Equal(t, []error{ErrKeyNotFound, ErrKeyNotFound}, errs)
+
+	// the batch is written at once and replayed
+	assert.Nil(t, db.MultiPut([]Item{{Key: []byte("c"), Value: []byte("4")}}))
+	assert.Nil(t, db.Close())
+	db, err = Open(options)
+	assert.Nil(t, err)
+	values, errs = db.MultiGet([][]byte{[]byte("a"), []byte("c")})
+	assert.Equal(t, []error{ErrKeyNotFound, nil}, errs)
+	assert.Equal(t, []byte("4"), values[1])
+}
+
+func TestBatch_MultiGet(t *testing.T) {
+	db, err := Open(DefaultOptions)
+	assert.Nil(t, err)
+	defer destroyDB(db)
+
+	assert.Nil(t, db.MultiPut([]Item{{Key: []byte("a"), Value: []byte("1")}, {Key: []byte("b"), Value: []byte("2")}}))
+	batch := db.NewBatch(DefaultBatchOptions)
+	assert.Nil(t, batch.MultiPut([]Item{{Key: []byte("c"), Value: []byte("3")}}))
+	assert.Nil(t, batch.MultiDelete([][]byte{[]byte("a")}))
+	values, errs := batch.MultiGet([][]byte{[]byte("a"), []byte("b"), []byte("c")})
+	assert.Equal(t, []error{ErrKeyNotFound, nil, nil}, errs)
+	assert.Equal(t, [][]byte{nil, []byte("2"), []byte("3")}, values)
+	assert.Nil(t, batch.Commit())
+
+	_, errs = db.MultiGet([][]byte{[]byte("a")})
+	assert.Equal(t, ErrKeyNotFound, errs[0])
+}
@@ -0,0 +1,655 @@
+package memdb
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/rosedblabs/wal"
+)
+
+const (
+	namespaceFileName = "NAMESPACES"
+	namespaceMagic    = 0x4d44424e // "MDBN"
+	// defaultNamespaceId is the id of the keys out of any namespace.
+	defaultNamespaceId = 0
+)
+
+var errCorruptedNamespaces = errors.New("memdb: the namespace file is corrupted")
+
+// Namespace is a handle of a namespace of the database, which is a separate set of keys
+// with its own index, key order, ttl sweeps and stats, like the column families of RocksDB.
+//
+// All the namespaces write into the data files of the database, so a Batch can
+// write into several of them atomically, see Batch.Namespace. A namespace is dropped
+// without visiting its keys, and its records are reclaimed by the next merge.
+//
+// The namespaces support the basic key-value operations, the other operations of DB,
+// like Append, DeleteRange or Rename, are only available for the keys out of any namespace.
+type Namespace struct {
+	db *DB
+	ks *keyspace
+}
+
+// NamespaceStat represents the statistics of a namespace.
+type NamespaceStat struct {
+	// Total number of keys
+	KeysNum int
+	// Total size of the records referenced by the index
+	LiveSize int64
+	// Memory used by the index, it may be an estimate
+	IndexSize int64
+}
+
+// keyspace is the index of the keys of a namespace, together with their expiry times
+// and merge operands. The keys out of any namespace are in the default keyspace of DB.
+type keyspace struct {
+	id         uint32
+	name       string
+	comparator string // name of the comparator recorded in the namespace file
+	lessFunc   func(a, b []byte) bool
+	index      Indexer
+	expires    *expiryTable  // expiry time of the keys with a ttl in the index
+	operands   *operandTable // positions of the records of the keys with merge operands
+	live       *liveStats    // live bytes of the namespace, nil for the default keyspace
+	dropped    bool
+}
+
+func newKeyspace(id uint32, name string, index Indexer, comparator Comparator) *keyspace {
+	ks := &keyspace{
+		id:         id,
+		name:       name,
+		comparator: comparator.Name,
+		lessFunc:   comparator.Less,
+		index:      index,
+		expires:    newExpiryTable(),
+		operands:   newOperandTable(),
+	}
+	if id != defaultNamespaceId {
+		ks.live = newLiveStats()
+	}
+	return ks
+}
+
+// memSize returns the estimated memory used by the keyspace in bytes.
+func (ks *keyspace) memSize() int64 {
+	return ks.index.MemSize() + ks.expires.memSize() + ks.operands.memSize()
+}
+
+// closeIndex closes the index of the keyspace if it has files, such as DiskIndex.
+func (ks *keyspace) closeIndex() error {
+	if closer, ok := ks.index.(io.Closer); ok {
+		return closer.Close()
+	}
+	return nil
+}
+
+// indexErr returns the error which failed the index of the keyspace, see failingIndexer.
+func (ks *keyspace) indexErr() error {
+	if index, ok := ks.index.(failingIndexer); ok {
+		return index.Err()
+	}
+	return nil
+}
+
+// liveStats tracks the bytes of every segment referenced by the index of a namespace,
+// so they are marked dead at once when the namespace is dropped.
+type liveStats struct {
+	mu       sync.Mutex
+	segments map[wal.SegmentID]int64
+	total    int64
+}
+
+func newLiveStats() *liveStats {
+	return &liveStats{segments: make(map[wal.SegmentID]int64)}
+}
+
+// indexed adds a chunk referenced by the index.
+func (s *liveStats) indexed(position *wal.ChunkPosition) {
+	s.mu.Lock()
+	s.segments[position.SegmentId] += int64(position.ChunkSize)
+	s.total += int64(position.ChunkSize)
+	s.mu.Unlock()
+}
+
+// released removes a chunk not referenced by the index anymore.
+func (s *liveStats) released(position *wal.ChunkPosition) {
+	s.mu.Lock()
+	s.segments[position.SegmentId] -= int64(position.ChunkSize)
+	s.total -= int64(position.ChunkSize)
+	s.mu.Unlock()
+}
+
+// remove forgets the segments that the filter returns true for, see segmentStats.remove.
+func (s *liveStats) remove(filter func(id wal.SegmentID) bool) {
+	s.mu.Lock()
+	for id, size := range s.segments {
+		if filter(id) {
+			s.total -= size
+			delete(s.segments, id)
+		}
+	}
+	s.mu.Unlock()
+}
+
+// size returns the live bytes of all the segments.
+func (s *liveStats) size() int64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.total
+}
+
+// indexed marks a chunk as live in the database and in the namespace of the keyspace.
+func (db *DB) indexed(ks *keyspace, position *wal.ChunkPosition) {
+	db.segmentStats.indexed(position)
+	if ks.live != nil {
+		ks.live.indexed(position)
+	}
+}
+
+// released marks a chunk as dead in the database and in the namespace of the keyspace.
+func (db *DB) released(ks *keyspace, position *wal.ChunkPosition) {
+	db.segmentStats.released(position)
+	if ks.live != nil {
+		ks.live.released(position)
+	}
+}
+
+// +---------+---------+-------+--------------------------------------------+---------+
+// |  magic  | next id | count | id | name length | name | comparator ...  |  crc32  |
+// +---------+---------+-------+--------------------------------------------+---------+
+//
+//	4 bytes   uvarint  uvarint   uvarint + uvarint + bytes + uvarint + bytes   4 bytes
+func encodeNamespaces(nextId uint32, spaces []*keyspace) []byte {
+	buf := binary.LittleEndian.AppendUint32(nil, namespaceMagic)
+	buf = binary.AppendUvarint(buf, uint64(nextId))
+	buf = binary.AppendUvarint(buf, uint64(len(spaces)))
+	for _, ks := range spaces {
+		buf = binary.AppendUvarint(buf, uint64(ks.id))
+		buf = binary.AppendUvarint(buf, uint64(len(ks.name)))
+		buf = append(buf, ks.name...)
+		buf = binary.AppendUvarint(buf, uint64(len(ks.comparator)))
+		buf = append(buf, ks.comparator...)
+	}
+	return binary.LittleEndian.AppendUint32(buf, crc32.ChecksumIEEE(buf))
+}
+
+// namespaceEntry is a namespace recorded in the namespace file.
+type namespaceEntry struct {
+	id         uint32
+	name       string
+	comparator string
+}
+
+func decodeNamespaces(buf []byte) (uint32, []namespaceEntry, error) {
+	if len(buf) < 8 {
+		return 0, nil, errCorruptedNamespaces
+	}
+	body, sum := buf[:len(buf)-4], binary.LittleEndian.Uint32(buf[len(buf)-4:])
+	if crc32.ChecksumIEEE(body) != sum || binary.LittleEndian.Uint32(body) != namespaceMagic {
+		return 0, nil, errCorruptedNamespaces
+	}
+
+	index := 4
+	uvarint := func() (uint64, error) {
+		v, n := binary.Uvarint(body[index:])
+		if n <= 0 {
+			return 0, errCorruptedNamespaces
+		}
+		index += n
+		return v, nil
+	}
+	str := func() (string, error) {
+		size, err := uvarint()
+		if err != nil {
+			return "", err
+		}
+		if uint64(len(body)-index) < size {
+			return "", errCorruptedNamespaces
+		}
+		s := string(body[index : index+int(size)])
+		index += int(size)
+		return s, nil
+	}
+
+	nextId, err := uvarint()
+	if err != nil {
+		return 0, nil, err
+	}
+	count, err := uvarint()
+	if err != nil {
+		return 0, nil, err
+	}
+	var entries []namespaceEntry
+	for i := uint64(0); i < count; i++ {
+		var entry namespaceEntry
+		id, err := uvarint()
+		if err != nil {
+			return 0, nil, err
+		}
+		entry.id = uint32(id)
+		if entry.name, err = str(); err != nil {
+			return 0, nil, err
+		}
+		if entry.comparator, err = str(); err != nil {
+			return 0, nil, err
+		}
+		entries = append(entries, entry)
+	}
+	return uint32(nextId), entries, nil
+}
+
+// openNamespaces loads the namespaces recorded in the namespace file,
+// their keys are loaded into the index with the ones of the default namespace.
+// The order of the keys of a namespace is set by Options.Namespaces,
+// it returns ErrComparatorMismatch if it is not the one the namespace is created with.
+func (db *DB) openNamespaces() error {
+	db.keyspaces = map[uint32]*keyspace{defaultNamespaceId: db.keyspace}
+	db.nextNamespaceId = defaultNamespaceId + 1
+
+	buf, err := os.ReadFile(filepath.Join(db.options.DirPath, namespaceFileName))
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return nil
+		}
+		return err
+	}
+	nextId, entries, err := decodeNamespaces(buf)
+	if err != nil {
+		return err
+	}
+	db.nextNamespaceId = nextId
+	for _, entry := range entries {
+		comparator := db.namespaceComparator(entry.name)
+		if err = checkComparator(entry.comparator, comparator.Name); err != nil {
+			return fmt.Errorf("namespace %q: %w", entry.name, err)
+		}
+		index, err := db.newNamespaceIndex(entry.id, comparator)
+		if err != nil {
+			return err
+		}
+		db.keyspaces[entry.id] = newKeyspace(entry.id, entry.name, index, comparator)
+	}
+	return nil
+}
+
+// newNamespaceIndex creates the index of the namespace of Options.IndexType,
+// whose keys are ordered by the comparator of the namespace.
+func (db *DB) newNamespaceIndex(id uint32, comparator Comparator) (Indexer, error) {
+	options := db.options
+	options.LessFunc = comparator.Less
+	return newIndexer(options, id)
+}
+
+// resolveNamespaceOptions returns a copy of the options of the namespaces,
+// whose comparators are resolved like the one of the database.
+func resolveNamespaceOptions(namespaces map[string]NamespaceOptions) (map[string]NamespaceOptions, error) {
+	if len(namespaces) == 0 {
+		return nil, nil
+	}
+	resolved := make(map[string]NamespaceOptions, len(namespaces))
+	for name, opts := range namespaces {
+		comparator, err := resolveComparator(opts.Comparator, opts.LessFunc)
+		if err != nil {
+			return nil, fmt.Errorf("namespace %q: %w", name, err)
+		}
+		resolved[name] = NamespaceOptions{Comparator: comparator}
+	}
+	return resolved, nil
+}
+
+// namespaceComparator returns the resolved comparator of the namespace,
+// the namespaces not in Options.Namespaces are ordered by BytewiseComparator.
+func (db *DB) namespaceComparator(name string) Comparator {
+	if opts, ok := db.options.Namespaces[name]; ok {
+		return opts.Comparator
+	}
+	return Comparator{Name: bytewiseComparatorName}
+}
+
+// writeNamespaces replaces the namespace file with the current namespaces.
+// The caller must hold db.mu.
+func (db *DB) writeNamespaces() error {
+	var spaces []*keyspace
+	for id, ks := range db.keyspaces {
+		if id != defaultNamespaceId {
+			spaces = append(spaces, ks)
+		}
+	}
+	sort.Slice(spaces, func(i, j int) bool { return spaces[i].id < spaces[j].id })
+	return writeFileAtomic(filepath.Join(db.options.DirPath, namespaceFileName), encodeNamespaces(db.nextNamespaceId, spaces))
+}
+
+// lookupNamespace returns the keyspace of the namespace, or nil if it does not exist.
+// The caller must hold db.mu.
+func (db *DB) lookupNamespace(name string) *keyspace {
+	for id, ks := range db.keyspaces {
+		if id != defaultNamespaceId && ks.name == name {
+			return ks
+		}
+	}
+	return nil
+}
+
+// Namespace returns the handle of the namespace, which is created if it does not exist.
+// The keys of a new namespace are ordered by the comparator of Options.Namespaces[name].
+func (db *DB) Namespace(name string) (*Namespace, error) {
+	if name == "" {
+		return nil, ErrNamespaceNameEmpty
+	}
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	if db.closed {
+		return nil, ErrDBClosed
+	}
+
+	if ks := db.lookupNamespace(name); ks != nil {
+		return &Namespace{db: db, ks: ks}, nil
+	}
+	comparator := db.namespaceComparator(name)
+	index, err := db.newNamespaceIndex(db.nextNamespaceId, comparator)
+	if err != nil {
+		return nil, err
+	}
+	ks := newKeyspace(db.nextNamespaceId, name, index, comparator)
+	db.keyspaces[ks.id] = ks
+	db.nextNamespaceId++
+	// the namespace is recorded before any of its records is written
+	if err := db.writeNamespaces(); err != nil {
+		delete(db.keyspaces, ks.id)
+		db.nextNamespaceId--
+		_ = ks.closeIndex()
+		return nil, err
+	}
+	return &Namespace{db: db, ks: ks}, nil
+}
+
+// DropNamespace drops the namespace and all its keys.
+// The keys are not visited, the namespace is removed from the namespace file,
+// and its records in the data files are dead, they are reclaimed by the next merge.
+// The handles of the namespace return ErrNamespaceDropped after it is dropped.
+func (db *DB) DropNamespace(name string) error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	if db.closed {
+		return ErrDBClosed
+	}
+
+	ks := db.lookupNamespace(name)
+	if ks == nil {
+		return ErrNamespaceNotFound
+	}
+	delete(db.keyspaces, ks.id)
+	if err := db.writeNamespaces(); err != nil {
+		db.keyspaces[ks.id] = ks
+		return err
+	}
+	ks.dropped = true
+	// the keys of the namespace are never read again
+	_ = ks.closeIndex()
+
+	ks.live.mu.Lock()
+	for id, size := range ks.live.segments {
+		db.segmentStats.releasedSize(id, size)
+	}
+	ks.live.mu.Unlock()
+	db.maybeAutoMerge()
+	return nil
+}
+
+// Namespaces returns the names of all the namespaces in ascending order.
+func (db *DB) Namespaces() []string {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+	var names []string
+	for id, ks := range db.keyspaces {
+		if id != defaultNamespaceId {
+			names = append(names, ks.name)
+		}
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Name returns the name of the namespace.
+func (ns *Namespace) Name() string {
+	return ns.ks.name
+}
+
+// Put a key-value pair into the namespace.
+func (ns *Namespace) Put(key []byte, value []byte) error {
+	return ns.db.update(func(batch *Batch) error {
+		return batch.Namespace(ns).Put(key, value)
+	})
+}
+
+// PutWithTTL a key-value pair into the namespace, with a ttl.
+func (ns *Namespace) PutWithTTL(key []byte, value []byte, ttl time.Duration) error {
+	return ns.db.update(func(batch *Batch) error {
+		return batch.Namespace(ns).PutWithTTL(key, value, ttl)
+	})
+}
+
+// Get the value of the key from the namespace.
+func (ns *Namespace) Get(key []byte) (value []byte, err error) {
+	err = ns.db.view(func(batch *Batch) error {
+		value, err = batch.Namespace(ns).Get(key)
+		return err
+	})
+	return value, err
+}
+
+// Delete the key from the namespace.
+func (ns *Namespace) Delete(key []byte) error {
+	return ns.db.update(func(batch *Batch) error {
+		return batch.Namespace(ns).Delete(key)
+	})
+}
+
+// Exist checks if the key exists in the namespace.
+func (ns *Namespace) Exist(key []byte) (exist bool, err error) {
+	err = ns.db.view(func(batch *Batch) error {
+		exist, err = batch.Namespace(ns).Exist(key)
+		return err
+	})
+	return exist, err
+}
+
+// Expire sets the ttl of the key in the namespace.
+func (ns *Namespace) Expire(key []byte, ttl time.Duration) error {
+	return ns.db.update(func(batch *Batch) error {
+		return batch.Namespace(ns).Expire(key, ttl)
+	})
+}
+
+// TTL gets the ttl of the key in the namespace.
+func (ns *Namespace) TTL(key []byte) (ttl time.Duration, err error) {
+	err = ns.db.view(func(batch *Batch) error {
+		ttl, err = batch.Namespace(ns).TTL(key)
+		return err
+	})
+	return ttl, err
+}
+
+// Persist removes the ttl of the key in the namespace.
+func (ns *Namespace) Persist(key []byte) error {
+	return ns.db.update(func(batch *Batch) error {
+		return batch.Namespace(ns).Persist(key)
+	})
+}
+
+// NewIterator returns an iterator of the keys in the namespace, see DB.NewIterator.
+// The iterator of a dropped namespace is always invalid.
+func (ns *Namespace) NewIterator(opts IteratorOptions) *Iterator {
+	ns.db.mu.RLock()
+	dropped := ns.ks.dropped
+	ns.db.mu.RUnlock()
+	if dropped {
+		return &Iterator{db: ns.db, options: opts}
+	}
+	return ns.db.newIterator(ns.ks, opts)
+}
+
+// Ascend calls handleFn for each key/value pair in the namespace in ascending order.
+func (ns *Namespace) Ascend(handleFn func(k []byte, v []byte) (bool, error)) {
+	ns.db.mu.RLock()
+	defer ns.db.mu.RUnlock()
+	if ns.ks.dropped {
+		return
+	}
+	ns.ks.index.Ascend(func(key []byte, pos *wal.ChunkPosition) (bool, error) {
+		value, err := ns.db.readValue(ns.ks, key, pos)
+		if err != nil {
+			return false, err
+		}
+		if value != nil {
+			return handleFn(key, value)
+		}
+		return true, nil
+	})
+}
+
+// Descend calls handleFn for each key/value pair in the namespace in descending order.
+func (ns *Namespace) Descend(handleFn func(k []byte, v []byte) (bool, error)) {
+	ns.db.mu.RLock()
+	defer ns.db.mu.RUnlock()
+	if ns.ks.dropped {
+		return
+	}
+	ns.ks.index.Descend(func(key []byte, pos *wal.ChunkPosition) (bool, error) {
+		value, err := ns.db.readValue(ns.ks, key, pos)
+		if err != nil {
+			return false, err
+		}
+		if value != nil {
+			return handleFn(key, value)
+		}
+		return true, nil
+	})
+}
+
+// AscendKeys calls handleFn for each key in the namespace in ascending order, see DB.AscendKeys.
+func (ns *Namespace) AscendKeys(pattern []byte, filterExpired bool, handleFn func(k []byte) (bool, error)) error {
+	ns.db.mu.RLock()
+	defer ns.db.mu.RUnlock()
+	if ns.ks.dropped {
+		return ErrNamespaceDropped
+	}
+
+	var reg *regexp.Regexp
+	if len(pattern) > 0 {
+		var err error
+		reg, err = regexp.Compile(string(pattern))
+		if err != nil {
+			return err
+		}
+	}
+
+	now := ns.db.now().UnixNano()
+	ns.ks.index.Ascend(func(key []byte, pos *wal.ChunkPosition) (bool, error) {
+		if reg != nil && !reg.Match(key) {
+			return true, nil
+		}
+		if filterExpired && ns.ks.expires.isExpired(key, now) {
+			return true, nil
+		}
+		return handleFn(key)
+	})
+	return nil
+}
+
+// Stat returns the statistics of the namespace.
+func (ns *Namespace) Stat() *NamespaceStat {
+	ns.db.mu.RLock()
+	defer ns.db.mu.RUnlock()
+	return &NamespaceStat{
+		KeysNum:   ns.ks.index.Size(),
+		LiveSize:  ns.ks.live.size(),
+		IndexSize: ns.ks.memSize(),
+	}
+}
+
+// NamespaceBatch writes the keys of a namespace in a Batch,
+// the writes are committed or rolled back together with the other ones of the batch.
+type NamespaceBatch struct {
+	b  *Batch
+	ks *keyspace
+}
+
+// Namespace returns the batch writing the keys of the namespace in the batch.
+func (b *Batch) Namespace(ns *Namespace) *NamespaceBatch {
+	return &NamespaceBatch{b: b, ks: ns.ks}
+}
+
+// Put adds a key-value pair of the namespace to the batch for writing.
+func (nb *NamespaceBatch) Put(key []byte, value []byte) error {
+	if nb.ks.dropped {
+		return ErrNamespaceDropped
+	}
+	return nb.b.put(nb.ks, key, value, 0)
+}
+
+// PutWithTTL adds a key-value pair of the namespace with ttl to the batch for writing.
+func (nb *NamespaceBatch) PutWithTTL(key []byte, value []byte, ttl time.Duration) error {
+	if nb.ks.dropped {
+		return ErrNamespaceDropped
+	}
+	return nb.b.put(nb.ks, key, value, nb.b.db.now().Add(ttl).UnixNano())
+}
+
+// Get retrieves the value of the key of the namespace from the batch.
+func (nb *NamespaceBatch) Get(key []byte) ([]byte, error) {
+	if nb.ks.dropped {
+		return nil, ErrNamespaceDropped
+	}
+	return nb.b.get(nb.ks, key)
+}
+
+// Delete marks the key of the namespace for deletion in the batch.
+func (nb *NamespaceBatch) Delete(key []byte) error {
+	if nb.ks.dropped {
+		return ErrNamespaceDropped
+	}
+	return nb.b.delete(nb.ks, key)
+}
+
+// Exist checks if the key exists in the namespace.
+func (nb *NamespaceBatch) Exist(key []byte) (bool, error) {
+	if nb.ks.dropped {
+		return false, ErrNamespaceDropped
+	}
+	return nb.b.exist(nb.ks, key)
+}
+
+// Expire sets the ttl of the key of the namespace.
+func (nb *NamespaceBatch) Expire(key []byte, ttl time.Duration) error {
+	if nb.ks.dropped {
+		return ErrNamespaceDropped
+	}
+	_, err := nb.b.expireAtIf(nb.ks, key, nb.b.db.now().Add(ttl), ExpireAlways)
+	return err
+}
+
+// TTL returns the ttl of the key of the namespace.
+func (nb *NamespaceBatch) TTL(key []byte) (time.Duration, error) {
+	if nb.ks.dropped {
+		return -1, ErrNamespaceDropped
+	}
+	return nb.b.ttl(nb.ks, key)
+}
+
+// Persist removes the ttl of the key of the namespace.
+func (nb *NamespaceBatch) Persist(key []byte) error {
+	if nb.ks.dropped {
+		return ErrNamespaceDropped
+	}
+	return nb.b.persist(nb.ks, key)
+}
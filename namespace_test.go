@@ -0,0 +1,375 @@
+package memdb
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/hupeh/memdb/utils"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestEncodeNamespaces(t *testing.T) {
+	spaces := []*keyspace{
+		newKeyspace(1, "users", newBTree(nil), BytewiseComparator),
+		newKeyspace(3, "orders", newBTree(nil), BytewiseComparator),
+	}
+	spaces[1].comparator = "reverse"
+	buf := encodeNamespaces(4, spaces)
+
+	nextId, entries, err := decodeNamespaces(buf)
+	assert.Nil(t, err)
+	assert.Equal(t, uint32(4), nextId)
+	assert.Equal(t, []namespaceEntry{
+		{id: 1, name: "users", comparator: bytewiseComparatorName},
+		{id: 3, name: "orders", comparator: "reverse"},
+	}, entries)
+
+	buf[5]++
+	_, _, err = decodeNamespaces(buf)
+	assert.Equal(t, errCorruptedNamespaces, err)
+	_, _, err = decodeNamespaces(buf[:3])
+	assert.Equal(t, errCorruptedNamespaces, err)
+}
+
+func TestDB_Namespace(t *testing.T) {
+	options := DefaultOptions
+	options.IndexCheckpoint = true
+	db, err := Open(options)
+	assert.Nil(t, err)
+	defer destroyDB(db)
+
+	_, err = db.Namespace("")
+	assert.Equal(t, ErrNamespaceNameEmpty, err)
+	users, err := db.Namespace("users")
+	assert.Nil(t, err)
+	assert.Equal(t, "users", users.Name())
+	users2, err := db.Namespace("users")
+	assert.Nil(t, err)
+	assert.Equal(t, users.ks, users2.ks)
+	_, err = db.Namespace("orders")
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"orders", "users"}, db.Namespaces())
+
+	// the same key in the namespaces is a different key
+	assert.Nil(t, db.Put([]byte("a"), []byte("1")))
+	assert.Nil(t, users.Put([]byte("a"), []byte("2")))
+	assertValue(t, db, "a", "1")
+	value, err := users.Get([]byte("a"))
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("2"), value)
+
+	assert.Nil(t, users.Delete([]byte("a")))
+	_, err = users.Get([]byte("a"))
+	assert.Equal(t, ErrKeyNotFound, err)
+	exist, err := users.Exist([]byte("a"))
+	assert.Nil(t, err)
+	assert.False(t, exist)
+	assertValue(t, db, "a", "1")
+
+	for i := 0; i < 100; i++ {
+		assert.Nil(t, users.Put(utils.GetTestKey(i), utils.RandomValue(128)))
+	}
+	assert.Equal(t, 100, users.Stat().KeysNum)
+	assert.True(t, users.Stat().LiveSize > 100*128)
+	assert.Equal(t, 101, db.Stat().KeysNum)
+
+	var keys int
+	users.Ascend(func(k []byte, v []byte) (bool, error) {
+		keys++
+		return true, nil
+	})
+	assert.Equal(t, 100, keys)
+	iter := users.NewIterator(IteratorOptions{})
+	keys = 0
+	for ; iter.Valid(); iter.Next() {
+		keys++
+	}
+	iter.Close()
+	assert.Equal(t, 100, keys)
+
+	// the keys of the namespaces are loaded with and without the checkpoint
+	for _, checkpoint := range []bool{true, false} {
+		if checkpoint {
+			assert.Nil(t, db.Close())
+		} else {
+			closeWithoutCheckpoint(t, db)
+		}
+		db, err = Open(options)
+		assert.Nil(t, err)
+		assert.Equal(t, []string{"orders", "users"}, db.Namespaces())
+		users, err = db.Namespace("users")
+		assert.Nil(t, err)
+		assert.Equal(t, 100, users.Stat().KeysNum)
+		assert.True(t, users.Stat().LiveSize > 100*128)
+		value, err = users.Get(utils.GetTestKey(10))
+		assert.Nil(t, err)
+		assert.NotNil(t, value)
+		_, err = users.Get([]byte("a"))
+		assert.Equal(t, ErrKeyNotFound, err)
+		assertValue(t, db, "a", "1")
+	}
+}
+
+func TestBatch_Namespace(t *testing.T) {
+	options := DefaultOptions
+	options.WatchQueueSize = 10
+	db, err := Open(options)
+	assert.Nil(t, err)
+	defer destroyDB(db)
+
+	users, err := db.Namespace("users")
+	assert.Nil(t, err)
+	w, err := db.Watch()
+	assert.Nil(t, err)
+
+	batch := db.NewBatch(DefaultBatchOptions)
+	assert.Nil(t, batch.Put([]byte("a"), []byte("1")))
+	assert.Nil(t, batch.Namespace(users).Put([]byte("a"), []byte("2")))
+	value, err := batch.Get([]byte("a"))
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("1"), value)
+	value, err = batch.Namespace(users).Get([]byte("a"))
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("2"), value)
+	assert.Nil(t, batch.Commit())
+
+	event := <-w
+	assert.Equal(t, "", event.Namespace)
+	event2 := <-w
+	assert.Equal(t, "users", event2.Namespace)
+	assert.Equal(t, []byte("2"), event2.Value)
+	assert.Equal(t, event.BatchId, event2.BatchId)
+
+	// a rolled back batch writes none of the namespaces
+	batch = db.NewBatch(DefaultBatchOptions)
+	assert.Nil(t, batch.Put([]byte("b"), []byte("1")))
+	assert.Nil(t, batch.Namespace(users).Put([]byte("b"), []byte("2")))
+	assert.Nil(t, batch.Rollback())
+	_, err = db.Get([]byte("b"))
+	assert.Equal(t, ErrKeyNotFound, err)
+	_, err = users.Get([]byte("b"))
+	assert.Equal(t, ErrKeyNotFound, err)
+}
+
+func TestDB_Namespace_LessFunc(t *testing.T) {
+	options := DefaultOptions
+	options.Namespaces = map[string]NamespaceOptions{
+		"reverse": {LessFunc: func(a, b []byte) bool { return bytes.Compare(a, b) > 0 }},
+	}
+	db, err := Open(options)
+	assert.Nil(t, err)
+	defer destroyDB(db)
+
+	reverse, err := db.Namespace("reverse")
+	assert.Nil(t, err)
+	for _, key := range []string{"a", "c", "b"} {
+		assert.Nil(t, reverse.Put([]byte(key), []byte(key)))
+		assert.Nil(t, db.Put([]byte(key), []byte(key)))
+	}
+
+	var keys []string
+	assert.Nil(t, reverse.AscendKeys(nil, true, func(k []byte) (bool, error) {
+		keys = append(keys, string(k))
+		return true, nil
+	}))
+	assert.Equal(t, []string{"c", "b", "a"}, keys)
+	keys = nil
+	assert.Nil(t, db.AscendKeys(nil, true, func(k []byte) (bool, error) {
+		keys = append(keys, string(k))
+		return true, nil
+	}))
+	assert.Equal(t, []string{"a", "b", "c"}, keys)
+}
+
+func TestDB_Namespace_IndexType(t *testing.T) {
+	for name, indexType := range testIndexTypes {
+		t.Run(name, func(t *testing.T) {
+			options := DefaultOptions
+			options.IndexType = indexType
+			options.DiskIndexMemtableSize = 100
+			if indexType != IndexART {
+				options.Namespaces = map[string]NamespaceOptions{"users": {Comparator: ReverseBytewiseComparator}}
+			}
+			db, err := Open(options)
+			assert.Nil(t, err)
+			defer destroyDB(db)
+
+			check := func(users *Namespace) {
+				// the index of the namespace is of the index type of the database
+				assert.IsType(t, db.index, users.ks.index)
+				assert.Equal(t, 1000, users.ks.index.Size())
+				var keys [][]byte
+				assert.Nil(t, users.AscendKeys(nil, false, func(k []byte) (bool, error) {
+					keys = append(keys, k)
+					return true, nil
+				}))
+				assert.Equal(t, 1000, len(keys))
+				if indexType != IndexART {
+					assert.Equal(t, utils.GetTestKey(999), keys[0])
+				} else {
+					assert.Equal(t, utils.GetTestKey(0), keys[0])
+				}
+			}
+			users, err := db.Namespace("users")
+			assert.Nil(t, err)
+			for i := 0; i < 1000; i++ {
+				assert.Nil(t, users.Put(utils.GetTestKey(i), utils.RandomValue(16)))
+			}
+			check(users)
+
+			assert.Nil(t, db.Close())
+			db, err = Open(options)
+			assert.Nil(t, err)
+			users, err = db.Namespace("users")
+			assert.Nil(t, err)
+			check(users)
+
+			// the index files of a dropped namespace are removed
+			dir := diskIndexDir(options.DirPath, users.ks.id)
+			if indexType == IndexDisk {
+				_, err = os.Stat(dir)
+				assert.Nil(t, err)
+			}
+			assert.Nil(t, db.DropNamespace("users"))
+			_, err = os.Stat(dir)
+			assert.True(t, os.IsNotExist(err))
+		})
+	}
+}
+
+func TestDB_Namespace_Expire(t *testing.T) {
+	clock := NewFakeClock(time.Now())
+	options := DefaultOptions
+	options.Clock = clock
+	options.ActiveExpireInterval = 0
+	db, err := Open(options)
+	assert.Nil(t, err)
+	defer destroyDB(db)
+
+	users, err := db.Namespace("users")
+	assert.Nil(t, err)
+	for i := 0; i < 10; i++ {
+		assert.Nil(t, users.PutWithTTL(utils.GetTestKey(i), utils.RandomValue(128), time.Minute))
+	}
+	assert.Nil(t, users.Put([]byte("a"), []byte("1")))
+	assert.Nil(t, users.Expire([]byte("a"), time.Hour))
+	ttl, err := users.TTL([]byte("a"))
+	assert.Nil(t, err)
+	assert.Equal(t, time.Hour, ttl)
+	assert.Nil(t, users.Persist([]byte("a")))
+	ttl, err = users.TTL([]byte("a"))
+	assert.Nil(t, err)
+	assert.Equal(t, time.Duration(-1), ttl)
+
+	clock.Advance(time.Minute)
+	_, err = users.Get(utils.GetTestKey(0))
+	assert.Equal(t, ErrKeyNotFound, err)
+	assert.Equal(t, 11, users.Stat().KeysNum)
+	assert.Nil(t, db.DeleteExpiredKeys(time.Second))
+	assert.Equal(t, 1, users.Stat().KeysNum)
+
+	// the expired records are replayed in the namespace
+	closeWithoutCheckpoint(t, db)
+	db, err = Open(options)
+	assert.Nil(t, err)
+	users, err = db.Namespace("users")
+	assert.Nil(t, err)
+	assert.Equal(t, 1, users.Stat().KeysNum)
+}
+
+func TestDB_DropNamespace(t *testing.T) {
+	options := DefaultOptions
+	options.IndexCheckpoint = false
+	db, err := Open(options)
+	assert.Nil(t, err)
+	defer destroyDB(db)
+
+	assert.Equal(t, ErrNamespaceNotFound, db.DropNamespace("users"))
+	users, err := db.Namespace("users")
+	assert.Nil(t, err)
+	for i := 0; i < 100; i++ {
+		assert.Nil(t, users.Put(utils.GetTestKey(i), utils.RandomValue(128)))
+		assert.Nil(t, db.Put(utils.GetTestKey(i), utils.RandomValue(128)))
+	}
+	stat := db.Stat()
+	liveSize := users.Stat().LiveSize
+
+	assert.Nil(t, db.DropNamespace("users"))
+	assert.Empty(t, db.Namespaces())
+	assert.Equal(t, ErrNamespaceDropped, users.Put([]byte("a"), []byte("1")))
+	_, err = users.Get(utils.GetTestKey(0))
+	assert.Equal(t, ErrNamespaceDropped, err)
+	iter := users.NewIterator(IteratorOptions{})
+	assert.False(t, iter.Valid())
+	stat2 := db.Stat()
+	assert.Equal(t, 100, stat2.KeysNum)
+	assert.Equal(t, stat.LiveSize-liveSize, stat2.LiveSize)
+	assert.Equal(t, stat.DeadSize+liveSize, stat2.DeadSize)
+
+	// the records of the dropped namespace are dead after reopening
+	assert.Nil(t, db.Close())
+	db, err = Open(options)
+	assert.Nil(t, err)
+	stat3 := db.Stat()
+	assert.Equal(t, 100, stat3.KeysNum)
+	assert.Equal(t, stat2.LiveSize, stat3.LiveSize)
+
+	// a namespace with the same name is a new one
+	users, err = db.Namespace("users")
+	assert.Nil(t, err)
+	assert.Equal(t, 0, users.Stat().KeysNum)
+	assert.Nil(t, users.Put([]byte("a"), []byte("1")))
+
+	// and the merge reclaims the records of the dropped one
+	assert.Nil(t, db.Merge(true))
+	stat4 := db.Stat()
+	assert.Equal(t, int64(0), stat4.DeadSize)
+	assert.Equal(t, 101, stat4.KeysNum)
+	assert.Equal(t, 1, users.Stat().KeysNum)
+	value, err := users.Get([]byte("a"))
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("1"), value)
+	assertTestData(t, db, 0, 100, true)
+
+	assert.Nil(t, db.Close())
+	db, err = Open(options)
+	assert.Nil(t, err)
+	users, err = db.Namespace("users")
+	assert.Nil(t, err)
+	assert.Equal(t, 1, users.Stat().KeysNum)
+	assert.Equal(t, 101, db.Stat().KeysNum)
+}
+
+func TestDB_DropNamespace_Checkpoint(t *testing.T) {
+	options := DefaultOptions
+	options.IndexCheckpoint = true
+	db, err := Open(options)
+	assert.Nil(t, err)
+	defer destroyDB(db)
+
+	users, err := db.Namespace("users")
+	assert.Nil(t, err)
+	for i := 0; i < 100; i++ {
+		assert.Nil(t, users.Put(utils.GetTestKey(i), utils.RandomValue(128)))
+	}
+	assert.Nil(t, db.Put([]byte("a"), []byte("1")))
+	assert.Nil(t, db.Checkpoint())
+
+	// the namespace is dropped after the checkpoint, its entries in it are dead
+	assert.Nil(t, db.DropNamespace("users"))
+	stat := db.Stat()
+	closeWithoutCheckpoint(t, db)
+	_, err = os.Stat(filepath.Join(options.DirPath, checkpointFileName))
+	assert.Nil(t, err)
+
+	db, err = Open(options)
+	assert.Nil(t, err)
+	assert.NotNil(t, db.checkpointState.position)
+	stat2 := db.Stat()
+	assert.Equal(t, 1, stat2.KeysNum)
+	assert.Equal(t, stat.LiveSize, stat2.LiveSize)
+	assert.Equal(t, stat.DeadSize, stat2.DeadSize)
+}
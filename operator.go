@@ -0,0 +1,369 @@
+package memdb
+
+import (
+	"encoding/binary"
+	"sync"
+	"sync/atomic"
+
+	"github.com/rosedblabs/wal"
+	"github.com/valyala/bytebufferpool"
+)
+
+// operandEntryOverhead is the estimated memory of every position in the operand table.
+const operandEntryOverhead = 48
+
+// MergeOperator combines the operands appended by DB.Append with the value of a key,
+// like the merge operators of RocksDB. It is set by Options.MergeOperator.
+//
+// The operands are written to the data files without reading the value of the key,
+// and they are combined when the key is read. They are folded into a single value
+// when the data files are merged, or when the key is written in another way.
+type MergeOperator interface {
+	// FullMerge returns the value of the key combining the existing value with the operands,
+	// in the order they are appended. The existing value is nil if the key did not exist.
+	FullMerge(key, existing []byte, operands [][]byte) ([]byte, error)
+}
+
+// MergeOperatorFunc is an adapter to use a function as a MergeOperator.
+type MergeOperatorFunc func(key, existing []byte, operands [][]byte) ([]byte, error)
+
+// FullMerge calls f(key, existing, operands).
+func (f MergeOperatorFunc) FullMerge(key, existing []byte, operands [][]byte) ([]byte, error) {
+	return f(key, existing, operands)
+}
+
+// ConcatOperator is a MergeOperator appending the operands to the end of the value.
+var ConcatOperator MergeOperator = MergeOperatorFunc(func(_, existing []byte, operands [][]byte) ([]byte, error) {
+	size := len(existing)
+	for _, operand := range operands {
+		size += len(operand)
+	}
+	value := make([]byte, 0, size)
+	value = append(value, existing...)
+	for _, operand := range operands {
+		value = append(value, operand...)
+	}
+	return value, nil
+})
+
+// operandTable keeps the positions of the records of the keys with merge operands,
+// from the value the operands are appended to, if any, to the latest operand
+// which is the position in the index. All of them are live data.
+type operandTable struct {
+	mu sync.RWMutex
+	m  map[string][]*wal.ChunkPosition
+}
+
+func newOperandTable() *operandTable {
+	return &operandTable{m: make(map[string][]*wal.ChunkPosition)}
+}
+
+// get the positions of the records of the key, nil if the key has no operands.
+func (t *operandTable) get(key []byte) []*wal.ChunkPosition {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	return t.m[string(key)]
+}
+
+// add the position of an operand of the key,
+// base is the position of the key in the index before it, nil if the key did not exist.
+func (t *operandTable) add(key []byte, base, position *wal.ChunkPosition) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	chain, ok := t.m[string(key)]
+	if !ok && base != nil {
+		chain = []*wal.ChunkPosition{base}
+	}
+	t.m[string(key)] = append(chain, position)
+}
+
+// remove the positions of the key and return them.
+func (t *operandTable) remove(key []byte) []*wal.ChunkPosition {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	chain, ok := t.m[string(key)]
+	if ok {
+		delete(t.m, string(key))
+	}
+	return chain
+}
+
+// keys returns the keys with operands.
+func (t *operandTable) keys() [][]byte {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	keys := make([][]byte, 0, len(t.m))
+	for key := range t.m {
+		keys = append(keys, []byte(key))
+	}
+	return keys
+}
+
+// clone returns a copy of the table.
+func (t *operandTable) clone() *operandTable {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	c := &operandTable{m: make(map[string][]*wal.ChunkPosition, len(t.m))}
+	for key, chain := range t.m {
+		c.m[key] = append([]*wal.ChunkPosition(nil), chain...)
+	}
+	return c
+}
+
+// memSize returns the estimated memory used by the table in bytes.
+func (t *operandTable) memSize() int64 {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	var size int64
+	for key, chain := range t.m {
+		size += int64(len(key)) + int64(len(chain))*operandEntryOverhead
+	}
+	return size
+}
+
+// appendOperands appends the operands to the value of an operand record,
+// every operand is prefixed by its length.
+func appendOperands(buf []byte, operands ...[]byte) []byte {
+	for _, operand := range operands {
+		buf = binary.AppendUvarint(buf, uint64(len(operand)))
+		buf = append(buf, operand...)
+	}
+	return buf
+}
+
+// decodeOperands decodes the operands from the value of an operand record.
+func decodeOperands(buf []byte) [][]byte {
+	var operands [][]byte
+	for len(buf) > 0 {
+		size, n := binary.Uvarint(buf)
+		if n <= 0 || uint64(len(buf)-n) < size {
+			break
+		}
+		operands = append(operands, buf[n:n+int(size)])
+		buf = buf[n+int(size):]
+	}
+	return operands
+}
+
+// Append adds a merge operand of the key to the batch, see MergeOperator.
+//
+// The value of the key is not read, unless the data files are being merged,
+// or the key is written in the batch already, then the operand is combined at once.
+// The ttl of the key is kept.
+func (b *Batch) Append(key []byte, operand []byte) error {
+	if len(key) == 0 {
+		return ErrKeyIsEmpty
+	}
+	if b.db.closed {
+		return ErrDBClosed
+	}
+	if b.options.ReadOnly {
+		return ErrReadOnlyBatch
+	}
+	operator := b.db.options.MergeOperator
+	if operator == nil {
+		return ErrNoMergeOperator
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	now := b.db.now().UnixNano()
+	if record := b.lookupPendingWrites(b.db.keyspace, key); record != nil {
+		switch {
+		case record.Type == LogRecordMergeOperand:
+			record.Value = appendOperands(record.Value, operand)
+		case record.Type == LogRecordDeleted || record.IsExpired(now):
+			value, err := operator.FullMerge(key, nil, [][]byte{operand})
+			if err != nil {
+				return err
+			}
+			record.Type, record.Value, record.Expire = LogRecordNormal, value, 0
+		default:
+			value, err := operator.FullMerge(key, record.Value, [][]byte{operand})
+			if err != nil {
+				return err
+			}
+			record.Value = value
+		}
+		return nil
+	}
+
+	record := &LogRecord{Key: key, Type: LogRecordMergeOperand, Expire: b.db.expires.get(key)}
+	position := b.lookupIndex(b.db.keyspace, key)
+	switch {
+	case position == nil || b.db.expires.isExpired(key, now):
+		// nothing to append to, the operand makes a new value
+		value, err := operator.FullMerge(key, nil, [][]byte{operand})
+		if err != nil {
+			return err
+		}
+		record.Type, record.Value, record.Expire = LogRecordNormal, value, 0
+	case atomic.LoadUint32(&b.db.mergeRunning) == 1:
+		// the merge moves the records the operands are appended to,
+		// so the operand is combined with the value at once while it is running.
+		existing, err := b.db.readValue(b.db.keyspace, key, position)
+		if err != nil {
+			return err
+		}
+		value, err := operator.FullMerge(key, existing, [][]byte{operand})
+		if err != nil {
+			return err
+		}
+		record.Type, record.Value = LogRecordNormal, value
+	default:
+		record.Value = appendOperands(nil, operand)
+	}
+	b.appendPendingWrites(key, record)
+	return nil
+}
+
+// Append adds a merge operand of the key, see MergeOperator.
+// Actually, it will open a new batch and commit it.
+// You can think the batch has only one Append operation.
+func (db *DB) Append(key []byte, operand []byte) error {
+	batch := db.batchPool.Get().(*Batch)
+	defer func() {
+		batch.reset()
+		db.batchPool.Put(batch)
+	}()
+	// This is a single append operation, we can set Sync to false.
+	// Because the data will be written to the WAL,
+	// and the WAL file will be synced to disk according to the DB options.
+	batch.init(false, false, db)
+	if err := batch.Append(key, operand); err != nil {
+		_ = batch.Rollback()
+		return err
+	}
+	return batch.Commit()
+}
+
+// appendIndex points the key to the operand record at position in the index of the keyspace,
+// the records it is appended to are still live. The expiry time of the operand
+// is the one of the key, which may be changed in the batch of the operand.
+func (db *DB) appendIndex(ks *keyspace, key []byte, position *wal.ChunkPosition, expire int64) {
+	db.indexed(ks, position)
+	base := ks.index.Put(key, position)
+	ks.operands.add(key, base, position)
+	ks.expires.set(key, expire)
+}
+
+// mergeOperands combines the value and the operands of the records at the positions.
+func (db *DB) mergeOperands(key []byte, chain []*wal.ChunkPosition) ([]byte, error) {
+	return db.readOperands(db.dataFiles, key, chain)
+}
+
+// readOperands is like mergeOperands, but it reads the records from the given data files.
+func (db *DB) readOperands(dataFiles *wal.WAL, key []byte, chain []*wal.ChunkPosition) ([]byte, error) {
+	if db.options.MergeOperator == nil {
+		return nil, ErrNoMergeOperator
+	}
+	var existing []byte
+	var operands [][]byte
+	for _, position := range chain {
+		chunk, err := dataFiles.Read(position)
+		if err != nil {
+			return nil, err
+		}
+		record := decodeLogRecord(chunk)
+		switch record.Type {
+		case LogRecordMergeOperand:
+			operands = append(operands, decodeOperands(record.Value)...)
+		case LogRecordNormal:
+			existing = record.Value
+		}
+	}
+	return db.options.MergeOperator.FullMerge(key, existing, operands)
+}
+
+// operandChain returns the positions of the records to combine for the operand record at position,
+// the operands appended after it are left out.
+func (db *DB) operandChain(key []byte, position *wal.ChunkPosition) []*wal.ChunkPosition {
+	chain := db.operands.get(key)
+	for i, p := range chain {
+		if positionEquals(p, position) {
+			return chain[:i+1]
+		}
+	}
+	return []*wal.ChunkPosition{position}
+}
+
+// readValue reads the value of the key at the position in the index of the keyspace,
+// combining the merge operands of the key if it has.
+// It returns nil if the key is deleted or expired.
+func (db *DB) readValue(ks *keyspace, key []byte, position *wal.ChunkPosition) ([]byte, error) {
+	if chain := ks.operands.get(key); chain != nil {
+		if ks.expires.isExpired(key, db.now().UnixNano()) {
+			return nil, nil
+		}
+		return db.mergeOperands(key, chain)
+	}
+	chunk, err := db.dataFiles.Read(position)
+	if err != nil {
+		return nil, err
+	}
+	return db.checkValue(chunk), nil
+}
+
+// foldOperands replaces the merge operands of all the keys with the combined values,
+// so the records the operands are appended to are no longer needed.
+// The expired keys are deleted instead. The caller must hold db.mu.
+func (db *DB) foldOperands() error {
+	keys := db.operands.keys()
+	if len(keys) == 0 {
+		return nil
+	}
+	now := db.now().UnixNano()
+	var expiredKeys, liveKeys [][]byte
+	for _, key := range keys {
+		if db.expires.isExpired(key, now) {
+			expiredKeys = append(expiredKeys, key)
+		} else {
+			liveKeys = append(liveKeys, key)
+		}
+	}
+	if err := db.expireKeys(db.keyspace, expiredKeys, now); err != nil {
+		return err
+	}
+
+	var records []*LogRecord
+	var buffers []*bytebufferpool.ByteBuffer
+	defer func() {
+		for _, buf := range buffers {
+			bytebufferpool.Put(buf)
+		}
+	}()
+	for _, key := range liveKeys {
+		value, err := db.mergeOperands(key, db.operands.get(key))
+		if err != nil {
+			return err
+		}
+		// the records are not in a batch, they are indexed as soon as they are read
+		record := &LogRecord{
+			Key:     key,
+			Value:   value,
+			Type:    LogRecordNormal,
+			BatchId: mergeFinishedBatchID,
+			Expire:  db.expires.get(key),
+		}
+		buf := bytebufferpool.Get()
+		buffers = append(buffers, buf)
+		db.dataFiles.PendingWrites(encodeLogRecord(record, db.encodeHeader, buf))
+		records = append(records, record)
+	}
+	if len(records) == 0 {
+		return nil
+	}
+
+	positions, err := db.dataFiles.WriteAll()
+	if err != nil {
+		db.dataFiles.ClearPendingWrites()
+		return err
+	}
+	db.lastPosition = positions[len(positions)-1]
+	for i, record := range records {
+		db.segmentStats.written(positions[i])
+		db.putIndex(db.keyspace, record.Key, positions[i], record.Expire)
+	}
+	return nil
+}
@@ -0,0 +1,185 @@
+package memdb
+
+import (
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func assertValue(t *testing.T, db *DB, key, value string) {
+	val, err := db.Get([]byte(key))
+	assert.Nil(t, err)
+	assert.Equal(t, value, string(val))
+}
+
+func TestDecodeOperands(t *testing.T) {
+	buf := appendOperands(nil, []byte("a"), []byte(""), []byte("bcd"))
+	assert.Equal(t, [][]byte{[]byte("a"), []byte(""), []byte("bcd")}, decodeOperands(buf))
+	assert.Nil(t, decodeOperands(nil))
+}
+
+func TestDB_Append(t *testing.T) {
+	for _, checkpoint := range []bool{false, true} {
+		options := DefaultOptions
+		options.MergeOperator = ConcatOperator
+		options.IndexCheckpoint = checkpoint
+		db, err := Open(options)
+		assert.Nil(t, err)
+
+		assert.Nil(t, db.Put([]byte("a"), []byte("x")))
+		assert.Nil(t, db.Append([]byte("a"), []byte("y")))
+		assert.Nil(t, db.Append([]byte("a"), []byte("z")))
+		// nothing to append to
+		assert.Nil(t, db.Append([]byte("b"), []byte("q")))
+		assertValue(t, db, "a", "xyz")
+		assertValue(t, db, "b", "q")
+		assert.Equal(t, 2, countRecords(t, db, LogRecordMergeOperand))
+
+		var values []string
+		db.Ascend(func(k []byte, v []byte) (bool, error) {
+			values = append(values, string(v))
+			return true, nil
+		})
+		assert.Equal(t, []string{"xyz", "q"}, values)
+		iter := db.NewIterator(DefaultIteratorOptions)
+		assert.Equal(t, "xyz", string(iter.Item().Value))
+		iter.Close()
+
+		// the operands are replayed, or loaded from the checkpoint
+		stat := db.Stat()
+		assert.Nil(t, db.Close())
+		db, err = Open(options)
+		assert.Nil(t, err)
+		assertValue(t, db, "a", "xyz")
+		assert.Equal(t, stat.LiveSize, db.Stat().LiveSize)
+		assert.Nil(t, db.Append([]byte("a"), []byte("w")))
+		assertValue(t, db, "a", "xyzw")
+
+		// the operands are folded by merge
+		assert.Nil(t, db.Merge(true))
+		assert.Equal(t, 0, countRecords(t, db, LogRecordMergeOperand))
+		assertValue(t, db, "a", "xyzw")
+		assert.Nil(t, db.Close())
+		db, err = Open(options)
+		assert.Nil(t, err)
+		assertValue(t, db, "a", "xyzw")
+		destroyDB(db)
+	}
+}
+
+func TestDB_Append_Overwrite(t *testing.T) {
+	options := DefaultOptions
+	options.MergeOperator = ConcatOperator
+	options.ActiveExpireInterval = 0
+	db, err := Open(options)
+	assert.Nil(t, err)
+	defer destroyDB(db)
+
+	assert.Nil(t, db.Put([]byte("a"), []byte("x")))
+	assert.Nil(t, db.Append([]byte("a"), []byte("y")))
+	live := db.Stat().LiveSize
+	// all the records of the operands become dead
+	assert.Nil(t, db.Put([]byte("a"), []byte("v")))
+	assert.True(t, db.Stat().LiveSize < live)
+	assert.Len(t, db.operands.m, 0)
+	assertValue(t, db, "a", "v")
+
+	assert.Nil(t, db.Append([]byte("a"), []byte("y")))
+	assert.Nil(t, db.Delete([]byte("a")))
+	_, err = db.Get([]byte("a"))
+	assert.Equal(t, ErrKeyNotFound, err)
+	assert.Len(t, db.operands.m, 0)
+	assert.Equal(t, int64(0), db.Stat().LiveSize)
+}
+
+func TestDB_Append_TTL(t *testing.T) {
+	clock := NewFakeClock(time.Now())
+	options := DefaultOptions
+	options.MergeOperator = ConcatOperator
+	options.Clock = clock
+	options.ActiveExpireInterval = 0
+	db, err := Open(options)
+	assert.Nil(t, err)
+	defer destroyDB(db)
+
+	// the ttl is kept
+	assert.Nil(t, db.PutWithTTL([]byte("a"), []byte("x"), time.Hour))
+	assert.Nil(t, db.Append([]byte("a"), []byte("y")))
+	ttl, err := db.TTL([]byte("a"))
+	assert.Nil(t, err)
+	assert.Equal(t, time.Hour, ttl)
+
+	// persist the key with operands
+	assert.Nil(t, db.Persist([]byte("a")))
+	assertValue(t, db, "a", "xy")
+	clock.Advance(time.Hour * 2)
+	assertValue(t, db, "a", "xy")
+
+	// the operands expire with the key
+	assert.Nil(t, db.PutWithTTL([]byte("b"), []byte("x"), time.Hour))
+	assert.Nil(t, db.Append([]byte("b"), []byte("y")))
+	clock.Advance(time.Hour)
+	_, err = db.Get([]byte("b"))
+	assert.Equal(t, ErrKeyNotFound, err)
+	assert.Nil(t, db.DeleteExpiredKeys(time.Second))
+	assert.Len(t, db.operands.m, 0)
+	// an expired key is appended to as a new one
+	assert.Nil(t, db.PutWithTTL([]byte("c"), []byte("x"), time.Hour))
+	clock.Advance(time.Hour)
+	assert.Nil(t, db.Append([]byte("c"), []byte("y")))
+	assertValue(t, db, "c", "y")
+}
+
+func TestBatch_Append(t *testing.T) {
+	options := DefaultOptions
+	options.WatchQueueSize = 10
+	options.MergeOperator = MergeOperatorFunc(func(_, existing []byte, operands [][]byte) ([]byte, error) {
+		var sum int
+		if existing != nil {
+			sum, _ = strconv.Atoi(string(existing))
+		}
+		for _, operand := range operands {
+			n, _ := strconv.Atoi(string(operand))
+			sum += n
+		}
+		return []byte(strconv.Itoa(sum)), nil
+	})
+	db, err := Open(options)
+	assert.Nil(t, err)
+	defer destroyDB(db)
+
+	assert.Nil(t, db.Put([]byte("sum"), []byte("1")))
+	w, err := db.Watch()
+	assert.Nil(t, err)
+	<-w
+
+	batch := db.NewBatch(DefaultBatchOptions)
+	assert.Nil(t, batch.Append([]byte("sum"), []byte("2")))
+	assert.Nil(t, batch.Append([]byte("sum"), []byte("3")))
+	value, err := batch.Get([]byte("sum"))
+	assert.Nil(t, err)
+	assert.Equal(t, "6", string(value))
+	assert.Nil(t, batch.Put([]byte("other"), []byte("1")))
+	assert.Nil(t, batch.Append([]byte("other"), []byte("4")))
+	assert.Nil(t, batch.Commit())
+
+	assertValue(t, db, "sum", "6")
+	assertValue(t, db, "other", "5")
+	// the operands of a batch are written in one record
+	assert.Equal(t, 1, countRecords(t, db, LogRecordMergeOperand))
+
+	for _, operand := range []string{"2", "3"} {
+		event := <-w
+		assert.Equal(t, WatchActionAppend, event.Action)
+		assert.Equal(t, operand, string(event.Value))
+	}
+}
+
+func TestDB_Append_No_Operator(t *testing.T) {
+	db, err := Open(DefaultOptions)
+	assert.Nil(t, err)
+	defer destroyDB(db)
+	assert.Equal(t, ErrNoMergeOperator, db.Append([]byte("a"), []byte("b")))
+}
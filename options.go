@@ -39,12 +39,101 @@ type Options struct {
 	// e.g. "0 0 * * *" means merge at 00:00:00 every day.
 	// it also supports seconds optionally.
 	// when enable the second field, the cron expression will be like this: "0/10 * * * * *" (every 10 seconds).
-	// when auto merge is enabled, the db will be closed and reopened after merge done.
+	// when auto merge is enabled, the merge files will be installed online after merge done.
 	// do not set this shecule too frequently, it will affect the performance.
 	// refer to https://en.wikipedia.org/wiki/Cron
 	AutoMergeCronExpr string
 
-	// LessFunc is used for custom index sorting
+	// AutoMergeDeadRatio triggers a merge automatically when the ratio of dead bytes,
+	// which are the overwritten, deleted and expired records, to all bytes of the data files
+	// reaches it. It must be between 0 and 1, and 0 means disabled.
+	AutoMergeDeadRatio float64
+
+	// AutoMergeReclaimableSize triggers a merge automatically when the dead bytes
+	// of the data files reach it. 0 means disabled.
+	AutoMergeReclaimableSize int64
+
+	// AutoMergeMinInterval is the minimum interval between two merges
+	// triggered by AutoMergeDeadRatio or AutoMergeReclaimableSize.
+	AutoMergeMinInterval time.Duration
+
+	// MergeSegmentDeadRatio makes merge selective. If it is greater than 0,
+	// merge only rewrites the live records of the segments whose ratio of dead bytes
+	// reaches it, and leaves the other segments alone.
+	// It must be between 0 and 1, and 0 means all the segments are rewritten.
+	MergeSegmentDeadRatio float64
+
+	// OnAutoMerge is called with the result after every merge started by the database itself,
+	// either by AutoMergeCronExpr or by the dead bytes thresholds.
+	// It is called in a background goroutine, and should not block for a long time.
+	OnAutoMerge func(result MergeResult)
+
+	// IndexType is the type of the in-memory index, IndexBTree by default.
+	// IndexART suits the keys sharing long prefixes, and IndexHash suits the
+	// workloads of point lookups, see the IndexType constants for details.
+	IndexType IndexType
+
+	// DiskIndexMemtableSize is the number of keys kept in memory by the IndexDisk index,
+	// they are written to an index file when it is reached.
+	DiskIndexMemtableSize int
+
+	// DiskIndexCacheSize is the size in bytes of the block cache of the IndexDisk index.
+	DiskIndexCacheSize int64
+
+	// IndexCheckpoint writes the index to a checkpoint file when the database is closed,
+	// and every IndexCheckpointInterval. Open loads the index from the checkpoint,
+	// and only replays the data written after it, instead of all the data files.
+	// It is disabled by default.
+	IndexCheckpoint bool
+
+	// IndexCheckpointInterval is the interval of the periodic index checkpoint,
+	// 0 means the index is only checkpointed by Close and DB.Checkpoint.
+	IndexCheckpointInterval time.Duration
+
+	// ActiveExpireInterval is the interval of deleting the expired keys in background.
+	// The keys are ordered by the expiry time in memory, so only the expired keys are visited.
+	// 0 means the expired keys are only deleted when they are read, or by DB.DeleteExpiredKeys,
+	// it is the default.
+	ActiveExpireInterval time.Duration
+
+	// ActiveExpireBudget is the maximum time spent on deleting the expired keys every ActiveExpireInterval,
+	// the keys left are deleted next time. 0 means no limit.
+	ActiveExpireBudget time.Duration
+
+	// OnLoadProgress is called with the progress after every segment file is loaded into the index
+	// when the database is opened. It is called in the goroutine calling Open.
+	OnLoadProgress func(progress LoadProgress)
+
+	// MergeOperator combines the operands appended by DB.Append with the values of the keys,
+	// Append returns ErrNoMergeOperator if it is nil.
+	MergeOperator MergeOperator
+
+	// Clock is the source of the current time of the key expiry,
+	// SystemClock is used if it is nil. See Clock for the time it covers.
+	Clock Clock
+
+	// Comparator is the order of the keys in the index, BytewiseComparator is used if it is not set.
+	// Only the name is needed for the comparators registered by RegisterComparator.
+	// Open returns ErrComparatorMismatch if the database is created with another comparator.
+	Comparator Comparator
+
+	// LessFunc is used for custom index sorting, it can not be set with Comparator.
+	// It is recorded as an unnamed comparator, which any other LessFunc matches,
+	// so Comparator should be preferred.
+	LessFunc func(key1, key2 []byte) bool
+
+	// Namespaces specifies the options of the namespaces by their names,
+	// the default options are used for the namespaces not in it. See DB.Namespace.
+	Namespaces map[string]NamespaceOptions
+}
+
+// NamespaceOptions specifies the options of a namespace.
+type NamespaceOptions struct {
+	// Comparator is the order of the keys in the namespace, see Options.Comparator.
+	Comparator Comparator
+
+	// LessFunc is used for custom sorting of the keys in the namespace, see Options.LessFunc.
+	// The keys are sorted in the byte-wise order if neither it nor Comparator is set.
 	LessFunc func(key1, key2 []byte) bool
 }
 
@@ -56,6 +145,32 @@ type BatchOptions struct {
 	ReadOnly bool
 }
 
+// MergeOptions specifies the options for a merge operation.
+type MergeOptions struct {
+	// ReopenAfterDone has the same semantics as the parameter of DB.Merge.
+	ReopenAfterDone bool
+
+	// RateLimitBytesPerSec caps the bytes read from the data files and
+	// written to the merge files per second, 0 means no limit.
+	RateLimitBytesPerSec int64
+
+	// Incremental merges the segments in small groups, and installs the merged segments
+	// of every group before merging the next one, so the old files are released as it goes.
+	// The merge needs the extra disk space of one group instead of the whole database,
+	// at the cost of rewriting the hint file for every group.
+	// The merged segments are always installed online, ReopenAfterDone is ignored.
+	Incremental bool
+
+	// SegmentsPerStep is the number of segments merged in a group by the incremental merge,
+	// 1 is used if it is not greater than 0.
+	SegmentsPerStep int
+
+	// OnProgress is called with the progress as the merge goes,
+	// at least once for every merged segment.
+	// It is called in the merge goroutine, and should not block for a long time.
+	OnProgress func(progress MergeProgress)
+}
+
 // IteratorOptions defines configuration options for creating a new iterator.
 type IteratorOptions struct {
 	// Prefix specifies a key prefix for filtering. If set, the iterator will only
@@ -80,13 +195,28 @@ const (
 )
 
 var DefaultOptions = Options{
-	DirPath:           tempDBDir(),
-	SegmentSize:       1 * GB,
-	Sync:              false,
-	BytesPerSync:      0,
-	WatchQueueSize:    0,
-	AutoMergeCronExpr: "",
-	LessFunc:          nil,
+	DirPath:                  tempDBDir(),
+	SegmentSize:              1 * GB,
+	Sync:                     false,
+	BytesPerSync:             0,
+	WatchQueueSize:           0,
+	AutoMergeCronExpr:        "",
+	AutoMergeDeadRatio:       0,
+	AutoMergeReclaimableSize: 0,
+	AutoMergeMinInterval:     time.Minute,
+	MergeSegmentDeadRatio:    0,
+	IndexType:                IndexBTree,
+	DiskIndexMemtableSize:    1 << 20,
+	DiskIndexCacheSize:       64 * MB,
+	ActiveExpireInterval:     0,
+	ActiveExpireBudget:       25 * time.Millisecond,
+	IndexCheckpoint:          false,
+	IndexCheckpointInterval:  10 * time.Minute,
+	MergeOperator:            nil,
+	Clock:                    nil,
+	Comparator:               Comparator{},
+	LessFunc:                 nil,
+	Namespaces:               nil,
 }
 
 var DefaultBatchOptions = BatchOptions{
@@ -94,6 +224,14 @@ var DefaultBatchOptions = BatchOptions{
 	ReadOnly: false,
 }
 
+var DefaultMergeOptions = MergeOptions{
+	ReopenAfterDone:      true,
+	RateLimitBytesPerSec: 0,
+	Incremental:          false,
+	SegmentsPerStep:      1,
+	OnProgress:           nil,
+}
+
 var DefaultIteratorOptions = IteratorOptions{
 	Prefix:          nil,
 	Reverse:         false,
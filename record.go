@@ -17,22 +17,40 @@ const (
 	LogRecordDeleted
 	// LogRecordBatchFinished is the batch finished log record type.
 	LogRecordBatchFinished
+	// LogRecordExpired is written when an expired key is deleted from the index,
+	// it has no value, and its expiry time is the one of the expired record.
+	LogRecordExpired
+	// LogRecordRangeDeleted is the range tombstone log record type,
+	// it deletes the keys in [key, value), an empty value means no upper bound.
+	LogRecordRangeDeleted
+	// LogRecordPrefixDeleted is the prefix tombstone log record type,
+	// it deletes the keys starting with the key of the record.
+	LogRecordPrefixDeleted
+	// LogRecordMergeOperand is the merge operand log record type,
+	// its value is the operands appended to the key, see MergeOperator.
+	LogRecordMergeOperand
 )
 
-// type batchId keySize valueSize expire
+// logRecordNamespaceFlag is set in the type byte of the records of a namespace,
+// the namespace id follows the type byte. The records of the default namespace do not have it,
+// so they are encoded as they were before the namespaces were introduced.
+const logRecordNamespaceFlag = 0x80
+
+// type namespace batchId keySize valueSize expire
 //
-//	1  +  10  +   5   +   5   +    10  = 31
-const maxLogRecordHeaderSize = binary.MaxVarintLen32*2 + binary.MaxVarintLen64*2 + 1
+//	1  +   5   +   10  +   5   +   5   +    10  = 36
+const maxLogRecordHeaderSize = binary.MaxVarintLen32*3 + binary.MaxVarintLen64*2 + 1
 
 // LogRecord is the log record of the key/value pair.
 // It contains the key, the value, the record type and the batch id
 // It will be encoded to byte slice and written to the wal.
 type LogRecord struct {
-	Key     []byte
-	Value   []byte
-	Type    LogRecordType
-	BatchId uint64
-	Expire  int64
+	Key       []byte
+	Value     []byte
+	Type      LogRecordType
+	BatchId   uint64
+	Expire    int64
+	Namespace uint32 // id of the namespace of the key, 0 is the default namespace
 }
 
 // IsExpired checks whether the log record is expired.
@@ -45,19 +63,31 @@ func (lr *LogRecord) IsExpired(now int64) bool {
 // Only used in start up to rebuild the index.
 type IndexRecord struct {
 	key        []byte
+	namespace  uint32
 	recordType LogRecordType
+	batchId    uint64
+	expire     int64
+	end        []byte // end of the range tombstones
 	position   *wal.ChunkPosition
 }
 
-// +-------------+-------------+-------------+--------------+---------------+---------+--------------+
-// |    type     |  batch id   |   key size  |   value size |     expire    |  key    |      value   |
-// +-------------+-------------+-------------+--------------+---------------+--------+--------------+
+// +-------------+-------------+-------------+-------------+--------------+---------------+---------+--------------+
+// |    type     |  namespace  |  batch id   |   key size  |   value size |     expire    |  key    |      value   |
+// +-------------+-------------+-------------+-------------+--------------+---------------+--------+--------------+
+//
+//	1 byte	     uvarint(max 5)  varint(max 10) varint(max 5)  varint(max 5) varint(max 10)  varint      varint
 //
-//	1 byte	      varint(max 10) varint(max 5)  varint(max 5) varint(max 10)  varint      varint
+// The namespace is only written if logRecordNamespaceFlag is set in the type.
 func encodeLogRecord(logRecord *LogRecord, header []byte, buf *bytebufferpool.ByteBuffer) []byte {
 	header[0] = logRecord.Type
 	var index = 1
 
+	// namespace
+	if logRecord.Namespace != 0 {
+		header[0] |= logRecordNamespaceFlag
+		index += binary.PutUvarint(header[index:], uint64(logRecord.Namespace))
+	}
+
 	// batch id
 	index += binary.PutUvarint(header[index:], logRecord.BatchId)
 	// key size
@@ -82,6 +112,14 @@ func decodeLogRecord(buf []byte) *LogRecord {
 	recordType := buf[0]
 
 	var index uint32 = 1
+	// namespace
+	var namespace uint64
+	if recordType&logRecordNamespaceFlag != 0 {
+		recordType &^= logRecordNamespaceFlag
+		var n int
+		namespace, n = binary.Uvarint(buf[index:])
+		index += uint32(n)
+	}
 	// batch id
 	batchId, n := binary.Uvarint(buf[index:])
 	index += uint32(n)
@@ -108,14 +146,21 @@ func decodeLogRecord(buf []byte) *LogRecord {
 	copy(value[:], buf[index:index+uint32(valueSize)])
 
 	return &LogRecord{Key: key, Value: value, Expire: expire,
-		BatchId: batchId, Type: recordType}
+		BatchId: batchId, Type: recordType, Namespace: uint32(namespace)}
 }
 
-func encodeHintRecord(key []byte, pos *wal.ChunkPosition) []byte {
-	// SegmentId BlockNumber ChunkOffset ChunkSize
-	//    5          5           10          5      =    25
+const (
+	// hintExpireVersion is the first manifest version whose hint records have the expiry time.
+	hintExpireVersion = 2
+	// hintNamespaceVersion is the first manifest version whose hint records have the namespace id.
+	hintNamespaceVersion = 3
+)
+
+func encodeHintRecord(namespace uint32, key []byte, pos *wal.ChunkPosition, expire int64) []byte {
+	// SegmentId BlockNumber ChunkOffset ChunkSize Expire Namespace
+	//    5          5           10          5       10       5     =    40
 	// see binary.MaxVarintLen64 and binary.MaxVarintLen32
-	buf := make([]byte, 25)
+	buf := make([]byte, 40)
 	var idx = 0
 
 	// SegmentId
@@ -126,6 +171,10 @@ func encodeHintRecord(key []byte, pos *wal.ChunkPosition) []byte {
 	idx += binary.PutUvarint(buf[idx:], uint64(pos.ChunkOffset))
 	// ChunkSize
 	idx += binary.PutUvarint(buf[idx:], uint64(pos.ChunkSize))
+	// Expire
+	idx += binary.PutVarint(buf[idx:], expire)
+	// Namespace
+	idx += binary.PutUvarint(buf[idx:], uint64(namespace))
 
 	// key
 	result := make([]byte, idx+len(key))
@@ -134,7 +183,10 @@ func encodeHintRecord(key []byte, pos *wal.ChunkPosition) []byte {
 	return result
 }
 
-func decodeHintRecord(buf []byte) ([]byte, *wal.ChunkPosition) {
+// decodeHintRecord decodes a hint record written with the given manifest version,
+// the hint records before hintExpireVersion have no expiry time,
+// and the ones before hintNamespaceVersion are all in the default namespace.
+func decodeHintRecord(buf []byte, version uint32) ([]byte, *wal.ChunkPosition, int64, uint32) {
 	var idx = 0
 	// SegmentId
 	segmentId, n := binary.Uvarint(buf[idx:])
@@ -148,6 +200,18 @@ func decodeHintRecord(buf []byte) ([]byte, *wal.ChunkPosition) {
 	// ChunkSize
 	chunkSize, n := binary.Uvarint(buf[idx:])
 	idx += n
+	// Expire
+	var expire int64
+	if version >= hintExpireVersion {
+		expire, n = binary.Varint(buf[idx:])
+		idx += n
+	}
+	// Namespace
+	var namespace uint64
+	if version >= hintNamespaceVersion {
+		namespace, n = binary.Uvarint(buf[idx:])
+		idx += n
+	}
 	// Key
 	key := buf[idx:]
 
@@ -156,11 +220,5 @@ func decodeHintRecord(buf []byte) ([]byte, *wal.ChunkPosition) {
 		BlockNumber: uint32(blockNumber),
 		ChunkOffset: int64(chunkOffset),
 		ChunkSize:   uint32(chunkSize),
-	}
-}
-
-func encodeMergeFinRecord(segmentId wal.SegmentID) []byte {
-	buf := make([]byte, 4)
-	binary.LittleEndian.PutUint32(buf, segmentId)
-	return buf
+	}, expire, uint32(namespace)
 }
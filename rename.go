@@ -0,0 +1,173 @@
+package memdb
+
+import (
+	"bytes"
+)
+
+// Rename renames the key oldKey to newKey in the batch, the value and the ttl of oldKey are kept,
+// and newKey is overwritten if it exists. It returns ErrKeyNotFound if oldKey does not exist.
+// The deletion of oldKey and the write of newKey are committed atomically with the batch,
+// so a half-done rename is never seen.
+func (b *Batch) Rename(oldKey, newKey []byte) error {
+	if len(oldKey) == 0 || len(newKey) == 0 {
+		return ErrKeyIsEmpty
+	}
+	if b.db.closed {
+		return ErrDBClosed
+	}
+	if b.options.ReadOnly {
+		return ErrReadOnlyBatch
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	record, _, err := b.lookupRecord(b.db.keyspace, oldKey, b.db.now().UnixNano())
+	if err != nil {
+		return err
+	}
+	if bytes.Equal(oldKey, newKey) {
+		return nil
+	}
+	// the record may be the pending write of oldKey, which is reused for the deletion
+	value, expire := record.Value, record.Expire
+	b.deletePendingWrite(b.db.keyspace, oldKey)
+	b.putPendingWrite(b.db.keyspace, newKey, value, expire)
+	return nil
+}
+
+// Copy copies the value and the ttl of the key src to the key dst in the batch,
+// and reports whether it is copied. If dst exists, it is overwritten only if overwrite is true.
+// It returns ErrKeyNotFound if src does not exist.
+//
+// The value is always written again in a new record of dst, even if it is large.
+// Every record in the data files holds its own key, and the data files are loaded and merged
+// by the keys of the records, so the index of dst can not reference the record of src.
+func (b *Batch) Copy(src, dst []byte, overwrite bool) (bool, error) {
+	if len(src) == 0 || len(dst) == 0 {
+		return false, ErrKeyIsEmpty
+	}
+	if b.db.closed {
+		return false, ErrDBClosed
+	}
+	if b.options.ReadOnly {
+		return false, ErrReadOnlyBatch
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	now := b.db.now().UnixNano()
+	record, _, err := b.lookupRecord(b.db.keyspace, src, now)
+	if err != nil {
+		return false, err
+	}
+	if bytes.Equal(src, dst) {
+		// the key is a copy of itself already
+		return overwrite, nil
+	}
+	if !overwrite {
+		if _, _, err := b.lookupRecord(b.db.keyspace, dst, now); err == nil {
+			return false, nil
+		} else if err != ErrKeyNotFound {
+			return false, err
+		}
+	}
+	b.putPendingWrite(b.db.keyspace, dst, record.Value, record.Expire)
+	return true, nil
+}
+
+// MovePrefix renames all the keys starting with the prefix from to the keys starting with the prefix to
+// in the batch, the rest of the keys, the values and the ttl are kept. It returns the number of the moved keys.
+//
+// The keys with the prefix from are deleted with one prefix tombstone record, see DeletePrefix,
+// and the keys with the prefix to are overwritten only if they are moved to.
+func (b *Batch) MovePrefix(from, to []byte) (int, error) {
+	if b.db.closed {
+		return 0, ErrDBClosed
+	}
+	if b.options.ReadOnly {
+		return 0, ErrReadOnlyBatch
+	}
+	if bytes.Equal(from, to) {
+		return 0, nil
+	}
+
+	b.mu.Lock()
+	// the keys with the prefix in the index and in pendingWrites
+	keys := b.db.indexRangeKeys(LogRecordPrefixDeleted, from, nil)
+	seen := make(map[string]struct{}, len(keys))
+	for _, key := range keys {
+		seen[string(key)] = struct{}{}
+	}
+	for _, record := range b.pendingWrites {
+		if isRangeTombstone(record.Type) || !bytes.HasPrefix(record.Key, from) {
+			continue
+		}
+		if _, ok := seen[string(record.Key)]; !ok {
+			seen[string(record.Key)] = struct{}{}
+			keys = append(keys, record.Key)
+		}
+	}
+
+	// read all the records before they are deleted
+	now := b.db.now().UnixNano()
+	var records []*LogRecord
+	for _, key := range keys {
+		record, _, err := b.lookupRecord(b.db.keyspace, key, now)
+		if err == ErrKeyNotFound {
+			continue
+		}
+		if err != nil {
+			b.mu.Unlock()
+			return 0, err
+		}
+		newKey := make([]byte, 0, len(to)+len(key)-len(from))
+		newKey = append(append(newKey, to...), key[len(from):]...)
+		records = append(records, &LogRecord{Key: newKey, Value: record.Value, Expire: record.Expire})
+	}
+	b.mu.Unlock()
+
+	if len(records) == 0 {
+		return 0, nil
+	}
+	if err := b.deleteRange(LogRecordPrefixDeleted, from, nil); err != nil {
+		return 0, err
+	}
+	b.mu.Lock()
+	for _, record := range records {
+		b.putPendingWrite(b.db.keyspace, record.Key, record.Value, record.Expire)
+	}
+	b.mu.Unlock()
+	return len(records), nil
+}
+
+// Rename renames the key oldKey to newKey in the database, see Batch.Rename.
+// Actually, it will open a new batch and commit it.
+func (db *DB) Rename(oldKey, newKey []byte) error {
+	return db.update(func(batch *Batch) error {
+		return batch.Rename(oldKey, newKey)
+	})
+}
+
+// Copy copies the key src to the key dst in the database, see Batch.Copy.
+// Actually, it will open a new batch and commit it.
+func (db *DB) Copy(src, dst []byte, overwrite bool) (bool, error) {
+	var copied bool
+	err := db.update(func(batch *Batch) (err error) {
+		copied, err = batch.Copy(src, dst, overwrite)
+		return err
+	})
+	return copied, err
+}
+
+// MovePrefix moves the keys with the prefix from to the prefix to in the database, see Batch.MovePrefix.
+// Actually, it will open a new batch and commit it.
+func (db *DB) MovePrefix(from, to []byte) (int, error) {
+	var moved int
+	err := db.update(func(batch *Batch) (err error) {
+		moved, err = batch.MovePrefix(from, to)
+		return err
+	})
+	return moved, err
+}
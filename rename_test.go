@@ -0,0 +1,168 @@
+package memdb
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDB_Rename(t *testing.T) {
+	options := DefaultOptions
+	options.WatchQueueSize = 10
+	db, err := Open(options)
+	assert.Nil(t, err)
+	defer destroyDB(db)
+
+	assert.Equal(t, ErrKeyNotFound, db.Rename([]byte("a"), []byte("b")))
+	assert.Equal(t, ErrKeyIsEmpty, db.Rename([]byte("a"), nil))
+
+	assert.Nil(t, db.PutWithTTL([]byte("a"), []byte("1"), time.Hour))
+	assert.Nil(t, db.Put([]byte("b"), []byte("2")))
+	w, err := db.Watch()
+	assert.Nil(t, err)
+	<-w
+	<-w
+
+	// the ttl is kept and the new key is overwritten
+	assert.Nil(t, db.Rename([]byte("a"), []byte("b")))
+	_, err = db.Get([]byte("a"))
+	assert.Equal(t, ErrKeyNotFound, err)
+	assertValue(t, db, "b", "1")
+	ttl, err := db.TTL([]byte("b"))
+	assert.Nil(t, err)
+	assert.True(t, ttl > time.Minute)
+	assert.Nil(t, db.Rename([]byte("b"), []byte("b")))
+	assertValue(t, db, "b", "1")
+
+	// the rename is one batch
+	event := <-w
+	assert.Equal(t, WatchActionDelete, event.Action)
+	assert.Equal(t, "a", string(event.Key))
+	event2 := <-w
+	assert.Equal(t, WatchActionPut, event2.Action)
+	assert.Equal(t, "b", string(event2.Key))
+	assert.Equal(t, event.BatchId, event2.BatchId)
+
+	assert.Nil(t, db.Close())
+	db, err = Open(options)
+	assert.Nil(t, err)
+	_, err = db.Get([]byte("a"))
+	assert.Equal(t, ErrKeyNotFound, err)
+	assertValue(t, db, "b", "1")
+}
+
+func TestDB_Copy(t *testing.T) {
+	options := DefaultOptions
+	options.MergeOperator = ConcatOperator
+	db, err := Open(options)
+	assert.Nil(t, err)
+	defer destroyDB(db)
+
+	_, err = db.Copy([]byte("a"), []byte("b"), false)
+	assert.Equal(t, ErrKeyNotFound, err)
+
+	assert.Nil(t, db.PutWithTTL([]byte("a"), []byte("1"), time.Hour))
+	assert.Nil(t, db.Append([]byte("a"), []byte("2")))
+	assert.Nil(t, db.Put([]byte("c"), []byte("3")))
+
+	copied, err := db.Copy([]byte("a"), []byte("b"), false)
+	assert.Nil(t, err)
+	assert.True(t, copied)
+	assertValue(t, db, "a", "12")
+	assertValue(t, db, "b", "12")
+	ttl, err := db.TTL([]byte("b"))
+	assert.Nil(t, err)
+	assert.True(t, ttl > time.Minute)
+
+	copied, err = db.Copy([]byte("a"), []byte("c"), false)
+	assert.Nil(t, err)
+	assert.False(t, copied)
+	assertValue(t, db, "c", "3")
+	copied, err = db.Copy([]byte("a"), []byte("c"), true)
+	assert.Nil(t, err)
+	assert.True(t, copied)
+	assertValue(t, db, "c", "12")
+}
+
+func TestDB_MovePrefix(t *testing.T) {
+	options := DefaultOptions
+	db, err := Open(options)
+	assert.Nil(t, err)
+	defer destroyDB(db)
+
+	assert.Nil(t, db.MultiPut([]Item{
+		{Key: []byte("old/1"), Value: []byte("1")},
+		{Key: []byte("old/2"), Value: []byte("2")},
+		{Key: []byte("old0"), Value: []byte("3")},
+		{Key: []byte("new/2"), Value: []byte("4")},
+		{Key: []byte("new/3"), Value: []byte("5")},
+	}))
+	assert.Nil(t, db.PutWithTTL([]byte("old/3"), []byte("6"), time.Hour))
+
+	moved, err := db.MovePrefix([]byte("old/"), []byte("new/"))
+	assert.Nil(t, err)
+	assert.Equal(t, 3, moved)
+	check := func() {
+		for _, key := range []string{"old/1", "old/2", "old/3"} {
+			_, err := db.Get([]byte(key))
+			assert.Equal(t, ErrKeyNotFound, err)
+		}
+		assertValue(t, db, "old0", "3")
+		assertValue(t, db, "new/1", "1")
+		assertValue(t, db, "new/2", "2")
+		assertValue(t, db, "new/3", "6")
+		ttl, err := db.TTL([]byte("new/3"))
+		assert.Nil(t, err)
+		assert.True(t, ttl > time.Minute)
+	}
+	check()
+	assert.Equal(t, 1, countRecords(t, db, LogRecordPrefixDeleted))
+
+	assert.Nil(t, db.Close())
+	db, err = Open(options)
+	assert.Nil(t, err)
+	check()
+
+	// the new prefix starts with the old one
+	moved, err = db.MovePrefix([]byte("new/"), []byte("new/new/"))
+	assert.Nil(t, err)
+	assert.Equal(t, 3, moved)
+	assertValue(t, db, "new/new/1", "1")
+	assertValue(t, db, "new/new/3", "6")
+	_, err = db.Get([]byte("new/1"))
+	assert.Equal(t, ErrKeyNotFound, err)
+
+	moved, err = db.MovePrefix([]byte("none/"), []byte("new/"))
+	assert.Nil(t, err)
+	assert.Equal(t, 0, moved)
+}
+
+func TestBatch_Rename(t *testing.T) {
+	db, err := Open(DefaultOptions)
+	assert.Nil(t, err)
+	defer destroyDB(db)
+
+	assert.Nil(t, db.Put([]byte("p/1"), []byte("1")))
+	batch := db.NewBatch(DefaultBatchOptions)
+	// the pending writes are renamed and moved too
+	assert.Nil(t, batch.Put([]byte("a"), []byte("2")))
+	assert.Nil(t, batch.Rename([]byte("a"), []byte("p/2")))
+	moved, err := batch.MovePrefix([]byte("p/"), []byte("q/"))
+	assert.Nil(t, err)
+	assert.Equal(t, 2, moved)
+	copied, err := batch.Copy([]byte("q/2"), []byte("r"), false)
+	assert.Nil(t, err)
+	assert.True(t, copied)
+	_, err = batch.Get([]byte("a"))
+	assert.Equal(t, ErrKeyNotFound, err)
+	assert.Nil(t, batch.Commit())
+
+	for _, key := range []string{"a", "p/1", "p/2"} {
+		_, err := db.Get([]byte(key))
+		assert.Equal(t, ErrKeyNotFound, err)
+	}
+	assertValue(t, db, "q/1", "1")
+	assertValue(t, db, "q/2", "2")
+	assertValue(t, db, "r", "2")
+}
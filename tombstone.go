@@ -0,0 +1,72 @@
+package memdb
+
+import (
+	"bytes"
+
+	"github.com/rosedblabs/wal"
+)
+
+// isRangeTombstone reports whether the record deletes a range of keys.
+func isRangeTombstone(recordType LogRecordType) bool {
+	return recordType == LogRecordRangeDeleted || recordType == LogRecordPrefixDeleted
+}
+
+// lessKey compares the keys in the order of the index.
+func (db *DB) lessKey(a, b []byte) bool {
+	if db.options.LessFunc != nil {
+		return db.options.LessFunc(a, b)
+	}
+	return bytes.Compare(a, b) < 0
+}
+
+// rangeContains reports whether the key is deleted by the range tombstone.
+//
+// The key of a LogRecordRangeDeleted record is the start of the range, and the value is the end,
+// the range is [start, end) in the order of the index, an empty end means no upper bound.
+// The key of a LogRecordPrefixDeleted record is the prefix of the deleted keys.
+func (db *DB) rangeContains(recordType LogRecordType, start, end, key []byte) bool {
+	if recordType == LogRecordPrefixDeleted {
+		return bytes.HasPrefix(key, start)
+	}
+	return !db.lessKey(key, start) && (len(end) == 0 || db.lessKey(key, end))
+}
+
+// deleteIndexRange deletes the keys of the range tombstone from the index,
+// and returns the number of the deleted keys.
+func (db *DB) deleteIndexRange(recordType LogRecordType, start, end []byte) int {
+	keys := db.indexRangeKeys(recordType, start, end)
+	for _, key := range keys {
+		db.deleteIndex(db.keyspace, key)
+	}
+	return len(keys)
+}
+
+// indexRangeKeys returns copies of the keys in the index deleted by the range tombstone.
+func (db *DB) indexRangeKeys(recordType LogRecordType, start, end []byte) [][]byte {
+	var keys [][]byte
+	collect := func(key []byte, _ *wal.ChunkPosition) (bool, error) {
+		if !db.rangeContains(recordType, start, end, key) {
+			// the keys with the prefix are contiguous only in the bytewise order
+			if recordType == LogRecordPrefixDeleted && db.options.LessFunc == nil {
+				return false, nil
+			}
+			return true, nil
+		}
+		// the keys are copied, they may be released by the index once deleted
+		keys = append(keys, bytes.Clone(key))
+		return true, nil
+	}
+
+	switch {
+	case recordType == LogRecordPrefixDeleted && db.options.LessFunc != nil:
+		db.index.Ascend(collect)
+	case len(start) == 0:
+		db.index.Ascend(collect)
+	case recordType == LogRecordRangeDeleted && len(end) > 0:
+		db.index.AscendRange(start, end, collect)
+	default:
+		db.index.AscendGreaterOrEqual(start, collect)
+	}
+
+	return keys
+}
@@ -0,0 +1,174 @@
+package memdb
+
+import (
+	"bytes"
+	"fmt"
+	"testing"
+
+	"github.com/hupeh/memdb/utils"
+	"github.com/stretchr/testify/assert"
+)
+
+func countRecords(t *testing.T, db *DB, recordType LogRecordType) int {
+	var count int
+	reader := db.dataFiles.NewReader()
+	for {
+		chunk, _, err := reader.Next()
+		if err != nil {
+			break
+		}
+		if decodeLogRecord(chunk).Type == recordType {
+			count++
+		}
+	}
+	return count
+}
+
+func assertKeysDeleted(t *testing.T, db *DB, start, end int, deleted func(i int) bool) {
+	for i := start; i < end; i++ {
+		_, err := db.Get(utils.GetTestKey(i))
+		if deleted(i) {
+			assert.Equal(t, ErrKeyNotFound, err, i)
+		} else {
+			assert.Nil(t, err, i)
+		}
+	}
+}
+
+func TestDB_DeleteRange(t *testing.T) {
+	options := DefaultOptions
+	options.IndexCheckpoint = false
+	db, err := Open(options)
+	assert.Nil(t, err)
+	defer destroyDB(db)
+
+	for i := 0; i < 100; i++ {
+		assert.Nil(t, db.Put(utils.GetTestKey(i), utils.RandomValue(128)))
+	}
+	assert.Nil(t, db.DeleteRange(utils.GetTestKey(10), utils.GetTestKey(20)))
+	inRange := func(i int) bool { return i >= 10 && i < 20 }
+	assertKeysDeleted(t, db, 0, 100, inRange)
+	assert.Equal(t, 90, db.Stat().KeysNum)
+	// one record for all the keys
+	assert.Equal(t, 1, countRecords(t, db, LogRecordRangeDeleted))
+	assert.Equal(t, 0, countRecords(t, db, LogRecordDeleted))
+
+	// no upper bound
+	assert.Nil(t, db.DeleteRange(utils.GetTestKey(90), nil))
+	outOfRange := func(i int) bool { return inRange(i) || i >= 90 }
+	assertKeysDeleted(t, db, 0, 100, outOfRange)
+
+	// the keys written after the range tombstone are not deleted
+	assert.Nil(t, db.Put(utils.GetTestKey(15), utils.RandomValue(128)))
+	afterPut := func(i int) bool { return i != 15 && outOfRange(i) }
+	assertKeysDeleted(t, db, 0, 100, afterPut)
+
+	// the range tombstones are replayed
+	assert.Nil(t, db.Close())
+	db, err = Open(options)
+	assert.Nil(t, err)
+	assertKeysDeleted(t, db, 0, 100, afterPut)
+	assert.Equal(t, 81, db.Stat().KeysNum)
+
+	// merge drops the range tombstones and the deleted keys
+	assert.Nil(t, db.Merge(true))
+	assert.Equal(t, 0, countRecords(t, db, LogRecordRangeDeleted))
+	assertKeysDeleted(t, db, 0, 100, afterPut)
+	assert.Nil(t, db.Close())
+	db, err = Open(options)
+	assert.Nil(t, err)
+	assertKeysDeleted(t, db, 0, 100, afterPut)
+}
+
+func TestDB_DeletePrefix(t *testing.T) {
+	for _, lessFunc := range []func(a, b []byte) bool{
+		nil,
+		func(a, b []byte) bool { return bytes.Compare(a, b) > 0 },
+	} {
+		options := DefaultOptions
+		options.IndexCheckpoint = false
+		options.LessFunc = lessFunc
+		db, err := Open(options)
+		assert.Nil(t, err)
+
+		for _, tenant := range []string{"a", "ab", "b"} {
+			for i := 0; i < 50; i++ {
+				assert.Nil(t, db.Put([]byte(fmt.Sprintf("%s/%03d", tenant, i)), utils.RandomValue(16)))
+			}
+		}
+		assert.Nil(t, db.DeletePrefix([]byte("a/")))
+		assert.Equal(t, 100, db.Stat().KeysNum)
+		_, err = db.Get([]byte("a/001"))
+		assert.Equal(t, ErrKeyNotFound, err)
+		_, err = db.Get([]byte("ab/001"))
+		assert.Nil(t, err)
+
+		assert.Nil(t, db.Close())
+		db, err = Open(options)
+		assert.Nil(t, err)
+		assert.Equal(t, 100, db.Stat().KeysNum)
+		_, err = db.Get([]byte("a/049"))
+		assert.Equal(t, ErrKeyNotFound, err)
+
+		// an empty prefix deletes all the keys
+		assert.Nil(t, db.DeletePrefix(nil))
+		assert.Equal(t, 0, db.Stat().KeysNum)
+		destroyDB(db)
+	}
+}
+
+func TestBatch_DeleteRange(t *testing.T) {
+	options := DefaultOptions
+	options.WatchQueueSize = 10
+	db, err := Open(options)
+	assert.Nil(t, err)
+	defer destroyDB(db)
+
+	for i := 0; i < 10; i++ {
+		assert.Nil(t, db.Put(utils.GetTestKey(i), utils.RandomValue(128)))
+	}
+	w, err := db.Watch()
+	assert.Nil(t, err)
+
+	batch := db.NewBatch(DefaultBatchOptions)
+	assert.Nil(t, batch.Put(utils.GetTestKey(20), utils.RandomValue(128)))
+	assert.Nil(t, batch.Put(utils.GetTestKey(30), utils.RandomValue(128)))
+	assert.Nil(t, batch.DeleteRange(utils.GetTestKey(5), utils.GetTestKey(25)))
+	assert.Nil(t, batch.Put(utils.GetTestKey(6), utils.RandomValue(128)))
+
+	// the range tombstone hides both the pending writes and the index
+	_, err = batch.Get(utils.GetTestKey(20))
+	assert.Equal(t, ErrKeyNotFound, err)
+	_, err = batch.Get(utils.GetTestKey(5))
+	assert.Equal(t, ErrKeyNotFound, err)
+	exist, err := batch.Exist(utils.GetTestKey(7))
+	assert.Nil(t, err)
+	assert.False(t, exist)
+	_, err = batch.Get(utils.GetTestKey(6))
+	assert.Nil(t, err)
+	_, err = batch.Get(utils.GetTestKey(30))
+	assert.Nil(t, err)
+	assert.Nil(t, batch.Commit())
+
+	assertKeysDeleted(t, db, 0, 10, func(i int) bool { return i >= 5 && i != 6 })
+	_, err = db.Get(utils.GetTestKey(20))
+	assert.Equal(t, ErrKeyNotFound, err)
+	_, err = db.Get(utils.GetTestKey(30))
+	assert.Nil(t, err)
+
+	// skip the events of the puts before the batch
+	var events []*Event
+	for len(events) < 3 {
+		event := <-w
+		if len(events) == 0 && !bytes.Equal(event.Key, utils.GetTestKey(30)) {
+			continue
+		}
+		events = append(events, event)
+	}
+	assert.Equal(t, WatchActionPut, events[0].Action)
+	assert.Equal(t, WatchActionDeleteRange, events[1].Action)
+	assert.Equal(t, utils.GetTestKey(5), events[1].Key)
+	assert.Equal(t, utils.GetTestKey(25), events[1].Value)
+	assert.Equal(t, WatchActionPut, events[2].Action)
+	assert.Equal(t, utils.GetTestKey(6), events[2].Key)
+}
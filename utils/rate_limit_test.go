@@ -0,0 +1,36 @@
+package utils
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRateLimiter_WaitN(t *testing.T) {
+	limiter := NewRateLimiter(1000)
+	start := time.Now()
+	// the first second is allowed at once, the next 500 bytes need half a second.
+	for i := 0; i < 15; i++ {
+		assert.Nil(t, limiter.WaitN(context.Background(), 100))
+	}
+	elapsed := time.Since(start)
+	assert.True(t, elapsed >= 400*time.Millisecond, elapsed)
+	assert.True(t, elapsed < 2*time.Second, elapsed)
+}
+
+func TestRateLimiter_Nil(t *testing.T) {
+	var limiter *RateLimiter
+	assert.Nil(t, NewRateLimiter(0))
+	assert.Nil(t, limiter.WaitN(context.Background(), 1<<30))
+}
+
+func TestRateLimiter_Cancel(t *testing.T) {
+	limiter := NewRateLimiter(10)
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	assert.Nil(t, limiter.WaitN(ctx, 10))
+	// 1000 bytes need 100 seconds
+	assert.Equal(t, context.DeadlineExceeded, limiter.WaitN(ctx, 1000))
+}
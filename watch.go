@@ -10,6 +10,16 @@ type WatchActionType = byte
 const (
 	WatchActionPut WatchActionType = iota
 	WatchActionDelete
+	// WatchActionExpire is the action of an expired key deleted from the database.
+	WatchActionExpire
+	// WatchActionDeleteRange is the action of the keys in [Key, Value) deleted by DeleteRange,
+	// an empty Value means no upper bound.
+	WatchActionDeleteRange
+	// WatchActionDeletePrefix is the action of the keys starting with Key deleted by DeletePrefix.
+	WatchActionDeletePrefix
+	// WatchActionAppend is the action of a merge operand appended by Append,
+	// the Value is the operand.
+	WatchActionAppend
 )
 
 // Event is the event that occurs when the database is modified.
@@ -19,6 +29,8 @@ type Event struct {
 	Key     []byte
 	Value   []byte
 	BatchId uint64
+	// Namespace is the name of the namespace of the key, empty for the keys out of any namespace.
+	Namespace string
 }
 
 // Watcher temporarily stores event information,
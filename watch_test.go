@@ -3,6 +3,7 @@ package memdb
 import (
 	"math/rand"
 	"testing"
+	"time"
 
 	"github.com/hupeh/memdb/utils"
 	"github.com/stretchr/testify/assert"
@@ -117,6 +118,33 @@ func TestWatch_Put_Delete_Watch(t *testing.T) {
 	}
 }
 
+func TestWatch_Expire_Watch(t *testing.T) {
+	options := DefaultOptions
+	options.WatchQueueSize = 10
+	options.ActiveExpireInterval = time.Millisecond * 20
+	db, err := Open(options)
+	assert.Nil(t, err)
+	defer destroyDB(db)
+
+	w, err := db.Watch()
+	assert.Nil(t, err)
+
+	key := utils.GetTestKey(rand.Int())
+	err = db.PutWithTTL(key, utils.RandomValue(128), time.Millisecond*100)
+	assert.Nil(t, err)
+
+	event := <-w
+	assert.Equal(t, WatchActionPut, event.Action)
+	select {
+	case event = <-w:
+		assert.Equal(t, WatchActionExpire, event.Action)
+		assert.Equal(t, key, event.Key)
+		assert.Equal(t, 0, len(event.Value))
+	case <-time.After(time.Second * 2):
+		t.Fatal("no expire event")
+	}
+}
+
 func TestWatch_Batch_Put_Watch(t *testing.T) {
 	options := DefaultOptions
 	options.WatchQueueSize = 1000